@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base32"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// labels the compressed applied config is stored in, split into chunks fitting into label values
+const (
+	appliedChunkLabelPrefix = "hetzner-flatcar/applied."
+	appliedChunksLabel      = "hetzner-flatcar/applied-chunks"
+	maxLabelValueLength     = 63
+)
+
+// labelEncoding only produces alphanumeric characters, label values have to start and end with one
+var labelEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// appliedClient stores and fetches applied configs at history.remote_url
+var appliedClient = &http.Client{Timeout: time.Minute}
+
+// redactRendered returns the rendered ignition config redacted like in reports
+func redactRendered(rendered renderedIgnition) ([]byte, error) {
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return nil, err
+	}
+	return redactIgnition(cfgJSON)
+}
+
+// compressApplied returns the redacted ignition config gzip compressed
+func compressApplied(rendered renderedIgnition) ([]byte, error) {
+	redactedJSON, err := redactRendered(rendered)
+	if err != nil {
+		return nil, err
+	}
+	var buffer bytes.Buffer
+	writer, _ := gzip.NewWriterLevel(&buffer, gzip.BestCompression)
+	if _, err := writer.Write(redactedJSON); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// decompressApplied returns the config compressed by compressApplied
+func decompressApplied(compressed []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, fmt.Errorf("error decompressing applied config: %w", err)
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// isAppliedLabel returns whether key is one of the labels the applied config is stored in
+func isAppliedLabel(key string) bool {
+	return key == appliedChunksLabel || strings.HasPrefix(key, appliedChunkLabelPrefix)
+}
+
+// appliedLabels returns the labels storing the compressed config
+func appliedLabels(compressed []byte) map[string]string {
+	encoded := labelEncoding.EncodeToString(compressed)
+	labels := make(map[string]string)
+	chunks := 0
+	for ; len(encoded) > 0; chunks++ {
+		length := maxLabelValueLength
+		if len(encoded) < length {
+			length = len(encoded)
+		}
+		labels[appliedChunkLabelPrefix+strconv.Itoa(chunks)] = encoded[:length]
+		encoded = encoded[length:]
+	}
+	labels[appliedChunksLabel] = strconv.Itoa(chunks)
+	return labels
+}
+
+// appliedFromLabels returns the compressed config stored in labels, nil if there's none
+func appliedFromLabels(labels map[string]string) ([]byte, error) {
+	count, ok := labels[appliedChunksLabel]
+	if !ok {
+		return nil, nil
+	}
+	chunks, err := strconv.Atoi(count)
+	if err != nil {
+		return nil, fmt.Errorf("invalid label %s=%s", appliedChunksLabel, count)
+	}
+	var encoded strings.Builder
+	for i := 0; i < chunks; i++ {
+		chunk, ok := labels[appliedChunkLabelPrefix+strconv.Itoa(i)]
+		if !ok {
+			return nil, fmt.Errorf("label %s%d is missing", appliedChunkLabelPrefix, i)
+		}
+		encoded.WriteString(chunk)
+	}
+	return labelEncoding.DecodeString(encoded.String())
+}
+
+// remoteURL returns the url the applied config of serverName is stored at, empty if not configured
+func (c historyConfig) remoteURL(serverName string) string {
+	return strings.ReplaceAll(c.RemoteURL, "{server}", serverName)
+}
+
+// uploadApplied stores the compressed config of serverName at history.remote_url with a PUT request
+func (p *provisioner) uploadApplied(serverName string, compressed []byte) error {
+	req, err := http.NewRequest(http.MethodPut, p.cfg.History.remoteURL(serverName), bytes.NewReader(compressed))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/gzip")
+	return p.doApplied(req, nil)
+}
+
+// downloadApplied fetches the compressed config of serverName from history.remote_url, nil if it doesn't exist
+func (p *provisioner) downloadApplied(serverName string) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodGet, p.cfg.History.remoteURL(serverName), nil)
+	if err != nil {
+		return nil, err
+	}
+	var compressed []byte
+	err = p.doApplied(req, func(body io.Reader) (err error) {
+		compressed, err = io.ReadAll(body)
+		return err
+	})
+	return compressed, err
+}
+
+// doApplied sends req with the configured headers, read is called with the body of successful responses
+func (p *provisioner) doApplied(req *http.Request, read func(io.Reader) error) error {
+	for name, value := range p.cfg.History.RemoteHeaders {
+		req.Header.Set(name, value)
+	}
+	resp, err := appliedClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if req.Method == http.MethodGet && resp.StatusCode == http.StatusNotFound {
+		return nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	if read != nil {
+		return read(resp.Body)
+	}
+	return nil
+}
+
+// persistApplied stores the redacted config applied to server in its labels and at history.remote_url, if configured.
+// labels are extended by the chunk labels and have to be set on the server afterwards.
+func (p *provisioner) persistApplied(server *hcloud.Server, rendered renderedIgnition, labels map[string]string) error {
+	if !p.cfg.History.Labels && p.cfg.History.RemoteURL == "" {
+		return nil
+	}
+	compressed, err := compressApplied(rendered)
+	if err != nil {
+		return fmt.Errorf("error compressing applied config: %w", err)
+	}
+	if p.cfg.History.RemoteURL != "" {
+		if err := p.uploadApplied(server.Name, compressed); err != nil {
+			return fmt.Errorf("error uploading applied config: %w", err)
+		}
+	}
+	if p.cfg.History.Labels {
+		// chunks of the previous config would be kept when merging the labels
+		for key := range server.Labels {
+			if isAppliedLabel(key) {
+				delete(server.Labels, key)
+			}
+		}
+		for key, value := range appliedLabels(compressed) {
+			labels[key] = value
+		}
+	}
+	return nil
+}
+
+// appliedConfig returns the redacted config applied to server from its labels, history.remote_url or the local history,
+// source describes where it was found, the config is nil if none of them has it
+func (p *provisioner) appliedConfig(server *hcloud.Server) (config []byte, source string, err error) {
+	compressed, err := appliedFromLabels(server.Labels)
+	if err != nil {
+		return nil, "", err
+	}
+	source = "labels"
+	if compressed == nil && p.cfg.History.RemoteURL != "" {
+		compressed, err = p.downloadApplied(server.Name)
+		if err != nil {
+			return nil, "", fmt.Errorf("error downloading applied config: %w", err)
+		}
+		source = p.cfg.History.remoteURL(server.Name)
+	}
+	if compressed != nil {
+		config, err = decompressApplied(compressed)
+		return config, source, err
+	}
+	entries, err := p.history(server.Name)
+	if err != nil || len(entries) == 0 {
+		return nil, "", err
+	}
+	config, err = redactIgnition(entries[0].Ignition)
+	return config, entries[0].Revision, err
+}
+
+// diffApplied writes the diff between the applied and the rendered config of serverName to w and returns whether they differ
+func (p *provisioner) diffApplied(w io.Writer, serverName string) (bool, error) {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return false, fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return false, fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	applied, source, err := p.appliedConfig(server)
+	if err != nil {
+		return false, err
+	}
+	if applied == nil {
+		applied, source = []byte{}, "/dev/null"
+	}
+	rendered, err := p.renderIgnition(server)
+	if err != nil {
+		return false, err
+	}
+	current, err := redactRendered(rendered)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(bytes.TrimSpace(applied), bytes.TrimSpace(current)) {
+		return false, nil
+	}
+	_, err = io.WriteString(w, unifiedDiff(serverName+" ("+source+")", serverName+" (rendered)", splitLines(applied), splitLines(current)))
+	return true, err
+}
+
+// runDiff prints the differences between the applied and the rendered configs, the exit code is 1 if any differ
+func runDiff(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	selector := addSelectorFlag(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 && *selector == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	serverNames, err := p.resolveServerNames(fs.Args(), *selector)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	sort.Strings(serverNames)
+	differ := false
+	for _, serverName := range serverNames {
+		changed, err := p.diffApplied(os.Stdout, serverName)
+		if err != nil {
+			fatalf("error diffing %s: %v\n", serverName, err)
+		}
+		differ = differ || changed
+	}
+	if differ {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// result of a command in the audit log while it's running
+const resultRunning = "running"
+
+// auditRecord is a command run on a server, recorded in the audit table of the run database
+type auditRecord struct {
+	ID       int64     `json:"id"`
+	Time     time.Time `json:"time"`
+	Operator string    `json:"operator"`
+	Server   string    `json:"server"`
+	Command  string    `json:"command"`
+	// ConfigHash is the hash of the config applied to the server when the command was run
+	ConfigHash  string `json:"config_hash,omitempty"`
+	GitRevision string `json:"git_revision,omitempty"`
+	Result      string `json:"result"`
+	Error       string `json:"error,omitempty"`
+}
+
+// startAudit records command as running on server before it's run, so no command is run without being recorded
+func (p *provisioner) startAudit(server *hcloud.Server, command string) (int64, error) {
+	db, err := openRuns(p.cfg.History.runDatabase())
+	if err != nil {
+		return 0, err
+	}
+	result, err := db.Exec(`INSERT INTO audit (time, operator, server, command, config_hash, git_revision, result) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		time.Now().UTC(), p.operatorName(), server.Name, secrets.redact(command), server.Labels[configHashLabel], p.revision, resultRunning)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// finishAudit records the result of the command recorded as id
+func (p *provisioner) finishAudit(id int64, commandErr error) error {
+	db, err := openRuns(p.cfg.History.runDatabase())
+	if err != nil {
+		return err
+	}
+	result, errorMessage := resultSucceeded, ""
+	if commandErr != nil {
+		result, errorMessage = resultFailed, secrets.redact(commandErr.Error())
+	}
+	_, err = db.Exec("UPDATE audit SET result = ?, error = ? WHERE id = ?", result, errorMessage, id)
+	return err
+}
+
+// queryAudit returns the recorded commands matching filter, newest first
+func queryAudit(path string, filter runFilter) ([]auditRecord, error) {
+	db, err := openRuns(path)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []string
+	var args []interface{}
+	if filter.Server != "" {
+		conditions = append(conditions, "server = ?")
+		args = append(args, filter.Server)
+	}
+	if filter.Result != "" {
+		conditions = append(conditions, "result = ?")
+		args = append(args, filter.Result)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	query := "SELECT id, time, operator, server, command, config_hash, git_revision, result, error FROM audit"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY time DESC, id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	records := []auditRecord{}
+	for rows.Next() {
+		var record auditRecord
+		if err := rows.Scan(&record.ID, &record.Time, &record.Operator, &record.Server, &record.Command, &record.ConfigHash, &record.GitRevision, &record.Result, &record.Error); err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+	return records, rows.Err()
+}
+
+func printAudit(w io.Writer, records []auditRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTIME\tOPERATOR\tSERVER\tCONFIG\tRESULT\tCOMMAND")
+	for _, record := range records {
+		configHash := "-"
+		if len(record.ConfigHash) >= 12 {
+			configHash = record.ConfigHash[:12]
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\n", record.ID, record.Time.Local().Format(time.RFC3339), record.Operator, record.Server,
+			configHash, record.Result, record.Command)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// parseBastion splits [user@]host[:port] into its parts, defaulting to root and port 22
+func parseBastion(bastion string) (user string, host string, port uint, err error) {
+	user = "root"
+	if at := strings.LastIndex(bastion, "@"); at >= 0 {
+		user, bastion = bastion[:at], bastion[at+1:]
+	}
+	host, portString, err := net.SplitHostPort(bastion)
+	if err != nil {
+		// no port given
+		return user, strings.Trim(bastion, "[]"), 22, nil
+	}
+	portNumber, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return "", "", 0, fmt.Errorf("invalid bastion port %s", portString)
+	}
+	return user, host, uint(portNumber), nil
+}
+
+// bastionDialer returns a dialer opening connections through a ssh connection to the bastion, which is established
+// on first use with the configured authentication and reused afterwards
+func (p *provisioner) bastionDialer(dial dialFunc) (dialFunc, error) {
+	user, host, port, err := parseBastion(p.cfg.SSH.Bastion)
+	if err != nil {
+		return nil, err
+	}
+	var mu sync.Mutex
+	var bastionClient *sshClient
+	return func(addr string) (net.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if bastionClient != nil {
+			conn, err := dialViaBastion(bastionClient, addr)
+			var openChannelErr *ssh.OpenChannelError
+			if err == nil || errors.As(err, &openChannelErr) {
+				return conn, err
+			}
+			// the connection to the bastion is broken, reconnect
+			p.logger.Printf("error connecting to %s via bastion, reconnecting: %v\n", addr, err)
+			bastionClient.Close()
+			bastionClient = nil
+		}
+		sshAuth, err := buildSSHAuth(p.cfg.HCloud)
+		if err != nil {
+			return nil, fmt.Errorf("error building ssh authentication: %w", err)
+		}
+		callback, err := p.hostKeyCallback()
+		if err != nil {
+			return nil, fmt.Errorf("error loading known hosts: %w", err)
+		}
+		bastionClient, err = sshConnect(dial, sshTarget{
+			User:      user,
+			Addr:      host,
+			Port:      port,
+			Auth:      sshAuth,
+			Callback:  callback,
+			Keepalive: p.keepalive,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error connecting to bastion %s: %w", p.cfg.SSH.Bastion, err)
+		}
+		return dialViaBastion(bastionClient, addr)
+	}, nil
+}
+
+// dialViaBastion connects to addr through the bastion.
+// Rejected connections are returned as network errors, so they're retried like direct connections, e.g. while the server boots.
+func dialViaBastion(bastionClient *sshClient, addr string) (net.Conn, error) {
+	conn, err := bastionClient.Dial("tcp", addr)
+	var openChannelErr *ssh.OpenChannelError
+	if errors.As(err, &openChannelErr) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: err}
+	}
+	return conn, err
+}
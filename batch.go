@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// results of provisioning a server in a batch and the matching result codes
+const (
+	resultSucceeded = "succeeded"
+	resultFailed    = "failed"
+	resultSkipped   = "skipped"
+)
+
+var resultCodes = map[string]int{
+	resultSucceeded: 0,
+	resultFailed:    1,
+	resultSkipped:   2,
+}
+
+// errSkipped is returned for servers not provisioned because another one failed before
+var errSkipped = errors.New("skipped after an earlier failure")
+
+// readServerNames reads newline separated server names from path or stdin if path is -, ignoring empty lines and # comments
+func readServerNames(path string, stdin io.Reader) ([]string, error) {
+	reader := stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("error opening servers file: %w", err)
+		}
+		defer file.Close()
+		reader = file
+	}
+	var serverNames []string
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		serverNames = append(serverNames, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading server names: %w", err)
+	}
+	return serverNames, nil
+}
+
+type serverResult struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+	Code   int    `json:"code"`
+	Error  string `json:"error,omitempty"`
+	// Phases are the durations of the phases and their steps in the order they finished
+	Phases []phaseTiming `json:"phases,omitempty"`
+}
+
+type batchSummary struct {
+	// Version is the build of hetzner-flatcar which produced the results
+	Version versionInfo    `json:"version"`
+	Servers []serverResult `json:"servers"`
+	// Canaries are the servers provisioned first in a canary rollout
+	Canaries  []string `json:"canaries,omitempty"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	Skipped   int      `json:"skipped"`
+	// Timings are the durations of the phases over all servers
+	Timings []phaseTotal `json:"timings,omitempty"`
+}
+
+// provisionBatch provisions the servers with at most concurrency at once.
+// Unless keepGoing is set, servers not started yet are skipped after the first failure.
+func (p *provisioner) provisionBatch(serverNames []string, concurrency int, keepGoing bool) batchSummary {
+	return summarize(serverNames, p.provisionAll(serverNames, concurrency, keepGoing))
+}
+
+// provisionAll provisions the servers like provisionBatch and returns the errors by server name
+func (p *provisioner) provisionAll(serverNames []string, concurrency int, keepGoing bool) map[string]error {
+	var mu sync.Mutex
+	failed := false
+	return forEachServer(serverNames, concurrency, func(serverName string) error {
+		mu.Lock()
+		skip := failed && !keepGoing
+		mu.Unlock()
+		if skip {
+			return errSkipped
+		}
+		err := p.provision(serverName)
+		if err != nil {
+			mu.Lock()
+			failed = true
+			mu.Unlock()
+		}
+		return err
+	})
+}
+
+// summarize returns the summary of provisioning serverNames, errs contains the failed and skipped ones
+func summarize(serverNames []string, errs map[string]error) batchSummary {
+	summary := batchSummary{Version: buildVersion()}
+	for _, serverName := range serverNames {
+		result := serverResult{Name: serverName, Result: resultSucceeded}
+		if err, ok := errs[serverName]; ok {
+			result.Result = resultFailed
+			if errors.Is(err, errSkipped) {
+				result.Result = resultSkipped
+			}
+			result.Error = err.Error()
+		}
+		result.Code = resultCodes[result.Result]
+		switch result.Result {
+		case resultSucceeded:
+			summary.Succeeded++
+		case resultFailed:
+			summary.Failed++
+		case resultSkipped:
+			summary.Skipped++
+		}
+		summary.Servers = append(summary.Servers, result)
+	}
+	return summary
+}
+
+func printSummary(w io.Writer, summary batchSummary) error {
+	return printJSON(w, summary)
+}
+
+// printJSON writes value as indented JSON
+func printJSON(w io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// maxListedCandidates is the number of available names listed if none is similar to an unknown one
+const maxListedCandidates = 10
+
+// editDistance returns the levenshtein distance of a and b, ignoring case
+func editDistance(a string, b string) int {
+	ra, rb := []rune(strings.ToLower(a)), []rune(strings.ToLower(b))
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(previous[j]+1, minInt(current[j-1]+1, previous[j-1]+cost))
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// suggest returns a hint for the unknown name, the most similar candidate or the available ones if none is similar enough
+func suggest(name string, candidates []string) string {
+	if len(candidates) == 0 {
+		return ""
+	}
+	best, bestDistance := "", -1
+	for _, candidate := range candidates {
+		distance := editDistance(name, candidate)
+		if bestDistance < 0 || distance < bestDistance {
+			best, bestDistance = candidate, distance
+		}
+	}
+	// a third of the name may differ, e.g. cpx3 -> cpx31 or fns1 -> fsn1
+	if bestDistance <= len(name)/3+1 {
+		return fmt.Sprintf("did you mean %s?", best)
+	}
+	sorted := append([]string{}, candidates...)
+	sort.Strings(sorted)
+	if len(sorted) > maxListedCandidates {
+		return fmt.Sprintf("available: %s, ...", strings.Join(sorted[:maxListedCandidates], ", "))
+	}
+	return fmt.Sprintf("available: %s", strings.Join(sorted, ", "))
+}
+
+// unknownResource returns the error for a resource referenced in the config that doesn't exist in the project,
+// with a suggestion from the names returned by list
+func unknownResource(field string, kind string, name string, list func() ([]string, error)) error {
+	message := fmt.Sprintf("%s %s doesn't exist", kind, name)
+	candidates, err := list()
+	if err != nil {
+		return fieldError{Field: field, Message: message, Hint: fmt.Sprintf("error listing %ss: %v", kind, err)}
+	}
+	return fieldError{Field: field, Message: message, Hint: suggest(name, candidates)}
+}
+
+// findServerType returns the server type called name or a fieldError with a suggestion if it doesn't exist
+func findServerType(client *hcloud.Client, name string) (*hcloud.ServerType, error) {
+	ctx := context.Background()
+	serverType, _, err := client.ServerType.GetByName(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error finding server type: %w", err)
+	}
+	if serverType != nil {
+		return serverType, nil
+	}
+	return nil, unknownResource("hcloud.server_type", "server type", name, func() ([]string, error) {
+		serverTypes, err := client.ServerType.All(ctx)
+		names := make([]string, len(serverTypes))
+		for i, serverType := range serverTypes {
+			names[i] = serverType.Name
+		}
+		return names, err
+	})
+}
+
+// isLabelSelector returns whether image is a label selector instead of an id or name, e.g. flatcar/channel=stable
+func isLabelSelector(image string) bool {
+	return strings.ContainsAny(image, "=!()")
+}
+
+// findImage returns the image with the id or name or a fieldError with a suggestion if it doesn't exist.
+// A label selector selects the newest snapshot matching it.
+// Deprecated images still work until they're removed, so they're only warned about.
+func findImage(client *hcloud.Client, idOrName string) (*hcloud.Image, error) {
+	ctx := context.Background()
+	if isLabelSelector(idOrName) {
+		return findSnapshot(client, idOrName)
+	}
+	image, _, err := client.Image.Get(ctx, idOrName)
+	if err != nil {
+		return nil, fmt.Errorf("error finding image: %w", err)
+	}
+	if image != nil {
+		return image, nil
+	}
+	return nil, unknownResource("hcloud.image", "image", idOrName, func() ([]string, error) {
+		images, err := client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{Type: []hcloud.ImageType{hcloud.ImageTypeSystem}})
+		names := make([]string, len(images))
+		for i, image := range images {
+			names[i] = image.Name
+		}
+		return names, err
+	})
+}
+
+// describeImage returns the name of image, snapshots have a description instead
+func describeImage(image *hcloud.Image) string {
+	if image.Name != "" {
+		return image.Name
+	}
+	return fmt.Sprintf("snapshot %d (%s)", image.ID, image.Description)
+}
+
+// findSnapshot returns the newest available snapshot matching selector
+func findSnapshot(client *hcloud.Client, selector string) (*hcloud.Image, error) {
+	snapshots, err := client.Image.AllWithOpts(context.Background(), hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: selector},
+		Type:     []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+		Status:   []hcloud.ImageStatus{hcloud.ImageStatusAvailable},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return nil, fieldError{Field: "hcloud.image", Message: fmt.Sprintf("no snapshot matches %s", selector), Hint: "label selector of snapshots, e.g. flatcar/channel=stable"}
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.After(snapshots[j].Created)
+	})
+	newest := snapshots[0]
+	log.Printf("using snapshot %d (%s) created %s, the newest of %d matching %s\n", newest.ID, newest.Description, newest.Created.Format(time.RFC3339), len(snapshots), selector)
+	return newest, nil
+}
+
+// findLocation returns the location called name or a fieldError with a suggestion if it doesn't exist
+func findLocation(client *hcloud.Client, name string) (*hcloud.Location, error) {
+	ctx := context.Background()
+	location, _, err := client.Location.GetByName(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error finding location: %w", err)
+	}
+	if location != nil {
+		return location, nil
+	}
+	return nil, unknownResource("hcloud.location", "location", name, func() ([]string, error) {
+		locations, err := client.Location.All(ctx)
+		names := make([]string, len(locations))
+		for i, location := range locations {
+			names[i] = location.Name
+		}
+		return names, err
+	})
+}
+
+// findSSHKey returns the ssh key called name or a fieldError with a suggestion if it doesn't exist
+func findSSHKey(client *hcloud.Client, name string) (*hcloud.SSHKey, error) {
+	ctx := context.Background()
+	sshKey, _, err := client.SSHKey.GetByName(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting ssh key: %w", err)
+	}
+	if sshKey != nil {
+		return sshKey, nil
+	}
+	return nil, unknownResource("hcloud.ssh_key", "ssh key", name, func() ([]string, error) {
+		sshKeys, err := client.SSHKey.All(ctx)
+		names := make([]string, len(sshKeys))
+		for i, sshKey := range sshKeys {
+			names[i] = sshKey.Name
+		}
+		return names, err
+	})
+}
+
+// findSSHKeys returns the ssh keys matching the label selector, no matching key is only warned about
+func findSSHKeys(client *hcloud.Client, selector string) ([]*hcloud.SSHKey, error) {
+	sshKeys, err := client.SSHKey.AllWithOpts(context.Background(), hcloud.SSHKeyListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: selector},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing ssh keys: %w", err)
+	}
+	if len(sshKeys) == 0 {
+		log.Printf("warning: no ssh key matches %s\n", selector)
+	}
+	names := make([]string, len(sshKeys))
+	for i, sshKey := range sshKeys {
+		names[i] = sshKey.Name
+	}
+	sort.Strings(names)
+	log.Printf("selected ssh keys %s by %s\n", strings.Join(names, ", "), selector)
+	return sshKeys, nil
+}
+
+// lookupMessage returns the error of a lookup without the config field
+func lookupMessage(err error) string {
+	if fieldErr, ok := err.(fieldError); ok && fieldErr.Hint != "" {
+		return fmt.Sprintf("%s (%s)", fieldErr.Message, fieldErr.Hint)
+	} else if ok {
+		return fieldErr.Message
+	}
+	return err.Error()
+}
+
+// catalogErrors combines the errors of the lookups, all unknown resources are reported at once
+func catalogErrors(errs []error) error {
+	var unknown configErrors
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		fieldErr, ok := err.(fieldError)
+		if !ok {
+			return err
+		}
+		unknown = append(unknown, fieldErr)
+	}
+	if len(unknown) > 0 {
+		return unknown
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// cleanup is a registered cleanup step, it runs at most once
+type cleanup struct {
+	name  string
+	fn    func() error
+	stack *cleanupStack
+}
+
+// cleanupStack holds the cleanup steps of the phases in progress, they run in reverse order on interrupts,
+// panics and fatal errors, which would skip deferred functions
+type cleanupStack struct {
+	mu    sync.Mutex
+	steps []*cleanup
+}
+
+// cleanups is the cleanup stack of the process
+var cleanups = &cleanupStack{}
+
+// push registers fn, the returned cleanup has to be run or discarded by the phase when it's done
+func (s *cleanupStack) push(name string, fn func() error) *cleanup {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	step := &cleanup{name: name, fn: fn, stack: s}
+	s.steps = append(s.steps, step)
+	return step
+}
+
+// remove takes step off the stack and returns whether it was still on it
+func (s *cleanupStack) remove(step *cleanup) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, candidate := range s.steps {
+		if candidate == step {
+			s.steps = append(s.steps[:i], s.steps[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the cleanup unless it already ran or was discarded, errors are logged
+func (c *cleanup) run() {
+	if c == nil || !c.stack.remove(c) {
+		return
+	}
+	if err := c.fn(); err != nil {
+		log.Printf("error during cleanup (%s): %v\n", c.name, err)
+	}
+}
+
+// discard removes the cleanup without running it
+func (c *cleanup) discard() {
+	if c == nil {
+		return
+	}
+	c.stack.remove(c)
+}
+
+// run runs all pending cleanups, the most recently registered first
+func (s *cleanupStack) run() {
+	for {
+		s.mu.Lock()
+		if len(s.steps) == 0 {
+			s.mu.Unlock()
+			return
+		}
+		step := s.steps[len(s.steps)-1]
+		s.mu.Unlock()
+		log.Printf("cleaning up: %s\n", step.name)
+		step.run()
+	}
+}
+
+// handleSignals runs the pending cleanups before exiting on SIGINT and SIGTERM
+func (s *cleanupStack) handleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		// a second signal exits immediately
+		signal.Reset(os.Interrupt, syscall.SIGTERM)
+		log.Printf("received %s, cleaning up\n", sig)
+		s.run()
+		code := 130
+		if sig == syscall.SIGTERM {
+			code = 143
+		}
+		os.Exit(code)
+	}()
+}
+
+// recoverPanic runs the pending cleanups if the goroutine panics and panics again, it has to be deferred directly
+func (s *cleanupStack) recoverPanic() {
+	if r := recover(); r != nil {
+		log.Printf("panic: %v, cleaning up\n", r)
+		s.run()
+		panic(r)
+	}
+}
+
+// fatalf runs the pending cleanups before logging the error and exiting like log.Fatalf
+func fatalf(format string, v ...interface{}) {
+	cleanups.run()
+	log.Fatalf(format, v...)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// commonFlags are the flags shared by all commands to load the config
+type commonFlags struct {
+	configPath          *string
+	hcloudContext       *string
+	staticOverrides     keyValueFlag
+	staticFileOverrides keyValueFlag
+	gitURL              *string
+	gitBranch           *string
+	gitPath             *string
+	gitDir              *string
+	force               *bool
+	deterministic       *bool
+	noCreate            *bool
+	eventsFormat        *string
+	eventsPath          *string
+	operator            *string
+
+	// overrides of config values, empty if not given
+	token          *string
+	sshKey         *string
+	privateNetwork *string
+	serverType     *string
+	locations      stringListFlag
+	image          *string
+	configTemplate *string
+	flatcarVersion *string
+	iso            *string
+
+	source *gitSource
+	// events is opened on the first load and shared by all provisioners
+	events *eventWriter
+}
+
+// addCommonFlags registers the common flags on fs
+func addCommonFlags(fs *flag.FlagSet) *commonFlags {
+	f := &commonFlags{
+		staticOverrides:     keyValueFlag{},
+		staticFileOverrides: keyValueFlag{},
+	}
+	f.configPath = fs.String("config", "", "path to the config file (default config.toml if it exists)")
+	f.hcloudContext = fs.String("context", "", "name of the hcloud context to use from the config")
+	fs.Var(f.staticOverrides, "set", "set template_static key to value (key=value), can be repeated")
+	fs.Var(f.staticFileOverrides, "set-file", "set template_static key to the content of a file (key=path), can be repeated")
+	f.gitURL = fs.String("git-url", "", "git repository containing config and templates")
+	f.gitBranch = fs.String("git-branch", "main", "branch of the git repository")
+	f.gitPath = fs.String("git-path", "", "directory inside the git repository containing the config")
+	f.gitDir = fs.String("git-dir", ".hetzner-flatcar-source", "local checkout of the git repository")
+	f.force = fs.Bool("force", false, "install even if the ignition config has warnings")
+	f.deterministic = fs.Bool("deterministic", false, "forbid template inputs which aren't reproducible and record the rendered files (overrides flatcar.deterministic)")
+	f.noCreate = fs.Bool("no-create", false, "fail instead of creating servers that don't exist")
+	f.eventsFormat = fs.String("events", "", "emit an event per provisioning phase in this format (ndjson)")
+	f.eventsPath = fs.String("events-file", "-", "file the events are appended to, - for stdout")
+	f.operator = fs.String("operator", "", "name recorded as operator in the run database and audit log (default $HETZNER_FLATCAR_OPERATOR or user@host)")
+	f.token = fs.String("token", "", "hcloud api token (overrides hcloud.token)")
+	f.sshKey = fs.String("ssh-key", "", "name of the hcloud ssh key (overrides hcloud.ssh_key)")
+	f.privateNetwork = fs.String("private-network", "", "name of the private network (overrides hcloud.private_network)")
+	f.serverType = fs.String("server-type", "", "server type (overrides hcloud.server_type)")
+	fs.Var(&f.locations, "location", "location, can be repeated to try several in order (overrides hcloud.location)")
+	f.image = fs.String("image", "", "image booted before installing flatcar (overrides hcloud.image)")
+	f.configTemplate = fs.String("template", "", "path to the config template (overrides flatcar.config_template)")
+	f.flatcarVersion = fs.String("flatcar-version", "", "flatcar version to install (overrides flatcar.version)")
+	f.iso = fs.String("iso", "", "name or id of an iso booted instead of the rescue system (overrides rescue.iso)")
+	return f
+}
+
+// applyOverrides sets all config values given as flags
+func (f *commonFlags) applyOverrides(conf *config) {
+	overrides := []struct {
+		flag  *string
+		value *string
+	}{
+		{f.token, &conf.HCloud.Token},
+		{f.sshKey, &conf.HCloud.SSHKey},
+		{f.privateNetwork, &conf.HCloud.PrivateNetwork},
+		{f.serverType, &conf.HCloud.ServerType},
+		{f.image, &conf.HCloud.Image},
+		{f.configTemplate, &conf.Flatcar.ConfigTemplate},
+		{f.flatcarVersion, &conf.Flatcar.Version},
+		{f.iso, &conf.Rescue.ISO},
+	}
+	for _, override := range overrides {
+		if *override.flag != "" {
+			*override.value = *override.flag
+		}
+	}
+	if len(f.locations) > 0 {
+		conf.HCloud.Location = stringList(f.locations)
+	}
+	if *f.deterministic {
+		conf.Flatcar.Deterministic = true
+	}
+}
+
+// loadProvisioner parses the config and resolves its resources, it's called again before every reconciliation in watch mode
+func (f *commonFlags) loadProvisioner() (*provisioner, error) {
+	if f.events == nil && *f.eventsFormat != "" {
+		// opened before changing into a git checkout, so the path is relative to the working directory
+		var err error
+		f.events, err = openEvents(*f.eventsFormat, *f.eventsPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg, revision, err := f.loadConfig()
+	if err != nil {
+		return nil, err
+	}
+	operatorOverride = *f.operator
+	p, err := newProvisioner(cfg, newHCloudClient(cfg.HCloud))
+	if err != nil {
+		return nil, err
+	}
+	p.revision = revision
+	p.force = *f.force
+	p.noCreate = *f.noCreate
+	p.events = f.events
+	return p, nil
+}
+
+// loadConfig syncs the git source if given and parses the config with all flag overrides applied, it returns the config and the git revision
+func (f *commonFlags) loadConfig() (config, string, error) {
+	if f.source == nil && *f.gitURL != "" {
+		// resolve the checkout before changing into it
+		checkoutDir, err := filepath.Abs(*f.gitDir)
+		if err != nil {
+			return config{}, "", fmt.Errorf("error resolving git checkout path: %w", err)
+		}
+		f.source = &gitSource{
+			URL:    *f.gitURL,
+			Branch: *f.gitBranch,
+			Path:   *f.gitPath,
+			Dir:    checkoutDir,
+		}
+	}
+
+	var revision string
+	if f.source != nil {
+		var err error
+		revision, err = f.source.sync()
+		if err != nil {
+			return config{}, "", fmt.Errorf("error syncing git source: %w", err)
+		}
+		// paths in the config are relative to the config in the repository
+		if err := os.Chdir(f.source.configDir()); err != nil {
+			return config{}, "", err
+		}
+		log.Printf("using config from %s at %s\n", f.source.URL, revision)
+	}
+
+	configPath := *f.configPath
+	if configPath == "" {
+		// without config file all required values have to be given as flags
+		if _, err := os.Stat("config.toml"); err == nil {
+			configPath = "config.toml"
+		}
+	}
+	cfg, err := ParseConfig(configPath, *f.hcloudContext, f.applyOverrides)
+	if err != nil {
+		return config{}, "", fmt.Errorf("error parsing config: %w", err)
+	}
+	if cfg.Flatcar.TemplateStatic == nil {
+		cfg.Flatcar.TemplateStatic = map[string]string{}
+	}
+	for key, value := range f.staticOverrides {
+		cfg.Flatcar.TemplateStatic[key] = value
+	}
+	for key, path := range f.staticFileOverrides {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return config{}, "", fmt.Errorf("error reading file for template_static key %s: %w", key, err)
+		}
+		cfg.Flatcar.TemplateStatic[key] = string(content)
+	}
+	registerSecrets(cfg)
+
+	return cfg, revision, nil
+}
+
+// newHCloudClient creates the hcloud api client, optionally for a custom endpoint like an api mock
+func newHCloudClient(conf hcloudConfig) *hcloud.Client {
+	opts := []hcloud.ClientOption{
+		hcloud.WithToken(conf.Token),
+		hcloud.WithApplication("hetzner-flatcar", buildVersion().Version),
+	}
+	if conf.Endpoint != "" {
+		opts = append(opts, hcloud.WithEndpoint(conf.Endpoint))
+	}
+	if conf.InsecureSkipTLSVerify {
+		log.Println("warning: tls verification of the hcloud api is disabled")
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		opts = append(opts, hcloud.WithHTTPClient(&http.Client{Transport: transport}))
+	}
+	return hcloud.NewClient(opts...)
+}
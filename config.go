@@ -1,71 +1,905 @@
 package main
 
 import (
-	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/ssh"
 )
 
+// stringList is a list of strings which can also be given as single string in the config
+type stringList []string
+
+func (l *stringList) UnmarshalTOML(value interface{}) error {
+	switch v := value.(type) {
+	case string:
+		*l = stringList{v}
+	case []interface{}:
+		list := make(stringList, len(v))
+		for i, item := range v {
+			itemString, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("expected string, got %T", item)
+			}
+			list[i] = itemString
+		}
+		*l = list
+	default:
+		return fmt.Errorf("expected string or list of strings, got %T", value)
+	}
+	return nil
+}
+
 type hcloudConfig struct {
-	Token             string
-	SSHKey            string `toml:"ssh_key"`
+	Token  string
+	SSHKey string `toml:"ssh_key"`
+	// SSHKeysSelector selects additional ssh keys of the project by label, added to servers and rescue along with ssh_key
+	SSHKeysSelector   string `toml:"ssh_keys_selector"`
 	SSHKeyPrivatePath string `toml:"ssh_key_private_path"`
-	PrivateNetwork    string `toml:"private_network"`
-	ServerType        string `toml:"server_type"`
-	Location          string
-	Image             string
+	// SSHKeyPrivate is the PEM encoded private key, usually injected as ${VAR}, used instead of ssh_key_private_path
+	SSHKeyPrivate string `toml:"ssh_key_private"`
+	// SSHCertificatePath points to an OpenSSH certificate signed for the private key or an agent key
+	SSHCertificatePath string `toml:"ssh_key_certificate_path"`
+	PrivateNetwork     string `toml:"private_network"`
+	// PrivateNetworkAliasIPs are additional ips of the server in the private network
+	PrivateNetworkAliasIPs []string `toml:"private_network_alias_ips"`
+	// CreatePrivateNetwork creates the private network with the following ip range, subnet and zone if it doesn't exist
+	CreatePrivateNetwork  bool   `toml:"create_private_network"`
+	PrivateNetworkIPRange string `toml:"private_network_ip_range"`
+	PrivateNetworkSubnet  string `toml:"private_network_subnet"`
+	PrivateNetworkZone    string `toml:"private_network_zone"`
+	// PrivateNetworkRoutes are added to the private network when it's created
+	PrivateNetworkRoutes []networkRoute `toml:"private_network_routes"`
+	// NATGateway is the private ip of a server forwarding the traffic of servers without public ipv4 to the internet,
+	// it adds the default route to the created network and the generated private network unit
+	NATGateway string `toml:"nat_gateway"`
+	ServerType string `toml:"server_type"`
+	// ServerTypeAliases map names usable as server_type to server types, e.g. { small = "cpx11" }
+	ServerTypeAliases map[string]string `toml:"server_type_aliases"`
+	// Location is the list of locations tried in order when creating servers
+	Location stringList
+	// Image is the name or id of the image servers are created from, or a label selector of snapshots of which the newest is used
+	Image string
+	// PrivateOnly creates servers without public network, they're installed via ssh.bastion or ssh.proxy
+	PrivateOnly bool `toml:"private_only"`
+	// SnapshotBeforeReinstall creates a snapshot of existing servers before reinstalling them
+	SnapshotBeforeReinstall bool `toml:"snapshot_before_reinstall"`
+	// SnapshotRetention is the number of snapshots kept per server
+	SnapshotRetention int `toml:"snapshot_retention"`
+	// ImageRetention is the number of snapshots selected by an Image label selector kept per channel by prune, 0 keeps all
+	ImageRetention int `toml:"image_retention"`
+	// PruneAfterRun prunes snapshots exceeding their retention after every run without failures
+	PruneAfterRun bool `toml:"prune_after_run"`
+	// StartAfterCreate creates new servers started from the flatcar snapshot Image with the ignition config as user data
+	// instead of installing flatcar via rescue
+	StartAfterCreate bool `toml:"start_after_create"`
+	// NamePatterns are globs of the server names managed by hetzner-flatcar, status reports matching servers without the managed label
+	NamePatterns []string `toml:"name_patterns"`
+	// Endpoint overrides the hcloud api url, e.g. to use an api mock in tests
+	Endpoint string
+	// InsecureSkipTLSVerify disables the certificate verification of the api endpoint
+	InsecureSkipTLSVerify bool `toml:"insecure_skip_tls_verify"`
+	// ProjectID is the id of the hcloud project, used to link to the console of servers in the cloud console
+	ProjectID int `toml:"project_id"`
+	// Contexts contains named overrides (e.g. one per hcloud project) selected with --context
+	Contexts map[string]hcloudConfig
+}
+
+// aliasIPs returns the parsed alias ips for the private network
+func (c hcloudConfig) aliasIPs() []net.IP {
+	aliasIPs := make([]net.IP, len(c.PrivateNetworkAliasIPs))
+	for i, aliasIP := range c.PrivateNetworkAliasIPs {
+		aliasIPs[i] = net.ParseIP(aliasIP)
+	}
+	return aliasIPs
+}
+
+// withContext returns a copy of the hcloud config with the values of the named context applied,
+// defined are the keys set in the context, so it can set values back to false or 0 as well
+func (c hcloudConfig) withContext(name string, defined map[string]bool) (hcloudConfig, error) {
+	override, ok := c.Contexts[name]
+	if !ok {
+		return c, fmt.Errorf("context %s doesn't exist", name)
+	}
+	merged := c
+	mergedValue := reflect.ValueOf(&merged).Elem()
+	overrideValue := reflect.ValueOf(override)
+	for i := 0; i < mergedValue.NumField(); i++ {
+		field := mergedValue.Type().Field(i)
+		if field.Name == "Contexts" {
+			continue
+		}
+		key, _, _ := strings.Cut(field.Tag.Get("toml"), ",")
+		if key == "" {
+			key = field.Name
+		}
+		if defined[strings.ToLower(key)] {
+			mergedValue.Field(i).Set(overrideValue.Field(i))
+		}
+	}
+	return merged, nil
+}
+
+// definedKeys returns the lower case keys set in the table at path, toml matches untagged fields case-insensitively
+func definedKeys(meta toml.MetaData, path ...string) map[string]bool {
+	keys := make(map[string]bool)
+	for _, key := range meta.Keys() {
+		if len(key) != len(path)+1 {
+			continue
+		}
+		matches := true
+		for i := range path {
+			matches = matches && strings.EqualFold(key[i], path[i])
+		}
+		if matches {
+			keys[strings.ToLower(key[len(path)])] = true
+		}
+	}
+	return keys
 }
 
 type flatcarConfig struct {
-	InstallScript   string `toml:"install_script"`
-	InstallArgs     string `toml:"install_args"`
-	InstallDevice   string `toml:"install_device"`
-	Version         string
-	ConfigTemplate  string            `toml:"config_template"`
+	InstallScript string `toml:"install_script"`
+	// InstallScriptURL is downloaded if InstallScript isn't set, {ref} is replaced by InstallScriptRef
+	InstallScriptURL string `toml:"install_script_url"`
+	// InstallScriptRef pins the branch, tag or commit of flatcar-install, defaults to flatcar-master
+	InstallScriptRef string `toml:"install_script_ref"`
+	InstallArgs      string `toml:"install_args"`
+	InstallDevice    string `toml:"install_device"`
+	// Wipe erases the install device with blkdiscard before installing: discard, secure or zero
+	Wipe    string
+	Version string
+	// Channel is the release channel the version is installed from, flatcar-install defaults to stable
+	Channel string
+	// Image is a local flatcar_production_image.bin.bz2 of Version uploaded instead of downloading it in the rescue system
+	Image string
+	// ImageChecksum is the expected sha256 of Image
+	ImageChecksum string `toml:"image_checksum"`
+	// Mirrors are base urls of flatcar image mirrors, the fastest one is passed to flatcar-install (-b), {channel} is replaced by the channel
+	Mirrors []string
+	// OEM selects the OEM image installed by flatcar-install (-o), e.g. hetzner
+	OEM            string `toml:"oem"`
+	ConfigTemplate string `toml:"config_template"`
+	// Templates maps server name globs (web-*) or labels (role=web) to templates used instead of ConfigTemplate
+	Templates       map[string]string `toml:"templates"`
 	TemplateStatic  map[string]string `toml:"template_static"`
 	TemplateCommand string            `toml:"template_command"`
+	// TemplateSecrets are template values masked in logs, events and reports, given literally or as file:PATH
+	TemplateSecrets map[string]string `toml:"template_secrets"`
+	// UpdateGroup, RebootStrategy and LocksmithWindow are written to /etc/flatcar/update.conf unless the template creates it
+	UpdateGroup     string `toml:"update_group"`
+	RebootStrategy  string `toml:"reboot_strategy"`
+	LocksmithWindow string `toml:"locksmith_window"`
+	// InjectSSHKey adds the hcloud ssh key to the authorized keys of core if the template doesn't set any
+	InjectSSHKey bool `toml:"inject_ssh_key"`
+	// PrivateNetworkUnit adds a networkd unit configuring the private interface
+	PrivateNetworkUnit bool           `toml:"private_network_unit"`
+	RemoteConfig       remoteConfig   `toml:"remote_config"`
+	UserData           userDataConfig `toml:"user_data"`
+	// Deterministic forbids template inputs which aren't reproducible and records the files the config is rendered from
+	Deterministic bool
+}
+
+// installScriptURL returns the url flatcar-install is downloaded from
+func (c flatcarConfig) installScriptURL() string {
+	scriptURL, ref := c.InstallScriptURL, c.InstallScriptRef
+	if scriptURL == "" {
+		scriptURL = defaultInstallScriptURL
+	}
+	if ref == "" {
+		ref = defaultInstallScriptRef
+	}
+	return strings.ReplaceAll(scriptURL, "{ref}", ref)
+}
+
+// remoteConfig configures installing a pointer config which replaces itself with the full config fetched from a url
+type remoteConfig struct {
+	// UploadURL is where the full config is stored with a PUT request, {server} is replaced by the server name
+	UploadURL string `toml:"upload_url"`
+	// URL is where ignition fetches the full config from, defaults to UploadURL
+	URL           string
+	UploadHeaders map[string]string `toml:"upload_headers"`
+	// Headers are sent by ignition when fetching the config, requires ignition spec 3.1 or later
+	Headers map[string]string
+	// CAFile is a pem file trusted for the upload and by ignition when fetching
+	CAFile string `toml:"ca_file"`
+	// AllowUpdates omits the hash of the config from the pointer, so the remote config can be changed
+	AllowUpdates bool `toml:"allow_updates"`
+}
+
+// userDataConfig configures an ignition config set as user data of new servers, which the installed config
+// merges or is replaced by on the first boot
+type userDataConfig struct {
+	// Template is rendered like ConfigTemplate before the server is created
+	Template string
+	// Mode is merge (default) or replace
+	Mode string
+}
+
+type sshConfig struct {
+	// KnownHosts is the known_hosts file the host key of the installed system is recorded in
+	KnownHosts string `toml:"known_hosts"`
+	// GenerateHostKeys enables generating the host key locally and injecting it via ignition
+	GenerateHostKeys bool `toml:"generate_host_keys"`
+	// StrictHostKeys verifies the installed system presents the generated host key instead of trusting it on first use
+	StrictHostKeys bool `toml:"strict_host_keys"`
+	// Proxy is a socks5 proxy url or a proxy command used for all ssh connections
+	Proxy string
+	// AddressFamily is the preferred address family (ipv4 or ipv6) of the public address used for ssh
+	AddressFamily string `toml:"address_family"`
+	// Bastion is a jump host ([user@]host[:port]) all ssh connections are tunneled through
+	Bastion string
+	// KeepaliveInterval is the interval keepalives are sent on ssh connections, defaults to 30s
+	KeepaliveInterval string `toml:"keepalive_interval"`
+	// CommandTimeout limits every command run in the rescue system, defaults to 30m
+	CommandTimeout string `toml:"command_timeout"`
+	// CommandRetries is how often rescue commands failing because of network problems are retried, defaults to 3, -1 disables retries
+	CommandRetries int `toml:"command_retries"`
+	// CommandRetryDelay is waited before the first retry and doubled for every further one, defaults to 10s
+	CommandRetryDelay string `toml:"command_retry_delay"`
+}
+
+// commandRetryDelay returns the delay before the first retry of a failed rescue command
+func (c sshConfig) commandRetryDelay() time.Duration {
+	delay, err := time.ParseDuration(c.CommandRetryDelay)
+	if err != nil {
+		return 10 * time.Second
+	}
+	return delay
+}
+
+// commandTimeout returns the timeout of commands run in the rescue system
+func (c sshConfig) commandTimeout() time.Duration {
+	timeout, err := time.ParseDuration(c.CommandTimeout)
+	if err != nil {
+		return 30 * time.Minute
+	}
+	return timeout
+}
+
+type historyConfig struct {
+	// Dir is the directory the applied ignition configs are stored in, one subdirectory per server
+	Dir string
+	// Database is the sqlite database every provisioning run is recorded in, defaults to runs.db in Dir
+	Database string
+	// Labels stores the redacted applied config compressed in server labels, so diff works from any machine
+	Labels bool
+	// RemoteURL is an object storage url the redacted applied config is stored at with PUT, {server} is replaced by the server name
+	RemoteURL string `toml:"remote_url"`
+	// RemoteHeaders are sent with requests to RemoteURL, e.g. for authentication
+	RemoteHeaders map[string]string `toml:"remote_headers"`
+}
+
+type artifactsConfig struct {
+	// Dir is the directory artifacts of installs are stored in, one subdirectory per server
+	Dir string
+	// Console enables capturing screenshots of the server console during install and first boot
+	Console bool
+	// RescueDiagnostics reboots servers whose first boot failed into rescue to read the journal from disk if ssh is down
+	RescueDiagnostics bool `toml:"rescue_diagnostics"`
+}
+
+type maintenanceConfig struct {
+	// Windows limit reinstalls of existing servers in watch and serve mode, in the format <cron schedule>/<length>
+	Windows []string
+}
+
+type firewallRule struct {
+	// Direction is in (default) or out
+	Direction string
+	// Protocol is tcp, udp, icmp, esp or gre
+	Protocol string
+	// Port is a port or range like 8000-8080, required for tcp and udp
+	Port           string
+	SourceIPs      []string `toml:"source_ips"`
+	DestinationIPs []string `toml:"destination_ips"`
+	Description    string
+}
+
+type firewallConfig struct {
+	// Name is the hcloud firewall applied to all managed servers, empty disables the firewall
+	Name string
+	// RulesFile is a toml file with additional [[rules]]
+	RulesFile string `toml:"rules_file"`
+	Rules     []firewallRule
+	// DelayExposure installs servers behind a staging firewall only allowing ssh,
+	// the firewall is applied once they're installed and healthy
+	DelayExposure bool `toml:"delay_exposure"`
+	// StagingSourceIPs may connect via ssh while servers are staged, defaults to any address
+	StagingSourceIPs []string `toml:"staging_source_ips"`
+}
+
+type loadBalancerConfig struct {
+	// Names are the load balancers servers are added to after installing and removed from before reinstalling or deleting them
+	Names []string
+	// UsePrivateIP makes the load balancers reach the servers via the private network
+	UsePrivateIP bool `toml:"use_private_ip"`
+	// DrainDelay is waited after removing a server for open connections to finish, defaults to 30s
+	DrainDelay string `toml:"drain_delay"`
+	// HealthTimeout is the time a new target has to pass the health checks of the load balancers, defaults to 5m
+	HealthTimeout string `toml:"health_timeout"`
+}
+
+type fileUpload struct {
+	// Source is the local file
+	Source      string
+	Destination string
+	// Mode is the octal mode of the destination, defaults to 0644
+	Mode string
+	// Owner is user[:group] of the destination, defaults to root
+	Owner string
+}
+
+type filesConfig struct {
+	// Rescue files are uploaded into the rescue system before installing
+	Rescue []fileUpload
+	// Host files are copied to the installed system after the first boot
+	Host []fileUpload
+}
+
+// rescueSettings configure the environment of the commands run in the rescue system
+type rescueSettings struct {
+	// HTTPProxy, HTTPSProxy and NoProxy are exported as http_proxy, https_proxy and no_proxy for apt, curl and flatcar-install
+	HTTPProxy  string `toml:"http_proxy"`
+	HTTPSProxy string `toml:"https_proxy"`
+	NoProxy    string `toml:"no_proxy"`
+	// ISO is the name or id of an iso booted instead of the rescue system, its live system has to accept the ssh key as User
+	ISO string `toml:"iso"`
+	// User is the ssh user of the rescue system, defaults to root, other users need passwordless sudo
+	User string
+	// WorkDir is the directory flatcar-install, the ignition config and uploaded files are stored in,
+	// defaults to /root for root and /home/<user> for other users
+	WorkDir string `toml:"work_dir"`
+	// DisableOnAbort disables the rescue boot of servers whose install failed or was interrupted before flatcar was installed
+	DisableOnAbort bool `toml:"disable_on_abort"`
+}
+
+// user returns the ssh user of the rescue system
+func (c rescueSettings) user() string {
+	if c.User == "" {
+		return "root"
+	}
+	return c.User
+}
+
+// path returns the path of name in the working directory of the rescue system
+func (c rescueSettings) path(name string) string {
+	workDir := c.WorkDir
+	if workDir == "" && c.user() == "root" {
+		workDir = "/root"
+	} else if workDir == "" {
+		workDir = path.Join("/home", c.user())
+	}
+	return path.Join(workDir, name)
+}
+
+// sudo returns whether commands in the rescue system have to be run with sudo
+func (c rescueSettings) sudo() bool {
+	return c.user() != "root"
+}
+
+// envPrefix returns the shell prefix exporting the proxy variables in upper and lower case, empty if none are set
+func (c rescueSettings) envPrefix() string {
+	var exports []string
+	for _, variable := range []struct{ name, value string }{{"http_proxy", c.HTTPProxy}, {"https_proxy", c.HTTPSProxy}, {"no_proxy", c.NoProxy}} {
+		if variable.value != "" {
+			exports = append(exports, fmt.Sprintf("%s=%s %s=%s", variable.name, shellQuote(variable.value), strings.ToUpper(variable.name), shellQuote(variable.value)))
+		}
+	}
+	if len(exports) == 0 {
+		return ""
+	}
+	return "export " + strings.Join(exports, " ") + "; "
 }
 
 type config struct {
-	HCloud  hcloudConfig
-	Flatcar flatcarConfig
+	HCloud       hcloudConfig
+	Flatcar      flatcarConfig
+	SSH          sshConfig
+	History      historyConfig
+	Artifacts    artifactsConfig
+	Maintenance  maintenanceConfig
+	Firewall     firewallConfig
+	LoadBalancer loadBalancerConfig `toml:"load_balancer"`
+	Files        filesConfig
+	Rescue       rescueSettings
+	Rollout      rolloutConfig
+	Plugins      []pluginConfig
+}
+
+// fieldError is an invalid or missing config value
+type fieldError struct {
+	// Field is the path of the value in the config, e.g. hcloud.token
+	Field   string
+	Message string
+	// Hint explains how to fix the value, optional
+	Hint string
+}
+
+func (e fieldError) Error() string {
+	if e.Hint != "" {
+		return fmt.Sprintf("%s: %s (%s)", e.Field, e.Message, e.Hint)
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Message)
+}
+
+// configErrors are all problems found in a config
+type configErrors []fieldError
+
+func (e configErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	lines := make([]string, len(e))
+	for i, err := range e {
+		lines[i] = "  " + err.Error()
+	}
+	return fmt.Sprintf("%d config errors:\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+func (e *configErrors) add(field string, message string, hint string) {
+	*e = append(*e, fieldError{Field: field, Message: message, Hint: hint})
+}
+
+// checkReadable adds an error if the file at path can't be read
+func (e *configErrors) checkReadable(field string, path string) {
+	file, err := os.Open(path)
+	if err != nil {
+		e.add(field, fmt.Sprintf("can't read %s", path), strings.TrimPrefix(err.Error(), "open "+path+": "))
+		return
+	}
+	file.Close()
 }
 
+// verifyConfig sets defaults and returns all missing and invalid values at once
 func verifyConfig(conf *config) error {
+	var errs configErrors
 	if conf.HCloud.Token == "" {
-		return errors.New("hcloud token missing")
+		errs.add("hcloud.token", "missing", "set it in the config or with --token, e.g. as ${HCLOUD_TOKEN}")
 	}
 	if conf.HCloud.SSHKey == "" {
-		return errors.New("ssh key missing")
+		errs.add("hcloud.ssh_key", "missing", "name of the ssh key in the hcloud project, or --ssh-key")
+	}
+	if conf.HCloud.SSHKeyPrivate != "" {
+		if conf.HCloud.SSHKeyPrivatePath != "" {
+			errs.add("hcloud.ssh_key_private", "conflicts with hcloud.ssh_key_private_path", "set only one of them")
+		}
+		if _, err := ssh.ParsePrivateKey([]byte(conf.HCloud.SSHKeyPrivate)); err != nil {
+			errs.add("hcloud.ssh_key_private", fmt.Sprintf("invalid private key: %v", err), "PEM encoded key without passphrase, e.g. ${SSH_PRIVATE_KEY}")
+		}
+	} else if conf.HCloud.SSHKeyPrivatePath != "" {
+		errs.checkReadable("hcloud.ssh_key_private_path", conf.HCloud.SSHKeyPrivatePath)
+	}
+	if conf.HCloud.SSHCertificatePath != "" {
+		errs.checkReadable("hcloud.ssh_key_certificate_path", conf.HCloud.SSHCertificatePath)
 	}
 	if conf.HCloud.PrivateNetwork == "" {
-		return errors.New("private network missing")
+		errs.add("hcloud.private_network", "missing", "name of the private network, or --private-network")
+	}
+	for _, aliasIP := range conf.HCloud.PrivateNetworkAliasIPs {
+		if net.ParseIP(aliasIP) == nil {
+			errs.add("hcloud.private_network_alias_ips", fmt.Sprintf("invalid ip %s", aliasIP), "")
+		}
+	}
+	if conf.HCloud.PrivateNetworkIPRange == "" {
+		conf.HCloud.PrivateNetworkIPRange = "10.0.0.0/16"
+	}
+	_, ipRange, err := net.ParseCIDR(conf.HCloud.PrivateNetworkIPRange)
+	if err != nil {
+		errs.add("hcloud.private_network_ip_range", fmt.Sprintf("invalid ip range %s", conf.HCloud.PrivateNetworkIPRange), "e.g. 10.0.0.0/16")
+	}
+	if conf.HCloud.PrivateNetworkSubnet == "" {
+		conf.HCloud.PrivateNetworkSubnet = conf.HCloud.PrivateNetworkIPRange
+	}
+	if subnetIP, _, err := net.ParseCIDR(conf.HCloud.PrivateNetworkSubnet); err != nil {
+		errs.add("hcloud.private_network_subnet", fmt.Sprintf("invalid subnet %s", conf.HCloud.PrivateNetworkSubnet), "e.g. 10.0.1.0/24")
+	} else if ipRange != nil && !ipRange.Contains(subnetIP) {
+		errs.add("hcloud.private_network_subnet", fmt.Sprintf("%s isn't part of %s", conf.HCloud.PrivateNetworkSubnet, conf.HCloud.PrivateNetworkIPRange), "")
+	}
+	if conf.HCloud.NATGateway != "" {
+		if gateway := net.ParseIP(conf.HCloud.NATGateway); gateway == nil || gateway.To4() == nil {
+			errs.add("hcloud.nat_gateway", fmt.Sprintf("invalid ipv4 %s", conf.HCloud.NATGateway), "private ip of the gateway server, e.g. 10.0.0.2")
+		} else if conf.HCloud.CreatePrivateNetwork && ipRange != nil && !ipRange.Contains(gateway) {
+			errs.add("hcloud.nat_gateway", fmt.Sprintf("%s isn't part of %s", conf.HCloud.NATGateway, conf.HCloud.PrivateNetworkIPRange), "")
+		}
+	}
+	for i, route := range conf.HCloud.PrivateNetworkRoutes {
+		field := fmt.Sprintf("hcloud.private_network_routes[%d]", i)
+		if _, _, err := net.ParseCIDR(route.Destination); err != nil {
+			errs.add(field+".destination", fmt.Sprintf("invalid destination %s", route.Destination), "e.g. 192.168.0.0/16")
+		}
+		if gateway := net.ParseIP(route.Gateway); gateway == nil {
+			errs.add(field+".gateway", fmt.Sprintf("invalid ip %s", route.Gateway), "private ip of the gateway server, e.g. 10.0.0.2")
+		} else if conf.HCloud.CreatePrivateNetwork && ipRange != nil && !ipRange.Contains(gateway) {
+			errs.add(field+".gateway", fmt.Sprintf("%s isn't part of %s", route.Gateway, conf.HCloud.PrivateNetworkIPRange), "")
+		}
 	}
 	if conf.HCloud.ServerType == "" {
-		return errors.New("server type missing")
+		errs.add("hcloud.server_type", "missing", "e.g. cx21, or --server-type")
+	} else if serverType, ok := conf.HCloud.ServerTypeAliases[conf.HCloud.ServerType]; ok {
+		conf.HCloud.ServerType = serverType
 	}
-	if conf.HCloud.Location == "" {
-		return errors.New("location missing")
+	if len(conf.HCloud.Location) == 0 {
+		errs.add("hcloud.location", "missing", "e.g. nbg1, or --location")
+	}
+	if conf.HCloud.PrivateOnly && conf.SSH.Bastion == "" && conf.SSH.Proxy == "" {
+		errs.add("hcloud.private_only", "servers without public network can't be reached", "set ssh.bastion or ssh.proxy")
+	}
+	if conf.HCloud.StartAfterCreate {
+		if conf.HCloud.Image == "" {
+			errs.add("hcloud.image", "missing", "start_after_create boots a snapshot with flatcar, e.g. flatcar/channel=stable")
+		}
+		if conf.Rescue.ISO != "" {
+			errs.add("hcloud.start_after_create", "conflicts with rescue.iso", "new servers aren't installed from the iso")
+		}
+		if conf.SSH.GenerateHostKeys {
+			errs.add("hcloud.start_after_create", "conflicts with ssh.generate_host_keys", "host keys are only generated for installs via rescue")
+		}
+		if conf.Flatcar.PrivateNetworkUnit {
+			errs.add("hcloud.start_after_create", "conflicts with flatcar.private_network_unit", "the private ip isn't known before the server is created")
+		}
+		if conf.Flatcar.UserData.Template != "" {
+			errs.add("hcloud.start_after_create", "conflicts with flatcar.user_data", "the user data is the whole config with start_after_create")
+		}
 	}
 	if conf.HCloud.Image == "" {
 		conf.HCloud.Image = "debian-11"
 	}
+	if conf.HCloud.SnapshotRetention < 0 {
+		errs.add("hcloud.snapshot_retention", "must not be negative", "")
+	}
+	if conf.HCloud.SnapshotRetention == 0 {
+		conf.HCloud.SnapshotRetention = 3
+	}
+	if conf.HCloud.ImageRetention < 0 {
+		errs.add("hcloud.image_retention", "must not be negative", "")
+	} else if conf.HCloud.ImageRetention > 0 && !isLabelSelector(conf.HCloud.Image) {
+		errs.add("hcloud.image_retention", "only applies to snapshots selected by labels", "set hcloud.image to a label selector, e.g. flatcar/channel=stable")
+	}
+	for _, pattern := range conf.HCloud.NamePatterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs.add("hcloud.name_patterns", fmt.Sprintf("invalid pattern %s: %v", pattern, err), "a glob like web-*")
+		}
+	}
 	if conf.Flatcar.Version == "" {
 		// TODO: set to latest version if not given
-		return errors.New("flatcar version missing")
+		errs.add("flatcar.version", "missing", "e.g. 3227.2.0 or current, or --flatcar-version")
+	}
+	if conf.Flatcar.Channel != "" && !flatcarChannels[conf.Flatcar.Channel] {
+		errs.add("flatcar.channel", fmt.Sprintf("invalid channel %s", conf.Flatcar.Channel), "use stable, beta, alpha or lts")
+	}
+	if remote := conf.Flatcar.RemoteConfig; remote.UploadURL != "" {
+		for _, field := range []struct{ name, url string }{{"upload_url", remote.UploadURL}, {"url", remote.URL}} {
+			if parsed, err := url.Parse(field.url); field.url != "" && (err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https")) {
+				errs.add("flatcar.remote_config."+field.name, fmt.Sprintf("invalid url %s", field.url), "an http or https url")
+			}
+		}
+		if remote.CAFile != "" {
+			errs.checkReadable("flatcar.remote_config.ca_file", remote.CAFile)
+		}
+	} else if remote.URL != "" {
+		errs.add("flatcar.remote_config.upload_url", "missing", "the full config has to be uploaded before ignition can fetch it")
+	}
+	if parsed, err := url.Parse(conf.History.RemoteURL); conf.History.RemoteURL != "" && (err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https")) {
+		errs.add("history.remote_url", fmt.Sprintf("invalid url %s", conf.History.RemoteURL), "an http or https url")
+	} else if conf.History.RemoteURL != "" && !strings.Contains(conf.History.RemoteURL, "{server}") {
+		errs.add("history.remote_url", "missing {server}", "every server needs its own object, e.g. https://bucket.example.com/applied/{server}.json.gz")
+	}
+	if conf.Flatcar.Image != "" {
+		errs.checkReadable("flatcar.image", conf.Flatcar.Image)
+	}
+	if conf.Flatcar.ImageChecksum != "" && !sha256Pattern.MatchString(conf.Flatcar.ImageChecksum) {
+		errs.add("flatcar.image_checksum", "invalid sha256", "64 hex characters, e.g. from sha256sum")
+	}
+	for i, mirror := range conf.Flatcar.Mirrors {
+		if parsed, err := url.Parse(mirror); err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+			errs.add(fmt.Sprintf("flatcar.mirrors[%d]", i), fmt.Sprintf("invalid url %s", mirror), "e.g. https://{channel}.release.flatcar-linux.net/amd64-usr")
+		}
+	}
+	if conf.Flatcar.OEM != "" && !oemPattern.MatchString(conf.Flatcar.OEM) {
+		errs.add("flatcar.oem", fmt.Sprintf("invalid oem %s", conf.Flatcar.OEM), "e.g. hetzner")
+	}
+	if conf.SSH.StrictHostKeys {
+		if conf.SSH.KnownHosts == "" {
+			errs.add("ssh.strict_host_keys", "strict host key checking needs a known_hosts file", "set ssh.known_hosts")
+		}
+		if !conf.SSH.GenerateHostKeys {
+			errs.add("ssh.strict_host_keys", "strict host key checking needs pinned host keys", "set ssh.generate_host_keys")
+		}
+	}
+	switch conf.SSH.AddressFamily {
+	case "", "ipv4", "ipv6":
+	default:
+		errs.add("ssh.address_family", fmt.Sprintf("invalid address family %s", conf.SSH.AddressFamily), "use ipv4 or ipv6")
+	}
+	if conf.SSH.KeepaliveInterval == "" {
+		conf.SSH.KeepaliveInterval = "30s"
+	}
+	if interval, err := time.ParseDuration(conf.SSH.KeepaliveInterval); err != nil || interval <= 0 {
+		errs.add("ssh.keepalive_interval", fmt.Sprintf("invalid duration %s", conf.SSH.KeepaliveInterval), "e.g. 30s")
+	}
+	if conf.SSH.CommandTimeout == "" {
+		conf.SSH.CommandTimeout = "30m"
+	}
+	if timeout, err := time.ParseDuration(conf.SSH.CommandTimeout); err != nil || timeout <= 0 {
+		errs.add("ssh.command_timeout", fmt.Sprintf("invalid duration %s", conf.SSH.CommandTimeout), "e.g. 30m")
+	}
+	if conf.SSH.CommandRetries == 0 {
+		conf.SSH.CommandRetries = 3
+	}
+	if conf.SSH.CommandRetryDelay == "" {
+		conf.SSH.CommandRetryDelay = "10s"
+	}
+	if _, err := time.ParseDuration(conf.SSH.CommandRetryDelay); err != nil {
+		errs.add("ssh.command_retry_delay", fmt.Sprintf("invalid duration %s", conf.SSH.CommandRetryDelay), "e.g. 10s")
+	}
+	switch conf.Flatcar.RebootStrategy {
+	case "", "reboot", "etcd-lock", "off":
+	default:
+		errs.add("flatcar.reboot_strategy", fmt.Sprintf("invalid reboot strategy %s", conf.Flatcar.RebootStrategy), "use reboot, etcd-lock or off")
+	}
+	if _, ok := wipeArgs[conf.Flatcar.Wipe]; conf.Flatcar.Wipe != "" && !ok {
+		errs.add("flatcar.wipe", fmt.Sprintf("invalid wipe method %s", conf.Flatcar.Wipe), "use discard, secure or zero")
+	}
+	if conf.Flatcar.LocksmithWindow != "" {
+		if _, _, err := parseLocksmithWindow(conf.Flatcar.LocksmithWindow); err != nil {
+			errs.add("flatcar.locksmith_window", err.Error(), "e.g. Thu 04:00/1h")
+		}
 	}
 	if conf.Flatcar.ConfigTemplate == "" {
 		conf.Flatcar.ConfigTemplate = "ignition.yml.gtpl"
 	}
+	if conf.Flatcar.TemplateCommand == "" {
+		errs.checkReadable("flatcar.config_template", conf.Flatcar.ConfigTemplate)
+		for pattern, template := range conf.Flatcar.Templates {
+			errs.checkReadable(fmt.Sprintf("flatcar.templates.%s", pattern), template)
+		}
+	}
+	if conf.Flatcar.Deterministic && conf.Flatcar.TemplateCommand != "" {
+		errs.add("flatcar.deterministic", "conflicts with flatcar.template_command", "the output of commands isn't reproducible, use a native template")
+	}
+	if conf.Flatcar.UserData.Template != "" {
+		errs.checkReadable("flatcar.user_data.template", conf.Flatcar.UserData.Template)
+	}
+	switch conf.Flatcar.UserData.Mode {
+	case "":
+		conf.Flatcar.UserData.Mode = userDataMerge
+	case userDataMerge, userDataReplace:
+	default:
+		errs.add("flatcar.user_data.mode", fmt.Sprintf("invalid mode %s", conf.Flatcar.UserData.Mode), "use merge or replace")
+	}
+	for pattern := range conf.Flatcar.Templates {
+		if _, err := path.Match(pattern, ""); err != nil {
+			errs.add(fmt.Sprintf("flatcar.templates.%s", pattern), fmt.Sprintf("invalid pattern: %v", err), "")
+		}
+	}
+	if conf.Flatcar.InstallScript != "" {
+		errs.checkReadable("flatcar.install_script", conf.Flatcar.InstallScript)
+	}
+	if scriptURL, err := url.Parse(conf.Flatcar.installScriptURL()); err != nil || (scriptURL.Scheme != "http" && scriptURL.Scheme != "https") {
+		errs.add("flatcar.install_script_url", fmt.Sprintf("invalid url %s", conf.Flatcar.InstallScriptURL), "an http or https url")
+	}
+	for name, ref := range conf.Flatcar.TemplateSecrets {
+		value, err := resolveSecret(ref)
+		if err != nil {
+			errs.add("flatcar.template_secrets."+name, err.Error(), "a value, ${ENVIRONMENT_VARIABLE} or file:PATH")
+			continue
+		}
+		conf.Flatcar.TemplateSecrets[name] = value
+	}
+	if conf.History.Dir == "" {
+		conf.History.Dir = "history"
+	}
+	for _, window := range conf.Maintenance.Windows {
+		if _, err := parseMaintenanceWindow(window); err != nil {
+			errs.add("maintenance.windows", err.Error(), "e.g. 0 2 * * 6/2h")
+		}
+	}
+	if conf.Artifacts.Dir == "" {
+		conf.Artifacts.Dir = "artifacts"
+	}
+	if conf.Firewall.RulesFile != "" {
+		var rulesFile struct {
+			Rules []firewallRule
+		}
+		if _, err := toml.DecodeFile(conf.Firewall.RulesFile, &rulesFile); err != nil {
+			errs.add("firewall.rules_file", err.Error(), "")
+		}
+		conf.Firewall.Rules = append(conf.Firewall.Rules, rulesFile.Rules...)
+	}
+	for _, files := range []struct {
+		field   string
+		uploads []fileUpload
+	}{{"files.rescue", conf.Files.Rescue}, {"files.host", conf.Files.Host}} {
+		for i, file := range files.uploads {
+			field := fmt.Sprintf("%s[%d]", files.field, i)
+			errs.checkReadable(field+".source", file.Source)
+			if !path.IsAbs(file.Destination) {
+				errs.add(field+".destination", fmt.Sprintf("%q isn't an absolute path", file.Destination), "")
+			}
+			if file.Mode != "" && !filePattern.MatchString(file.Mode) {
+				errs.add(field+".mode", fmt.Sprintf("invalid mode %s", file.Mode), "octal, e.g. 0755")
+			}
+			if file.Owner != "" && !ownerPattern.MatchString(file.Owner) {
+				errs.add(field+".owner", fmt.Sprintf("invalid owner %s", file.Owner), "user or user:group")
+			}
+		}
+	}
+	for _, proxy := range []struct{ name, url string }{{"http_proxy", conf.Rescue.HTTPProxy}, {"https_proxy", conf.Rescue.HTTPSProxy}} {
+		if parsed, err := url.Parse(proxy.url); proxy.url != "" && (err != nil || parsed.Host == "") {
+			errs.add("rescue."+proxy.name, fmt.Sprintf("invalid proxy url %s", proxy.url), "e.g. http://proxy.example.com:3128")
+		}
+	}
+	if conf.Rescue.User != "" && !userPattern.MatchString(conf.Rescue.User) {
+		errs.add("rescue.user", fmt.Sprintf("invalid user %s", conf.Rescue.User), "a user name, e.g. deploy")
+	}
+	if conf.Rescue.WorkDir != "" && !path.IsAbs(conf.Rescue.WorkDir) {
+		errs.add("rescue.work_dir", fmt.Sprintf("%s isn't absolute", conf.Rescue.WorkDir), "e.g. /srv/hetzner-flatcar")
+	}
+	if _, err := canaryCount(conf.Rollout.Canary, 1); err != nil {
+		errs.add("rollout.canary", err.Error(), "number of servers or percentage, e.g. 1 or 10%")
+	}
+	if timeout, err := time.ParseDuration(conf.Rollout.Soak); conf.Rollout.Soak != "" && (err != nil || timeout < 0) {
+		errs.add("rollout.soak", fmt.Sprintf("invalid duration %s", conf.Rollout.Soak), "e.g. 10m")
+	}
+	for i, plugin := range conf.Plugins {
+		field := fmt.Sprintf("plugins[%d]", i)
+		if plugin.Name == "" {
+			conf.Plugins[i].Name = field
+		}
+		if len(plugin.Command) == 0 {
+			errs.add(field+".command", "missing", "executable and arguments, e.g. [\"./register-cmdb\"]")
+		}
+		for _, hook := range plugin.Hooks {
+			if !validHook(hook) {
+				errs.add(field+".hooks", fmt.Sprintf("unknown hook %s", hook), fmt.Sprintf("before-<phase> or after-<phase> of %s", strings.Join(pluginPhases, ", ")))
+			}
+		}
+		if timeout, err := time.ParseDuration(plugin.Timeout); plugin.Timeout != "" && (err != nil || timeout <= 0) {
+			errs.add(field+".timeout", fmt.Sprintf("invalid duration %s", plugin.Timeout), "e.g. 5m")
+		}
+	}
+	if conf.LoadBalancer.DrainDelay == "" {
+		conf.LoadBalancer.DrainDelay = "30s"
+	}
+	if _, err := time.ParseDuration(conf.LoadBalancer.DrainDelay); err != nil {
+		errs.add("load_balancer.drain_delay", fmt.Sprintf("invalid duration %s", conf.LoadBalancer.DrainDelay), "e.g. 30s")
+	}
+	if conf.LoadBalancer.HealthTimeout == "" {
+		conf.LoadBalancer.HealthTimeout = "5m"
+	}
+	if _, err := time.ParseDuration(conf.LoadBalancer.HealthTimeout); err != nil {
+		errs.add("load_balancer.health_timeout", fmt.Sprintf("invalid duration %s", conf.LoadBalancer.HealthTimeout), "e.g. 5m")
+	}
+	if conf.Firewall.Name == "" && len(conf.Firewall.Rules) > 0 {
+		errs.add("firewall.name", "missing", "rules are only applied to a named firewall")
+	}
+	for i, rule := range conf.Firewall.Rules {
+		if _, err := firewallRuleFromConfig(rule); err != nil {
+			errs.add(fmt.Sprintf("firewall.rules[%d]", i), err.Error(), "")
+		}
+	}
+	if conf.Firewall.DelayExposure {
+		if conf.Firewall.Name == "" {
+			errs.add("firewall.delay_exposure", "needs a firewall", "set firewall.name")
+		}
+		if len(conf.LoadBalancer.Names) > 0 && !conf.LoadBalancer.UsePrivateIP {
+			errs.add("firewall.delay_exposure", "health checks of the load balancers can't pass while servers are staged", "set load_balancer.use_private_ip")
+		}
+	}
+	if _, err := parseCIDRs(conf.Firewall.StagingSourceIPs); err != nil {
+		errs.add("firewall.staging_source_ips", err.Error(), "e.g. 203.0.113.10/32")
+	}
+	if len(errs) > 0 {
+		return errs
+	}
 	return nil
 }
 
-func ParseConfig(filename string) (config, error) {
+// oemPattern matches the oem ids of flatcar images, as in flatcar_production_<oem>_image.bin.bz2
+var oemPattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+// sha256Pattern matches hex encoded sha256 checksums
+var sha256Pattern = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+
+// filePattern matches octal file modes
+var filePattern = regexp.MustCompile(`^0?[0-7]{3,4}$`)
+
+// userPattern matches user names
+var userPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*[$]?$`)
+
+// ownerPattern matches user[:group] with user and group names or ids
+var ownerPattern = regexp.MustCompile(`^[a-z_][a-z0-9_-]*[$]?(:[a-z_][a-z0-9_-]*[$]?)?$|^\d+(:\d+)?$`)
+
+// envReference matches ${VAR} and ${VAR:-default}
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnvString replaces all environment variable references in value
+func expandEnvString(value string) (string, error) {
+	var err error
+	expanded := envReference.ReplaceAllStringFunc(value, func(reference string) string {
+		match := envReference.FindStringSubmatch(reference)
+		if envValue, ok := os.LookupEnv(match[1]); ok {
+			return envValue
+		}
+		if match[2] == "" {
+			err = fmt.Errorf("environment variable %s is not set", match[1])
+		}
+		return match[3]
+	})
+	return expanded, err
+}
+
+// expandEnv expands environment variable references in all strings contained in value
+func expandEnv(value reflect.Value) error {
+	switch value.Kind() {
+	case reflect.String:
+		expanded, err := expandEnvString(value.String())
+		if err != nil {
+			return err
+		}
+		value.SetString(expanded)
+	case reflect.Struct:
+		for i := 0; i < value.NumField(); i++ {
+			if err := expandEnv(value.Field(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice:
+		for i := 0; i < value.Len(); i++ {
+			if err := expandEnv(value.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := value.MapRange()
+		for iter.Next() {
+			// map values aren't addressable, so expand a copy and store it afterwards
+			mapValue := reflect.New(iter.Value().Type()).Elem()
+			mapValue.Set(iter.Value())
+			if err := expandEnv(mapValue); err != nil {
+				return err
+			}
+			value.SetMapIndex(iter.Key(), mapValue)
+		}
+	}
+	return nil
+}
+
+// ParseConfig reads the config from filename and applies the hcloud context if one is given,
+// if filename is empty the config is built from the overrides alone.
+// The overrides (e.g. command line flags) are applied after the context and take precedence over the file.
+func ParseConfig(filename string, context string, overrides ...func(*config)) (config, error) {
 	var conf config
-	_, err := toml.DecodeFile(filename, &conf)
-	if err != nil {
+	var meta toml.MetaData
+	if filename != "" {
+		var err error
+		meta, err = toml.DecodeFile(filename, &conf)
+		if err != nil {
+			return conf, err
+		}
+	}
+	if err := expandEnv(reflect.ValueOf(&conf).Elem()); err != nil {
 		return conf, err
 	}
-	err = verifyConfig(&conf)
+	if context != "" {
+		var err error
+		conf.HCloud, err = conf.HCloud.withContext(context, definedKeys(meta, "hcloud", "contexts", context))
+		if err != nil {
+			return conf, err
+		}
+	}
+	for _, override := range overrides {
+		override(&conf)
+	}
+	err := verifyConfig(&conf)
 	return conf, err
 }
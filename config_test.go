@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/BurntSushi/toml"
+)
+
+func TestContextOverridesZeroValues(t *testing.T) {
+	var conf config
+	meta, err := toml.Decode(`
+[hcloud]
+token = "default"
+server_type = "cx21"
+private_only = true
+snapshot_retention = 3
+
+[hcloud.contexts.test]
+Token = "test"
+private_only = false
+snapshot_retention = 0
+`, &conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, err := conf.HCloud.withContext("test", definedKeys(meta, "hcloud", "contexts", "test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.Token != "test" {
+		t.Errorf("expected token of the context, got %q", merged.Token)
+	}
+	if merged.PrivateOnly || merged.SnapshotRetention != 0 {
+		t.Errorf("expected the context to override private_only and snapshot_retention, got %v and %d", merged.PrivateOnly, merged.SnapshotRetention)
+	}
+	if merged.ServerType != "cx21" {
+		t.Errorf("expected values not set in the context to be kept, got server type %q", merged.ServerType)
+	}
+
+	if _, err := conf.HCloud.withContext("prod", nil); err == nil {
+		t.Errorf("expected unknown context to fail")
+	}
+}
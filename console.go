@@ -0,0 +1,465 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/des"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/net/websocket"
+)
+
+// consoleSnapshotInterval is the minimum time between two saved screenshots of the console
+const consoleSnapshotInterval = 5 * time.Second
+
+// vncConn is a minimal RFB client for the hcloud web console, supporting vnc authentication and raw encoding
+type vncConn struct {
+	conn        io.ReadWriteCloser
+	reader      *bufio.Reader
+	framebuffer *image.RGBA
+}
+
+// dialConsole connects to the vnc console of the server via websocket
+func dialConsole(wssURL string, password string) (*vncConn, error) {
+	parsedURL, err := url.Parse(wssURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid console url: %w", err)
+	}
+	wsConfig, err := websocket.NewConfig(wssURL, "https://"+parsedURL.Host)
+	if err != nil {
+		return nil, err
+	}
+	wsConfig.Protocol = []string{"binary"}
+	ws, err := websocket.DialConfig(wsConfig)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to console: %w", err)
+	}
+	ws.PayloadType = websocket.BinaryFrame
+	c := &vncConn{conn: ws, reader: bufio.NewReader(ws)}
+	if err := c.handshake(password); err != nil {
+		ws.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *vncConn) read(data interface{}) error {
+	return binary.Read(c.reader, binary.BigEndian, data)
+}
+
+func (c *vncConn) write(data interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := binary.Write(buf, binary.BigEndian, data); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(buf.Bytes())
+	return err
+}
+
+// handshake negotiates protocol version 3.8, authenticates and sets a 32 bit true color pixel format
+func (c *vncConn) handshake(password string) error {
+	version := make([]byte, 12)
+	if _, err := io.ReadFull(c.reader, version); err != nil {
+		return fmt.Errorf("error reading protocol version: %w", err)
+	}
+	if _, err := c.conn.Write([]byte("RFB 003.008\n")); err != nil {
+		return err
+	}
+
+	var securityTypeCount uint8
+	if err := c.read(&securityTypeCount); err != nil {
+		return err
+	}
+	if securityTypeCount == 0 {
+		return errors.New("console refused connection")
+	}
+	securityTypes := make([]byte, securityTypeCount)
+	if _, err := io.ReadFull(c.reader, securityTypes); err != nil {
+		return err
+	}
+	if !bytes.Contains(securityTypes, []byte{2}) {
+		return fmt.Errorf("console doesn't support vnc authentication (offered %v)", securityTypes)
+	}
+	if err := c.write(uint8(2)); err != nil {
+		return err
+	}
+	challenge := make([]byte, 16)
+	if _, err := io.ReadFull(c.reader, challenge); err != nil {
+		return err
+	}
+	response, err := vncAuthResponse(password, challenge)
+	if err != nil {
+		return err
+	}
+	if _, err := c.conn.Write(response); err != nil {
+		return err
+	}
+	var securityResult uint32
+	if err := c.read(&securityResult); err != nil {
+		return err
+	}
+	if securityResult != 0 {
+		return errors.New("console authentication failed")
+	}
+
+	// share the console with other viewers
+	if err := c.write(uint8(1)); err != nil {
+		return err
+	}
+	var serverInit struct {
+		Width, Height uint16
+		PixelFormat   [16]byte
+		NameLength    uint32
+	}
+	if err := c.read(&serverInit); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(io.Discard, c.reader, int64(serverInit.NameLength)); err != nil {
+		return err
+	}
+	c.framebuffer = image.NewRGBA(image.Rect(0, 0, int(serverInit.Width), int(serverInit.Height)))
+
+	// SetPixelFormat: 32 bpp, depth 24, little endian, true color with 8 bit per channel
+	if err := c.write(struct {
+		Type                            uint8
+		Padding                         [3]byte
+		BitsPerPixel, Depth             uint8
+		BigEndian, TrueColor            uint8
+		RedMax, GreenMax, BlueMax       uint16
+		RedShift, GreenShift, BlueShift uint8
+		Padding2                        [3]byte
+	}{Type: 0, BitsPerPixel: 32, Depth: 24, TrueColor: 1, RedMax: 255, GreenMax: 255, BlueMax: 255, RedShift: 16, GreenShift: 8}); err != nil {
+		return err
+	}
+	// SetEncodings: raw only
+	return c.write(struct {
+		Type     uint8
+		Padding  uint8
+		Count    uint16
+		Encoding int32
+	}{Type: 2, Count: 1, Encoding: 0})
+}
+
+// vncAuthResponse encrypts the challenge with the password as des key with reversed bit order, as vnc authentication expects
+func vncAuthResponse(password string, challenge []byte) ([]byte, error) {
+	key := make([]byte, 8)
+	copy(key, password)
+	for i, b := range key {
+		var reversed byte
+		for bit := 0; bit < 8; bit++ {
+			if b&(1<<bit) != 0 {
+				reversed |= 1 << (7 - bit)
+			}
+		}
+		key[i] = reversed
+	}
+	cipher, err := des.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	response := make([]byte, len(challenge))
+	for i := 0; i < len(challenge); i += 8 {
+		cipher.Encrypt(response[i:i+8], challenge[i:i+8])
+	}
+	return response, nil
+}
+
+// update requests a framebuffer update and applies it, returning after the first update message
+func (c *vncConn) update(incremental bool) error {
+	var incrementalFlag uint8
+	if incremental {
+		incrementalFlag = 1
+	}
+	bounds := c.framebuffer.Bounds()
+	if err := c.write(struct {
+		Type, Incremental   uint8
+		X, Y, Width, Height uint16
+	}{3, incrementalFlag, 0, 0, uint16(bounds.Dx()), uint16(bounds.Dy())}); err != nil {
+		return err
+	}
+	for {
+		var messageType uint8
+		if err := c.read(&messageType); err != nil {
+			return err
+		}
+		switch messageType {
+		case 0:
+			return c.readFramebufferUpdate()
+		case 1:
+			// SetColourMapEntries isn't used with true color, skip it
+			var header struct {
+				Padding    uint8
+				FirstColor uint16
+				Count      uint16
+			}
+			if err := c.read(&header); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(io.Discard, c.reader, int64(header.Count)*6); err != nil {
+				return err
+			}
+		case 2:
+			// Bell
+		case 3:
+			var header struct {
+				Padding [3]byte
+				Length  uint32
+			}
+			if err := c.read(&header); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(io.Discard, c.reader, int64(header.Length)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported console message type %d", messageType)
+		}
+	}
+}
+
+func (c *vncConn) readFramebufferUpdate() error {
+	var header struct {
+		Padding uint8
+		Count   uint16
+	}
+	if err := c.read(&header); err != nil {
+		return err
+	}
+	for i := 0; i < int(header.Count); i++ {
+		var rect struct {
+			X, Y, Width, Height uint16
+			Encoding            int32
+		}
+		if err := c.read(&rect); err != nil {
+			return err
+		}
+		if rect.Encoding != 0 {
+			return fmt.Errorf("unsupported console encoding %d", rect.Encoding)
+		}
+		pixels := make([]byte, int(rect.Width)*int(rect.Height)*4)
+		if _, err := io.ReadFull(c.reader, pixels); err != nil {
+			return err
+		}
+		for y := 0; y < int(rect.Height); y++ {
+			for x := 0; x < int(rect.Width); x++ {
+				offset := (y*int(rect.Width) + x) * 4
+				c.framebuffer.SetRGBA(int(rect.X)+x, int(rect.Y)+y, color.RGBA{R: pixels[offset+2], G: pixels[offset+1], B: pixels[offset], A: 255})
+			}
+		}
+	}
+	return nil
+}
+
+func (c *vncConn) Close() error {
+	return c.conn.Close()
+}
+
+// captureConsole saves screenshots of the console of the server to the artifacts directory whenever it changes until ctx is done.
+// The console shows errors of the rescue system, flatcar-install and ignition, which are lost otherwise.
+func (p *provisioner) captureConsole(ctx context.Context, server *hcloud.Server) {
+	dir := filepath.Join(p.cfg.Artifacts.Dir, server.Name, "console")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		p.logger.Printf("error creating console capture directory: %v\n", err)
+		return
+	}
+	for ctx.Err() == nil {
+		err := p.captureConsoleSession(ctx, server, dir)
+		if ctx.Err() != nil {
+			return
+		}
+		// the console is closed e.g. on reboots, reconnect
+		p.logger.Printf("console capture interrupted, reconnecting: %v\n", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
+
+// startConsoleCapture captures the console of server in the background until the returned function is called
+func (p *provisioner) startConsoleCapture(server *hcloud.Server) func() {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		p.captureConsole(ctx, server)
+		close(done)
+	}()
+	p.logger.Printf("capturing console to %s\n", filepath.Join(p.cfg.Artifacts.Dir, server.Name, "console"))
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (p *provisioner) captureConsoleSession(ctx context.Context, server *hcloud.Server, dir string) error {
+	result, _, err := p.client.Server.RequestConsole(ctx, server)
+	if err != nil {
+		return fmt.Errorf("error requesting console: %w", err)
+	}
+	conn, err := dialConsole(result.WSSURL, result.Password)
+	if err != nil {
+		return err
+	}
+	// unblock reads when the capture is stopped
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+			conn.Close()
+		}
+	}()
+
+	var lastHash [sha256.Size]byte
+	var lastSave time.Time
+	incremental := false
+	for {
+		if err := conn.update(incremental); err != nil {
+			return err
+		}
+		incremental = true
+		if time.Since(lastSave) >= consoleSnapshotInterval {
+			hash := sha256.Sum256(conn.framebuffer.Pix)
+			if hash != lastHash {
+				path := filepath.Join(dir, time.Now().UTC().Format("20060102T150405Z")+".png")
+				if err := writePNG(path, conn.framebuffer); err != nil {
+					p.logger.Printf("error saving console screenshot: %v\n", err)
+				}
+				lastHash = hash
+				lastSave = time.Now()
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+func writePNG(path string, img image.Image) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// webConsoleURL returns the url of the console of the server in the cloud console, empty if hcloud.project_id isn't set
+func (p *provisioner) webConsoleURL(server *hcloud.Server) string {
+	if p.cfg.HCloud.ProjectID == 0 {
+		return ""
+	}
+	return fmt.Sprintf("https://console.hetzner.cloud/console/%d/%d", p.cfg.HCloud.ProjectID, server.ID)
+}
+
+// logConsoleHint logs where the console of a server which failed to boot can be viewed
+func (p *provisioner) logConsoleHint(server *hcloud.Server) {
+	if url := p.webConsoleURL(server); url != "" {
+		p.logger.Printf("check the console of %s at %s\n", server.Name, url)
+		return
+	}
+	result, _, err := p.client.Server.RequestConsole(context.Background(), server)
+	if err != nil {
+		p.logger.Printf("error requesting console: %v\n", err)
+		return
+	}
+	p.logger.Printf("check the console of %s with a vnc client at %s (password %s)\n", server.Name, result.WSSURL, result.Password)
+}
+
+// openBrowser opens url in the default browser
+func openBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.Command("open", url)
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+// runConsole prints the console url of a server
+func runConsole(args []string) {
+	fs := flag.NewFlagSet("console", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	open := fs.Bool("open", false, "open the cloud console in the browser, requires hcloud.project_id")
+	screenshot := fs.String("screenshot", "", "save a screenshot of the console to this png file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	serverName := fs.Arg(0)
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		fatalf("error finding server: %v\n", err)
+	}
+	if server == nil {
+		fatalf("server %s doesn't exist\n", serverName)
+	}
+
+	if *open {
+		url := p.webConsoleURL(server)
+		if url == "" {
+			fatalf("--open requires hcloud.project_id\n")
+		}
+		if err := openBrowser(url); err != nil {
+			fatalf("error opening browser: %v\n", err)
+		}
+		fmt.Println(url)
+		return
+	}
+
+	result, _, err := p.client.Server.RequestConsole(context.Background(), server)
+	if err != nil {
+		fatalf("error requesting console: %v\n", err)
+	}
+	if *screenshot != "" {
+		conn, err := dialConsole(result.WSSURL, result.Password)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+		defer conn.Close()
+		if err := conn.update(false); err != nil {
+			fatalf("error reading console: %v\n", err)
+		}
+		if err := writePNG(*screenshot, conn.framebuffer); err != nil {
+			fatalf("error saving screenshot: %v\n", err)
+		}
+		return
+	}
+	if url := p.webConsoleURL(server); url != "" {
+		fmt.Printf("cloud console: %s\n", url)
+	}
+	fmt.Printf("vnc websocket: %s\n", result.WSSURL)
+	fmt.Printf("vnc password:  %s\n", result.Password)
+}
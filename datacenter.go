@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// datacenterServices are the time servers and resolvers Hetzner recommends for servers in a location
+type datacenterServices struct {
+	NTP []string
+	DNS []string
+}
+
+// hetznerServices are reachable from all locations, the ntp servers via the public network only
+var hetznerServices = datacenterServices{
+	NTP: []string{"ntp1.hetzner.de", "ntp2.hetzner.com", "ntp3.hetzner.net"},
+	DNS: []string{"185.12.64.1", "185.12.64.2", "2a01:4ff:ff00::add:1", "2a01:4ff:ff00::add:2"},
+}
+
+// locationServices are the services by location name, locations missing here get hetznerServices
+var locationServices = map[string]datacenterServices{
+	"fsn1": hetznerServices,
+	"nbg1": hetznerServices,
+	"hel1": hetznerServices,
+	"ash":  hetznerServices,
+	"hil":  hetznerServices,
+	"sin":  hetznerServices,
+}
+
+// servicesFor returns the services recommended for servers in location
+func servicesFor(location hcloud.Location) datacenterServices {
+	if services, ok := locationServices[location.Name]; ok {
+		return services
+	}
+	return hetznerServices
+}
+
+// timesyncdDropIn and resolvedDropIn are the paths of the drop-ins written by storageFiles
+const (
+	timesyncdDropIn = "/etc/systemd/timesyncd.conf.d/10-hetzner.conf"
+	resolvedDropIn  = "/etc/systemd/resolved.conf.d/10-hetzner.conf"
+)
+
+// storageFiles returns container linux config storage files with drop-ins configuring the services in
+// systemd-timesyncd and systemd-resolved, every line indented by indent to be placed below storage.files
+func (services datacenterServices) storageFiles(indent int) string {
+	var lines []string
+	file := func(path string, contents ...string) {
+		lines = append(lines,
+			fmt.Sprintf("- path: %s", path),
+			"  filesystem: root",
+			"  mode: 0644",
+			"  contents:",
+			"    inline: |",
+		)
+		for _, line := range contents {
+			lines = append(lines, "      "+line)
+		}
+	}
+	file(timesyncdDropIn, "[Time]", "NTP="+strings.Join(services.NTP, " "))
+	file(resolvedDropIn, "[Resolve]", "DNS="+strings.Join(services.DNS, " "))
+	indentString := strings.Repeat(" ", indent)
+	for i := range lines {
+		lines[i] = indentString + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// nonReproducibleDirs contain files which change on every read, e.g. /dev/urandom or /proc/uptime
+var nonReproducibleDirs = []string{"/dev", "/proc", "/sys"}
+
+// renderInput is a file the config of a server was rendered from, recorded in deterministic mode
+type renderInput struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// inputRecorder collects the inputs of the configs rendered per server
+type inputRecorder struct {
+	mu     sync.Mutex
+	inputs map[string]map[string]string
+}
+
+// reset forgets the inputs of serverName before its config is rendered again
+func (r *inputRecorder) reset(serverName string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.inputs, serverName)
+}
+
+func (r *inputRecorder) record(serverName string, path string, content []byte) {
+	sum := sha256.Sum256(content)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.inputs == nil {
+		r.inputs = make(map[string]map[string]string)
+	}
+	if r.inputs[serverName] == nil {
+		r.inputs[serverName] = make(map[string]string)
+	}
+	r.inputs[serverName][path] = hex.EncodeToString(sum[:])
+}
+
+// get returns the inputs of serverName sorted by path
+func (r *inputRecorder) get(serverName string) []renderInput {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	inputs := make([]renderInput, 0, len(r.inputs[serverName]))
+	for path, sum := range r.inputs[serverName] {
+		inputs = append(inputs, renderInput{Path: path, SHA256: sum})
+	}
+	sort.Slice(inputs, func(i, j int) bool {
+		return inputs[i].Path < inputs[j].Path
+	})
+	return inputs
+}
+
+// readInput reads a file the config of serverName is rendered from, in deterministic mode only regular files
+// outside of nonReproducibleDirs are allowed and the file is recorded with its hash
+func (p *provisioner) readInput(serverName string, filename string) ([]byte, error) {
+	if !p.cfg.Flatcar.Deterministic {
+		return os.ReadFile(filename)
+	}
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return nil, err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		path = resolved
+	}
+	for _, dir := range nonReproducibleDirs {
+		if path == dir || strings.HasPrefix(path, dir+"/") {
+			return nil, fmt.Errorf("%s isn't reproducible, deterministic mode only reads regular files", filename)
+		}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s isn't a regular file, deterministic mode only reads regular files", filename)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	p.inputs.record(serverName, filename, content)
+	return content, nil
+}
+
+// deterministicServer returns server without the values which change without the config changing,
+// e.g. its status, traffic or the labels set by hetzner-flatcar, so templates can't depend on them
+func deterministicServer(server hcloud.Server) hcloud.Server {
+	server.Status = ""
+	server.Locked = false
+	server.RescueEnabled = false
+	server.ISO = nil
+	server.IncludedTraffic = 0
+	server.IngoingTraffic = 0
+	server.OutgoingTraffic = 0
+	labels := make(map[string]string, len(server.Labels))
+	for key, value := range server.Labels {
+		if key == managedLabel || key == installedVersionLabel || strings.HasPrefix(key, "hetzner-flatcar/") {
+			continue
+		}
+		labels[key] = value
+	}
+	server.Labels = labels
+	return server
+}
+
+// logInputs logs the recorded inputs of the config of serverName in deterministic mode
+func (p *provisioner) logInputs(serverName string) {
+	if !p.cfg.Flatcar.Deterministic {
+		return
+	}
+	for _, input := range p.inputs.get(serverName) {
+		p.logger.Printf("rendered %s from %s (sha256 %s)\n", serverName, input.Path, input.SHA256)
+	}
+}
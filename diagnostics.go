@@ -0,0 +1,288 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/crypto/ssh"
+)
+
+// diagnosticsTimeout limits the collection of the parts of a diagnostics bundle which don't need a reboot
+const diagnosticsTimeout = 30 * time.Second
+
+// ignitionJournalCommand prints the journal of the ignition units
+var ignitionJournalCommand = journalctlCommand([]string{"ignition*"}, false, 0)
+
+// diagnosticsBundle collects the files of a diagnostics bundle in memory
+type diagnosticsBundle struct {
+	names []string
+	files map[string][]byte
+}
+
+func (b *diagnosticsBundle) add(name string, content []byte) {
+	if b.files == nil {
+		b.files = make(map[string][]byte)
+	}
+	if _, ok := b.files[name]; !ok {
+		b.names = append(b.names, name)
+	}
+	b.files[name] = content
+}
+
+// addError adds the error of collecting the part name of the bundle, so missing parts are explained
+func (b *diagnosticsBundle) addError(name string, err error) {
+	log.Printf("error collecting %s for diagnostics: %v\n", name, err)
+	b.add(name+".error.txt", []byte(secrets.redact(err.Error())+"\n"))
+}
+
+func (b *diagnosticsBundle) write(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	archive := zip.NewWriter(file)
+	for _, name := range b.names {
+		w, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(b.files[name]); err != nil {
+			return err
+		}
+	}
+	if err := archive.Close(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// collectDiagnostics writes a zip with everything available to debug the failed first boot of server to the artifacts directory:
+// the error, the rendered config, the actions of the server, the console and the journal of ignition.
+// The journal is read via ssh, if that's down too it's read from the disk in the rescue system with artifacts.rescue_diagnostics.
+// Collection errors are only logged and added to the bundle.
+func (p *provisioner) collectDiagnostics(server *hcloud.Server, cause error, cfgJSON []byte) {
+	p.logger.Printf("collecting diagnostics of %s\n", server.Name)
+	var bundle diagnosticsBundle
+	bundle.add("error.txt", []byte(secrets.redact(cause.Error())+"\n"))
+	// redacted like in reports, password hashes and http header values included
+	if redactedJSON, err := redactIgnition(cfgJSON); err != nil {
+		bundle.addError("ignition.json", err)
+	} else {
+		bundle.add("ignition.json", redactedJSON)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+	if actions, err := p.serverActions(ctx, server); err != nil {
+		bundle.addError("actions.json", err)
+	} else {
+		bundle.add("actions.json", actions)
+	}
+	p.addConsole(ctx, &bundle, server)
+
+	journal, err := p.installedJournal(server)
+	if err != nil {
+		bundle.addError("journal.txt", err)
+		if p.cfg.Artifacts.RescueDiagnostics && p.cfg.Rescue.ISO == "" {
+			if journal, err = p.rescueJournal(server); err != nil {
+				bundle.addError("rescue-journal.txt", err)
+			} else {
+				bundle.add("rescue-journal.txt", journal)
+			}
+		}
+	} else {
+		bundle.add("journal.txt", journal)
+	}
+
+	path := filepath.Join(p.cfg.Artifacts.Dir, server.Name, "diagnostics-"+time.Now().UTC().Format(installedAtFormat)+".zip")
+	if err := bundle.write(path); err != nil {
+		p.logger.Printf("error writing diagnostics bundle: %v\n", err)
+		return
+	}
+	p.logger.Printf("wrote diagnostics of %s to %s\n", server.Name, path)
+}
+
+// serverActions returns the actions of server as returned by the api, hcloud-go doesn't list the actions of a server
+func (p *provisioner) serverActions(ctx context.Context, server *hcloud.Server) ([]byte, error) {
+	req, err := p.client.NewRequest(ctx, http.MethodGet, fmt.Sprintf("/servers/%d/actions?sort=id:desc", server.ID), nil)
+	if err != nil {
+		return nil, err
+	}
+	var body struct {
+		Actions json.RawMessage `json:"actions"`
+	}
+	if _, err := p.client.Do(req, &body); err != nil {
+		return nil, fmt.Errorf("error listing actions: %w", err)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body.Actions, "", "  "); err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
+
+// addConsole adds the screenshots captured with artifacts.console or a screenshot of the current console to bundle
+func (p *provisioner) addConsole(ctx context.Context, bundle *diagnosticsBundle, server *hcloud.Server) {
+	screenshots, _ := filepath.Glob(filepath.Join(p.cfg.Artifacts.Dir, server.Name, "console", "*.png"))
+	if len(screenshots) > 0 {
+		sort.Strings(screenshots)
+		for _, screenshot := range screenshots {
+			content, err := os.ReadFile(screenshot)
+			if err != nil {
+				bundle.addError("console", err)
+				return
+			}
+			bundle.add("console/"+filepath.Base(screenshot), content)
+		}
+		return
+	}
+	screenshot, err := p.screenshotConsole(ctx, server)
+	if err != nil {
+		bundle.addError("console.png", err)
+		return
+	}
+	bundle.add("console.png", screenshot)
+}
+
+// screenshotConsole returns the current console of server as png
+func (p *provisioner) screenshotConsole(ctx context.Context, server *hcloud.Server) ([]byte, error) {
+	result, _, err := p.client.Server.RequestConsole(ctx, server)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting console: %w", err)
+	}
+	conn, err := dialConsole(result.WSSURL, result.Password)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// unblock the update if the console doesn't answer
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+	if err := conn.update(false); err != nil {
+		return nil, err
+	}
+	var screenshot bytes.Buffer
+	if err := png.Encode(&screenshot, conn.framebuffer); err != nil {
+		return nil, err
+	}
+	return screenshot.Bytes(), nil
+}
+
+// installedJournal returns the ignition journal of the installed system via ssh as core.
+// The host key isn't verified, the installed system failed before it could be recorded.
+func (p *provisioner) installedJournal(server *hcloud.Server) ([]byte, error) {
+	sshAuth, err := buildSSHAuth(p.cfg.HCloud)
+	if err != nil {
+		return nil, fmt.Errorf("error building ssh authentication: %w", err)
+	}
+	addr, err := p.flatcarAddress(server)
+	if err != nil {
+		return nil, err
+	}
+	var hostKey ssh.PublicKey
+	client, err := sshConnect(p.dial, sshTarget{
+		User:      "core",
+		Addr:      addr,
+		Port:      22,
+		Auth:      sshAuth,
+		Callback:  recordHostKey(&hostKey),
+		Keepalive: p.keepalive,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to installed system: %w", err)
+	}
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticsTimeout)
+	defer cancel()
+	return client.output(ctx, "sudo "+ignitionJournalCommand)
+}
+
+// rescueJournal reboots server into rescue, reads the ignition journal from the root partition of the installed system
+// and reboots it into the installed system again
+func (p *provisioner) rescueJournal(server *hcloud.Server) ([]byte, error) {
+	addr, err := p.rescueAddress(server)
+	if err != nil {
+		return nil, err
+	}
+	ctx := context.Background()
+	p.logger.Printf("rebooting %s into rescue to read the journal of the installed system\n", server.Name)
+	result, _, err := p.client.Server.EnableRescue(ctx, server, hcloud.ServerEnableRescueOpts{
+		Type:    hcloud.ServerRescueTypeLinux64,
+		SSHKeys: p.sshKeys(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error enabling rescue: %w", err)
+	}
+	secrets.add(result.RootPassword)
+	if err := waitForAction(p.logger, p.client.Action, result.Action); err != nil {
+		return nil, fmt.Errorf("error enabling rescue: %w", err)
+	}
+	if err := p.resetServer(server); err != nil {
+		return nil, err
+	}
+	// the rescue system is only booted once, the installed system boots again afterwards
+	defer func() {
+		if err := p.resetServer(server); err != nil {
+			p.logger.Printf("error rebooting %s into the installed system: %v\n", server.Name, err)
+		}
+	}()
+	time.Sleep(rebootWait)
+
+	sshAuth, err := buildSSHAuth(p.cfg.HCloud)
+	if err != nil {
+		sshAuth = nil
+	}
+	if !p.cfg.Rescue.sudo() {
+		sshAuth = append(sshAuth, ssh.Password(result.RootPassword))
+	}
+	var hostKey ssh.PublicKey
+	var client *sshClient
+	for retries := 1; ; retries++ {
+		client, err = sshConnect(p.dial, sshTarget{
+			User:      p.cfg.Rescue.user(),
+			Addr:      addr,
+			Port:      22,
+			Auth:      sshAuth,
+			Callback:  recordHostKey(&hostKey),
+			Keepalive: p.keepalive,
+		})
+		var netError net.Error
+		if err == nil || !errors.As(err, &netError) || retries == 30 {
+			break
+		}
+		time.Sleep(10 * time.Second)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to rescue system: %w", err)
+	}
+	defer client.Close()
+	command := fmt.Sprintf("mount -o ro /dev/disk/by-label/ROOT /mnt && %s -D /mnt/var/log/journal; umount /mnt", ignitionJournalCommand)
+	if p.cfg.Rescue.sudo() {
+		command = sudoCommand(command)
+	}
+	return client.output(ctx, command)
+}
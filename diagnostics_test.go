@@ -0,0 +1,66 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCollectDiagnostics(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	p.cfg.Artifacts.Dir = t.TempDir()
+	rescue.user = "core"
+	rescue.outputs["sudo journalctl --no-pager -u 'ignition*'"] = "ignition[412]: files: op(1): [failed] writing file\n"
+	api.addServer("web-1", "running", nil)
+	api.action("reboot")
+	server, _, err := p.client.Server.GetByName(context.Background(), "web-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfgJSON := `{"ignition":{"version":"2.3.0","config":{"append":[{"source":"https://example.com/config.ign","httpHeaders":[{"name":"Authorization","value":"Bearer header-secret"}]}]}},` +
+		`"passwd":{"users":[{"name":"core","passwordHash":"$6$hash-secret"}]}}`
+	p.collectDiagnostics(server, errors.New("error waiting for first boot"), []byte(cfgJSON))
+
+	bundles, _ := filepath.Glob(filepath.Join(p.cfg.Artifacts.Dir, "web-1", "diagnostics-*.zip"))
+	if len(bundles) != 1 {
+		t.Fatalf("expected one diagnostics bundle, got %v", bundles)
+	}
+	archive, err := zip.OpenReader(bundles[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	files := make(map[string]string)
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := io.ReadAll(reader)
+		reader.Close()
+		files[file.Name] = string(content)
+	}
+	if !strings.Contains(files["error.txt"], "first boot") {
+		t.Errorf("error missing in bundle: %q", files["error.txt"])
+	}
+	if !strings.Contains(files["ignition.json"], `"2.3.0"`) {
+		t.Errorf("rendered config missing in bundle: %q", files["ignition.json"])
+	}
+	if strings.Contains(files["ignition.json"], "hash-secret") || strings.Contains(files["ignition.json"], "header-secret") {
+		t.Errorf("rendered config not redacted in bundle: %q", files["ignition.json"])
+	}
+	if !strings.Contains(files["actions.json"], `"reboot"`) {
+		t.Errorf("actions missing in bundle: %q", files["actions.json"])
+	}
+	if !strings.Contains(files["journal.txt"], "[failed] writing file") {
+		t.Errorf("journal missing in bundle: %v", files)
+	}
+	if _, ok := files["console.png.error.txt"]; !ok {
+		t.Errorf("failed console screenshot not explained in bundle: %v", files)
+	}
+}
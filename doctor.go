@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// results of a doctor check
+const (
+	checkPass = "pass"
+	checkWarn = "warn"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+type checkResult struct {
+	Name   string
+	Result string
+	Detail string
+}
+
+// doctor runs the checks of the preconditions of provisioning one after another
+type doctor struct {
+	cfg     config
+	client  *hcloud.Client
+	results []checkResult
+}
+
+func (d *doctor) report(name string, result string, detail string, args ...interface{}) {
+	d.results = append(d.results, checkResult{Name: name, Result: result, Detail: fmt.Sprintf(detail, args...)})
+}
+
+// failed returns whether any check failed
+func (d *doctor) failed() bool {
+	for _, result := range d.results {
+		if result.Result == checkFail {
+			return true
+		}
+	}
+	return false
+}
+
+// errReadOnlyToken is returned by probeWriteAccess for tokens without write permission
+var errReadOnlyToken = errors.New("token lacks write permission, provisioning needs a read-write token")
+
+// probeWriteAccess checks whether the token is allowed to write, it returns errReadOnlyToken if it isn't.
+// There is no api to query the permissions of a token, but creating an invalid ssh key fails
+// with invalid_input for read-write tokens and forbidden for read-only ones without creating anything.
+// Other errors mean the permissions are unknown.
+func probeWriteAccess(client *hcloud.Client) error {
+	ctx := context.Background()
+	sshKey, _, err := client.SSHKey.Create(ctx, hcloud.SSHKeyCreateOpts{Name: "hetzner-flatcar-probe", PublicKey: "invalid"})
+	switch {
+	case err == nil:
+		// unexpected, but clean up
+		if _, err := client.SSHKey.Delete(ctx, sshKey); err != nil {
+			log.Printf("error deleting ssh key hetzner-flatcar-probe: %v\n", err)
+		}
+		return nil
+	case hcloud.IsError(err, hcloud.ErrorCodeForbidden):
+		return errReadOnlyToken
+	case hcloud.IsError(err, hcloud.ErrorCodeInvalidInput):
+		return nil
+	}
+	return err
+}
+
+// checkToken verifies the token is valid and allowed to write
+func (d *doctor) checkToken() bool {
+	if _, err := d.client.Location.All(context.Background()); err != nil {
+		d.report("api token", checkFail, "%v", err)
+		return false
+	}
+	switch err := probeWriteAccess(d.client); {
+	case err == nil:
+		d.report("api token", checkPass, "valid, read-write")
+	case errors.Is(err, errReadOnlyToken):
+		d.report("api token", checkFail, "read-only, provisioning needs a read-write token")
+	default:
+		d.report("api token", checkWarn, "valid, permissions unknown: %v", err)
+	}
+	return true
+}
+
+// checkSSHKey verifies the hcloud ssh key exists and the matching private key is available locally
+func (d *doctor) checkSSHKey() {
+	sshKey, err := findSSHKey(d.client, d.cfg.HCloud.SSHKey)
+	if err != nil {
+		d.report("ssh key (hcloud)", checkFail, "%s", lookupMessage(err))
+		return
+	}
+	d.report("ssh key (hcloud)", checkPass, "%s %s", sshKey.Name, sshKey.Fingerprint)
+
+	agentKeys, agentErr := listAgentKeys()
+	switch {
+	case agentErr != nil && d.cfg.HCloud.SSHKeyPrivatePath == "" && d.cfg.HCloud.SSHKeyPrivate == "":
+		d.report("ssh agent", checkFail, "%v", agentErr)
+	case agentErr != nil:
+		d.report("ssh agent", checkSkip, "not used, a private key is configured")
+	default:
+		d.report("ssh agent", checkPass, "%d keys", len(agentKeys))
+	}
+
+	match, err := matchLocalKey(d.cfg.HCloud, sshKey)
+	switch {
+	case errors.Is(err, errNoAgent):
+		// already reported as agent failure
+	case err != nil:
+		d.report("ssh key (local)", checkFail, "%v", err)
+	default:
+		d.report("ssh key (local)", checkPass, "%s", match)
+	}
+}
+
+func listAgentKeys() ([]*agent.Key, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	if socket == "" {
+		return nil, errors.New("SSH_AUTH_SOCK isn't set")
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to ssh agent: %w", err)
+	}
+	defer conn.Close()
+	return agent.NewClient(conn).List()
+}
+
+// checkResources verifies server type, image, locations and the private network exist and the network has a subnet in the zone of every location
+func (d *doctor) checkResources() {
+	ctx := context.Background()
+	conf := d.cfg.HCloud
+	serverType, err := findServerType(d.client, conf.ServerType)
+	if err != nil {
+		d.report("server type", checkFail, "%s", lookupMessage(err))
+	} else {
+		d.report("server type", checkPass, "%s", serverType.Name)
+	}
+	image, err := findImage(d.client, conf.Image)
+	switch {
+	case err != nil:
+		d.report("image", checkFail, "%s", lookupMessage(err))
+	case image.IsDeprecated():
+		d.report("image", checkWarn, "%s is deprecated since %s", describeImage(image), image.Deprecated.Format("2006-01-02"))
+	default:
+		d.report("image", checkPass, "%s", describeImage(image))
+	}
+
+	network, _, err := d.client.Network.GetByName(ctx, conf.PrivateNetwork)
+	switch {
+	case err != nil:
+		d.report("private network", checkFail, "%v", err)
+	case network == nil && conf.CreatePrivateNetwork:
+		d.report("private network", checkPass, "%s doesn't exist, it's created with the first server", conf.PrivateNetwork)
+	case network == nil:
+		d.report("private network", checkFail, "%s doesn't exist", conf.PrivateNetwork)
+	default:
+		d.report("private network", checkPass, "%s %s", network.Name, network.IPRange)
+	}
+
+	for _, locationName := range conf.Location {
+		name := fmt.Sprintf("location %s", locationName)
+		location, err := findLocation(d.client, locationName)
+		if err != nil {
+			d.report(name, checkFail, "%s", lookupMessage(err))
+			continue
+		}
+		if network == nil {
+			d.report(name, checkPass, "network zone %s", location.NetworkZone)
+			continue
+		}
+		var zones []string
+		inZone := false
+		for _, subnet := range network.Subnets {
+			zones = append(zones, string(subnet.NetworkZone))
+			if subnet.NetworkZone == location.NetworkZone {
+				inZone = true
+			}
+		}
+		if !inZone {
+			d.report(name, checkFail, "network %s has no subnet in zone %s (subnets in: %s)", network.Name, location.NetworkZone, strings.Join(zones, ", "))
+			continue
+		}
+		d.report(name, checkPass, "network zone %s", location.NetworkZone)
+	}
+}
+
+// checkTemplate renders and transpiles the template for serverName, or a placeholder server if it doesn't exist
+func (d *doctor) checkTemplate(serverName string) {
+	p, err := newProvisioner(d.cfg, d.client)
+	if err != nil {
+		d.report("template", checkSkip, "resources missing")
+		return
+	}
+	server, _, err := d.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		d.report("template", checkFail, "%v", err)
+		return
+	}
+	if server == nil {
+		server = p.placeholderServer(serverName)
+	}
+	// the render logs are noise in the table
+	log.SetOutput(io.Discard)
+	rendered, err := p.renderIgnition(server)
+	setLogOutput(os.Stderr)
+	if err != nil {
+		d.report("template", checkFail, "%v", err)
+		return
+	}
+	d.report("template", checkPass, "rendered and transpiled for %s", server.Name)
+	warnings, err := lintIgnition(rendered, server)
+	if err != nil {
+		d.report("ignition", checkFail, "%v", err)
+		return
+	}
+	if len(warnings) > 0 {
+		d.report("ignition", checkWarn, "%s", strings.Join(warnings, "; "))
+		return
+	}
+	d.report("ignition", checkPass, "no warnings")
+}
+
+// placeholderServer returns a server as it would be created in the first location, used to render templates of missing servers
+func (p *provisioner) placeholderServer(name string) *hcloud.Server {
+	privateIP := make(net.IP, len(p.privateNetwork.IPRange.IP))
+	copy(privateIP, p.privateNetwork.IPRange.IP)
+	privateIP[len(privateIP)-1] += 2
+	return &hcloud.Server{
+		Name:       name,
+		ServerType: p.serverType,
+		Datacenter: &hcloud.Datacenter{Name: p.locations[0].Name, Location: p.locations[0]},
+		PublicNet: hcloud.ServerPublicNet{
+			IPv4: hcloud.ServerPublicNetIPv4{IP: net.ParseIP("192.0.2.1")},
+		},
+		PrivateNet: []hcloud.ServerPrivateNet{{Network: p.privateNetwork, IP: privateIP}},
+		Labels:     map[string]string{},
+	}
+}
+
+func printChecks(w io.Writer, results []checkResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "CHECK\tRESULT\tDETAIL")
+	for _, result := range results {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", result.Name, result.Result, result.Detail)
+	}
+	return tw.Flush()
+}
+
+// runDoctor checks the preconditions of provisioning and prints a table of the results
+func runDoctor(args []string) {
+	fs := flag.NewFlagSet("doctor", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	fs.Parse(args)
+	serverName := "doctor-check"
+	if fs.NArg() > 0 {
+		serverName = fs.Arg(0)
+	}
+
+	d := &doctor{}
+	cfg, _, err := common.loadConfig()
+	if err != nil {
+		d.report("config", checkFail, "%v", err)
+	} else {
+		d.report("config", checkPass, "valid")
+		d.cfg = cfg
+		d.client = newHCloudClient(cfg.HCloud)
+		if d.checkToken() {
+			d.checkSSHKey()
+			d.checkResources()
+			d.checkTemplate(serverName)
+		}
+	}
+
+	if err := printChecks(os.Stdout, d.results); err != nil {
+		fatalf("error printing checks: %v\n", err)
+	}
+	if d.failed() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,1573 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The end-to-end tests run the whole provisioning pipeline against an in-process fake of the hcloud api
+// and an in-process ssh server standing in for the rescue system, which records the commands and uploads.
+
+const testTemplate = `passwd:
+  users:
+    - name: core
+      ssh_authorized_keys:
+        - {{ .SSHKey.PublicKey }}
+storage:
+  files:
+    - path: /etc/hostname
+      filesystem: root
+      mode: 0644
+      contents:
+        inline: {{ .Server.Name }}
+`
+
+// testRescuePassword is the root password of the rescue system returned when enabling rescue
+const testRescuePassword = "rescue-secret"
+
+// fakeHCloud implements the parts of the hcloud api used by the provisioner
+type fakeHCloud struct {
+	t  *testing.T
+	mu sync.Mutex
+	// servers by id
+	servers map[int]*schema.Server
+	// actions are the commands of all actions created, e.g. create_server or poweron
+	actions []string
+	nextID  int
+	// sshPublicKey is the public key of the hcloud ssh key, the key of the provisioner
+	sshPublicKey string
+	// snapshots are listed by label selector, deletedImages are the ids of deleted ones
+	snapshots     []schema.Image
+	deletedImages []int
+	// teamKeys are listed by label selector, the ssh keys of created servers and enabled rescue systems are recorded
+	teamKeys      []schema.SSHKey
+	createSSHKeys []int
+	rescueSSHKeys []int
+	// readOnly rejects writes like a read-only token, only the write probe is checked
+	readOnly bool
+	// userData is the user data of the last created server
+	userData string
+}
+
+func newFakeHCloud(t *testing.T) *fakeHCloud {
+	created := time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC)
+	stable := map[string]string{"flatcar/channel": "stable"}
+	return &fakeHCloud{t: t, servers: map[int]*schema.Server{}, nextID: 100, snapshots: []schema.Image{
+		{ID: 8, Description: "flatcar 3760.2.0", Type: "snapshot", Status: "available", Created: created, Labels: stable},
+		{ID: 9, Description: "flatcar 3815.2.0", Type: "snapshot", Status: "available", Created: created.Add(24 * time.Hour), Labels: stable},
+	}}
+}
+
+func (f *fakeHCloud) writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(value); err != nil {
+		f.t.Errorf("error encoding response: %v", err)
+	}
+}
+
+// action records a finished action
+func (f *fakeHCloud) action(command string) schema.Action {
+	f.actions = append(f.actions, command)
+	f.nextID++
+	now := time.Now()
+	return schema.Action{ID: f.nextID, Command: command, Status: "success", Progress: 100, Started: now, Finished: &now}
+}
+
+// addServer adds an existing server attached to the private network
+func (f *fakeHCloud) addServer(name string, status string, labels map[string]string) *schema.Server {
+	f.nextID++
+	server := &schema.Server{
+		ID:     f.nextID,
+		Name:   name,
+		Status: status,
+		PublicNet: schema.ServerPublicNet{
+			IPv4: schema.ServerPublicNetIPv4{IP: "192.0.2.10"},
+			IPv6: schema.ServerPublicNetIPv6{IP: "2001:db8::/64"},
+		},
+		PrivateNet: []schema.ServerPrivateNet{{Network: 2, IP: "10.0.0.2", MACAddress: "86:00:00:00:00:01"}},
+		ServerType: schema.ServerType{ID: 3, Name: "cx11"},
+		Datacenter: schema.Datacenter{ID: 6, Name: "nbg1-dc3", Location: schema.Location{ID: 5, Name: "nbg1"}},
+		Labels:     labels,
+	}
+	f.servers[server.ID] = server
+	return server
+}
+
+func (f *fakeHCloud) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	pagination := map[string]interface{}{"pagination": map[string]int{"page": 1, "per_page": 50, "last_page": 1}}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	switch {
+	case req.Method == http.MethodGet && req.URL.Path == "/ssh_keys":
+		sshKeys := []schema.SSHKey{{ID: 1, Name: "deploy", PublicKey: f.sshPublicKey}}
+		if selector := req.URL.Query().Get("label_selector"); selector != "" {
+			sshKeys = []schema.SSHKey{}
+			key, value, _ := strings.Cut(selector, "=")
+			for _, sshKey := range f.teamKeys {
+				if sshKey.Labels[key] == value {
+					sshKeys = append(sshKeys, sshKey)
+				}
+			}
+		}
+		f.writeJSON(rw, http.StatusOK, schema.SSHKeyListResponse{SSHKeys: sshKeys})
+	case req.Method == http.MethodPost && req.URL.Path == "/ssh_keys":
+		// the write probe creates an invalid key
+		if f.readOnly {
+			f.writeJSON(rw, http.StatusForbidden, schema.ErrorResponse{Error: schema.Error{Code: "forbidden", Message: "insufficient permissions"}})
+			return
+		}
+		f.writeJSON(rw, http.StatusBadRequest, schema.ErrorResponse{Error: schema.Error{Code: "invalid_input", Message: "invalid public key"}})
+	case req.Method == http.MethodGet && req.URL.Path == "/networks":
+		f.writeJSON(rw, http.StatusOK, map[string]interface{}{"networks": []map[string]interface{}{{
+			"id": 2, "name": "internal", "ip_range": "10.0.0.0/16",
+			"subnets": []map[string]string{{"type": "cloud", "ip_range": "10.0.0.0/24", "network_zone": "eu-central", "gateway": "10.0.0.1"}},
+		}}})
+	case req.Method == http.MethodGet && req.URL.Path == "/server_types":
+		serverTypes := []schema.ServerType{}
+		if name := req.URL.Query().Get("name"); name == "" || name == "cx11" {
+			serverTypes = append(serverTypes, schema.ServerType{ID: 3, Name: "cx11"})
+		}
+		f.writeJSON(rw, http.StatusOK, schema.ServerTypeListResponse{ServerTypes: serverTypes})
+	case req.Method == http.MethodGet && req.URL.Path == "/images":
+		images := []schema.Image{{ID: 4, Name: strPtr("debian-11"), Type: "system", Status: "available"}}
+		if selector := req.URL.Query().Get("label_selector"); selector != "" {
+			images = []schema.Image{}
+			key, value, hasValue := strings.Cut(selector, "=")
+			for _, snapshot := range f.snapshots {
+				if label, ok := snapshot.Labels[key]; ok && (!hasValue || label == value) {
+					images = append(images, snapshot)
+				}
+			}
+		}
+		f.writeJSON(rw, http.StatusOK, schema.ImageListResponse{Images: images})
+	case req.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "images":
+		id, _ := strconv.Atoi(parts[1])
+		f.deletedImages = append(f.deletedImages, id)
+		for i, snapshot := range f.snapshots {
+			if snapshot.ID == id {
+				f.snapshots = append(f.snapshots[:i], f.snapshots[i+1:]...)
+				break
+			}
+		}
+		rw.WriteHeader(http.StatusNoContent)
+	case req.Method == http.MethodGet && req.URL.Path == "/isos":
+		isos := []schema.ISO{}
+		if name := req.URL.Query().Get("name"); name == "flatcar-live" {
+			isos = append(isos, schema.ISO{ID: 7, Name: name, Type: "private"})
+		}
+		f.writeJSON(rw, http.StatusOK, map[string]interface{}{"isos": isos, "meta": pagination})
+	case req.Method == http.MethodGet && req.URL.Path == "/locations":
+		locations := []schema.Location{}
+		if name := req.URL.Query().Get("name"); name == "" || name == "nbg1" {
+			locations = append(locations, schema.Location{ID: 5, Name: "nbg1", NetworkZone: "eu-central"})
+		}
+		f.writeJSON(rw, http.StatusOK, schema.LocationListResponse{Locations: locations})
+	case req.Method == http.MethodGet && req.URL.Path == "/datacenters":
+		datacenter := schema.Datacenter{ID: 6, Name: "nbg1-dc3", Location: schema.Location{ID: 5, Name: "nbg1"}}
+		datacenter.ServerTypes.Supported = []int{3}
+		datacenter.ServerTypes.Available = []int{3}
+		f.writeJSON(rw, http.StatusOK, map[string]interface{}{"datacenters": []schema.Datacenter{datacenter}, "meta": pagination})
+	case req.Method == http.MethodGet && req.URL.Path == "/servers":
+		servers := []schema.Server{}
+		for _, server := range f.servers {
+			if name := req.URL.Query().Get("name"); (name == "" || server.Name == name) && matchesSelector(server.Labels, req.URL.Query().Get("label_selector")) {
+				servers = append(servers, *server)
+			}
+		}
+		f.writeJSON(rw, http.StatusOK, map[string]interface{}{"servers": servers, "meta": pagination})
+	case req.Method == http.MethodPost && req.URL.Path == "/servers":
+		var createRequest schema.ServerCreateRequest
+		if err := json.NewDecoder(req.Body).Decode(&createRequest); err != nil {
+			f.t.Errorf("error decoding server create request: %v", err)
+		}
+		f.createSSHKeys = createRequest.SSHKeys
+		f.userData = createRequest.UserData
+		status := "off"
+		if createRequest.StartAfterCreate != nil && *createRequest.StartAfterCreate {
+			status = "running"
+		}
+		server := f.addServer(createRequest.Name, status, *createRequest.Labels)
+		f.writeJSON(rw, http.StatusCreated, schema.ServerCreateResponse{Server: *server, Action: f.action("create_server")})
+	case req.Method == http.MethodDelete && len(parts) == 2 && parts[0] == "servers":
+		server := f.server(rw, parts[1])
+		if server == nil {
+			return
+		}
+		delete(f.servers, server.ID)
+		f.writeJSON(rw, http.StatusOK, schema.ServerDeleteResponse{Action: f.action("delete_server")})
+	case len(parts) == 2 && parts[0] == "servers":
+		server := f.server(rw, parts[1])
+		if server == nil {
+			return
+		}
+		if req.Method == http.MethodPut {
+			var updateRequest schema.ServerUpdateRequest
+			if err := json.NewDecoder(req.Body).Decode(&updateRequest); err != nil {
+				f.t.Errorf("error decoding server update request: %v", err)
+			}
+			if updateRequest.Labels != nil {
+				server.Labels = *updateRequest.Labels
+			}
+		}
+		f.writeJSON(rw, http.StatusOK, schema.ServerGetResponse{Server: *server})
+	case req.Method == http.MethodPost && len(parts) == 4 && parts[0] == "servers" && parts[2] == "actions":
+		server := f.server(rw, parts[1])
+		if server == nil {
+			return
+		}
+		switch parts[3] {
+		case "enable_rescue":
+			var rescueRequest schema.ServerActionEnableRescueRequest
+			if err := json.NewDecoder(req.Body).Decode(&rescueRequest); err != nil {
+				f.t.Errorf("error decoding enable rescue request: %v", err)
+			}
+			f.rescueSSHKeys = rescueRequest.SSHKeys
+			server.RescueEnabled = true
+			f.writeJSON(rw, http.StatusCreated, schema.ServerActionEnableRescueResponse{Action: f.action(parts[3]), RootPassword: testRescuePassword})
+			return
+		case "poweron", "reboot":
+			server.Status = "running"
+		}
+		f.writeJSON(rw, http.StatusCreated, map[string]schema.Action{"action": f.action(parts[3])})
+	case req.Method == http.MethodGet && len(parts) == 3 && parts[0] == "servers" && parts[2] == "actions":
+		actions := make([]schema.Action, len(f.actions))
+		for i, command := range f.actions {
+			actions[i] = schema.Action{ID: i + 1, Command: command, Status: "success", Progress: 100}
+		}
+		f.writeJSON(rw, http.StatusOK, schema.ActionListResponse{Actions: actions})
+	case req.Method == http.MethodGet && len(parts) == 2 && parts[0] == "actions":
+		id, _ := strconv.Atoi(parts[1])
+		now := time.Now()
+		f.writeJSON(rw, http.StatusOK, schema.ActionGetResponse{Action: schema.Action{ID: id, Status: "success", Progress: 100, Started: now, Finished: &now}})
+	default:
+		f.t.Errorf("unexpected api request %s %s", req.Method, req.URL)
+		f.writeJSON(rw, http.StatusNotFound, schema.ErrorResponse{Error: schema.Error{Code: "not_found", Message: "not found"}})
+	}
+}
+
+func (f *fakeHCloud) server(rw http.ResponseWriter, idString string) *schema.Server {
+	id, _ := strconv.Atoi(idString)
+	server, ok := f.servers[id]
+	if !ok {
+		f.writeJSON(rw, http.StatusNotFound, schema.ErrorResponse{Error: schema.Error{Code: "not_found", Message: "server not found"}})
+		return nil
+	}
+	return server
+}
+
+// matchesSelector returns whether labels match a label selector of key=value, key and !key terms
+func matchesSelector(labels map[string]string, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, term := range strings.Split(selector, ",") {
+		if strings.HasPrefix(term, "!") {
+			if _, ok := labels[term[1:]]; ok {
+				return false
+			}
+			continue
+		}
+		key, value, hasValue := strings.Cut(term, "=")
+		if label, ok := labels[key]; !ok || (hasValue && label != value) {
+			return false
+		}
+	}
+	return true
+}
+
+func strPtr(value string) *string {
+	return &value
+}
+
+// fakeRescue is a ssh server standing in for the rescue system
+type fakeRescue struct {
+	t        *testing.T
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	mu       sync.Mutex
+	commands []string
+	files    map[string]*bytes.Buffer
+	// exitStatuses are returned by the next runs of a command, 0 once they are used up
+	exitStatuses map[string][]uint32
+	// addrs are the addresses connected to
+	addrs []string
+	// user is the user accepted with the client key, root by default
+	user string
+	// outputs are written by commands
+	outputs map[string]string
+}
+
+// newFakeRescue starts a ssh server accepting the public key of clientKey
+func newFakeRescue(t *testing.T, clientKey ssh.PublicKey) *fakeRescue {
+	hostKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &fakeRescue{t: t, files: map[string]*bytes.Buffer{}, exitStatuses: map[string][]uint32{}, user: "root", outputs: map[string]string{}}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			r.mu.Lock()
+			user := r.user
+			r.mu.Unlock()
+			if conn.User() != user || !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key for %s", conn.User())
+			}
+			return nil, nil
+		},
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() != "root" || string(password) != testRescuePassword {
+				return nil, fmt.Errorf("wrong password for %s", conn.User())
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.listener, r.config = listener, config
+	go r.serve()
+	t.Cleanup(func() { listener.Close() })
+	return r
+}
+
+// dial connects to the fake rescue system regardless of the address
+func (r *fakeRescue) dial(addr string) (net.Conn, error) {
+	r.mu.Lock()
+	r.addrs = append(r.addrs, addr)
+	r.mu.Unlock()
+	return net.Dial("tcp", r.listener.Addr().String())
+}
+
+func (r *fakeRescue) serve() {
+	for {
+		conn, err := r.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, channels, requests, err := ssh.NewServerConn(conn, r.config)
+			if err != nil {
+				return
+			}
+			go ssh.DiscardRequests(requests)
+			for newChannel := range channels {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "only sessions are supported")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go r.session(channel, requests)
+			}
+		}()
+	}
+}
+
+// session records exec requests and serves the sftp subsystem
+func (r *fakeRescue) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			length := binary.BigEndian.Uint32(req.Payload)
+			// tolerate trailing whitespace clients may add to commands
+			command := strings.TrimSpace(string(req.Payload[4 : 4+length]))
+			r.mu.Lock()
+			r.commands = append(r.commands, command)
+			// checksums of uploaded files are computed like sha256sum would
+			var output string
+			if path := strings.Trim(strings.TrimPrefix(command, "sha256sum "), "'"); strings.HasPrefix(command, "sha256sum ") && r.files[path] != nil {
+				sum := sha256.Sum256(r.files[path].Bytes())
+				output = hex.EncodeToString(sum[:]) + "  " + path + "\n"
+			} else if commandOutput, ok := r.outputs[command]; ok {
+				output = commandOutput
+			}
+			var status uint32
+			if statuses := r.exitStatuses[command]; len(statuses) > 0 {
+				status, r.exitStatuses[command] = statuses[0], statuses[1:]
+			}
+			r.mu.Unlock()
+			req.Reply(true, nil)
+			channel.Write([]byte(output))
+			channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+			return
+		case "subsystem":
+			req.Reply(true, nil)
+			server := sftp.NewRequestServer(channel, sftp.Handlers{FileGet: r, FilePut: r, FileCmd: r, FileList: r})
+			server.Serve()
+			return
+		default:
+			req.Reply(false, nil)
+		}
+	}
+}
+
+func (r *fakeRescue) Filewrite(req *sftp.Request) (io.WriterAt, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	buf := &bytes.Buffer{}
+	r.files[req.Filepath] = buf
+	return &bufferWriterAt{mu: &r.mu, buf: buf}, nil
+}
+
+func (r *fakeRescue) Fileread(req *sftp.Request) (io.ReaderAt, error) {
+	return nil, os.ErrNotExist
+}
+
+func (r *fakeRescue) Filecmd(req *sftp.Request) error {
+	return nil
+}
+
+func (r *fakeRescue) Filelist(req *sftp.Request) (sftp.ListerAt, error) {
+	return nil, os.ErrNotExist
+}
+
+// bufferWriterAt appends writes to a buffer, the sftp client writes sequentially
+type bufferWriterAt struct {
+	mu  *sync.Mutex
+	buf *bytes.Buffer
+}
+
+func (w *bufferWriterAt) WriteAt(data []byte, offset int64) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if offset != int64(w.buf.Len()) {
+		return 0, fmt.Errorf("unexpected write at offset %d", offset)
+	}
+	return w.buf.Write(data)
+}
+
+// newTestProvisioner wires a provisioner to fresh fakes of the hcloud api and the rescue system
+func newTestProvisioner(t *testing.T) (*provisioner, *fakeHCloud, *fakeRescue) {
+	rebootWait = 0
+	rescueRetryDelay = 0
+
+	dir := t.TempDir()
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "id_ecdsa")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	templatePath := filepath.Join(dir, "ignition.yml.gtpl")
+	if err := os.WriteFile(templatePath, []byte(testTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	clientPublicKey, err := ssh.NewPublicKey(&clientKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := newFakeHCloud(t)
+	api.sshPublicKey = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(clientPublicKey)))
+	apiServer := httptest.NewServer(api)
+	t.Cleanup(apiServer.Close)
+	rescue := newFakeRescue(t, clientPublicKey)
+
+	cfg := config{
+		HCloud: hcloudConfig{
+			Token:             "test",
+			SSHKey:            "deploy",
+			SSHKeyPrivatePath: keyPath,
+			PrivateNetwork:    "internal",
+			ServerType:        "cx11",
+			Location:          stringList{"nbg1"},
+			Image:             "debian-11",
+		},
+		Flatcar: flatcarConfig{
+			Version:        "3227.2.0",
+			ConfigTemplate: templatePath,
+			TemplateStatic: map[string]string{},
+		},
+		History: historyConfig{Dir: filepath.Join(dir, "history")},
+	}
+	client := hcloud.NewClient(
+		hcloud.WithToken("test"),
+		hcloud.WithEndpoint(apiServer.URL),
+		hcloud.WithPollInterval(time.Millisecond),
+	)
+	p, err := newProvisioner(cfg, client)
+	if err != nil {
+		t.Fatalf("error creating provisioner: %v", err)
+	}
+	p.dial = rescue.dial
+	return p, api, rescue
+}
+
+// commandIndex returns the position of command in commands, -1 if it wasn't run
+func commandIndex(commands []string, command string) int {
+	for i, run := range commands {
+		if run == command {
+			return i
+		}
+	}
+	return -1
+}
+
+// expectedCommands are the commands run in the rescue system for an install with the default options
+func expectedCommands() []string {
+	return []string{
+		"curl -fsS -o /root/flatcar-install 'https://raw.githubusercontent.com/flatcar-linux/init/flatcar-master/bin/flatcar-install'",
+		"sha256sum '/root/ignition.json'",
+		"apt update",
+		"apt install -y gawk",
+		"chmod +x /root/flatcar-install",
+		"/root/flatcar-install -i /root/ignition.json -V 3227.2.0 -s",
+		"reboot now",
+	}
+}
+
+func TestProvisionCreatesServer(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(rescue.commands, expectedCommands()) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+	if expected := []string{"create_server", "enable_rescue", "poweron"}; !reflect.DeepEqual(api.actions, expected) {
+		t.Errorf("unexpected actions %v, expected %v", api.actions, expected)
+	}
+	ignition, ok := rescue.files["/root/ignition.json"]
+	if !ok {
+		t.Fatal("ignition config wasn't uploaded")
+	}
+	if !strings.Contains(ignition.String(), "data:,web-1") {
+		t.Errorf("uploaded ignition config doesn't contain hostname: %s", ignition)
+	}
+	if len(api.servers) != 1 {
+		t.Fatalf("expected 1 server, got %d", len(api.servers))
+	}
+	for _, server := range api.servers {
+		if server.Labels[managedLabel] != managedLabelValue || server.Labels[configHashLabel] == "" {
+			t.Errorf("unexpected labels %v", server.Labels)
+		}
+		if _, err := time.Parse(installedAtFormat, server.Labels[installedAtLabel]); err != nil || server.Labels[installedVersionLabel] != "3227.2.0" || len(server.Labels[templateSHALabel]) != 16 {
+			t.Errorf("unexpected install labels %v", server.Labels)
+		}
+	}
+	entries, err := p.history("web-1")
+	if err != nil || len(entries) != 1 {
+		t.Errorf("expected 1 history entry, got %d (%v)", len(entries), err)
+	}
+	runs, err := queryRuns(p.cfg.History.runDatabase(), runFilter{Server: "web-1"})
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("expected 1 recorded run, got %d (%v)", len(runs), err)
+	}
+	if runs[0].Result != resultSucceeded || runs[0].ConfigHash != entries[0].ConfigHash || len(runs[0].Phases) == 0 {
+		t.Errorf("unexpected run %+v", runs[0])
+	}
+}
+
+func TestProvisionBootsSnapshotWithUserData(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	p.cfg.HCloud.StartAfterCreate = true
+	p.image = &hcloud.Image{ID: 9, Type: hcloud.ImageTypeSnapshot, Description: "flatcar 3815.2.0", Labels: map[string]string{installedVersionLabel: "3815.2.0"}}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if expected := []string{"create_server"}; !reflect.DeepEqual(api.actions, expected) {
+		t.Errorf("unexpected actions %v, expected %v", api.actions, expected)
+	}
+	if len(rescue.commands) != 0 {
+		t.Errorf("commands run without rescue:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+	if !strings.Contains(api.userData, "data:,web-1") {
+		t.Errorf("user data doesn't contain the ignition config: %s", api.userData)
+	}
+	for _, server := range api.servers {
+		if server.Labels[installedVersionLabel] != "3815.2.0" {
+			t.Errorf("version of the snapshot not labeled: %v", server.Labels)
+		}
+	}
+
+	// configs depending on the created server can't be passed as user data
+	template := filepath.Join(t.TempDir(), "id.yml.gtpl")
+	if err := os.WriteFile(template, []byte(testTemplate+"    - path: /etc/server-id\n      filesystem: root\n      contents:\n        inline: \"{{ .Server.ID }}\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Flatcar.ConfigTemplate = template
+	api.actions = nil
+	if err := p.provision("web-2"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if expected := []string{"create_server", "enable_rescue", "reboot"}; !reflect.DeepEqual(api.actions, expected) {
+		t.Errorf("unexpected actions %v, expected the install via rescue %v", api.actions, expected)
+	}
+}
+
+func TestProvisionMergesUserDataOnFirstBoot(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	template := filepath.Join(t.TempDir(), "user-data.yml.gtpl")
+	if err := os.WriteFile(template, []byte("storage:\n  files:\n    - path: /etc/location\n      filesystem: root\n      contents:\n        inline: {{ .Location.Name }}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Flatcar.UserData.Template = template
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if !strings.Contains(api.userData, "data:,nbg1") {
+		t.Errorf("user data wasn't rendered: %s", api.userData)
+	}
+	var ignition struct {
+		Ignition struct {
+			Config struct {
+				Append []struct {
+					Source       string
+					Verification struct{ Hash string }
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(rescue.files["/root/ignition.json"].Bytes(), &ignition); err != nil {
+		t.Fatalf("invalid ignition config: %v", err)
+	}
+	sum := sha512.Sum512([]byte(api.userData))
+	if references := ignition.Ignition.Config.Append; len(references) != 1 || references[0].Source != userDataURL || references[0].Verification.Hash != "sha512-"+hex.EncodeToString(sum[:]) {
+		t.Errorf("installed config doesn't merge the user data: %+v", references)
+	}
+
+	// the user data of existing servers can't be set
+	api.addServer("web-2", "running", map[string]string{})
+	if err := p.provision("web-2"); err == nil || !strings.Contains(err.Error(), "wasn't created with flatcar.user_data") {
+		t.Errorf("expected error for server without user data, got %v", err)
+	}
+}
+
+func TestProvisionReinstallsExistingServer(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	api.addServer("web-1", "running", map[string]string{})
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	if !reflect.DeepEqual(rescue.commands, expectedCommands()) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+	if expected := []string{"enable_rescue", "reboot"}; !reflect.DeepEqual(api.actions, expected) {
+		t.Errorf("unexpected actions %v, expected %v", api.actions, expected)
+	}
+	if len(api.servers) != 1 {
+		t.Errorf("expected no new server, got %d servers", len(api.servers))
+	}
+}
+
+func TestProvisionPinsVersionByLabel(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	api.addServer("web-1", "running", map[string]string{versionLabel: "3815.2.0", channelLabel: "beta"})
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	expected := expectedCommands()
+	expected[5] = "/root/flatcar-install -i /root/ignition.json -C beta -V 3815.2.0 -s"
+	if !reflect.DeepEqual(rescue.commands, expected) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionEmitsEvents(t *testing.T) {
+	p, _, _ := newTestProvisioner(t)
+	var buf bytes.Buffer
+	p.events = &eventWriter{w: &buf}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	var phases []string
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var ev event
+		if err := decoder.Decode(&ev); err != nil {
+			t.Fatalf("invalid event: %v", err)
+		}
+		if ev.Server != "web-1" {
+			t.Errorf("unexpected server %s in event", ev.Server)
+		}
+		phases = append(phases, ev.Phase)
+	}
+	expected := []string{eventServerCreated, eventRendered, eventRescueEnabled, eventRescueBooting, eventRescueConnected, eventInstallStarted, eventInstallFinished, eventRebooting, eventSucceeded}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("unexpected phases %v, expected %v", phases, expected)
+	}
+}
+
+func TestProvisionReportsInstallProgress(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	var buf bytes.Buffer
+	p.events = &eventWriter{w: &buf}
+	rescue.outputs["/root/flatcar-install -i /root/ignition.json -V 3227.2.0 -s"] = strings.Join([]string{
+		"Downloading, writing and verifying flatcar_production_image.bin.bz2...",
+		"     0K ........ ........ ........ ........ ........ ........ 12% 30.1M 3s",
+		"  3072K ........ ........ ........ ........ ........ ........ 57% 28.5M 1s",
+		"  6144K ........ ........ ........ ........ ........ ....... 100% 29.0M=1s",
+		"8589934592 bytes (8.6 GB, 8.0 GiB) copied, 40 s, 215 MB/s",
+		"Installing Ignition config /root/ignition.json...",
+		"Success! Flatcar Container Linux 3227.2.0 is installed on /dev/sda",
+	}, "\n") + "\n"
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	var progress []string
+	decoder := json.NewDecoder(&buf)
+	for decoder.More() {
+		var ev event
+		if err := decoder.Decode(&ev); err != nil {
+			t.Fatalf("invalid event: %v", err)
+		}
+		if ev.Phase == eventInstallProgress {
+			progress = append(progress, ev.Progress.String())
+		}
+	}
+	expected := []string{"download", "download 12%", "download 57%", "download 100%", "download 8.0 GiB", "ignition", "done"}
+	if !reflect.DeepEqual(progress, expected) {
+		t.Errorf("unexpected install progress %v, expected %v", progress, expected)
+	}
+}
+
+func TestProvisionFailsWithReadOnlyToken(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	api.readOnly = true
+
+	err := p.provision("web-1")
+	if !errors.Is(err, errReadOnlyToken) {
+		t.Fatalf("expected read-only token error, got %v", err)
+	}
+	if len(api.actions) != 0 {
+		t.Errorf("actions were created with a read-only token: %v", api.actions)
+	}
+}
+
+func TestProvisionSummarizesPhaseTimings(t *testing.T) {
+	p, _, _ := newTestProvisioner(t)
+
+	summary := p.provisionBatch([]string{"web-1"}, 1, false)
+	p.addTimings(&summary)
+
+	var phases []string
+	for _, timing := range summary.Servers[0].Phases {
+		phases = append(phases, timing.Parent+"/"+timing.Phase)
+	}
+	expected := []string{"/ensure_server", "/render", "/enable_rescue", "boot_rescue/ssh_connect", "/boot_rescue", "flatcar_install/upload", "flatcar_install/apt", "flatcar_install/install", "flatcar_install/reboot", "/flatcar_install"}
+	if !reflect.DeepEqual(phases, expected) {
+		t.Errorf("unexpected phases %v, expected %v", phases, expected)
+	}
+	if len(summary.Timings) != len(expected) || summary.Timings[0].Count != 1 || summary.Timings[0].MaxServer != "web-1" {
+		t.Errorf("unexpected timings %+v", summary.Timings)
+	}
+	var buf bytes.Buffer
+	if err := printTimings(&buf, summary.Timings); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "\n  ssh_connect ") || !strings.Contains(buf.String(), "\nflatcar_install ") {
+		t.Errorf("steps aren't indented below their phase:\n%s", buf.String())
+	}
+}
+
+func TestProvisionRunsPlugins(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	dir := t.TempDir()
+	script := filepath.Join(dir, "plugin")
+	// records the hooks and the request of the last one
+	content := `#!/bin/sh
+echo "$1 $2" >> "` + dir + `/hooks"
+cat > "` + dir + `/request.json"
+`
+	if err := os.WriteFile(script, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Plugins = []pluginConfig{{Name: "record", Command: []string{script}}}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	hooks, err := os.ReadFile(filepath.Join(dir, "hooks"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected []string
+	for _, phase := range []string{"provision", "ensure_server", "render", "enable_rescue", "boot_rescue", "flatcar_install"} {
+		expected = append(expected, "before-"+phase+" web-1")
+		if phase != "provision" {
+			expected = append(expected, "after-"+phase+" web-1")
+		}
+	}
+	expected = append(expected, "after-provision web-1")
+	if got := strings.Split(strings.TrimSpace(string(hooks)), "\n"); !reflect.DeepEqual(got, expected) {
+		t.Errorf("unexpected hooks %v, expected %v", got, expected)
+	}
+	data, err := os.ReadFile(filepath.Join(dir, "request.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var request pluginRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		t.Fatalf("invalid request: %v", err)
+	}
+	if request.Hook != "after-provision" || request.Hetzner == nil || request.Hetzner.Server.Name != "web-1" {
+		t.Errorf("unexpected request %+v", request)
+	}
+
+	// a failing before hook aborts the provisioning before the phase
+	p.cfg.Plugins = []pluginConfig{{Name: "deny", Command: []string{"false"}, Hooks: []string{"before-enable_rescue"}}}
+	api.actions = nil
+	err = p.provision("web-1")
+	if err == nil || !strings.Contains(err.Error(), "plugin deny failed at before-enable_rescue") {
+		t.Fatalf("expected plugin failure, got %v", err)
+	}
+	if len(api.actions) != 0 {
+		t.Errorf("rescue was enabled despite the failing plugin: %v", api.actions)
+	}
+}
+
+func TestProvisionCanaryAbortsRollout(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	// the canary web-1 fails before anything is changed
+	p.cfg.Plugins = []pluginConfig{{Name: "fail-canary", Command: []string{"sh", "-c", `[ "$1" != before-provision ] || [ "$2" != web-1 ]`, "plugin"}}}
+
+	summary := p.provisionCanary([]string{"web-1", "web-2", "web-3"}, 1, 0, 1, true)
+	if summary.Failed != 1 || summary.Skipped != 2 || !reflect.DeepEqual(summary.Canaries, []string{"web-1"}) {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if len(api.actions) != 0 {
+		t.Errorf("servers were provisioned after the canary failed: %v", api.actions)
+	}
+}
+
+func TestProvisionWritesReport(t *testing.T) {
+	p, _, _ := newTestProvisioner(t)
+	p.report = newReport()
+
+	for i := 0; i < 2; i++ {
+		if err := p.provision("web-1"); err != nil {
+			t.Fatalf("provisioning failed: %v", err)
+		}
+	}
+
+	for _, name := range []string{"report.md", "report.html"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := p.report.write(path, ""); err != nil {
+			t.Fatalf("error writing report: %v", err)
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, expected := range []string{"web-1", "apt install -y gawk", eventInstallStarted, resultSucceeded, "No changes."} {
+			if !strings.Contains(string(content), expected) {
+				t.Errorf("%s doesn't contain %q:\n%s", name, expected, content)
+			}
+		}
+	}
+
+	diff := unifiedDiff("a", "b", []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10"}, []string{"1", "2", "3", "4", "5", "x", "7", "8", "9", "10", "11"})
+	expected := "--- a\n+++ b\n@@ -3,8 +3,9 @@\n 3\n 4\n 5\n-6\n+x\n 7\n 8\n 9\n 10\n+11\n"
+	if diff != expected {
+		t.Errorf("unexpected diff:\n%s", diff)
+	}
+}
+
+func TestProvisionStoresAppliedConfigInLabels(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	p.cfg.History.Labels = true
+
+	for i := 0; i < 2; i++ {
+		if err := p.provision("web-1"); err != nil {
+			t.Fatalf("provisioning failed: %v", err)
+		}
+	}
+
+	var labels map[string]string
+	for _, server := range api.servers {
+		labels = server.Labels
+	}
+	chunks := 0
+	for key, value := range labels {
+		if strings.HasPrefix(key, appliedChunkLabelPrefix) {
+			chunks++
+			if len(value) > maxLabelValueLength {
+				t.Errorf("label %s exceeds the maximum length: %s", key, value)
+			}
+		}
+	}
+	if labels[appliedChunksLabel] != strconv.Itoa(chunks) || chunks == 0 {
+		t.Fatalf("unexpected applied config labels %v", labels)
+	}
+	// another machine without the local history
+	p.cfg.History.Dir = t.TempDir()
+	var diff strings.Builder
+	differs, err := p.diffApplied(&diff, "web-1")
+	if err != nil || differs {
+		t.Errorf("expected no diff, got %v (%v):\n%s", differs, err, diff.String())
+	}
+	delete(labels, appliedChunksLabel)
+	differs, err = p.diffApplied(&diff, "web-1")
+	if err != nil || !differs || !strings.Contains(diff.String(), "--- web-1 (/dev/null)") {
+		t.Errorf("expected diff against /dev/null, got %v (%v):\n%s", differs, err, diff.String())
+	}
+}
+
+func TestProvisionInstallsPointerConfig(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	uploads := map[string][]byte{}
+	storage := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut || req.Header.Get("Authorization") != "Bearer secret" {
+			rw.WriteHeader(http.StatusForbidden)
+			return
+		}
+		body, _ := io.ReadAll(req.Body)
+		uploads[req.URL.Path] = body
+	}))
+	defer storage.Close()
+	p.cfg.Flatcar.RemoteConfig = remoteConfig{
+		UploadURL:     storage.URL + "/ignition/{server}.json",
+		URL:           "https://config.example.com/ignition/{server}.json",
+		UploadHeaders: map[string]string{"Authorization": "Bearer secret"},
+	}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	full, ok := uploads["/ignition/web-1.json"]
+	if !ok || !strings.Contains(string(full), "data:,web-1") {
+		t.Fatalf("full config wasn't uploaded: %s", full)
+	}
+	var pointer struct {
+		Ignition struct {
+			Config struct {
+				Replace struct {
+					Source       string
+					Verification struct {
+						Hash string
+					}
+				}
+			}
+		}
+	}
+	if err := json.Unmarshal(rescue.files["/root/ignition.json"].Bytes(), &pointer); err != nil {
+		t.Fatalf("invalid pointer config: %v", err)
+	}
+	replace := pointer.Ignition.Config.Replace
+	if replace.Source != "https://config.example.com/ignition/web-1.json" || !strings.HasPrefix(replace.Verification.Hash, "sha512-") {
+		t.Errorf("unexpected replace %+v", replace)
+	}
+}
+
+func TestProvisionUploadsRescueFiles(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	source := filepath.Join(t.TempDir(), "firmware.bin")
+	if err := os.WriteFile(source, []byte("firmware"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Files.Rescue = []fileUpload{{Source: source, Destination: "/root/firmware/blob.bin", Mode: "0600"}}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	if uploaded := rescue.files["/root/.hetzner-flatcar-upload-0"]; uploaded == nil || uploaded.String() != "firmware" {
+		t.Errorf("file wasn't uploaded: %v", uploaded)
+	}
+	expected := "install -D -m 0600 '/root/.hetzner-flatcar-upload-0' '/root/firmware/blob.bin' && rm -f '/root/.hetzner-flatcar-upload-0'"
+	if rescue.commands[3] != expected {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionUploadsLocalImage(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	image := filepath.Join(t.TempDir(), "flatcar_production_image.bin.bz2")
+	if err := os.WriteFile(image, []byte("image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sum := "6105d6cc76af400325e94d588ce511be5bfdbb73b437dc51eca43917d7a43e3d"
+	p.cfg.Flatcar.Image = image
+	p.cfg.Flatcar.ImageChecksum = sum
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	imageTarget := "/root/" + imageName
+	if uploaded := rescue.files[imageTarget]; uploaded == nil || uploaded.String() != "image" {
+		t.Errorf("image wasn't uploaded: %v", uploaded)
+	}
+	expected := expectedCommands()
+	expected = append(expected[:2], append([]string{"sha256sum '" + imageTarget + "'"}, expected[2:]...)...)
+	expected[6] = "/root/flatcar-install -i /root/ignition.json -f " + imageTarget + " -s"
+	if !reflect.DeepEqual(rescue.commands, expected) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionRetriesTransientFailures(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	p.cfg.SSH.CommandRetries = 2
+	p.cfg.SSH.CommandRetryDelay = "1ms"
+	download := expectedCommands()[0]
+	// couldn't connect
+	rescue.exitStatuses[download] = []uint32{7}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if expected := append([]string{download}, expectedCommands()...); !reflect.DeepEqual(rescue.commands, expected) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+
+	p, _, rescue = newTestProvisioner(t)
+	p.cfg.SSH.CommandRetries = 2
+	p.cfg.SSH.CommandRetryDelay = "1ms"
+	// http error, e.g. 404 for an unknown install_script_ref
+	rescue.exitStatuses[download] = []uint32{22}
+	if err := p.provision("web-1"); err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if len(rescue.commands) != 1 {
+		t.Errorf("expected no retry, got commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionExplainsUnreachableRescue(t *testing.T) {
+	p, _, _ := newTestProvisioner(t)
+	p.dial = func(addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+
+	err := p.provision("web-1")
+	if err == nil {
+		t.Fatal("expected provisioning to fail")
+	}
+	if !strings.Contains(err.Error(), "30 refused") || !strings.Contains(err.Error(), "console --screenshot") {
+		t.Errorf("error doesn't explain the refused connections: %v", err)
+	}
+}
+
+func TestProvisionExportsRescueProxy(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	p.cfg.Rescue = rescueSettings{HTTPProxy: "http://proxy.example.com:3128", NoProxy: "10.0.0.0/8"}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	prefix := "export http_proxy='http://proxy.example.com:3128' HTTP_PROXY='http://proxy.example.com:3128' no_proxy='10.0.0.0/8' NO_PROXY='10.0.0.0/8'; "
+	if !strings.HasPrefix(rescue.commands[0], prefix+"curl ") || rescue.commands[2] != prefix+"apt update" {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionAsNonRootRescueUser(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	rescue.user = "deploy"
+	p.cfg.Rescue = rescueSettings{User: "deploy", WorkDir: "/srv/install", HTTPProxy: "http://proxy.example.com:3128"}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+
+	if rescue.files["/srv/install/ignition.json"] == nil {
+		t.Error("ignition config wasn't uploaded into the working directory")
+	}
+	prefix := "export http_proxy='http://proxy.example.com:3128' HTTP_PROXY='http://proxy.example.com:3128'; "
+	expected := []string{
+		sudoCommand(prefix + "curl -fsS -o /srv/install/flatcar-install 'https://raw.githubusercontent.com/flatcar-linux/init/flatcar-master/bin/flatcar-install'"),
+		"sha256sum '/srv/install/ignition.json'",
+		sudoCommand(prefix + "apt update"),
+		sudoCommand(prefix + "apt install -y gawk"),
+		sudoCommand(prefix + "chmod +x /srv/install/flatcar-install"),
+		sudoCommand(prefix + "/srv/install/flatcar-install -i /srv/install/ignition.json -V 3227.2.0 -s "),
+		sudoCommand("reboot now"),
+	}
+	if !reflect.DeepEqual(rescue.commands, expected) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionWipesInstallDevice(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	p.cfg.Flatcar.Wipe = "discard"
+	rescue.outputs["lsblk -dbnpo NAME,SIZE,TYPE"] = "/dev/sda 40960000000 disk\n/dev/sdb 10737418240 disk\n/dev/sr0 1073741312 rom\n"
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	wipe := commandIndex(rescue.commands, "blkdiscard -f /dev/sdb")
+	if wipe < 0 || wipe > commandIndex(rescue.commands, "/root/flatcar-install -i /root/ignition.json -V 3227.2.0 -s") {
+		t.Errorf("smallest disk wasn't wiped before installing: %v", rescue.commands)
+	}
+}
+
+func TestProvisionDisablesRescueOnAbort(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	p.cfg.Rescue.DisableOnAbort = true
+	p.dial = func(addr string) (net.Conn, error) {
+		return nil, errors.New("connection refused by test")
+	}
+
+	if err := p.provision("web-1"); err == nil {
+		t.Fatal("provisioning succeeded without ssh")
+	}
+	if expected := []string{"create_server", "enable_rescue", "poweron", "disable_rescue"}; !reflect.DeepEqual(api.actions, expected) {
+		t.Errorf("unexpected actions %v, expected %v", api.actions, expected)
+	}
+	if len(cleanups.steps) != 0 {
+		t.Errorf("cleanups left on the stack: %d", len(cleanups.steps))
+	}
+}
+
+func TestProvisionBootsISO(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	p.cfg.Rescue.ISO = "flatcar-live"
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if expected := []string{"create_server", "attach_iso", "poweron", "detach_iso", "reset"}; !reflect.DeepEqual(api.actions, expected) {
+		t.Errorf("unexpected actions %v, expected %v", api.actions, expected)
+	}
+	// no apt in the live system and reset via the api instead of rebooting
+	commands := expectedCommands()
+	expected := append(commands[:2:2], commands[4:6]...)
+	if !reflect.DeepEqual(rescue.commands, expected) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionNoCreate(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	p.noCreate = true
+
+	if err := p.provision("web-1"); err == nil {
+		t.Fatal("expected provisioning a missing server to fail with noCreate")
+	}
+	if len(api.actions) != 0 || len(rescue.commands) != 0 {
+		t.Errorf("expected nothing to happen, got actions %v and commands %v", api.actions, rescue.commands)
+	}
+}
+
+func TestProvisionSelectsTemplateByPattern(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	webTemplate := filepath.Join(t.TempDir(), "web.yml.gtpl")
+	if err := os.WriteFile(webTemplate, []byte(strings.Replace(testTemplate, "inline: {{ .Server.Name }}", "inline: web-{{ .Server.Name }}", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Flatcar.Templates = map[string]string{"web-*": webTemplate, "db-*": "missing.yml.gtpl"}
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if ignition := rescue.files["/root/ignition.json"]; ignition == nil || !strings.Contains(ignition.String(), "data:,web-web-1") {
+		t.Errorf("ignition config wasn't rendered from the web template: %v", ignition)
+	}
+}
+
+func TestProvisionRendersDeterministically(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	dir := t.TempDir()
+	motd := filepath.Join(dir, "motd")
+	if err := os.WriteFile(motd, []byte("welcome"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	template := filepath.Join(dir, "inputs.yml.gtpl")
+	content := strings.Replace(testTemplate, "inline: {{ .Server.Name }}", `inline: "{{ .Server.Name }}{{ .Server.Status }}{{ call .ReadFile "`+motd+`" }}"`, 1)
+	if err := os.WriteFile(template, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Flatcar.ConfigTemplate = template
+	p.cfg.Flatcar.Deterministic = true
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if ignition := rescue.files["/root/ignition.json"]; ignition == nil || !strings.Contains(ignition.String(), "data:,web-1welcome") {
+		t.Errorf("status of the server was rendered: %v", ignition)
+	}
+	entries, err := p.history("web-1")
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected one history entry, got %v: %v", entries, err)
+	}
+	motdSum := sha256.Sum256([]byte("welcome"))
+	templateSum := sha256.Sum256([]byte(content))
+	expected := []renderInput{{Path: template, SHA256: hex.EncodeToString(templateSum[:])}, {Path: motd, SHA256: hex.EncodeToString(motdSum[:])}}
+	if !reflect.DeepEqual(entries[0].Inputs, expected) {
+		t.Errorf("unexpected inputs %+v, expected %+v", entries[0].Inputs, expected)
+	}
+
+	if err := os.WriteFile(template, []byte(strings.Replace(testTemplate, "inline: {{ .Server.Name }}", `inline: "{{ call .ReadFile "/proc/uptime" }}"`, 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := p.provision("web-1"); err == nil || !strings.Contains(err.Error(), "isn't reproducible") {
+		t.Errorf("expected error reading /proc, got %v", err)
+	}
+}
+
+func TestProvisionRedactsTemplateSecrets(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	template := filepath.Join(t.TempDir(), "secret.yml.gtpl")
+	if err := os.WriteFile(template, []byte(strings.Replace(testTemplate, "inline: {{ .Server.Name }}", "inline: {{ .Secrets.token }}", 1)), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Flatcar.ConfigTemplate = template
+	p.cfg.Flatcar.TemplateSecrets = map[string]string{"token": "s3cr3t-token"}
+	registerSecrets(p.cfg)
+	p.report = newReport()
+	var logs bytes.Buffer
+	setLogOutput(&logs)
+	t.Cleanup(func() {
+		setLogOutput(os.Stderr)
+	})
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if ignition := rescue.files["/root/ignition.json"]; ignition == nil || !strings.Contains(ignition.String(), "s3cr3t-token") {
+		t.Errorf("secret wasn't rendered into the ignition config: %v", ignition)
+	}
+	log.Printf("token %s, rescue password %s\n", "s3cr3t-token", testRescuePassword)
+	if strings.Contains(logs.String(), "s3cr3t-token") || strings.Contains(logs.String(), testRescuePassword) {
+		t.Errorf("log output contains secrets:\n%s", logs.String())
+	}
+	diff := p.report.servers["web-1"].Diff
+	if strings.Contains(diff, "s3cr3t-token") || !strings.Contains(diff, redacted) {
+		t.Errorf("report diff isn't redacted:\n%s", diff)
+	}
+}
+
+func TestProvisionIPv6OnlyServer(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	server := api.addServer("web-1", "running", map[string]string{})
+	server.PublicNet.IPv4 = schema.ServerPublicNetIPv4{}
+	// servers without ipv4 need the private interface configured
+	p.cfg.Flatcar.PrivateNetworkUnit = true
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if expected := []string{"[2001:db8::2]:22"}; !reflect.DeepEqual(rescue.addrs, expected) {
+		t.Errorf("connected to %v, expected %v", rescue.addrs, expected)
+	}
+}
+
+func TestProvisionRoutesViaNATGateway(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	server := api.addServer("web-1", "running", map[string]string{})
+	server.PublicNet.IPv4 = schema.ServerPublicNetIPv4{}
+	p.cfg.Flatcar.PrivateNetworkUnit = true
+	p.cfg.HCloud.NATGateway = "10.0.0.3"
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	var ignition struct {
+		Networkd struct {
+			Units []struct{ Name, Contents string }
+		}
+	}
+	if err := json.Unmarshal(rescue.files["/root/ignition.json"].Bytes(), &ignition); err != nil {
+		t.Fatalf("invalid ignition config: %v", err)
+	}
+	if len(ignition.Networkd.Units) != 1 || !strings.HasSuffix(ignition.Networkd.Units[0].Contents, "[Route]\nGateway=10.0.0.1\nGatewayOnLink=yes\n") {
+		t.Errorf("no default route via the network gateway: %+v", ignition.Networkd.Units)
+	}
+}
+
+func TestProvisionRendersTimeAndDNSFiles(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	template := filepath.Join(t.TempDir(), "services.yml.gtpl")
+	if err := os.WriteFile(template, []byte(testTemplate+"{{ call .TimeAndDNSFiles 4 }}\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.Flatcar.ConfigTemplate = template
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	var ignition struct {
+		Storage struct {
+			Files []struct{ Path string }
+		}
+	}
+	if err := json.Unmarshal(rescue.files["/root/ignition.json"].Bytes(), &ignition); err != nil {
+		t.Fatalf("invalid ignition config: %v", err)
+	}
+	var paths []string
+	for _, file := range ignition.Storage.Files {
+		paths = append(paths, file.Path)
+	}
+	if !reflect.DeepEqual(paths, []string{"/etc/hostname", timesyncdDropIn, resolvedDropIn}) {
+		t.Errorf("unexpected files %v", paths)
+	}
+	if content := rescue.files["/root/ignition.json"].String(); !strings.Contains(content, "ntp1.hetzner.de") {
+		t.Errorf("time servers missing in ignition config:\n%s", content)
+	}
+}
+
+func TestProvisionerSuggestsCatalogNames(t *testing.T) {
+	p, _, _ := newTestProvisioner(t)
+	cfg := p.cfg
+	cfg.HCloud.ServerType = "cx1"
+	cfg.HCloud.Location = stringList{"nbg"}
+
+	_, err := newProvisioner(cfg, p.client)
+	errs, ok := err.(configErrors)
+	if !ok || len(errs) != 2 {
+		t.Fatalf("expected 2 config errors, got %v", err)
+	}
+	for _, expected := range []string{"hcloud.server_type: server type cx1 doesn't exist (did you mean cx11?)", "hcloud.location: location nbg doesn't exist (did you mean nbg1?)"} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("error doesn't contain %q: %v", expected, err)
+		}
+	}
+}
+
+func TestProvisionerSelectsNewestSnapshot(t *testing.T) {
+	p, _, _ := newTestProvisioner(t)
+	cfg := p.cfg
+	cfg.HCloud.Image = "flatcar/channel=stable"
+
+	p, err := newProvisioner(cfg, p.client)
+	if err != nil {
+		t.Fatalf("error creating provisioner: %v", err)
+	}
+	if p.image.ID != 9 {
+		t.Errorf("expected the newest snapshot 9, got %d", p.image.ID)
+	}
+}
+
+func TestStatusFindsAndAdoptsOrphans(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	p.cfg.HCloud.NamePatterns = []string{"web-*"}
+	api.addServer("web-1", "running", map[string]string{managedLabel: managedLabelValue})
+	orphan := api.addServer("web-2", "running", map[string]string{})
+	api.addServer("db-1", "running", map[string]string{})
+
+	orphans, err := p.orphans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(orphans, []string{"web-2"}) {
+		t.Fatalf("unexpected orphans %v", orphans)
+	}
+	if err := p.adopt("web-2"); err != nil {
+		t.Fatalf("adopting failed: %v", err)
+	}
+	if orphan.Labels[managedLabel] != managedLabelValue {
+		t.Errorf("adopted server has labels %v", orphan.Labels)
+	}
+}
+
+func TestProvisionAddsSSHKeysSelectedByLabel(t *testing.T) {
+	p, api, rescue := newTestProvisioner(t)
+	infra := map[string]string{"team": "infra"}
+	api.teamKeys = []schema.SSHKey{
+		{ID: 1, Name: "deploy", PublicKey: api.sshPublicKey, Labels: infra},
+		{ID: 11, Name: "alice", PublicKey: "ssh-ed25519 AAAAalice", Labels: infra},
+		{ID: 12, Name: "bob", PublicKey: "ssh-ed25519 AAAAbob", Labels: map[string]string{"team": "web"}},
+	}
+	cfg := p.cfg
+	cfg.HCloud.SSHKeysSelector = "team=infra"
+	p, err := newProvisioner(cfg, p.client)
+	if err != nil {
+		t.Fatalf("error creating provisioner: %v", err)
+	}
+	p.dial = rescue.dial
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	expected := []int{1, 11}
+	if !reflect.DeepEqual(api.createSSHKeys, expected) || !reflect.DeepEqual(api.rescueSSHKeys, expected) {
+		t.Errorf("unexpected ssh keys %v at create and %v at rescue, expected %v", api.createSSHKeys, api.rescueSSHKeys, expected)
+	}
+}
+
+func TestPruneDeletesSnapshotsExceedingRetention(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	p.cfg.HCloud.Image = "flatcar/channel=stable"
+	p.cfg.HCloud.ImageRetention = 1
+	p.cfg.HCloud.SnapshotRetention = 2
+	created := time.Date(2024, 4, 1, 10, 0, 0, 0, time.UTC)
+	for i := 0; i < 3; i++ {
+		api.snapshots = append(api.snapshots, schema.Image{
+			ID: 20 + i, Type: "snapshot", Status: "available", Created: created.Add(time.Duration(i) * time.Hour),
+			Labels: map[string]string{snapshotOfLabel: "web-1"},
+		})
+	}
+
+	entries, err := p.prune(true)
+	if err != nil {
+		t.Fatalf("error pruning: %v", err)
+	}
+	if len(entries) != 2 || len(api.deletedImages) != 0 {
+		t.Fatalf("expected 2 snapshots listed without deleting them, got %d (deleted %v)", len(entries), api.deletedImages)
+	}
+	if _, err := p.prune(false); err != nil {
+		t.Fatalf("error pruning: %v", err)
+	}
+	sort.Ints(api.deletedImages)
+	if expected := []int{8, 20}; !reflect.DeepEqual(api.deletedImages, expected) {
+		t.Errorf("deleted %v, expected %v", api.deletedImages, expected)
+	}
+}
+
+func TestProvisionFallsBackToRescuePassword(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	// neither a private key nor an agent
+	p.cfg.HCloud.SSHKeyPrivatePath = ""
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if !reflect.DeepEqual(rescue.commands, expectedCommands()) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+func TestProvisionUsesInlinePrivateKey(t *testing.T) {
+	p, _, rescue := newTestProvisioner(t)
+	key, err := os.ReadFile(p.cfg.HCloud.SSHKeyPrivatePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.HCloud.SSHKeyPrivatePath = ""
+	p.cfg.HCloud.SSHKeyPrivate = string(key)
+	t.Setenv("SSH_AUTH_SOCK", "")
+
+	if err := p.provision("web-1"); err != nil {
+		t.Fatalf("provisioning failed: %v", err)
+	}
+	if !reflect.DeepEqual(rescue.commands, expectedCommands()) {
+		t.Errorf("unexpected commands:\n%s", strings.Join(rescue.commands, "\n"))
+	}
+}
+
+// useUnknownKey replaces the private key of p by one unknown to the rescue system
+func useUnknownKey(t *testing.T, p *provisioner) {
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cfg.HCloud.SSHKeyPrivatePath = filepath.Join(t.TempDir(), "id_other")
+	if err := os.WriteFile(p.cfg.HCloud.SSHKeyPrivatePath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestProvisionRejectsMismatchingKey(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	useUnknownKey(t, p)
+
+	err := p.provision("web-1")
+	if err == nil || !strings.Contains(err.Error(), "doesn't match hcloud ssh key deploy") {
+		t.Fatalf("expected key mismatch, got %v", err)
+	}
+	if expected := []string{"create_server"}; !reflect.DeepEqual(api.actions, expected) {
+		t.Errorf("rescue was enabled despite the mismatch: %v", api.actions)
+	}
+}
+
+func TestReinstallChecksKeyBeforeChangingServer(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	api.addServer("web-1", "running", map[string]string{managedLabel: managedLabelValue})
+	useUnknownKey(t, p)
+	// the fake api fails the test on load balancer requests, the server isn't taken out of them
+	p.cfg.LoadBalancer.Names = []string{"web"}
+	p.cfg.HCloud.SnapshotBeforeReinstall = true
+
+	err := p.provision("web-1")
+	if err == nil || !strings.Contains(err.Error(), "doesn't match hcloud ssh key deploy") {
+		t.Fatalf("expected key mismatch, got %v", err)
+	}
+	if len(api.actions) != 0 {
+		t.Errorf("server was changed despite the mismatch: %v", api.actions)
+	}
+}
+
+func TestExecAuditLog(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	server := api.addServer("web-1", "running", map[string]string{configHashLabel: "3f2a9c1d0e4b5a6978695a4b3c2d1e0f12345678"})
+	operatorOverride = "alice"
+	t.Cleanup(func() {
+		operatorOverride = ""
+	})
+
+	// the server isn't managed, so the command fails after it's recorded
+	if err := p.execCommand("web-1", "systemctl restart nginx", &sync.Mutex{}); err == nil {
+		t.Fatal("expected connection error")
+	}
+	records, err := queryAudit(p.cfg.History.runDatabase(), runFilter{Server: "web-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected one audit record, got %+v", records)
+	}
+	record := records[0]
+	if record.Operator != "alice" || record.Command != "systemctl restart nginx" || record.ConfigHash != server.Labels[configHashLabel] || record.Result != resultFailed || record.Error == "" {
+		t.Errorf("unexpected audit record %+v", record)
+	}
+}
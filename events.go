@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// phases of provisioning a server reported as events
+const (
+	eventServerCreated   = "server-created"
+	eventServerFound     = "server-found"
+	eventRendered        = "rendered"
+	eventSnapshotCreated = "snapshot-created"
+	eventRescueEnabled   = "rescue-enabled"
+	eventRescueBooting   = "rescue-booting"
+	eventRescueConnected = "rescue-connected"
+	eventInstallStarted  = "install-started"
+	eventInstallProgress = "install-progress"
+	eventInstallFinished = "install-finished"
+	eventRebooting       = "rebooting"
+	eventFirstBoot       = "first-boot"
+	eventSucceeded       = "succeeded"
+	eventFailed          = "failed"
+)
+
+type event struct {
+	Time   time.Time `json:"time"`
+	Server string    `json:"server"`
+	Phase  string    `json:"phase"`
+	Error  string    `json:"error,omitempty"`
+	// Progress of flatcar-install in install-progress events
+	Progress *installProgress `json:"progress,omitempty"`
+}
+
+// eventWriter writes one JSON object per event and line, it's safe for concurrent use
+type eventWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// openEvents returns an event writer for format writing to path, - for stdout
+func openEvents(format string, path string) (*eventWriter, error) {
+	if format != "ndjson" {
+		return nil, fmt.Errorf("unsupported event format %s, only ndjson is supported", format)
+	}
+	if path == "-" {
+		return &eventWriter{w: os.Stdout}, nil
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("error opening events file: %w", err)
+	}
+	return &eventWriter{w: file}, nil
+}
+
+func (e *eventWriter) write(ev event) {
+	line, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("error encoding event: %v\n", err)
+		return
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.w.Write(append(line, '\n')); err != nil {
+		log.Printf("error writing event: %v\n", err)
+	}
+}
+
+// emit reports that serverName reached phase to the run in progress, the progress table and as event with --events
+func (p *provisioner) emit(serverName string, phase string, err error) {
+	p.recordPhase(serverName, phase)
+	if p.progress != nil {
+		p.progress.update(serverName, phase, err)
+	}
+	if p.events == nil {
+		return
+	}
+	ev := event{Time: time.Now().UTC(), Server: serverName, Phase: phase}
+	if err != nil {
+		ev.Error = secrets.redact(err.Error())
+	}
+	p.events.write(ev)
+}
+
+// emitProgress reports the progress of flatcar-install on serverName to the progress table and as event with --events,
+// unlike phases it isn't recorded in the run database
+func (p *provisioner) emitProgress(serverName string, progress installProgress) {
+	if p.progress != nil {
+		p.progress.detail(serverName, progress.String())
+	}
+	if p.events == nil {
+		return
+	}
+	p.events.write(event{Time: time.Now().UTC(), Server: serverName, Phase: eventInstallProgress, Progress: &progress})
+}
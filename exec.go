@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// hostKeyCallback verifies host keys of installed servers using the configured known_hosts file or ~/.ssh/known_hosts
+func (p *provisioner) hostKeyCallback() (ssh.HostKeyCallback, error) {
+	if p.cfg.SSH.KnownHosts != "" {
+		return knownhosts.New(p.cfg.SSH.KnownHosts)
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return knownhosts.New(filepath.Join(home, ".ssh", "known_hosts"))
+}
+
+// connect establishes a ssh connection as core to the installed system of the server
+func (p *provisioner) connect(server *hcloud.Server) (*sshClient, error) {
+	if server.Labels[managedLabel] != managedLabelValue {
+		return nil, fmt.Errorf("server %s isn't managed by hetzner-flatcar", server.Name)
+	}
+	sshAuth, err := buildSSHAuth(p.cfg.HCloud)
+	if err != nil {
+		return nil, fmt.Errorf("error building ssh authentication: %w", err)
+	}
+	callback, err := p.hostKeyCallback()
+	if err != nil {
+		return nil, fmt.Errorf("error loading known hosts: %w", err)
+	}
+	addr, err := p.flatcarAddress(server)
+	if err != nil {
+		return nil, err
+	}
+	var algorithms []string
+	if p.cfg.SSH.KnownHosts != "" {
+		algorithms, err = knownHostAlgorithms(p.cfg.SSH.KnownHosts, addr)
+		if err != nil {
+			return nil, fmt.Errorf("error loading known hosts: %w", err)
+		}
+	}
+	return sshConnect(p.dial, sshTarget{
+		User:              "core",
+		Addr:              addr,
+		Port:              22,
+		Auth:              sshAuth,
+		Callback:          callback,
+		HostKeyAlgorithms: algorithms,
+		Keepalive:         p.keepalive,
+	})
+}
+
+// connectByName looks up the server named serverName and connects to it
+func (p *provisioner) connectByName(serverName string) (*sshClient, error) {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return nil, fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return nil, fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	return p.connect(server)
+}
+
+// execCommand runs command on the server, prefixing every line of output with the server name.
+// The command is recorded in the audit log with the operator and the applied config before it's run.
+func (p *provisioner) execCommand(serverName string, command string, outputLock *sync.Mutex) (err error) {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	auditID, err := p.startAudit(server, command)
+	if err != nil {
+		return fmt.Errorf("error recording command in audit log: %w", err)
+	}
+	defer func() {
+		if auditErr := p.finishAudit(auditID, err); auditErr != nil {
+			p.logger.Printf("error recording result of command on %s in audit log: %v\n", serverName, auditErr)
+		}
+	}()
+	sshClient, err := p.connect(server)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	stdout := newPrefixWriter(outputLock, os.Stdout, serverName)
+	stderr := newPrefixWriter(outputLock, os.Stderr, serverName)
+	err = sshClient.run(context.Background(), command, stdout, stderr)
+	stdout.Flush()
+	stderr.Flush()
+	return err
+}
+
+// splitCommand splits args at -- into flags and the remote command.
+// A single argument is run as is, so a command line can be given as one string,
+// multiple arguments are quoted to keep their boundaries in the remote shell.
+func splitCommand(args []string) ([]string, string) {
+	for i, arg := range args {
+		if arg != "--" {
+			continue
+		}
+		command := args[i+1:]
+		if len(command) == 1 {
+			return args[:i], command[0]
+		}
+		quoted := make([]string, len(command))
+		for j, part := range command {
+			quoted[j] = shellQuote(part)
+		}
+		return args[:i], strings.Join(quoted, " ")
+	}
+	return args, ""
+}
+
+// runExec runs a command on all given and selected servers
+func runExec(args []string) {
+	fs := flag.NewFlagSet("exec", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	selector := addSelectorFlag(fs)
+	concurrency := fs.Int("concurrency", 10, "maximum number of servers the command runs on at once")
+	flagArgs, command := splitCommand(args)
+	fs.Parse(flagArgs)
+	if command == "" || (fs.NArg() == 0 && *selector == "") {
+		fs.Usage()
+		os.Exit(1)
+	}
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	serverNames, err := p.resolveServerNames(fs.Args(), *selector)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	var outputLock sync.Mutex
+	errs := forEachServer(serverNames, *concurrency, func(serverName string) error {
+		return p.execCommand(serverName, command, &outputLock)
+	})
+	if len(errs) > 0 {
+		printErrors(os.Stderr, errs)
+		fatalf("command failed on %d of %d servers\n", len(errs), len(serverNames))
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitCommandKeepsArguments(t *testing.T) {
+	for _, test := range []struct {
+		args    []string
+		flags   []string
+		command string
+	}{
+		{args: []string{"web-1", "--", "uptime"}, flags: []string{"web-1"}, command: "uptime"},
+		{args: []string{"web-1", "--", "systemctl status nginx | head"}, flags: []string{"web-1"}, command: "systemctl status nginx | head"},
+		{args: []string{"--", "sh", "-c", "echo a b"}, flags: []string{}, command: `'sh' '-c' 'echo a b'`},
+		{args: []string{"--", "echo", "it's", "$HOME;"}, flags: []string{}, command: `'echo' 'it'\''s' '$HOME;'`},
+		{args: []string{"web-1"}, flags: []string{"web-1"}, command: ""},
+	} {
+		flags, command := splitCommand(test.args)
+		if !reflect.DeepEqual(flags, test.flags) || command != test.command {
+			t.Errorf("splitCommand(%q) = %q, %q, expected %q, %q", test.args, flags, command, test.flags, test.command)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// stagingLabel marks servers which are installed behind the staging firewall, the configured firewall isn't applied to them
+const stagingLabel = "hetzner-flatcar/staging"
+
+// exposedSelector selects the managed servers which aren't staged
+var exposedSelector = fmt.Sprintf("%s,!%s", managedSelector, stagingLabel)
+
+// firewallPollInterval is the interval the firewalls applied to a server are polled in while staging or exposing it
+var firewallPollInterval = 2 * time.Second
+
+// firewallApplyTimeout is the time hcloud gets to apply the firewalls of a server after its labels changed
+var firewallApplyTimeout = 2 * time.Minute
+
+// selector returns the label selector the firewall is applied to
+func (c firewallConfig) selector() string {
+	if c.DelayExposure {
+		return exposedSelector
+	}
+	return managedSelector
+}
+
+// stagingName returns the name of the firewall applied to servers while they're installed
+func (c firewallConfig) stagingName() string {
+	return c.Name + "-staging"
+}
+
+// stagingRules returns the rules of the staging firewall, inbound only ssh from firewall.staging_source_ips
+// and the outbound rules of the firewall, so the install reaches the same destinations as the installed system
+func stagingRules(conf firewallConfig, rules []hcloud.FirewallRule) []hcloud.FirewallRule {
+	sourceIPs := conf.StagingSourceIPs
+	if len(sourceIPs) == 0 {
+		sourceIPs = []string{"0.0.0.0/0", "::/0"}
+	}
+	// validated while parsing the config
+	parsed, _ := parseCIDRs(sourceIPs)
+	port := "22"
+	description := "ssh while staged"
+	staging := []hcloud.FirewallRule{{
+		Direction:   hcloud.FirewallRuleDirectionIn,
+		Protocol:    hcloud.FirewallRuleProtocolTCP,
+		Port:        &port,
+		SourceIPs:   parsed,
+		Description: &description,
+	}}
+	for _, rule := range rules {
+		if rule.Direction == hcloud.FirewallRuleDirectionOut {
+			staging = append(staging, rule)
+		}
+	}
+	return staging
+}
+
+// delaysExposure returns whether servers are installed behind the staging firewall,
+// servers without public network aren't exposed anyway
+func (p *provisioner) delaysExposure() bool {
+	return p.cfg.Firewall.DelayExposure && !p.cfg.HCloud.PrivateOnly
+}
+
+// stageServer replaces the firewall of an existing server by the staging firewall before it's reinstalled
+func (p *provisioner) stageServer(server *hcloud.Server) error {
+	if err := p.setLabels(server, map[string]string{stagingLabel: "true"}); err != nil {
+		return err
+	}
+	p.logger.Printf("staging %s behind firewall %s\n", server.Name, p.stagingFirewall.Name)
+	// reinstalling a server which may still be exposed is what staging prevents
+	return p.waitForFirewall(server, p.stagingFirewall, p.firewall)
+}
+
+// exposeServer replaces the staging firewall of server by the firewall once it's installed and healthy
+func (p *provisioner) exposeServer(server *hcloud.Server) error {
+	labels := make(map[string]string, len(server.Labels))
+	for key, value := range server.Labels {
+		if key != stagingLabel {
+			labels[key] = value
+		}
+	}
+	updatedServer, _, err := p.client.Server.Update(context.Background(), server, hcloud.ServerUpdateOpts{Labels: labels})
+	if err != nil {
+		return fmt.Errorf("error updating server labels: %w", err)
+	}
+	if updatedServer == nil {
+		return errors.New("server vanished while updating labels")
+	}
+	server.Labels = updatedServer.Labels
+	p.logger.Printf("exposing %s behind firewall %s\n", server.Name, p.firewall.Name)
+	if err := p.waitForFirewall(server, p.firewall, p.stagingFirewall); err != nil {
+		// the server is installed, hcloud applies the firewall eventually
+		p.logger.Printf("warning: %v\n", err)
+	}
+	return nil
+}
+
+// waitForFirewall waits until applied is applied to server and removed isn't anymore,
+// hcloud applies firewalls to servers matching their label selectors asynchronously
+func (p *provisioner) waitForFirewall(server *hcloud.Server, applied *hcloud.Firewall, removed *hcloud.Firewall) error {
+	deadline := time.Now().Add(firewallApplyTimeout)
+	for {
+		current, _, err := p.client.Server.GetByID(context.Background(), server.ID)
+		if err != nil {
+			return fmt.Errorf("error checking firewalls of %s: %w", server.Name, err)
+		}
+		if current == nil {
+			return fmt.Errorf("server %s vanished while waiting for firewall %s", server.Name, applied.Name)
+		}
+		isApplied, isRemoved := false, true
+		for _, status := range current.PublicNet.Firewalls {
+			switch status.Firewall.ID {
+			case applied.ID:
+				isApplied = status.Status == hcloud.FirewallStatusApplied
+			case removed.ID:
+				isRemoved = false
+			}
+		}
+		if isApplied && isRemoved {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("firewall %s wasn't applied to %s within %s", applied.Name, server.Name, firewallApplyTimeout)
+		}
+		time.Sleep(firewallPollInterval)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"github.com/hetznercloud/hcloud-go/hcloud/schema"
+)
+
+func TestStagingRules(t *testing.T) {
+	port := "443"
+	https := hcloud.FirewallRule{Direction: hcloud.FirewallRuleDirectionIn, Protocol: hcloud.FirewallRuleProtocolTCP, Port: &port}
+	dns := hcloud.FirewallRule{Direction: hcloud.FirewallRuleDirectionOut, Protocol: hcloud.FirewallRuleProtocolUDP}
+	for _, test := range []struct {
+		name      string
+		conf      firewallConfig
+		rules     []hcloud.FirewallRule
+		sourceIPs []string
+		outbound  []hcloud.FirewallRule
+	}{
+		{name: "defaults to any address", sourceIPs: []string{"0.0.0.0/0", "::/0"}},
+		{name: "staging source ips", conf: firewallConfig{StagingSourceIPs: []string{"203.0.113.10/32"}}, sourceIPs: []string{"203.0.113.10/32"}},
+		{name: "only outbound rules are copied", rules: []hcloud.FirewallRule{https, dns}, sourceIPs: []string{"0.0.0.0/0", "::/0"}, outbound: []hcloud.FirewallRule{dns}},
+	} {
+		rules := stagingRules(test.conf, test.rules)
+		if len(rules) == 0 || !allowsSSH(rules[:1]) {
+			t.Errorf("%s: first rule doesn't allow ssh: %+v", test.name, rules)
+			continue
+		}
+		var sourceIPs []string
+		for _, ipNet := range rules[0].SourceIPs {
+			sourceIPs = append(sourceIPs, ipNet.String())
+		}
+		if !reflect.DeepEqual(sourceIPs, test.sourceIPs) {
+			t.Errorf("%s: ssh allowed from %v, expected %v", test.name, sourceIPs, test.sourceIPs)
+		}
+		if len(rules[1:]) != len(test.outbound) || (len(test.outbound) > 0 && !reflect.DeepEqual(rules[1:], test.outbound)) {
+			t.Errorf("%s: unexpected rules %+v, expected %+v", test.name, rules[1:], test.outbound)
+		}
+	}
+}
+
+func TestStageServerWaitsForStagingFirewall(t *testing.T) {
+	firewallPollInterval = 0
+	firewallApplyTimeout = 10 * time.Millisecond
+	defer func() {
+		firewallPollInterval = 2 * time.Second
+		firewallApplyTimeout = 2 * time.Minute
+	}()
+	p, api, _ := newTestProvisioner(t)
+	p.firewall = &hcloud.Firewall{ID: 9, Name: "flatcar"}
+	p.stagingFirewall = &hcloud.Firewall{ID: 10, Name: "flatcar-staging"}
+	created := api.addServer("web-1", "running", map[string]string{managedLabel: managedLabelValue})
+	server := &hcloud.Server{ID: created.ID, Name: "web-1", Labels: created.Labels}
+
+	// the firewall still exposes the server
+	created.PublicNet.Firewalls = []schema.ServerFirewall{{ID: 9, Status: "applied"}, {ID: 10, Status: "applied"}}
+	if err := p.stageServer(server); err == nil {
+		t.Error("expected staging to fail while the firewall is still applied")
+	}
+	if server.Labels[stagingLabel] != "true" {
+		t.Errorf("staging label wasn't set: %v", server.Labels)
+	}
+
+	created.PublicNet.Firewalls = []schema.ServerFirewall{{ID: 10, Status: "applied"}}
+	if err := p.stageServer(server); err != nil {
+		t.Errorf("staging failed: %v", err)
+	}
+}
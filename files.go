@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/crypto/ssh"
+)
+
+// fileInstallCommand returns the command moving the uploaded file at tmpPath to its destination with the configured mode and owner
+func fileInstallCommand(file fileUpload, tmpPath string) string {
+	mode := file.Mode
+	if mode == "" {
+		mode = "0644"
+	}
+	args := []string{"install", "-D", "-m", mode}
+	if file.Owner != "" {
+		owner, group, hasGroup := strings.Cut(file.Owner, ":")
+		args = append(args, "-o", shellQuote(owner))
+		if hasGroup {
+			args = append(args, "-g", shellQuote(group))
+		}
+	}
+	args = append(args, shellQuote(tmpPath), shellQuote(file.Destination))
+	return fmt.Sprintf("%s && rm -f %s", strings.Join(args, " "), shellQuote(tmpPath))
+}
+
+// sudoCommand wraps command to run it as root with passwordless sudo
+func sudoCommand(command string) string {
+	return "sudo -n sh -c " + shellQuote(command)
+}
+
+// uploadFiles uploads the files via sftp into tmpDir and moves them into place, with sudo if the user isn't root
+func uploadFiles(sshClient *sshSession, files []fileUpload, tmpDir string, sudo bool) error {
+	for i, file := range files {
+		tmpPath := path.Join(tmpDir, fmt.Sprintf(".hetzner-flatcar-upload-%d", i))
+		sshClient.logger.Printf("uploading %s to %s\n", file.Source, file.Destination)
+		if _, err := sshClient.upload(file.Source, tmpPath); err != nil {
+			return fmt.Errorf("error uploading %s: %w", file.Source, err)
+		}
+		command := fileInstallCommand(file, tmpPath)
+		if sudo {
+			command = sudoCommand(command)
+		}
+		if _, err := sshClient.output(context.Background(), command); err != nil {
+			return fmt.Errorf("error moving %s to %s: %w", file.Source, file.Destination, err)
+		}
+	}
+	return nil
+}
+
+// uploadHostFiles copies the configured files to the installed system as core, verifying its host key
+func (p *provisioner) uploadHostFiles(server *hcloud.Server, hostKey ssh.PublicKey) error {
+	sshAuth, err := buildSSHAuth(p.cfg.HCloud)
+	if err != nil {
+		return fmt.Errorf("error building ssh authentication: %w", err)
+	}
+	addr, err := p.flatcarAddress(server)
+	if err != nil {
+		return err
+	}
+	connect := func() (*sshClient, error) {
+		return sshConnect(p.dial, sshTarget{
+			User:              "core",
+			Addr:              addr,
+			Port:              22,
+			Auth:              sshAuth,
+			Callback:          ssh.FixedHostKey(hostKey),
+			HostKeyAlgorithms: []string{hostKey.Type()},
+			Keepalive:         p.keepalive,
+		})
+	}
+	client, err := connect()
+	if err != nil {
+		return fmt.Errorf("error connecting to %s: %w", server.Name, err)
+	}
+	sshClient := &sshSession{sshClient: client, connect: connect, logger: p.logger}
+	defer cleanups.push("close ssh connection to "+server.Name, sshClient.Close).run()
+	return uploadFiles(sshClient, p.cfg.Files.Host, "/home/core", true)
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// managedSelector selects all servers managed by hetzner-flatcar
+var managedSelector = fmt.Sprintf("%s=%s", managedLabel, managedLabelValue)
+
+// firewallRuleFromConfig validates rule and converts it into an hcloud firewall rule
+func firewallRuleFromConfig(rule firewallRule) (hcloud.FirewallRule, error) {
+	converted := hcloud.FirewallRule{
+		Direction: hcloud.FirewallRuleDirection(rule.Direction),
+		Protocol:  hcloud.FirewallRuleProtocol(rule.Protocol),
+	}
+	if converted.Direction == "" {
+		converted.Direction = hcloud.FirewallRuleDirectionIn
+	}
+	if converted.Direction != hcloud.FirewallRuleDirectionIn && converted.Direction != hcloud.FirewallRuleDirectionOut {
+		return hcloud.FirewallRule{}, fmt.Errorf("invalid direction %s, use in or out", rule.Direction)
+	}
+	switch converted.Protocol {
+	case hcloud.FirewallRuleProtocolTCP, hcloud.FirewallRuleProtocolUDP:
+		if rule.Port == "" {
+			return hcloud.FirewallRule{}, fmt.Errorf("port missing for %s", rule.Protocol)
+		}
+		port := rule.Port
+		converted.Port = &port
+	case hcloud.FirewallRuleProtocolICMP, hcloud.FirewallRuleProtocolESP, hcloud.FirewallRuleProtocolGRE:
+		if rule.Port != "" {
+			return hcloud.FirewallRule{}, fmt.Errorf("port isn't supported for %s", rule.Protocol)
+		}
+	default:
+		return hcloud.FirewallRule{}, fmt.Errorf("invalid protocol %s, use tcp, udp, icmp, esp or gre", rule.Protocol)
+	}
+	var err error
+	if converted.SourceIPs, err = parseCIDRs(rule.SourceIPs); err != nil {
+		return hcloud.FirewallRule{}, err
+	}
+	if converted.DestinationIPs, err = parseCIDRs(rule.DestinationIPs); err != nil {
+		return hcloud.FirewallRule{}, err
+	}
+	if converted.Direction == hcloud.FirewallRuleDirectionIn && len(converted.SourceIPs) == 0 {
+		return hcloud.FirewallRule{}, errors.New("source_ips missing for inbound rule")
+	}
+	if converted.Direction == hcloud.FirewallRuleDirectionOut && len(converted.DestinationIPs) == 0 {
+		return hcloud.FirewallRule{}, errors.New("destination_ips missing for outbound rule")
+	}
+	if rule.Description != "" {
+		description := rule.Description
+		converted.Description = &description
+	}
+	return converted, nil
+}
+
+func parseCIDRs(cidrs []string) ([]net.IPNet, error) {
+	parsed := make([]net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr %s", cidr)
+		}
+		parsed = append(parsed, *ipNet)
+	}
+	return parsed, nil
+}
+
+// ruleKey returns a comparable representation of rule, independent of the order of its ips
+func ruleKey(rule hcloud.FirewallRule) string {
+	ips := func(ipNets []net.IPNet) string {
+		formatted := make([]string, len(ipNets))
+		for i, ipNet := range ipNets {
+			formatted[i] = ipNet.String()
+		}
+		sort.Strings(formatted)
+		return strings.Join(formatted, ",")
+	}
+	var port, description string
+	if rule.Port != nil {
+		port = *rule.Port
+	}
+	if rule.Description != nil {
+		description = *rule.Description
+	}
+	return strings.Join([]string{string(rule.Direction), string(rule.Protocol), port, ips(rule.SourceIPs), ips(rule.DestinationIPs), description}, "|")
+}
+
+// equalRules checks whether both lists contain the same rules, ignoring their order
+func equalRules(a []hcloud.FirewallRule, b []hcloud.FirewallRule) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	keys := make(map[string]int)
+	for _, rule := range a {
+		keys[ruleKey(rule)]++
+	}
+	for _, rule := range b {
+		keys[ruleKey(rule)]--
+	}
+	for _, count := range keys {
+		if count != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// allowsSSH returns whether any rule allows inbound ssh, which is required to install servers
+func allowsSSH(rules []hcloud.FirewallRule) bool {
+	for _, rule := range rules {
+		if rule.Direction != hcloud.FirewallRuleDirectionIn || rule.Protocol != hcloud.FirewallRuleProtocolTCP {
+			continue
+		}
+		start, end, isRange := strings.Cut(*rule.Port, "-")
+		if !isRange {
+			end = start
+		}
+		first, errFirst := strconv.Atoi(start)
+		last, errLast := strconv.Atoi(end)
+		if errFirst == nil && errLast == nil && first <= 22 && last >= 22 {
+			return true
+		}
+	}
+	return false
+}
+
+// syncFirewall creates the configured firewall or updates its rules and applies it to all managed servers
+// Rule drift is reconciled once per run.
+func (p *provisioner) syncFirewall() error {
+	conf := p.cfg.Firewall
+	if conf.Name == "" {
+		return nil
+	}
+	p.firewallMu.Lock()
+	defer p.firewallMu.Unlock()
+	if p.firewallSynced {
+		return nil
+	}
+	if err := p.applyFirewall(); err != nil {
+		return err
+	}
+	p.firewallSynced = true
+	return nil
+}
+
+func (p *provisioner) applyFirewall() error {
+	conf := p.cfg.Firewall
+	rules := make([]hcloud.FirewallRule, len(conf.Rules))
+	for i, rule := range conf.Rules {
+		// validated while parsing the config
+		rules[i], _ = firewallRuleFromConfig(rule)
+	}
+	if !allowsSSH(rules) {
+		p.logger.Printf("warning: firewall %s doesn't allow inbound ssh, installing servers will fail\n", conf.Name)
+	}
+	firewall, err := p.reconcileFirewall(conf.Name, rules, conf.selector())
+	if err != nil {
+		return err
+	}
+	p.firewall = firewall
+	if !conf.DelayExposure {
+		return nil
+	}
+	staging, err := p.reconcileFirewall(conf.stagingName(), stagingRules(conf, rules), stagingLabel)
+	if err != nil {
+		return err
+	}
+	p.stagingFirewall = staging
+	return nil
+}
+
+// reconcileFirewall creates the firewall name or updates its rules and applies it to the servers matching selector
+func (p *provisioner) reconcileFirewall(name string, rules []hcloud.FirewallRule, selector string) (*hcloud.Firewall, error) {
+	applyTo := hcloud.FirewallResource{
+		Type:          hcloud.FirewallResourceTypeLabelSelector,
+		LabelSelector: &hcloud.FirewallResourceLabelSelector{Selector: selector},
+	}
+
+	ctx := context.Background()
+	firewall, _, err := p.client.Firewall.GetByName(ctx, name)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting firewall: %w", err)
+	}
+	if firewall == nil {
+		p.logger.Printf("creating firewall %s with %d rules\n", name, len(rules))
+		result, _, err := p.client.Firewall.Create(ctx, hcloud.FirewallCreateOpts{
+			Name:    name,
+			Labels:  map[string]string{managedLabel: managedLabelValue},
+			Rules:   rules,
+			ApplyTo: []hcloud.FirewallResource{applyTo},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating firewall: %w", err)
+		}
+		if err := waitForActions(p.logger, p.client.Action, result.Actions); err != nil {
+			return nil, fmt.Errorf("error waiting for action: %w", err)
+		}
+		return result.Firewall, nil
+	}
+
+	if !equalRules(firewall.Rules, rules) {
+		p.logger.Printf("updating rules of firewall %s\n", name)
+		actions, _, err := p.client.Firewall.SetRules(ctx, firewall, hcloud.FirewallSetRulesOpts{Rules: rules})
+		if err != nil {
+			return nil, fmt.Errorf("error updating firewall rules: %w", err)
+		}
+		if err := waitForActions(p.logger, p.client.Action, actions); err != nil {
+			return nil, fmt.Errorf("error waiting for action: %w", err)
+		}
+	}
+	applied, stale := checkSelectors(firewall.AppliedTo, selector)
+	if len(stale) > 0 {
+		p.logger.Printf("removing outdated label selectors of firewall %s\n", name)
+		actions, _, err := p.client.Firewall.RemoveResources(ctx, firewall, stale)
+		if err != nil {
+			return nil, fmt.Errorf("error removing firewall resources: %w", err)
+		}
+		if err := waitForActions(p.logger, p.client.Action, actions); err != nil {
+			return nil, fmt.Errorf("error waiting for action: %w", err)
+		}
+	}
+	if applied {
+		return firewall, nil
+	}
+	p.logger.Printf("applying firewall %s to %s\n", name, selector)
+	actions, _, err := p.client.Firewall.ApplyResources(ctx, firewall, []hcloud.FirewallResource{applyTo})
+	if err != nil {
+		return nil, fmt.Errorf("error applying firewall: %w", err)
+	}
+	if err := waitForActions(p.logger, p.client.Action, actions); err != nil {
+		return nil, fmt.Errorf("error waiting for action: %w", err)
+	}
+	return firewall, nil
+}
+
+// checkSelectors returns whether the firewall is applied to selector and the managed label selectors it's applied to
+// instead, which are left over from toggling firewall.delay_exposure
+func checkSelectors(appliedTo []hcloud.FirewallResource, selector string) (bool, []hcloud.FirewallResource) {
+	applied := false
+	var stale []hcloud.FirewallResource
+	for _, resource := range appliedTo {
+		if resource.Type != hcloud.FirewallResourceTypeLabelSelector {
+			continue
+		}
+		switch resource.LabelSelector.Selector {
+		case selector:
+			applied = true
+		case managedSelector, exposedSelector:
+			stale = append(stale, resource)
+		}
+	}
+	return applied, stale
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestCheckFirewallSelectors(t *testing.T) {
+	resource := func(selector string) hcloud.FirewallResource {
+		return hcloud.FirewallResource{Type: hcloud.FirewallResourceTypeLabelSelector, LabelSelector: &hcloud.FirewallResourceLabelSelector{Selector: selector}}
+	}
+	server := hcloud.FirewallResource{Type: hcloud.FirewallResourceTypeServer, Server: &hcloud.FirewallResourceServer{ID: 1}}
+	for _, test := range []struct {
+		name      string
+		appliedTo []hcloud.FirewallResource
+		selector  string
+		applied   bool
+		stale     []string
+	}{
+		{name: "not applied", selector: managedSelector},
+		{name: "applied", appliedTo: []hcloud.FirewallResource{resource(managedSelector)}, selector: managedSelector, applied: true},
+		{name: "delay_exposure enabled", appliedTo: []hcloud.FirewallResource{resource(managedSelector)}, selector: exposedSelector, stale: []string{managedSelector}},
+		{name: "delay_exposure disabled", appliedTo: []hcloud.FirewallResource{resource(exposedSelector)}, selector: managedSelector, stale: []string{exposedSelector}},
+		{name: "other resources are kept", appliedTo: []hcloud.FirewallResource{server, resource("role=web"), resource(exposedSelector)}, selector: exposedSelector, applied: true},
+	} {
+		applied, stale := checkSelectors(test.appliedTo, test.selector)
+		var staleSelectors []string
+		for _, resource := range stale {
+			staleSelectors = append(staleSelectors, resource.LabelSelector.Selector)
+		}
+		if applied != test.applied || !reflect.DeepEqual(staleSelectors, test.stale) {
+			t.Errorf("%s: got applied %v and stale %v, expected %v and %v", test.name, applied, staleSelectors, test.applied, test.stale)
+		}
+	}
+}
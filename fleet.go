@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+// forEachServer calls fn for every server with at most concurrency calls running at once and returns the failed servers
+func forEachServer(serverNames []string, concurrency int, fn func(serverName string) error) map[string]error {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var mu sync.Mutex
+	errs := make(map[string]error)
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, serverName := range serverNames {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(serverName string) {
+			defer cleanups.recoverPanic()
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+			if err := fn(serverName); err != nil {
+				mu.Lock()
+				errs[serverName] = err
+				mu.Unlock()
+			}
+		}(serverName)
+	}
+	wg.Wait()
+	return errs
+}
+
+// printErrors writes the errors sorted by server name
+func printErrors(w io.Writer, errs map[string]error) {
+	serverNames := make([]string, 0, len(errs))
+	for serverName := range errs {
+		serverNames = append(serverNames, serverName)
+	}
+	sort.Strings(serverNames)
+	for _, serverName := range serverNames {
+		fmt.Fprintf(w, "%s: %v\n", serverName, errs[serverName])
+	}
+}
+
+// prefixWriter prefixes every line written to it, so output of multiple servers can be interleaved
+type prefixWriter struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	prefix string
+	buf    []byte
+}
+
+func newPrefixWriter(mu *sync.Mutex, w io.Writer, prefix string) *prefixWriter {
+	return &prefixWriter{mu: mu, w: w, prefix: prefix}
+}
+
+func (w *prefixWriter) Write(data []byte) (int, error) {
+	w.buf = append(w.buf, data...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		if err := w.writeLine(w.buf[:i+1]); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[i+1:]
+	}
+	return len(data), nil
+}
+
+// Flush writes a remaining incomplete line
+func (w *prefixWriter) Flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.writeLine(append(w.buf, '\n'))
+	w.buf = nil
+	return err
+}
+
+func (w *prefixWriter) writeLine(line []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err := fmt.Fprintf(w.w, "%s: %s", w.prefix, line)
+	return err
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitRevisionLabel is the server label storing the commit of the git source the server was provisioned from
+const gitRevisionLabel = "hetzner-flatcar/git-sha"
+
+// gitSource is a git repository containing the config and templates
+type gitSource struct {
+	URL    string
+	Branch string
+	// Path is the directory inside the repository containing the config
+	Path string
+	// Dir is the local checkout of the repository
+	Dir string
+}
+
+// runGit runs git with args and returns its trimmed stdout
+func runGit(args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	stderr := &bytes.Buffer{}
+	cmd.Stderr = stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// sync clones or updates the local checkout and returns the commit it's at
+func (g gitSource) sync() (string, error) {
+	if _, err := os.Stat(filepath.Join(g.Dir, ".git")); os.IsNotExist(err) {
+		log.Printf("cloning %s (branch %s) into %s\n", g.URL, g.Branch, g.Dir)
+		if _, err := runGit("clone", "--branch", g.Branch, "--single-branch", g.URL, g.Dir); err != nil {
+			return "", err
+		}
+	} else {
+		log.Printf("updating %s from %s (branch %s)\n", g.Dir, g.URL, g.Branch)
+		if _, err := runGit("-C", g.Dir, "fetch", "origin", g.Branch); err != nil {
+			return "", err
+		}
+		if _, err := runGit("-C", g.Dir, "reset", "--hard", "FETCH_HEAD"); err != nil {
+			return "", err
+		}
+	}
+	return runGit("-C", g.Dir, "rev-parse", "HEAD")
+}
+
+// configDir returns the directory containing the config inside the local checkout
+func (g gitSource) configDir() string {
+	return filepath.Join(g.Dir, g.Path)
+}
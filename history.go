@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	ignTypes "github.com/flatcar/ignition/config/v2_3/types"
+)
+
+// historyRevisionFormat is the time format used as revision of history entries
+const historyRevisionFormat = "20060102T150405Z"
+
+// historyEntry is an ignition config applied to a server
+type historyEntry struct {
+	Revision    string    `json:"revision"`
+	Time        time.Time `json:"time"`
+	ConfigHash  string    `json:"config_hash"`
+	GitRevision string    `json:"git_revision,omitempty"`
+	// Inputs are the files the config was rendered from, only recorded in deterministic mode
+	Inputs   []renderInput   `json:"inputs,omitempty"`
+	Ignition json.RawMessage `json:"ignition"`
+}
+
+// rendered returns the stored ignition config, container linux configs are parsed again so they can be extended
+func (e historyEntry) rendered() (renderedIgnition, error) {
+	var header struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(e.Ignition, &header); err != nil {
+		return renderedIgnition{}, fmt.Errorf("error parsing stored ignition config: %w", err)
+	}
+	if !strings.HasPrefix(header.Ignition.Version, "2.") {
+		return renderedIgnition{raw: e.Ignition}, nil
+	}
+	var cfg ignTypes.Config
+	if err := json.Unmarshal(e.Ignition, &cfg); err != nil {
+		return renderedIgnition{}, fmt.Errorf("error parsing stored ignition config: %w", err)
+	}
+	return renderedIgnition{config: &cfg}, nil
+}
+
+// recordHistory stores the ignition config applied to the server in the history directory
+func (p *provisioner) recordHistory(serverName string, rendered renderedIgnition, hash string, gitRevision string) error {
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	entry := historyEntry{
+		Revision:    now.Format(historyRevisionFormat),
+		Time:        now,
+		ConfigHash:  hash,
+		GitRevision: gitRevision,
+		Ignition:    cfgJSON,
+	}
+	if p.cfg.Flatcar.Deterministic {
+		entry.Inputs = p.inputs.get(serverName)
+	}
+	dir := filepath.Join(p.cfg.History.Dir, serverName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("error creating history directory: %w", err)
+	}
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, entry.Revision+".json"), entryJSON, 0600); err != nil {
+		return fmt.Errorf("error writing history entry: %w", err)
+	}
+	p.logger.Printf("recorded revision %s of server '%s'\n", entry.Revision, serverName)
+	return nil
+}
+
+// history returns the ignition configs applied to the server, newest first
+func (p *provisioner) history(serverName string) ([]historyEntry, error) {
+	paths, err := filepath.Glob(filepath.Join(p.cfg.History.Dir, serverName, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]historyEntry, 0, len(paths))
+	for _, path := range paths {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading history entry: %w", err)
+		}
+		var entry historyEntry
+		if err := json.Unmarshal(content, &entry); err != nil {
+			return nil, fmt.Errorf("error parsing history entry %s: %w", path, err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Time.After(entries[j].Time)
+	})
+	return entries, nil
+}
+
+// findRevision returns the newest history entry matching the revision, config hash or git revision prefix
+func (p *provisioner) findRevision(serverName string, revision string) (historyEntry, error) {
+	entries, err := p.history(serverName)
+	if err != nil {
+		return historyEntry{}, err
+	}
+	for _, entry := range entries {
+		if entry.Revision == revision ||
+			strings.HasPrefix(entry.ConfigHash, revision) ||
+			(entry.GitRevision != "" && strings.HasPrefix(entry.GitRevision, revision)) {
+			return entry, nil
+		}
+	}
+	return historyEntry{}, fmt.Errorf("revision %s of server %s not found in history", revision, serverName)
+}
+
+// reinstallRevision reinstalls the server with the ignition config of a previous revision
+func (p *provisioner) reinstallRevision(serverName string, revision string) (err error) {
+	var entry historyEntry
+	p.startRun(serverName, "rollback")
+	defer func() {
+		p.finishRun(serverName, entry.ConfigHash, entry.GitRevision, err)
+	}()
+	entry, err = p.findRevision(serverName, revision)
+	if err != nil {
+		return err
+	}
+	rendered, err := entry.rendered()
+	if err != nil {
+		return err
+	}
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	p.logger.Printf("reinstalling server '%s' with revision %s\n", serverName, entry.Revision)
+	if err := p.checkInstall(server, rendered); err != nil {
+		return err
+	}
+	if p.cfg.HCloud.SnapshotBeforeReinstall {
+		if err := p.snapshotServer(server); err != nil {
+			return err
+		}
+	}
+	if err := p.install(server, rendered); err != nil {
+		return err
+	}
+	labels := map[string]string{configHashLabel: entry.ConfigHash}
+	if entry.GitRevision != "" {
+		labels[gitRevisionLabel] = entry.GitRevision
+	}
+	if err := p.setLabels(server, labels); err != nil {
+		return err
+	}
+	return p.recordHistory(serverName, rendered, entry.ConfigHash, entry.GitRevision)
+}
+
+func printHistory(w io.Writer, entries []historyEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "REVISION\tTIME\tCONFIG\tGIT")
+	for _, entry := range entries {
+		gitRevision := entry.GitRevision
+		if gitRevision == "" {
+			gitRevision = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", entry.Revision, entry.Time.Local().Format(time.RFC3339), entry.ConfigHash[:12], gitRevision)
+	}
+	return tw.Flush()
+}
+
+// runHistory lists the ignition configs applied to a server or the recorded provisioning runs
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	runs := fs.Bool("runs", false, "list the recorded provisioning runs instead of the applied configs, optionally of a single server")
+	result := fs.String("result", "", "only list runs or commands with this result (succeeded or failed)")
+	since := fs.Duration("since", 0, "only list runs or commands started within this duration, e.g. 72h")
+	limit := fs.Int("limit", 0, "maximum number of runs or commands to list (default all)")
+	audit := fs.Bool("audit", false, "list the commands run with exec instead of the applied configs, optionally on a single server")
+	jsonOutput := fs.Bool("json", false, "print the runs including their phases as JSON")
+	fs.Parse(args)
+	if fs.NArg() > 1 || (fs.NArg() == 0 && !*runs && !*audit) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	filter := runFilter{Server: fs.Arg(0), Result: *result, Limit: *limit}
+	if *since > 0 {
+		filter.Since = time.Now().Add(-*since)
+	}
+	if *audit {
+		records, err := queryAudit(p.cfg.History.runDatabase(), filter)
+		if err != nil {
+			fatalf("error reading audit log: %v\n", err)
+		}
+		if *jsonOutput {
+			if err := printJSON(os.Stdout, records); err != nil {
+				fatalf("error encoding audit log: %v\n", err)
+			}
+			return
+		}
+		if err := printAudit(os.Stdout, records); err != nil {
+			fatalf("error printing audit log: %v\n", err)
+		}
+		return
+	}
+	if *runs {
+		records, err := queryRuns(p.cfg.History.runDatabase(), filter)
+		if err != nil {
+			fatalf("error reading runs: %v\n", err)
+		}
+		if *jsonOutput {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			if err := encoder.Encode(records); err != nil {
+				fatalf("error encoding runs: %v\n", err)
+			}
+			return
+		}
+		if err := printRuns(os.Stdout, records); err != nil {
+			fatalf("error printing runs: %v\n", err)
+		}
+		return
+	}
+	entries, err := p.history(fs.Arg(0))
+	if err != nil {
+		fatalf("error reading history: %v\n", err)
+	}
+	if len(entries) == 0 {
+		fatalf("no history recorded for %s\n", fs.Arg(0))
+	}
+	if err := printHistory(os.Stdout, entries); err != nil {
+		fatalf("error printing history: %v\n", err)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	clconfig "github.com/flatcar/container-linux-config-transpiler/config"
+	ignTypes "github.com/flatcar/ignition/config/v2_3/types"
+	"gopkg.in/yaml.v3"
+)
+
+// renderedIgnition is an ignition config ready to be installed.
+// Container linux configs are kept as ignition v2 config so they can be extended by the tool,
+// butane configs are translated into ignition v3 json by the butane binary and passed through unmodified.
+type renderedIgnition struct {
+	config *ignTypes.Config
+	raw    []byte
+}
+
+// JSON returns the ignition config as json
+func (r renderedIgnition) JSON() ([]byte, error) {
+	if r.config == nil {
+		return r.raw, nil
+	}
+	return json.Marshal(r.config)
+}
+
+// detectButane checks whether input is a butane config (identified by variant and version) or a container linux config
+func detectButane(input []byte) (bool, error) {
+	var header struct {
+		Variant string `yaml:"variant"`
+		Version string `yaml:"version"`
+	}
+	if err := yaml.Unmarshal(input, &header); err != nil {
+		return false, fmt.Errorf("error parsing rendered config: %w", err)
+	}
+	switch {
+	case header.Variant == "" && header.Version == "":
+		return false, nil
+	case header.Variant == "" || header.Version == "":
+		return false, errors.New("rendered config has only one of variant and version, butane configs need both and container linux configs none")
+	case header.Variant != "flatcar":
+		return false, fmt.Errorf("butane variant %s isn't supported, use flatcar", header.Variant)
+	}
+	return true, nil
+}
+
+// transpileConfig converts the rendered container linux or butane config into ignition
+func transpileConfig(logger *log.Logger, input []byte) (renderedIgnition, error) {
+	isButane, err := detectButane(input)
+	if err != nil {
+		return renderedIgnition{}, err
+	}
+	if isButane {
+		logger.Println("transpiling butane config")
+		cmd := exec.Command("butane", "--strict")
+		cmd.Stdin = bytes.NewReader(input)
+		stderr := &bytes.Buffer{}
+		cmd.Stderr = stderr
+		output, err := cmd.Output()
+		if err != nil {
+			return renderedIgnition{}, fmt.Errorf("butane failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		return renderedIgnition{raw: output}, nil
+	}
+
+	logger.Println("transpiling container linux config")
+	cfg, pt, report := clconfig.Parse(input)
+	if report.IsFatal() {
+		return renderedIgnition{}, errors.New("config parsing failed")
+	}
+	transpiledConfig, report := clconfig.Convert(cfg, "", pt)
+	if report.IsFatal() {
+		return renderedIgnition{}, errors.New("config conversion failed")
+	}
+	return renderedIgnition{config: &transpiledConfig}, nil
+}
+
+// addFile adds a file with inline contents to the root filesystem of the ignition config
+func addFile(ignitionConfig *ignTypes.Config, path string, mode int, contents []byte) {
+	ignitionConfig.Storage.Files = append(ignitionConfig.Storage.Files, ignTypes.File{
+		Node: ignTypes.Node{
+			Filesystem: "root",
+			Path:       path,
+		},
+		FileEmbedded1: ignTypes.FileEmbedded1{
+			Contents: ignTypes.FileContents{
+				Source: "data:;base64," + base64.StdEncoding.EncodeToString(contents),
+			},
+			Mode: &mode,
+		},
+	})
+}
+
+// hasFile checks whether the ignition config contains a file at path
+func hasFile(ignitionConfig ignTypes.Config, path string) bool {
+	for _, file := range ignitionConfig.Storage.Files {
+		if file.Path == path {
+			return true
+		}
+	}
+	return false
+}
+
+// injectCoreSSHKeys adds publicKeys to the authorized keys of core if the config doesn't set any
+func injectCoreSSHKeys(ignitionConfig *ignTypes.Config, publicKeys []string) bool {
+	keys := make([]ignTypes.SSHAuthorizedKey, len(publicKeys))
+	for i, publicKey := range publicKeys {
+		keys[i] = ignTypes.SSHAuthorizedKey(strings.TrimSpace(publicKey))
+	}
+	for i, user := range ignitionConfig.Passwd.Users {
+		if user.Name != "core" {
+			continue
+		}
+		if len(user.SSHAuthorizedKeys) > 0 {
+			return false
+		}
+		ignitionConfig.Passwd.Users[i].SSHAuthorizedKeys = keys
+		return true
+	}
+	ignitionConfig.Passwd.Users = append(ignitionConfig.Passwd.Users, ignTypes.PasswdUser{
+		Name:              "core",
+		SSHAuthorizedKeys: keys,
+	})
+	return true
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// imageName is the name the local flatcar image is uploaded as into the working directory of the rescue system
+const imageName = "flatcar_production_image.bin.bz2"
+
+// uploadImage uploads the local flatcar image into the rescue system, verifying its checksum on both ends
+func (p *provisioner) uploadImage(sshClient *sshSession) error {
+	conf := p.cfg.Flatcar
+	if conf.ImageChecksum != "" {
+		sum, err := fileSHA256(conf.Image)
+		if err != nil {
+			return fmt.Errorf("error computing checksum of image: %w", err)
+		}
+		if !strings.EqualFold(sum, conf.ImageChecksum) {
+			return fmt.Errorf("checksum mismatch of %s: expected %s, got %s", conf.Image, conf.ImageChecksum, sum)
+		}
+	}
+	p.logger.Printf("uploading local image %s\n", conf.Image)
+	sum, err := sshClient.upload(conf.Image, p.cfg.Rescue.path(imageName))
+	if err != nil {
+		return fmt.Errorf("error uploading image: %w", err)
+	}
+	p.logger.Printf("uploaded image with sha256 %s\n", sum)
+	return nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/crypto/ssh"
+)
+
+// rebootWait is the time a server is given to (re)boot before connecting to it
+var rebootWait = 30 * time.Second
+
+// install boots server into rescue and installs flatcar with the given ignition config
+// checkInstall runs the checks of install, they don't change anything, so a server failing them
+// is neither snapshotted, staged nor taken out of its load balancers
+func (p *provisioner) checkInstall(server *hcloud.Server, rendered renderedIgnition) error {
+	warnings, err := lintIgnition(rendered, server)
+	if err != nil {
+		return err
+	}
+	for _, warning := range warnings {
+		p.logger.Printf("warning: %s\n", warning)
+	}
+	if len(warnings) > 0 && !p.force {
+		return errors.New("ignition config has warnings, use --force to install anyway")
+	}
+	if p.cfg.SSH.GenerateHostKeys && rendered.config == nil {
+		return errors.New("ssh.generate_host_keys is only supported for container linux configs")
+	}
+	// a wrong key would only show up as failing ssh connections to the rescue system
+	return p.checkSSHKey()
+}
+
+func (p *provisioner) install(server *hcloud.Server, rendered renderedIgnition) error {
+	cfg := p.cfg
+	client := p.client
+
+	version, channel, err := p.flatcarRelease(server)
+	if err != nil {
+		return err
+	}
+
+	var pinnedHostKey ssh.PublicKey
+	if cfg.SSH.GenerateHostKeys {
+		// inject into a copy, so the rendered config stays unchanged for hashing
+		ignitionConfig := *rendered.config
+		pinnedHostKey, err = injectHostKey(&ignitionConfig)
+		if err != nil {
+			return fmt.Errorf("error generating host key: %w", err)
+		}
+		p.logger.Printf("generated %s host key %s\n", pinnedHostKey.Type(), ssh.FingerprintSHA256(pinnedHostKey))
+		rendered = renderedIgnition{config: &ignitionConfig}
+	}
+
+	if cfg.Flatcar.RemoteConfig.UploadURL != "" {
+		rendered, err = p.pointerIgnition(server, rendered)
+		if err != nil {
+			return err
+		}
+	}
+
+	// the config often contains secrets, it's only kept in memory and streamed into the rescue system
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return fmt.Errorf("error encoding ignition config: %w", err)
+	}
+
+	rescueAddr, err := p.rescueAddress(server)
+	if err != nil {
+		return err
+	}
+
+	// only taken out of its load balancers once all checks passed
+	if err := p.removeFromLoadBalancers(server); err != nil {
+		return err
+	}
+
+	// enable rescue boot
+	var rescuePassword string
+	end, err := p.beginPhase(server.Name, server, "enable_rescue")
+	if err != nil {
+		return err
+	}
+	var detachISO *cleanup
+	if cfg.Rescue.ISO != "" {
+		// the iso is detached before the installed system boots and on failures, or it would be booted again
+		detachISO, err = p.attachISO(server)
+		if err != nil {
+			return err
+		}
+		defer detachISO.run()
+	} else if !server.RescueEnabled {
+		p.logger.Println("enabling rescue boot")
+		result, _, err := client.Server.EnableRescue(context.Background(), server, hcloud.ServerEnableRescueOpts{
+			Type:    hcloud.ServerRescueTypeLinux64,
+			SSHKeys: p.sshKeys(),
+		})
+		if err != nil {
+			return fmt.Errorf("error sending enablerescue request: %w", err)
+		}
+		if result.Action.Error() != nil {
+			return fmt.Errorf("error enabling rescue: %w", result.Action.Error())
+		}
+		rescuePassword = result.RootPassword
+		secrets.add(rescuePassword)
+
+		err = waitForAction(p.logger, client.Action, result.Action)
+		if err != nil {
+			return fmt.Errorf("error waiting for action: %w", err)
+		}
+	}
+	p.emit(server.Name, eventRescueEnabled, nil)
+	// rescue stays enabled until the server booted into it, an aborted install would boot it on the next reboot
+	var disableRescue *cleanup
+	if cfg.Rescue.DisableOnAbort && cfg.Rescue.ISO == "" {
+		disableRescue = cleanups.push("disable rescue of "+server.Name, func() error {
+			return p.disableRescue(server)
+		})
+		defer disableRescue.run()
+	}
+
+	if err := end(server, nil); err != nil {
+		return err
+	}
+
+	end, err = p.beginPhase(server.Name, server, "boot_rescue")
+	if err != nil {
+		return err
+	}
+	var action *hcloud.Action
+	if server.Status == hcloud.ServerStatusRunning {
+		// server is already running, reboot into rescue
+		p.logger.Println("server already running, rebooting into rescue for reinstall")
+		action, _, err = client.Server.Reboot(context.Background(), server)
+	} else {
+		p.logger.Printf("powering server on")
+		action, _, err = client.Server.Poweron(context.Background(), server)
+	}
+	if err != nil {
+		return fmt.Errorf("error sending reboot or poweron request: %w", err)
+	}
+	if action.Error() != nil {
+		return fmt.Errorf("error rebooting or powering on server: %w", action.Error())
+	}
+
+	err = waitForAction(p.logger, client.Action, action)
+	if err != nil {
+		return fmt.Errorf("error waiting for action: %w", err)
+	}
+	p.emit(server.Name, eventRescueBooting, nil)
+
+	if cfg.Artifacts.Console {
+		defer p.startConsoleCapture(server)()
+	}
+
+	// give the server some time to (re)boot
+	p.logger.Printf("sleeping %s to wait for server to (re)boot into rescue\n", rebootWait)
+	time.Sleep(rebootWait)
+
+	sshAuth, err := buildSSHAuth(cfg.HCloud)
+	if rescuePassword != "" && !cfg.Rescue.sudo() {
+		// fall back to the root password of the rescue system if key authentication fails
+		if err != nil {
+			p.logger.Printf("warning: falling back to rescue root password: error building ssh authentication: %v\n", err)
+			sshAuth, err = nil, nil
+		}
+		sshAuth = append(sshAuth, ssh.Password(rescuePassword))
+	}
+	if err != nil {
+		return fmt.Errorf("error building ssh authentication: %w", err)
+	}
+
+	initialRetries := 30
+	retries := 1
+	connectionSuccess := false
+	var reach rescueReachability
+	var rescueClient *sshClient
+	var rescueHostKey ssh.PublicKey
+	rescueTarget := sshTarget{
+		User: cfg.Rescue.user(),
+		Addr: rescueAddr,
+		Port: 22,
+		Auth: sshAuth,
+		// the rescue system has a random host key on every boot, it's trusted on first use,
+		// ssh.strict_host_keys only applies to the installed system
+		Callback:  recordHostKey(&rescueHostKey),
+		Keepalive: p.keepalive,
+	}
+	connected := p.timeStep(server.Name, "boot_rescue", "ssh_connect")
+	for retries <= initialRetries {
+		rescueClient, err = sshConnect(p.dial, rescueTarget)
+		if err == nil {
+			connectionSuccess = true
+			break
+		} else {
+			if netError, ok := err.(net.Error); ok {
+				p.logger.Printf("retrying network error (%d/%d): %v\n", retries, initialRetries, netError)
+				reach.add(err)
+				if err := p.checkRescueReachability(server, &reach); err != nil {
+					return err
+				}
+				retries++
+				time.Sleep(rescueRetryDelay)
+			} else {
+				return fmt.Errorf("unretriable error while etablishing ssh connection: %w", err)
+			}
+		}
+	}
+	connected()
+
+	if err := end(server, nil); err != nil {
+		return err
+	}
+	if !connectionSuccess {
+		return explainUnreachableRescue(server.Name, rescueTarget.Addr, &reach)
+	}
+	disableRescue.discard()
+	p.emit(server.Name, eventRescueConnected, nil)
+
+	// reconnects have to reach the same rescue system
+	sshClient := &sshSession{sshClient: rescueClient, env: cfg.Rescue.envPrefix(), sudo: cfg.Rescue.sudo(), transcript: p.report.recorder(server.Name), logger: p.logger, connect: func() (*sshClient, error) {
+		reconnectTarget := rescueTarget
+		reconnectTarget.Callback = ssh.FixedHostKey(rescueHostKey)
+		return sshConnect(p.dial, reconnectTarget)
+	}}
+	// closed on interrupts and fatal errors as well
+	defer cleanups.push("close ssh connection to rescue system of "+server.Name, sshClient.Close).run()
+
+	end, err = p.beginPhase(server.Name, server, "flatcar_install")
+	if err != nil {
+		return err
+	}
+	p.emit(server.Name, eventInstallStarted, nil)
+	installScriptTarget := cfg.Rescue.path("flatcar-install")
+	ignitionTarget := cfg.Rescue.path("ignition.json")
+
+	uploaded := p.timeStep(server.Name, "flatcar_install", "upload")
+	if cfg.Flatcar.InstallScript != "" {
+		_, err = sshClient.upload(cfg.Flatcar.InstallScript, installScriptTarget)
+		if err != nil {
+			return fmt.Errorf("error uploading flatcar-install script: %w", err)
+		}
+	} else {
+		// download install script on remote maschine
+		scriptURL := cfg.Flatcar.installScriptURL()
+		p.logger.Printf("downloading flatcar-install from %s\n", scriptURL)
+		if err := sshClient.runRetry(fmt.Sprintf("curl -fsS -o %s %s", installScriptTarget, shellQuote(scriptURL)), cfg.SSH, retryTimeouts, nil); err != nil {
+			return fmt.Errorf("error downloading install script: %w", err)
+		}
+	}
+	if err := sshClient.uploadContent(cfgJSON, ignitionTarget); err != nil {
+		return fmt.Errorf("error uploading ignition file: %w", err)
+	}
+	if err := uploadFiles(sshClient, cfg.Files.Rescue, cfg.Rescue.path(""), cfg.Rescue.sudo()); err != nil {
+		return err
+	}
+	// the local image is only of the configured version, servers pinning another one download it
+	localImage := cfg.Flatcar.Image != "" && version == cfg.Flatcar.Version && channel == cfg.Flatcar.Channel
+	if localImage {
+		if err := p.uploadImage(sshClient); err != nil {
+			return err
+		}
+	}
+	uploaded()
+
+	// build flatcar-install command
+	var installDeviceArg string
+	if cfg.Flatcar.InstallDevice == "" {
+		installDeviceArg = "-s"
+	} else {
+		installDeviceArg = fmt.Sprintf("-d %s", cfg.Flatcar.InstallDevice)
+	}
+	var channelArg string
+	if channel != "" {
+		channelArg = fmt.Sprintf(" -C %s", channel)
+	}
+	if version != cfg.Flatcar.Version || channel != cfg.Flatcar.Channel {
+		p.logger.Printf("installing flatcar %s%s pinned by the labels of %s\n", version, channelArg, server.Name)
+	}
+	var oemArg string
+	if cfg.Flatcar.OEM != "" {
+		oemArg = fmt.Sprintf(" -o %s", cfg.Flatcar.OEM)
+	}
+	versionArg := fmt.Sprintf("-V %s", version)
+	if !localImage && len(cfg.Flatcar.Mirrors) > 0 {
+		if mirror := p.fastestMirror(sshClient, version, channel); mirror != "" {
+			p.logger.Printf("downloading flatcar from %s\n", mirror)
+			versionArg += fmt.Sprintf(" -b %s", shellQuote(mirror))
+		}
+	}
+	if localImage {
+		// flatcar-install doesn't download anything with -f, the checksum was verified on upload
+		channelArg = ""
+		versionArg = fmt.Sprintf("-f %s", cfg.Rescue.path(imageName))
+	}
+	installCommand := fmt.Sprintf("%s -i %s%s%s %s %s %s", installScriptTarget, ignitionTarget, channelArg, oemArg, versionArg, installDeviceArg, cfg.Flatcar.InstallArgs)
+
+	// execute commands to finally install flatcar, step is the part of the timing summary
+	// flatcar-install isn't retried, it writes the disk
+	commands := []struct {
+		step    string
+		command string
+		retry   retryPolicy
+	}{
+		{"apt", "apt update", retryTimeouts},
+		{"apt", "apt install -y gawk", retryTimeouts},
+		{"install", fmt.Sprintf("chmod +x %s", installScriptTarget), retryTimeouts},
+		{"install", installCommand, retryNever},
+	}
+	if cfg.Rescue.ISO != "" {
+		// the live system of the iso has to bring gawk itself, it isn't necessarily debian based
+		commands = commands[2:]
+	}
+	if cfg.Flatcar.Wipe != "" {
+		wiped := p.timeStep(server.Name, "flatcar_install", "wipe")
+		if err := p.wipeDevice(sshClient, server.Name); err != nil {
+			return err
+		}
+		wiped()
+	}
+	for _, step := range commands {
+		command := step.command
+		done := p.timeStep(server.Name, "flatcar_install", step.step)
+		p.logger.Printf("running command '%s'\n", command)
+		output := func(line string) {
+			p.logger.Printf("%s - %s", command, line)
+		}
+		if command == installCommand {
+			output = p.installOutput(server.Name, command)
+		}
+		if err := sshClient.runRetry(command, cfg.SSH, step.retry, output); err != nil {
+			return fmt.Errorf("error running command '%s': %w", command, err)
+		}
+		done()
+	}
+
+	p.emit(server.Name, eventInstallFinished, nil)
+
+	rebooted := p.timeStep(server.Name, "flatcar_install", "reboot")
+	if detachISO != nil {
+		if err := p.resetFromISO(server, detachISO); err != nil {
+			return err
+		}
+	} else {
+		// run reboot command
+		rebootCommand := "reboot now"
+		if cfg.Rescue.sudo() {
+			rebootCommand = sudoCommand(rebootCommand)
+		}
+		if err := sshClient.run(context.Background(), rebootCommand, nil, nil); err != nil {
+			p.logger.Printf("reboot command failed, VM probably rebooted anyways: %v\n", err)
+		}
+	}
+	rebooted()
+
+	if err := end(server, nil); err != nil {
+		return err
+	}
+	p.emit(server.Name, eventRebooting, nil)
+
+	return p.firstBoot(server, cfgJSON, pinnedHostKey, rescueHostKey, false)
+}
+
+// firstBoot waits for the installed system to come up if anything depends on it or wait is set, records its host key and
+// adds it to the load balancers. previousKey is the host key of the rescue system which the installed system has to replace.
+func (p *provisioner) firstBoot(server *hcloud.Server, cfgJSON []byte, pinnedHostKey ssh.PublicKey, previousKey ssh.PublicKey, wait bool) error {
+	cfg := p.cfg
+	addr, err := p.flatcarAddress(server)
+	if err != nil {
+		return err
+	}
+	// servers are only added to load balancers, get files copied and are exposed once booted,
+	// with console capture the console is captured until the installed system is up
+	// in strict mode the installed system has to present the pinned host key before it's used
+	hostKey := pinnedHostKey
+	waitFirstBoot := wait || (cfg.SSH.KnownHosts != "" && hostKey == nil) || cfg.SSH.StrictHostKeys || cfg.Artifacts.Console || len(cfg.LoadBalancer.Names) > 0 || len(cfg.Files.Host) > 0 || p.delaysExposure()
+	if waitFirstBoot {
+		// only measured if the install waits for the installed system
+		end, err := p.beginPhase(server.Name, server, "first_boot")
+		if err != nil {
+			return err
+		}
+		p.logger.Printf("sleeping %s to wait for server to reboot into flatcar\n", rebootWait)
+		time.Sleep(rebootWait)
+		var algorithms []string
+		if hostKey != nil {
+			// request the pinned key type, flatcar generates the remaining ones on first boot
+			algorithms = []string{hostKey.Type()}
+		}
+		scannedKey, err := waitForHostKey(p.logger, p.dial, addr, previousKey, algorithms...)
+		if err != nil {
+			p.logConsoleHint(server)
+			err = fmt.Errorf("error waiting for first boot: %w", err)
+			p.collectDiagnostics(server, err, cfgJSON)
+			return err
+		}
+		if hostKey == nil {
+			hostKey = scannedKey
+		} else if cfg.SSH.StrictHostKeys && !bytes.Equal(scannedKey.Marshal(), hostKey.Marshal()) {
+			return fmt.Errorf("installed system presents host key %s instead of the pinned %s", ssh.FingerprintSHA256(scannedKey), ssh.FingerprintSHA256(hostKey))
+		}
+		p.emit(server.Name, eventFirstBoot, nil)
+		if err := end(server, nil); err != nil {
+			return err
+		}
+	}
+
+	if cfg.SSH.KnownHosts != "" {
+		if err := updateKnownHosts(cfg.SSH.KnownHosts, addr, hostKey); err != nil {
+			return fmt.Errorf("error updating known hosts: %w", err)
+		}
+		p.logger.Printf("recorded %s host key of %s in %s\n", hostKey.Type(), addr, cfg.SSH.KnownHosts)
+	}
+
+	if len(cfg.Files.Host) > 0 {
+		if err := p.uploadHostFiles(server, hostKey); err != nil {
+			return err
+		}
+	}
+
+	if err := p.addToLoadBalancers(server); err != nil {
+		return err
+	}
+
+	p.logger.Println("------")
+	p.logger.Printf("successfully (re)installed %s, ID: %d, address: %s\n", server.Name, server.ID, addr)
+	return nil
+}
+
+// disableRescue disables the rescue boot of server
+func (p *provisioner) disableRescue(server *hcloud.Server) error {
+	action, _, err := p.client.Server.DisableRescue(context.Background(), server)
+	if err != nil {
+		return fmt.Errorf("error disabling rescue: %w", err)
+	}
+	return waitForAction(p.logger, p.client.Action, action)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// stages of flatcar-install reported as install progress
+const (
+	installStageDownload = "download"
+	installStageWrite    = "write"
+	installStageIgnition = "ignition"
+	installStageDone     = "done"
+)
+
+// installProgress is how far flatcar-install got, parsed from its output
+type installProgress struct {
+	Stage string `json:"stage"`
+	// Percent of the image downloaded, reported by wget
+	Percent int `json:"percent,omitempty"`
+	// Bytes written to the install device, reported by dd
+	Bytes int64 `json:"bytes,omitempty"`
+}
+
+func (progress installProgress) String() string {
+	switch {
+	case progress.Bytes > 0:
+		return fmt.Sprintf("%s %s", progress.Stage, formatBytes(progress.Bytes))
+	case progress.Percent > 0:
+		return fmt.Sprintf("%s %d%%", progress.Stage, progress.Percent)
+	}
+	return progress.Stage
+}
+
+var (
+	// wget's progress, e.g. "  3072K ........ ........  2% 28.5M 14s"
+	percentPattern = regexp.MustCompile(`\s(\d{1,3})%`)
+	// dd's progress and summary, e.g. "1073741824 bytes (1.1 GB, 1.0 GiB) copied, 5 s, 215 MB/s"
+	bytesPattern = regexp.MustCompile(`^(\d+) bytes .*copied`)
+)
+
+// installProgressParser follows the progress of flatcar-install line by line
+type installProgressParser struct {
+	current installProgress
+}
+
+// parse updates the progress with a line of output, changed reports whether it did and
+// meter whether the line is only a progress meter not worth logging
+func (parser *installProgressParser) parse(line string) (changed bool, meter bool) {
+	// progress meters redraw their line with carriage returns, only the last state matters
+	line = strings.TrimRight(line, "\r")
+	if i := strings.LastIndex(line, "\r"); i >= 0 {
+		line = line[i+1:]
+	}
+	line = strings.TrimSpace(line)
+	next := parser.current
+	switch {
+	case strings.HasPrefix(line, "Downloading"):
+		next = installProgress{Stage: installStageDownload}
+	case strings.HasPrefix(line, "Writing"):
+		next = installProgress{Stage: installStageWrite}
+	case strings.HasPrefix(line, "Installing Ignition config"):
+		next = installProgress{Stage: installStageIgnition}
+	case strings.HasPrefix(line, "Success!"):
+		next = installProgress{Stage: installStageDone}
+	default:
+		if match := bytesPattern.FindStringSubmatch(line); match != nil {
+			meter = true
+			next.Bytes, _ = strconv.ParseInt(match[1], 10, 64)
+			if next.Stage == "" {
+				next.Stage = installStageWrite
+			}
+		} else if match := percentPattern.FindStringSubmatch(" " + line); match != nil && next.Stage == installStageDownload {
+			meter = true
+			if percent, _ := strconv.Atoi(match[1]); percent <= 100 && percent > next.Percent {
+				next.Percent = percent
+			}
+		}
+	}
+	if next == parser.current {
+		return false, meter
+	}
+	parser.current = next
+	return true, meter
+}
+
+// installOutput returns the output handler of the flatcar-install command on serverName: progress meters are
+// turned into install-progress events and only logged at every 10% or stage, other lines are logged as they are
+func (p *provisioner) installOutput(serverName string, command string) func(line string) {
+	parser := &installProgressParser{}
+	var logged installProgress
+	return func(line string) {
+		changed, meter := parser.parse(line)
+		if !meter {
+			p.logger.Printf("%s - %s", command, line)
+		}
+		if !changed {
+			return
+		}
+		progress := parser.current
+		p.emitProgress(serverName, progress)
+		if meter && progress.Stage == logged.Stage && progress.Percent/10 == logged.Percent/10 && progress.Bytes == logged.Bytes {
+			return
+		}
+		if meter {
+			p.logger.Printf("install progress of %s: %s\n", serverName, progress)
+		}
+		logged = progress
+	}
+}
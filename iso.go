@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// attachISO attaches the configured ISO to server instead of enabling rescue. The returned cleanup detaches it
+// again, it has to run before the installed system boots, otherwise the server keeps booting the ISO.
+func (p *provisioner) attachISO(server *hcloud.Server) (*cleanup, error) {
+	iso, _, err := p.client.ISO.Get(context.Background(), p.cfg.Rescue.ISO)
+	if err != nil {
+		return nil, fmt.Errorf("error finding iso: %w", err)
+	}
+	if iso == nil {
+		return nil, fmt.Errorf("iso %s doesn't exist", p.cfg.Rescue.ISO)
+	}
+	p.logger.Printf("attaching iso %s\n", iso.Name)
+	action, _, err := p.client.Server.AttachISO(context.Background(), server, iso)
+	if err != nil {
+		return nil, fmt.Errorf("error attaching iso: %w", err)
+	}
+	if err := waitForAction(p.logger, p.client.Action, action); err != nil {
+		return nil, fmt.Errorf("error attaching iso: %w", err)
+	}
+	return cleanups.push("detach iso from "+server.Name, func() error {
+		return p.detachISO(server)
+	}), nil
+}
+
+// detachISO detaches the ISO from server
+func (p *provisioner) detachISO(server *hcloud.Server) error {
+	p.logger.Printf("detaching iso from %s\n", server.Name)
+	action, _, err := p.client.Server.DetachISO(context.Background(), server)
+	if err != nil {
+		return fmt.Errorf("error detaching iso: %w", err)
+	}
+	return waitForAction(p.logger, p.client.Action, action)
+}
+
+// resetFromISO detaches the ISO and resets server, so it boots the installed system from disk.
+// The live system of the ISO might not survive the ISO being detached, so it isn't rebooted from within.
+func (p *provisioner) resetFromISO(server *hcloud.Server, detach *cleanup) error {
+	detach.discard()
+	if err := p.detachISO(server); err != nil {
+		return err
+	}
+	return p.resetServer(server)
+}
+
+// resetServer resets server and waits for the action
+func (p *provisioner) resetServer(server *hcloud.Server) error {
+	action, _, err := p.client.Server.Reset(context.Background(), server)
+	if err != nil {
+		return fmt.Errorf("error resetting server: %w", err)
+	}
+	return waitForAction(p.logger, p.client.Action, action)
+}
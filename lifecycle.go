@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/crypto/ssh"
+)
+
+// runRemoteShutdown runs a shutdown command like systemctl reboot on the server, the connection closing is expected
+func (p *provisioner) runRemoteShutdown(server *hcloud.Server, command string) error {
+	sshClient, err := p.connect(server)
+	if err != nil {
+		return err
+	}
+	defer sshClient.Close()
+	p.logger.Printf("running '%s' on server '%s'\n", command, server.Name)
+	_, err = sshClient.output(context.Background(), command)
+	var exitMissing *ssh.ExitMissingError
+	if err != nil && !errors.As(err, &exitMissing) {
+		return fmt.Errorf("error running '%s': %w", command, err)
+	}
+	return nil
+}
+
+// waitForPoweroff polls the server until it's off or the timeout is exceeded
+func (p *provisioner) waitForPoweroff(server *hcloud.Server, timeout time.Duration) (bool, error) {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		current, _, err := p.client.Server.GetByID(context.Background(), server.ID)
+		if err != nil {
+			return false, fmt.Errorf("error requesting server status: %w", err)
+		}
+		if current == nil {
+			return false, fmt.Errorf("server %s vanished", server.Name)
+		}
+		if current.Status == hcloud.ServerStatusOff {
+			return true, nil
+		}
+		time.Sleep(5 * time.Second)
+	}
+	return false, nil
+}
+
+// reboot reboots the server via ACPI or, if viaSSH is set, via systemctl reboot
+func (p *provisioner) reboot(serverName string, viaSSH bool) error {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	if viaSSH {
+		return p.runRemoteShutdown(server, "sudo systemctl reboot")
+	}
+	p.logger.Printf("rebooting server '%s'\n", serverName)
+	action, _, err := p.client.Server.Reboot(context.Background(), server)
+	if err != nil {
+		return fmt.Errorf("error rebooting server: %w", err)
+	}
+	return waitForAction(p.logger, p.client.Action, action)
+}
+
+// poweroff shuts the server down via ACPI or, if viaSSH is set, via systemctl poweroff and powers it off hard if it's still running after timeout
+func (p *provisioner) poweroff(serverName string, viaSSH bool, timeout time.Duration) error {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	if server.Status == hcloud.ServerStatusOff {
+		p.logger.Printf("server '%s' is already off\n", serverName)
+		return nil
+	}
+	if viaSSH {
+		if err := p.runRemoteShutdown(server, "sudo systemctl poweroff"); err != nil {
+			return err
+		}
+	} else {
+		p.logger.Printf("shutting down server '%s'\n", serverName)
+		action, _, err := p.client.Server.Shutdown(context.Background(), server)
+		if err != nil {
+			return fmt.Errorf("error shutting down server: %w", err)
+		}
+		if err := waitForAction(p.logger, p.client.Action, action); err != nil {
+			return err
+		}
+	}
+	off, err := p.waitForPoweroff(server, timeout)
+	if err != nil || off {
+		return err
+	}
+	p.logger.Printf("server '%s' is still running after %s, powering off\n", serverName, timeout)
+	action, _, err := p.client.Server.Poweroff(context.Background(), server)
+	if err != nil {
+		return fmt.Errorf("error powering off server: %w", err)
+	}
+	return waitForAction(p.logger, p.client.Action, action)
+}
+
+// runLifecycle implements the reboot and poweroff subcommands
+func runLifecycle(name string, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	common := addCommonFlags(fs)
+	selector := addSelectorFlag(fs)
+	concurrency := fs.Int("concurrency", 1, "maximum number of servers handled at once")
+	viaSSH := fs.Bool("ssh", false, "shut down gracefully via systemctl over ssh instead of ACPI")
+	timeout := fs.Duration("timeout", 2*time.Minute, "time to wait for a graceful poweroff before powering off hard")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	fs.Parse(args)
+	if fs.NArg() == 0 && *selector == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	serverNames, err := p.resolveServerNames(fs.Args(), *selector)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if !*yes && !confirm(fmt.Sprintf("%s %s?", name, strings.Join(serverNames, ", "))) {
+		fatalf("aborted\n")
+	}
+	errs := forEachServer(serverNames, *concurrency, func(serverName string) error {
+		if name == "reboot" {
+			return p.reboot(serverName, *viaSSH)
+		}
+		return p.poweroff(serverName, *viaSSH, *timeout)
+	})
+	if len(errs) > 0 {
+		printErrors(os.Stderr, errs)
+		fatalf("%s failed on %d of %d servers\n", name, len(errs), len(serverNames))
+	}
+}
+
+func runReboot(args []string) {
+	runLifecycle("reboot", args)
+}
+
+func runPoweroff(args []string) {
+	runLifecycle("poweroff", args)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// lintConfig contains the parts of ignition configs checked by lintIgnition, they are the same in spec v2 and v3
+type lintConfig struct {
+	Networkd struct {
+		Units []struct {
+			Name string `json:"name"`
+		} `json:"units"`
+	} `json:"networkd"`
+	Passwd struct {
+		Users []struct {
+			Name              string   `json:"name"`
+			SSHAuthorizedKeys []string `json:"sshAuthorizedKeys"`
+		} `json:"users"`
+	} `json:"passwd"`
+	Storage struct {
+		Files []struct {
+			Path string `json:"path"`
+		} `json:"files"`
+	} `json:"storage"`
+}
+
+// lintIgnition checks the ignition config for mistakes likely to lock out the user after the disk has been wiped
+func lintIgnition(rendered renderedIgnition, server *hcloud.Server) ([]string, error) {
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return nil, err
+	}
+	var ignitionConfig lintConfig
+	if err := json.Unmarshal(cfgJSON, &ignitionConfig); err != nil {
+		return nil, fmt.Errorf("error parsing ignition config: %w", err)
+	}
+
+	var warnings []string
+
+	coreHasKeys := false
+	for _, user := range ignitionConfig.Passwd.Users {
+		if user.Name == "core" && len(user.SSHAuthorizedKeys) > 0 {
+			coreHasKeys = true
+		}
+	}
+	if !coreHasKeys {
+		warnings = append(warnings, "no ssh authorized keys for user core")
+	}
+
+	if server.PublicNet.IPv4.IP == nil || server.PublicNet.IPv4.IP.IsUnspecified() {
+		hasNetworkConfig := len(ignitionConfig.Networkd.Units) > 0
+		for _, file := range ignitionConfig.Storage.Files {
+			if strings.HasPrefix(file.Path, "/etc/systemd/network/") {
+				hasNetworkConfig = true
+			}
+		}
+		if !hasNetworkConfig {
+			warnings = append(warnings, "server has no public ipv4 but no networkd config for the private interface")
+		}
+	}
+
+	seenPaths := map[string]bool{}
+	for _, file := range ignitionConfig.Storage.Files {
+		if seenPaths[file.Path] {
+			warnings = append(warnings, fmt.Sprintf("file %s is defined multiple times", file.Path))
+		}
+		seenPaths[file.Path] = true
+	}
+
+	return warnings, nil
+}
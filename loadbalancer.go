@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// healthPollInterval is the interval the health status of new load balancer targets is polled in
+var healthPollInterval = 5 * time.Second
+
+func (p *provisioner) loadBalancer(name string) (*hcloud.LoadBalancer, error) {
+	loadBalancer, _, err := p.client.LoadBalancer.GetByName(context.Background(), name)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting load balancer %s: %w", name, err)
+	}
+	if loadBalancer == nil {
+		return nil, fmt.Errorf("load balancer %s doesn't exist", name)
+	}
+	return loadBalancer, nil
+}
+
+// findTarget returns the target of loadBalancer pointing directly at server
+func findTarget(loadBalancer *hcloud.LoadBalancer, server *hcloud.Server) (hcloud.LoadBalancerTarget, bool) {
+	for _, target := range loadBalancer.Targets {
+		if target.Type == hcloud.LoadBalancerTargetTypeServer && target.Server.Server.ID == server.ID {
+			return target, true
+		}
+	}
+	return hcloud.LoadBalancerTarget{}, false
+}
+
+// removeFromLoadBalancers removes server from the configured load balancers and waits for the drain delay if it was a target of any
+func (p *provisioner) removeFromLoadBalancers(server *hcloud.Server) error {
+	conf := p.cfg.LoadBalancer
+	removed := false
+	for _, name := range conf.Names {
+		loadBalancer, err := p.loadBalancer(name)
+		if err != nil {
+			return err
+		}
+		if _, ok := findTarget(loadBalancer, server); !ok {
+			continue
+		}
+		p.logger.Printf("removing %s from load balancer %s\n", server.Name, name)
+		action, _, err := p.client.LoadBalancer.RemoveServerTarget(context.Background(), loadBalancer, server)
+		if err != nil {
+			return fmt.Errorf("error removing target from load balancer %s: %w", name, err)
+		}
+		if err := waitForAction(p.logger, p.client.Action, action); err != nil {
+			return fmt.Errorf("error waiting for action: %w", err)
+		}
+		removed = true
+	}
+	if removed {
+		drainDelay, _ := time.ParseDuration(conf.DrainDelay)
+		p.logger.Printf("waiting %s for connections to drain\n", drainDelay)
+		time.Sleep(drainDelay)
+	}
+	return nil
+}
+
+// addToLoadBalancers adds server as target to the configured load balancers and waits until their health checks pass
+func (p *provisioner) addToLoadBalancers(server *hcloud.Server) error {
+	conf := p.cfg.LoadBalancer
+	for _, name := range conf.Names {
+		loadBalancer, err := p.loadBalancer(name)
+		if err != nil {
+			return err
+		}
+		if _, ok := findTarget(loadBalancer, server); !ok {
+			p.logger.Printf("adding %s to load balancer %s\n", server.Name, name)
+			action, _, err := p.client.LoadBalancer.AddServerTarget(context.Background(), loadBalancer, hcloud.LoadBalancerAddServerTargetOpts{
+				Server:       server,
+				UsePrivateIP: hcloud.Bool(conf.UsePrivateIP),
+			})
+			if err != nil {
+				return fmt.Errorf("error adding target to load balancer %s: %w", name, err)
+			}
+			if err := waitForAction(p.logger, p.client.Action, action); err != nil {
+				return fmt.Errorf("error waiting for action: %w", err)
+			}
+		}
+		if err := p.waitForHealthy(name, server); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waitForHealthy polls the load balancer until all its services report server as healthy
+func (p *provisioner) waitForHealthy(name string, server *hcloud.Server) error {
+	healthTimeout, _ := time.ParseDuration(p.cfg.LoadBalancer.HealthTimeout)
+	deadline := time.Now().Add(healthTimeout)
+	for {
+		loadBalancer, err := p.loadBalancer(name)
+		if err != nil {
+			return err
+		}
+		target, ok := findTarget(loadBalancer, server)
+		if !ok {
+			return fmt.Errorf("%s isn't a target of load balancer %s anymore", server.Name, name)
+		}
+		healthy := true
+		for _, status := range target.HealthStatus {
+			if status.Status != hcloud.LoadBalancerTargetHealthStatusStatusHealthy {
+				healthy = false
+			}
+		}
+		if healthy {
+			p.logger.Printf("%s is healthy on load balancer %s\n", server.Name, name)
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s didn't become healthy on load balancer %s within %s", server.Name, name, healthTimeout)
+		}
+		time.Sleep(healthPollInterval)
+	}
+}
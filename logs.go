@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// journalctlCommand builds the journalctl command line for the logs subcommand
+func journalctlCommand(units []string, follow bool, lines int) string {
+	args := []string{"journalctl", "--no-pager"}
+	for _, unit := range units {
+		args = append(args, "-u", shellQuote(unit))
+	}
+	if follow {
+		args = append(args, "-f")
+	}
+	if lines > 0 {
+		args = append(args, "-n", strconv.Itoa(lines))
+	}
+	return strings.Join(args, " ")
+}
+
+// connectRescue establishes a ssh connection as rescue.user to the rescue system of the server.
+// The host key can't be verified because the rescue system generates a new one on every boot.
+func (p *provisioner) connectRescue(serverName string) (*sshClient, error) {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return nil, fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return nil, fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	sshAuth, err := buildSSHAuth(p.cfg.HCloud)
+	if err != nil {
+		return nil, fmt.Errorf("error building ssh authentication: %w", err)
+	}
+	addr, err := p.rescueAddress(server)
+	if err != nil {
+		return nil, err
+	}
+	var hostKey ssh.PublicKey
+	return sshConnect(p.dial, sshTarget{
+		User:      p.cfg.Rescue.user(),
+		Addr:      addr,
+		Port:      22,
+		Auth:      sshAuth,
+		Callback:  recordHostKey(&hostKey),
+		Keepalive: p.keepalive,
+	})
+}
+
+// runLogs streams the journal of a server
+func runLogs(args []string) {
+	fs := flag.NewFlagSet("logs", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	units := stringListFlag{}
+	fs.Var(&units, "u", "only show logs of this unit, can be repeated")
+	follow := fs.Bool("f", false, "follow the journal")
+	lines := fs.Int("n", 0, "number of most recent lines to show (default all, 10 with -f)")
+	rescue := fs.Bool("rescue", false, "show the journal of the rescue system, e.g. during an install")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	serverName := fs.Arg(0)
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+
+	command := journalctlCommand(units, *follow, *lines)
+	var sshClient *sshClient
+	if *rescue {
+		sshClient, err = p.connectRescue(serverName)
+		if p.cfg.Rescue.sudo() {
+			command = "sudo " + command
+		}
+	} else {
+		sshClient, err = p.connectByName(serverName)
+		command = "sudo " + command
+	}
+	if err != nil {
+		fatalf("error connecting to %s: %v\n", serverName, err)
+	}
+	defer sshClient.Close()
+	if err := sshClient.run(context.Background(), command, os.Stdout, os.Stderr); err != nil {
+		var exitError *ssh.ExitError
+		if errors.As(err, &exitError) {
+			os.Exit(exitError.ExitStatus())
+		}
+		fatalf("error running journalctl: %v\n", err)
+	}
+}
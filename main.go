@@ -1,58 +1,26 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
 	"context"
-	"encoding/json"
-	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
 	"log"
-	"net"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strings"
-	"text/template"
+	"sync"
 	"time"
 
-	clconfig "github.com/flatcar/container-linux-config-transpiler/config"
 	"github.com/hetznercloud/hcloud-go/hcloud"
-	"github.com/melbahja/goph"
-	"gopkg.in/yaml.v3"
 )
 
-var installScriptSource = "https://raw.githubusercontent.com/flatcar-linux/init/flatcar-master/bin/flatcar-install"
+// defaultInstallScriptURL is the flatcar-install script downloaded by default, {ref} is replaced by the install script ref
+const defaultInstallScriptURL = "https://raw.githubusercontent.com/flatcar-linux/init/{ref}/bin/flatcar-install"
 
-func transpileConfig(input []byte) (string, error) {
-	cfg, pt, report := clconfig.Parse(input)
-	if report.IsFatal() {
-		return "", errors.New("config parsing failed")
-	}
-	transpiledConfig, report := clconfig.Convert(cfg, "", pt)
-	if report.IsFatal() {
-		return "", errors.New("config conversion failed")
-	}
-	cfgJSON, err := json.Marshal(&transpiledConfig)
-	if err != nil {
-		return "", err
-	}
-
-	outFile, err := os.CreateTemp(os.TempDir(), "ignition")
-	if err != nil {
-		return "", err
-	}
-
-	if _, err := outFile.Write(cfgJSON); err != nil {
-		return "", err
-	}
-	return outFile.Name(), nil
-}
+// defaultInstallScriptRef is the branch, tag or commit of flatcar-install used by default
+const defaultInstallScriptRef = "flatcar-master"
 
 // waitForAction queries the current state of an action every second and waits for it to complete
-func waitForAction(actionClient hcloud.ActionClient, action *hcloud.Action) error {
-	log.Printf("waiting for action %s to complete\n", action.Command)
+func waitForAction(logger *log.Logger, actionClient hcloud.ActionClient, action *hcloud.Action) error {
+	logger.Printf("waiting for action %s to complete\n", action.Command)
 	progressChannel, errorChannel := actionClient.WatchProgress(context.Background(), action)
 	success := false
 	for progress := range progressChannel {
@@ -68,378 +36,250 @@ func waitForAction(actionClient hcloud.ActionClient, action *hcloud.Action) erro
 	return err
 }
 
-type templateData struct {
-	Server   hcloud.Server
-	SSHKey   hcloud.SSHKey
-	Static   map[string]string
-	ReadFile func(string) (string, error)
-	Indent   func(int, string) string
-}
-
-type customTemplateDataHetzner struct {
-	Server hcloud.Server
-	SSHKey hcloud.SSHKey
+// waitForActions waits for all actions concurrently and returns the error of the first failed one
+func waitForActions(logger *log.Logger, actionClient hcloud.ActionClient, actions []*hcloud.Action) error {
+	errs := make([]error, len(actions))
+	var wg sync.WaitGroup
+	for i, action := range actions {
+		wg.Add(1)
+		go func(i int, action *hcloud.Action) {
+			defer cleanups.recoverPanic()
+			defer wg.Done()
+			errs[i] = waitForAction(logger, actionClient, action)
+		}(i, action)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-type customTemplateData struct {
-	Hetzner customTemplateDataHetzner
+// commands are the subcommands, running without one provisions the given servers
+var commands = map[string]func(args []string){
+	"serve":       runServe,
+	"import":      runImport,
+	"status":      runStatus,
+	"destroy":     runDestroy,
+	"rollback":    runRollback,
+	"history":     runHistory,
+	"diff":        runDiff,
+	"prune":       runPrune,
+	"exec":        runExec,
+	"reboot":      runReboot,
+	"poweroff":    runPoweroff,
+	"logs":        runLogs,
+	"console":     runConsole,
+	"version":     runVersion,
+	"self-update": runSelfUpdate,
+	"doctor":      runDoctor,
+	"config":      runConfig,
+	"wait":        runWait,
 }
 
 func main() {
-	// TODO: cli parser...
-	if len(os.Args) == 1 {
-		fmt.Printf("%s <server name>\n", os.Args[0])
-		os.Exit(1)
-	}
-	cfg, err := ParseConfig("config.toml")
-	if err != nil {
-		log.Fatalf("error parsing config: %v\n", err)
-	}
-
-	serverName := os.Args[1]
-
-	client := hcloud.NewClient(hcloud.WithToken(cfg.HCloud.Token))
-
-	// find ssh key
-	sshKeyName := cfg.HCloud.SSHKey
-	sshKey, _, err := client.SSHKey.GetByName(context.Background(), sshKeyName)
-	if err != nil {
-		log.Fatalf("error requesting ssh key: %v\n", err)
-	}
-	if sshKey == nil {
-		log.Fatalf("ssh key %s doesn't exist\n", sshKeyName)
-	}
-
-	// find private network
-	privateNetworkName := cfg.HCloud.PrivateNetwork
-	privateNetwork, _, err := client.Network.GetByName(context.Background(), privateNetworkName)
-	if err != nil {
-		log.Fatalf("error requesting network: %v\n", err)
-	}
-	if privateNetwork == nil {
-		log.Fatalf("network %s doesn't exist\n", privateNetworkName)
-	}
-
-	serverExists := true
-	server, _, err := client.Server.GetByName(context.Background(), serverName)
-	if err != nil {
-		log.Fatalf("error finding server: %v\n", err)
-	}
-	if server == nil {
-		serverExists = false
-	}
-
-	if serverExists {
-		log.Printf("server '%s' (id %d) already exists, checking for necessary changes\n", serverName, server.ID)
-		// check if redeploy is necessary -- fetching user data afterwards not possible, maybe cache locally/connect to server?
-		// TODO: check if specification matches
-		// TODO: support more than one network?
-		// TODO: disable if network doesn't exist / not given
-		privateNetworkAttached := false
-		for _, attachedPrivateNet := range server.PrivateNet {
-			if attachedPrivateNet.Network.ID == privateNetwork.ID {
-				privateNetworkAttached = true
-				break
-			}
-		}
-		if !privateNetworkAttached {
-			// attach to private network
-			action, _, err := client.Server.AttachToNetwork(context.Background(), server, hcloud.ServerAttachToNetworkOpts{
-				Network: privateNetwork,
-			})
-			if err != nil {
-				log.Fatalf("error request attach to network: %v\n", err)
-			}
-			if action.Error() != nil {
-				log.Fatalf("error attaching server to network: %v\n", action.Error())
-			}
-			log.Printf("attached server to network %s\n", privateNetworkName)
-		}
-	} else {
-		log.Printf("creating server '%s'", serverName)
-		// create server
-		startAfterCreate := false
-		serverType, _, err := client.ServerType.GetByName(context.Background(), cfg.HCloud.ServerType)
-		if err != nil {
-			log.Fatalf("error finding server type: %v\n", err)
-		}
-		image, _, err := client.Image.Get(context.Background(), cfg.HCloud.Image)
-		if err != nil {
-			log.Fatalf("error finding image: %v\n", err)
-		}
-		location, _, err := client.Location.GetByName(context.Background(), cfg.HCloud.Location)
-		if err != nil {
-			log.Fatalf("error finding location: %v\n", err)
-		}
-		createOpts := hcloud.ServerCreateOpts{
-			Name:             serverName,
-			StartAfterCreate: &startAfterCreate,
-			ServerType:       serverType,
-			Image:            image,
-			Location:         location,
-			SSHKeys:          []*hcloud.SSHKey{sshKey},
-			Networks:         []*hcloud.Network{privateNetwork},
-		}
-		serverCreateResult, _, err := client.Server.Create(context.Background(), createOpts)
-		if err != nil {
-			log.Fatalf("error creating server: %v\n", err)
-		}
-		if serverCreateResult.Action.Error() != nil {
-			log.Fatalf("error creating server: %v\n", serverCreateResult.Action.Error())
-		}
-
-		err = waitForAction(client.Action, serverCreateResult.Action)
-		if err != nil {
-			log.Fatalf("error waiting for action: %v\n", err)
-		}
-
-		for _, pastCreateAction := range serverCreateResult.NextActions {
-			err = waitForAction(client.Action, pastCreateAction)
-			if err != nil {
-				log.Fatalf("error waiting for action: %v\n", err)
-			}
+	setLogOutput(os.Stderr)
+	cleanups.handleSignals()
+	defer cleanups.recoverPanic()
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
 		}
+	}
 
-		// update server object for templating
-		server, _, err = client.Server.GetByID(context.Background(), serverCreateResult.Server.ID)
+	common := addCommonFlags(flag.CommandLine)
+	watch := flag.Bool("watch", false, "keep running and reconcile the given servers periodically")
+	watchInterval := flag.Duration("interval", 10*time.Minute, "interval between reconciliations in watch mode")
+	watchListen := flag.String("listen", ":8080", "address of the health and status endpoint in watch mode, empty to disable")
+	selector := addSelectorFlag(flag.CommandLine)
+	count := flag.Int("count", 0, "provision <name>-1 to <name>-<count> for every given name without a range")
+	dryRun := flag.Bool("dry-run", false, "print the planned actions and costs without changing anything")
+	fixDrift := flag.Bool("fix-drift", false, "reinstall servers whose applied config differs from the rendered one in watch mode")
+	serversFile := flag.String("servers-file", "", "read newline separated server names from this file, - for stdin")
+	concurrency := flag.Int("concurrency", 1, "maximum number of servers provisioned at once")
+	keepGoing := flag.Bool("keep-going", false, "keep provisioning the remaining servers after a failure")
+	jsonSummary := flag.Bool("json", false, "print a JSON summary with the result of every server")
+	healthcheckURL := flag.String("healthcheck-url", "", "url pinged after every reconciliation in watch mode, with /fail appended on errors (healthchecks.io style)")
+	reportPath := flag.String("report", "", "write a report of the run with plan, ignition diffs, command transcripts and timings to this file (.md or .html)")
+	canary := flag.String("canary", "", "provision this number (e.g. 1) or percentage (e.g. 10%) of servers first and only continue if they're healthy, overrides rollout.canary")
+	soak := flag.Duration("soak", -1, "time waited after provisioning the canaries before checking their health, overrides rollout.soak")
+	progressMode := flag.String("progress", progressAuto, "show a progress table instead of log lines (auto: if stderr is a terminal, always or never)")
+	at := flag.String("at", "", "only reinstall drifted servers after this time in watch mode, e.g. 2024-05-03T02:00Z")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "%s [flags] [--selector <selector>] [--servers-file <file>] [--canary <n|n%%> [--soak <duration>]] [server name...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s serve [flags]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s import [flags] <server name>...\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s status [flags] [--selector <selector>] [server name...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s destroy [flags] [--selector <selector>] [server name...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s rollback [flags] [--snapshot <id> | --list | --to <revision>] <server name>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s history [flags] [--runs | --audit [--result <result>] [--since <duration>] [--json]] <server name>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s prune [flags] [--dry-run]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s diff [flags] [--selector <selector>] [server name...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s exec [flags] [--selector <selector>] [server name...] -- <command>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s wait [flags] [--for ssh|unit:<name>|http:<url>]... [--timeout <duration>] [--selector <selector>] [server name...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s logs [flags] [-u <unit>] [-f] [--rescue] <server name>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s console [flags] [--open | --screenshot <file>] <server name>\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s reboot|poweroff [flags] [--selector <selector>] [server name...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s doctor [flags] [server name]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s config schema\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s version [--json]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "%s self-update [--check] [--version <tag>] [--yes]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	args := flag.Args()
+	if *serversFile != "" {
+		fileNames, err := readServerNames(*serversFile, os.Stdin)
 		if err != nil {
-			log.Fatalf("error requesting updated server object: %v\n", err)
+			fatalf("%v\n", err)
 		}
+		args = append(args, fileNames...)
+	}
+	if len(args) == 0 && *selector == "" {
+		flag.Usage()
+		os.Exit(1)
 	}
 
-	var templateContent []byte
-	if cfg.Flatcar.TemplateCommand == "" {
-		ignitionTemplate := cfg.Flatcar.ConfigTemplate
-		log.Printf("rendering ignition config using native template at %s\n", ignitionTemplate)
-		buffer := &bytes.Buffer{}
-		tmpl, err := template.New(filepath.Base(ignitionTemplate)).ParseFiles(ignitionTemplate)
-		if err != nil {
-			log.Fatalf("error loading template: %v\n", err)
-		}
-		err = tmpl.Execute(buffer, templateData{
-			Server: *server,
-			SSHKey: *sshKey,
-			Static: cfg.Flatcar.TemplateStatic,
-			ReadFile: func(filename string) (string, error) {
-				content, err := ioutil.ReadFile(filename)
-				return string(content), err
-			},
-			Indent: func(indent int, input string) string {
-				lines := strings.Split(input, "\n")
-				output := make([]string, len(lines))
-				indentString := strings.Repeat(" ", indent)
-				for i := 0; i < len(output); i++ {
-					output[i] = indentString + lines[i]
-				}
-				return strings.Join(output, "\n")
-			},
-		})
+	if *watch {
+		notBefore, err := parseAt(*at)
 		if err != nil {
-			log.Fatalf("error rendering template: %v\n", err)
-		}
-
-		templateContent, _ = ioutil.ReadAll(buffer)
-	} else {
-		log.Printf("rendering ignition config using command '%s'\n", cfg.Flatcar.TemplateCommand)
-
-		// marshal template data for passing it to the custom command
-		templateData := customTemplateData{
-			Hetzner: customTemplateDataHetzner{
-				Server: *server,
-				SSHKey: *sshKey,
-			},
+			fatalf("%v\n", err)
 		}
-		templateDataYAML, err := yaml.Marshal(templateData)
-		if err != nil {
-			log.Fatalf("error marshaling hcloud data to yaml: %v\n", err)
+		w := &watcher{
+			load:        common.loadProvisioner,
+			serverNames: withCount(args, *count),
+			selector:    *selector,
+			interval:    *watchInterval,
+			fixDrift:    *fixDrift,
+			at:          notBefore,
+			healthcheck: *healthcheckURL,
 		}
-
-		// execute custom template command
-		tmplCmd := exec.Command(cfg.Flatcar.TemplateCommand, server.Name)
-		tmplCmd.Stdin = bytes.NewReader(templateDataYAML)
-		templateContent, err = tmplCmd.Output()
-		if err != nil {
-			log.Println(string(err.(*exec.ExitError).Stderr))
-			log.Fatalf("error running template command: %v\n", err)
+		if *watchListen != "" {
+			go w.serve(*watchListen)
 		}
+		w.run()
+		return
 	}
 
-	renderedPath, err := transpileConfig(templateContent)
+	p, err := common.loadProvisioner()
 	if err != nil {
-		log.Fatalf("error transpiling config: %v\n", err)
+		fatalf("%v\n", err)
 	}
-
-	defer func(path string) {
-		if err := os.Remove(path); err != nil {
-			log.Fatalf("error removing tempfile: %v\n", err)
-		}
-	}(renderedPath)
-
-	// enable rescue boot
-	if !server.RescueEnabled {
-		log.Println("enabling rescue boot")
-		result, _, err := client.Server.EnableRescue(context.Background(), server, hcloud.ServerEnableRescueOpts{
-			Type:    hcloud.ServerRescueTypeLinux64,
-			SSHKeys: []*hcloud.SSHKey{sshKey},
-		})
+	serverNames, err := p.resolveServerNames(withCount(args, *count), *selector)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if *reportPath != "" {
+		p.report = newReport()
+	}
+	if *dryRun || p.report != nil {
+		entries, err := p.plan(serverNames)
 		if err != nil {
-			log.Fatalf("error sending enablerescue request: %v\n", err)
+			fatalf("error planning: %v\n", err)
 		}
-		if result.Action.Error() != nil {
-			log.Fatalf("error enabling rescue: %v\n", result.Action.Error())
+		if err := p.report.setPlan(entries); err != nil {
+			fatalf("error adding plan to report: %v\n", err)
 		}
-
-		err = waitForAction(client.Action, result.Action)
-		if err != nil {
-			log.Fatalf("error waiting for action: %v\n", err)
+		if *dryRun {
+			if err := printPlan(os.Stdout, entries); err != nil {
+				fatalf("error printing plan: %v\n", err)
+			}
+			if p.privateNetworkMissing() {
+				fmt.Printf("network %s doesn't exist and will be created\n", p.cfg.HCloud.PrivateNetwork)
+			}
+			if p.report != nil {
+				if err := p.report.write(*reportPath, p.revision); err != nil {
+					fatalf("%v\n", err)
+				}
+			}
+			return
 		}
 	}
-
-	var action *hcloud.Action
-	if server.Status == hcloud.ServerStatusRunning {
-		// server is already running, reboot into rescue
-		log.Println("server already running, rebooting into rescue for reinstall")
-		action, _, err = client.Server.Reboot(context.Background(), server)
-	} else {
-		log.Printf("powering server on")
-		action, _, err = client.Server.Poweron(context.Background(), server)
+	// a read-only token fails before the servers are started, not on each of them
+	if err := p.checkWriteAccess(); err != nil {
+		fatalf("%v\n", err)
 	}
-	if err != nil {
-		log.Fatalf("error sending reboot or poweron request: %v\n", err)
+	if *canary != "" {
+		p.cfg.Rollout.Canary = *canary
 	}
-	if action.Error() != nil {
-		log.Fatalf("error rebooting or powering on server: %v\n", action.Error())
-	}
-
-	err = waitForAction(client.Action, action)
+	canaries, err := canaryCount(p.cfg.Rollout.Canary, len(serverNames))
 	if err != nil {
-		log.Fatalf("error waiting for action: %v\n", err)
-	}
-
-	// give the server some time to (re)boot
-	log.Println("sleeping 30s to wait for server to (re)boot into rescue")
-	time.Sleep(30 * time.Second)
-
-	var sshAuth goph.Auth
-	if cfg.HCloud.SSHKeyPrivatePath != "" {
-		sshAuth, err = goph.Key(cfg.HCloud.SSHKeyPrivatePath, "")
-	} else {
-		sshAuth, err = goph.UseAgent()
+		fatalf("%v\n", err)
 	}
+	showProgress, err := useProgress(*progressMode)
 	if err != nil {
-		log.Fatalf("error building ssh authentication: %v\n", err)
+		fatalf("%v\n", err)
 	}
-
-	initialRetries := 30
-	retries := 1
-	connectionSuccess := false
-	retryDelay := 10 * time.Second
-	var sshClient *goph.Client
-	for retries <= initialRetries {
-		// TODO: add option to enable host key checking, will be random, though because rescue always has a different hostkey
-		var addr string
-		if ip := server.PublicNet.IPv4.IP; ip != nil {
-			addr = ip.String()
-		} else {
-			addr = fmt.Sprintf("%s2", server.PublicNet.IPv6.IP.String())
+	if showProgress {
+		if p.progress, err = startProgress(serverNames); err != nil {
+			fatalf("%v\n", err)
 		}
-		// rescue os always uses ::2
-		sshClient, err = goph.NewUnknown("root", addr, sshAuth)
-		if err == nil {
-			connectionSuccess = true
-			break
-		} else {
-			if netError, ok := err.(net.Error); ok {
-				log.Printf("retrying network error (%d/%d): %v\n", retries, initialRetries, netError)
-				retries++
-				time.Sleep(retryDelay)
-			} else {
-				log.Fatalf("unretriable error while etablishing ssh connection: %v\n", err)
-				break
-			}
-		}
-	}
-
-	if !connectionSuccess {
-		log.Fatalf("ssh connection wasn't successful")
 	}
-
-	// Defer closing the network connection.
-	defer sshClient.Close()
-
-	installScriptTarget := "/root/flatcar-install"
-	ignitionTarget := "/root/ignition.json"
-
-	if cfg.Flatcar.InstallScript != "" {
-		err = sshClient.Upload(cfg.Flatcar.InstallScript, installScriptTarget)
-		if err != nil {
-			log.Fatalf("error uploading flatcar-install script: %v\n", err)
+	var summary batchSummary
+	if canaries > 0 {
+		soakTime := *soak
+		if soakTime < 0 {
+			soakTime, _ = time.ParseDuration(p.cfg.Rollout.Soak)
 		}
+		summary = p.provisionCanary(serverNames, canaries, soakTime, *concurrency, *keepGoing)
 	} else {
-		// download install script on remote maschine
-		cmd, err := sshClient.Command(fmt.Sprintf("curl -sS -o %s %s", installScriptTarget, installScriptSource))
-		if err != nil {
-			log.Fatalf("error creating cmd for install script download: %v\n", err)
-		}
-		err = cmd.Run()
-		if err != nil {
-			log.Fatalf("error downloading install script: %v\n", err)
-		}
+		summary = p.provisionBatch(serverNames, *concurrency, *keepGoing)
 	}
-	err = sshClient.Upload(renderedPath, ignitionTarget)
-	if err != nil {
-		log.Fatalf("error uploading ignition file: %v\n", err)
-	}
-
-	// build flatcar-install command
-	var installDeviceArg string
-	if cfg.Flatcar.InstallDevice == "" {
-		installDeviceArg = "-s"
-	} else {
-		installDeviceArg = fmt.Sprintf("-d %s", cfg.Flatcar.InstallDevice)
+	p.addTimings(&summary)
+	p.progress.finish(summary)
+	if len(summary.Timings) > 0 {
+		if err := printTimings(os.Stderr, summary.Timings); err != nil {
+			log.Printf("error printing timings: %v\n", err)
+		}
 	}
-	installCommand := fmt.Sprintf("%s -i %s -V %s %s %s", installScriptTarget, ignitionTarget, cfg.Flatcar.Version, installDeviceArg, cfg.Flatcar.InstallArgs)
-
-	// execute commands to finally install flatcar
-	commands := []string{
-		"apt update",
-		"apt install -y gawk",
-		fmt.Sprintf("chmod +x %s", installScriptTarget),
-		installCommand,
+	if p.report != nil {
+		if err := p.report.write(*reportPath, p.revision); err != nil {
+			log.Printf("%v\n", err)
+		}
 	}
-	for _, command := range commands {
-		log.Printf("running command '%s'\n", command)
-		cmd, err := sshClient.Command(command)
-		if err != nil {
-			log.Fatalf("error creating goph.Cmd for '%s': %v\n", command, err)
+	if *jsonSummary {
+		if err := printSummary(os.Stdout, summary); err != nil {
+			fatalf("error printing summary: %v\n", err)
 		}
-		stdoutPipe, err := cmd.StdoutPipe()
-		if err != nil {
-			log.Fatalf("error creating stdoutpipe for '%s': %v\n", command, err)
+	}
+	if summary.Failed == 0 && p.cfg.HCloud.PruneAfterRun {
+		if _, err := p.prune(false); err != nil {
+			log.Printf("error pruning snapshots: %v\n", err)
 		}
-		go func() {
-			// TODO: don't print this if not desired
-			scanner := bufio.NewScanner(stdoutPipe)
-			for scanner.Scan() {
-				log.Printf("%s - %s", command, scanner.Text())
+	}
+	if summary.Failed > 0 {
+		for _, result := range summary.Servers {
+			if result.Result == resultFailed {
+				log.Printf("error provisioning %s: %s\n", result.Name, result.Error)
 			}
-		}()
-		err = cmd.Run()
-		if err != nil {
-			log.Fatalf("error running command '%s': %v\n", command, err)
 		}
+		fatalf("provisioning failed on %d of %d servers, %d skipped\n", summary.Failed, len(serverNames), summary.Skipped)
 	}
+}
 
-	// run reboot command
-	cmd, err := sshClient.Command("reboot now")
+// runImport adopts existing servers, e.g. created by terraform, so they can be reinstalled with --no-create
+func runImport(args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	p, err := common.loadProvisioner()
 	if err != nil {
-		log.Fatalf("error creating goph.Cmd for reboot command: %v\n", err)
+		fatalf("%v\n", err)
 	}
-	err = cmd.Run()
+	serverNames, err := p.expandServerNames(fs.Args())
 	if err != nil {
-		log.Printf("reboot command failed, VM probably rebooted anyways: %v\n", err)
+		fatalf("%v\n", err)
+	}
+	for _, serverName := range serverNames {
+		if err := p.adopt(serverName); err != nil {
+			fatalf("error importing %s: %v\n", serverName, err)
+		}
 	}
-
-	log.Println("------")
-	log.Printf("successfully (re)installed %s, ID: %d IPv4: %s IPv6: %s\n", server.Name, server.ID, server.PublicNet.IPv4.IP.String(), server.PublicNet.IPv6.IP.String())
 }
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxWindowSearch limits the search for the next maintenance window
+const maxWindowSearch = 366 * 24 * time.Hour
+
+// cronField is the set of allowed values of one field of a cron schedule
+type cronField map[int]bool
+
+// parseCronField parses *, numbers, ranges (1-5), steps (*/2, 1-10/3) and comma separated lists of them
+func parseCronField(field string, min, max int) (cronField, error) {
+	values := cronField{}
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step < 1 {
+				return nil, fmt.Errorf("invalid step in %s", part)
+			}
+		}
+		start, end := min, max
+		if rangePart != "*" {
+			startPart, endPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			start, err = strconv.Atoi(startPart)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value %s", part)
+			}
+			end = start
+			if isRange {
+				end, err = strconv.Atoi(endPart)
+				if err != nil {
+					return nil, fmt.Errorf("invalid value %s", part)
+				}
+			} else if hasStep {
+				end = max
+			}
+		}
+		if start < min || end > max || start > end {
+			return nil, fmt.Errorf("%s is out of range %d-%d", part, min, max)
+		}
+		for value := start; value <= end; value += step {
+			values[value] = true
+		}
+	}
+	return values, nil
+}
+
+// cronSchedule is a parsed cron expression with minute, hour, day of month, month and day of week
+type cronSchedule struct {
+	minute, hour, dayOfMonth, month, dayOfWeek cronField
+	// restricted day fields are combined with or, like cron does
+	dayOfMonthAny, dayOfWeekAny bool
+}
+
+func parseCronSchedule(schedule string) (*cronSchedule, error) {
+	fields := strings.Fields(schedule)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron schedule %s doesn't have 5 fields", schedule)
+	}
+	var s cronSchedule
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("invalid minute: %w", err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("invalid hour: %w", err)
+	}
+	if s.dayOfMonth, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("invalid day of month: %w", err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("invalid month: %w", err)
+	}
+	if s.dayOfWeek, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("invalid day of week: %w", err)
+	}
+	// 7 is sunday as well
+	if s.dayOfWeek[7] {
+		s.dayOfWeek[0] = true
+	}
+	s.dayOfMonthAny = fields[2] == "*"
+	s.dayOfWeekAny = fields[4] == "*"
+	return &s, nil
+}
+
+// matches returns whether the schedule fires at the minute of t
+func (s *cronSchedule) matches(t time.Time) bool {
+	if !s.minute[t.Minute()] || !s.hour[t.Hour()] || !s.month[int(t.Month())] {
+		return false
+	}
+	dayOfMonth := s.dayOfMonth[t.Day()]
+	dayOfWeek := s.dayOfWeek[int(t.Weekday())]
+	switch {
+	case s.dayOfMonthAny && s.dayOfWeekAny:
+		return true
+	case s.dayOfMonthAny:
+		return dayOfWeek
+	case s.dayOfWeekAny:
+		return dayOfMonth
+	}
+	return dayOfMonth || dayOfWeek
+}
+
+// maintenanceWindow starts whenever its schedule fires and lasts for length
+type maintenanceWindow struct {
+	schedule *cronSchedule
+	length   time.Duration
+}
+
+// parseMaintenanceWindow parses a window like "0 2 * * 6/2h" into its cron schedule and length
+func parseMaintenanceWindow(window string) (maintenanceWindow, error) {
+	separator := strings.LastIndex(window, "/")
+	if separator == -1 {
+		return maintenanceWindow{}, fmt.Errorf("maintenance window %s isn't in the format <cron schedule>/<length>", window)
+	}
+	length, err := time.ParseDuration(window[separator+1:])
+	if err != nil || length < time.Minute {
+		return maintenanceWindow{}, fmt.Errorf("invalid maintenance window length in %s", window)
+	}
+	schedule, err := parseCronSchedule(window[:separator])
+	if err != nil {
+		return maintenanceWindow{}, fmt.Errorf("invalid maintenance window %s: %w", window, err)
+	}
+	return maintenanceWindow{schedule: schedule, length: length}, nil
+}
+
+// open returns whether the window is open at t
+func (w maintenanceWindow) open(t time.Time) bool {
+	t = t.Truncate(time.Minute)
+	for start := t; t.Sub(start) < w.length; start = start.Add(-time.Minute) {
+		if w.schedule.matches(start) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the next time the window opens after t
+func (w maintenanceWindow) next(t time.Time) (time.Time, bool) {
+	start := t.Truncate(time.Minute).Add(time.Minute)
+	for candidate := start; candidate.Sub(start) < maxWindowSearch; candidate = candidate.Add(time.Minute) {
+		if w.schedule.matches(candidate) {
+			return candidate, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// maintenanceSchedule decides when disruptive reinstalls may happen
+type maintenanceSchedule struct {
+	windows []maintenanceWindow
+	// notBefore delays all reinstalls until this time, e.g. set with --at
+	notBefore time.Time
+}
+
+// newMaintenanceSchedule parses the configured windows, all of them are validated while parsing the config
+func newMaintenanceSchedule(conf maintenanceConfig, notBefore time.Time) maintenanceSchedule {
+	schedule := maintenanceSchedule{notBefore: notBefore}
+	for _, window := range conf.Windows {
+		parsed, _ := parseMaintenanceWindow(window)
+		schedule.windows = append(schedule.windows, parsed)
+	}
+	return schedule
+}
+
+// restricted returns whether reinstalls are limited to maintenance windows at all
+func (s maintenanceSchedule) restricted() bool {
+	return len(s.windows) > 0 || !s.notBefore.IsZero()
+}
+
+// open returns whether reinstalls are allowed at t
+func (s maintenanceSchedule) open(t time.Time) bool {
+	if t.Before(s.notBefore) {
+		return false
+	}
+	if len(s.windows) == 0 {
+		return true
+	}
+	for _, window := range s.windows {
+		if window.open(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns the earliest time at or after t reinstalls are allowed
+func (s maintenanceSchedule) next(t time.Time) (time.Time, bool) {
+	if t.Before(s.notBefore) {
+		t = s.notBefore
+	}
+	if s.open(t) {
+		return t, true
+	}
+	var earliest time.Time
+	for _, window := range s.windows {
+		if start, ok := window.next(t); ok && (earliest.IsZero() || start.Before(earliest)) {
+			earliest = start
+		}
+	}
+	return earliest, !earliest.IsZero()
+}
+
+// atLayouts are the accepted formats of --at
+var atLayouts = []string{time.RFC3339, "2006-01-02T15:04Z07:00", "2006-01-02T15:04", "2006-01-02 15:04"}
+
+// parseAt parses the time given with --at, times without zone are local
+func parseAt(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range atLayouts {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time %s, use e.g. 2024-05-03T02:00Z", value)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	provisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hetzner_flatcar_provisions_total",
+		Help: "Number of provisioned servers by result.",
+	}, []string{"result"})
+	phaseDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hetzner_flatcar_phase_duration_seconds",
+		Help:    "Duration of the phases of provisioning a server.",
+		Buckets: []float64{1, 5, 15, 30, 60, 120, 300, 600, 1200},
+	}, []string{"phase"})
+	lastSuccess = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hetzner_flatcar_last_success_timestamp_seconds",
+		Help: "Time of the last successful provisioning of a server.",
+	}, []string{"server"})
+	serverDrifted = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "hetzner_flatcar_server_drifted",
+		Help: "Whether the applied config of a server differs from the rendered one (1) or not (0), set in watch mode.",
+	}, []string{"server"})
+	reconciliationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hetzner_flatcar_reconciliations_total",
+		Help: "Number of reconciliations in watch mode by result.",
+	}, []string{"result"})
+	lastReconcile = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "hetzner_flatcar_last_reconcile_timestamp_seconds",
+		Help: "Time of the last reconciliation in watch mode.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(provisionsTotal, phaseDuration, lastSuccess, serverDrifted, reconciliationsTotal, lastReconcile)
+}
+
+// metricsHandler serves the metrics in the prometheus format
+var metricsHandler = promhttp.Handler()
+
+// startPhase starts timing a phase of provisioning, the returned function records its duration
+func startPhase(phase string) func() {
+	start := time.Now()
+	return func() {
+		phaseDuration.WithLabelValues(phase).Observe(time.Since(start).Seconds())
+	}
+}
+
+// observeProvision counts the result of provisioning serverName
+func observeProvision(serverName string, err error) {
+	if err != nil {
+		provisionsTotal.WithLabelValues(resultFailed).Inc()
+		return
+	}
+	provisionsTotal.WithLabelValues(resultSucceeded).Inc()
+	lastSuccess.WithLabelValues(serverName).SetToCurrentTime()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// probeBytes is the size of the ranged request used to measure the throughput of a mirror
+const probeBytes = 4 << 20
+
+// probeTimeout limits the probe of a single mirror
+var probeTimeout = 30 * time.Second
+
+// mirrorURL returns the base url of mirror for channel, {channel} is replaced by the channel defaulting to stable
+func mirrorURL(mirror string, channel string) string {
+	if channel == "" {
+		channel = "stable"
+	}
+	return strings.TrimSuffix(strings.ReplaceAll(mirror, "{channel}", channel), "/")
+}
+
+// fastestMirror downloads the first bytes of the image from every configured mirror within the rescue system
+// and returns the base url of the fastest one, empty if there are no mirrors or all of them failed
+func (p *provisioner) fastestMirror(sshClient *sshSession, version string, channel string) string {
+	mirrors := p.cfg.Flatcar.Mirrors
+	if len(mirrors) == 1 {
+		return mirrorURL(mirrors[0], channel)
+	}
+	var fastest string
+	var fastestSpeed float64
+	for _, mirror := range mirrors {
+		base := mirrorURL(mirror, channel)
+		imageURL := fmt.Sprintf("%s/%s/flatcar_production_image.bin.bz2", base, version)
+		var speed string
+		command := fmt.Sprintf("curl -fsS -r 0-%d -o /dev/null --max-time %d -w '%%{speed_download}' %s", probeBytes-1, int(probeTimeout.Seconds())-5, shellQuote(imageURL))
+		err := sshClient.runTimeout(command, probeTimeout, func(line string) {
+			speed = line
+		})
+		if err != nil {
+			p.logger.Printf("warning: probing mirror %s failed: %v\n", base, err)
+			continue
+		}
+		bytesPerSecond, err := strconv.ParseFloat(strings.TrimSpace(speed), 64)
+		if err != nil {
+			p.logger.Printf("warning: probing mirror %s returned invalid speed %q\n", base, speed)
+			continue
+		}
+		p.logger.Printf("mirror %s: %s/s\n", base, formatBytes(int64(bytesPerSecond)))
+		if bytesPerSecond > fastestSpeed {
+			fastest, fastestSpeed = base, bytesPerSecond
+		}
+	}
+	if fastest == "" && len(mirrors) > 0 {
+		p.logger.Println("warning: all mirrors failed, downloading from the default release server")
+	}
+	return fastest
+}
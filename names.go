@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+)
+
+// namePattern matches a numeric range like {1..5} or {01..10} in a server name
+var namePattern = regexp.MustCompile(`\{(\d+)\.\.(\d+)\}`)
+
+// expandServerName expands a range in the name into one name per index, e.g. web-{1..3} into web-1, web-2 and web-3.
+// The returned indexes are the numbers the names were generated from.
+func expandServerName(name string) ([]string, []int, error) {
+	match := namePattern.FindStringSubmatchIndex(name)
+	if match == nil {
+		return []string{name}, []int{0}, nil
+	}
+	startString := name[match[2]:match[3]]
+	start, err := strconv.Atoi(startString)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid range in %s: %w", name, err)
+	}
+	end, err := strconv.Atoi(name[match[4]:match[5]])
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid range in %s: %w", name, err)
+	}
+	if end < start {
+		return nil, nil, fmt.Errorf("invalid range in %s: end is lower than start", name)
+	}
+	if namePattern.MatchString(name[match[1]:]) {
+		return nil, nil, fmt.Errorf("invalid name %s: only a single range is supported", name)
+	}
+	// keep leading zeros of the start, e.g. {01..10}
+	format := "%d"
+	if len(startString) > 1 && startString[0] == '0' {
+		format = fmt.Sprintf("%%0%dd", len(startString))
+	}
+	names := make([]string, 0, end-start+1)
+	indexes := make([]int, 0, end-start+1)
+	for i := start; i <= end; i++ {
+		names = append(names, name[:match[0]]+fmt.Sprintf(format, i)+name[match[1]:])
+		indexes = append(indexes, i)
+	}
+	return names, indexes, nil
+}
+
+// expandServerNames expands the ranges in all names and records the index of every generated name
+func (p *provisioner) expandServerNames(names []string) ([]string, error) {
+	if p.indexes == nil {
+		p.indexes = make(map[string]int)
+	}
+	var serverNames []string
+	for _, name := range names {
+		expanded, indexes, err := expandServerName(name)
+		if err != nil {
+			return nil, err
+		}
+		for i, serverName := range expanded {
+			p.indexes[serverName] = indexes[i]
+		}
+		serverNames = append(serverNames, expanded...)
+	}
+	return serverNames, nil
+}
+
+// withCount turns every name without a range into a range from 1 to count, e.g. worker into worker-{1..3}
+func withCount(names []string, count int) []string {
+	if count <= 0 {
+		return names
+	}
+	counted := make([]string, len(names))
+	for i, name := range names {
+		if namePattern.MatchString(name) {
+			counted[i] = name
+			continue
+		}
+		counted[i] = fmt.Sprintf("%s-{1..%d}", name, count)
+	}
+	return counted
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// privateNetworkMissing returns whether the private network doesn't exist yet and is created on the first provisioning
+func (p *provisioner) privateNetworkMissing() bool {
+	p.networkMu.Lock()
+	defer p.networkMu.Unlock()
+	return p.privateNetwork.ID == 0
+}
+
+// ensurePrivateNetwork creates the private network with its subnet if it doesn't exist yet
+func (p *provisioner) ensurePrivateNetwork() error {
+	p.networkMu.Lock()
+	defer p.networkMu.Unlock()
+	if p.privateNetwork.ID != 0 {
+		return nil
+	}
+	conf := p.cfg.HCloud
+	zone := hcloud.NetworkZone(conf.PrivateNetworkZone)
+	if zone == "" {
+		zone = p.locations[0].NetworkZone
+	}
+	_, subnet, _ := net.ParseCIDR(conf.PrivateNetworkSubnet)
+	p.logger.Printf("creating network %s (%s, subnet %s in %s)\n", conf.PrivateNetwork, p.privateNetwork.IPRange, subnet, zone)
+	network, _, err := p.client.Network.Create(context.Background(), hcloud.NetworkCreateOpts{
+		Name:    conf.PrivateNetwork,
+		IPRange: p.privateNetwork.IPRange,
+		Subnets: []hcloud.NetworkSubnet{{
+			Type:        hcloud.NetworkSubnetTypeCloud,
+			IPRange:     subnet,
+			NetworkZone: zone,
+		}},
+		Routes: conf.networkRoutes(),
+		Labels: map[string]string{managedLabel: managedLabelValue},
+	})
+	if err != nil {
+		return fmt.Errorf("error creating network: %w", err)
+	}
+	p.privateNetwork = network
+	return nil
+}
+
+// findPrivateNet returns the attachment of server to network
+func findPrivateNet(server *hcloud.Server, network *hcloud.Network) (hcloud.ServerPrivateNet, bool) {
+	for _, attachedPrivateNet := range server.PrivateNet {
+		if attachedPrivateNet.Network.ID == network.ID {
+			return attachedPrivateNet, true
+		}
+	}
+	return hcloud.ServerPrivateNet{}, false
+}
+
+// equalIPs checks whether both lists contain the same ips, ignoring their order
+func equalIPs(a []net.IP, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for _, ipA := range a {
+		found := false
+		for _, ipB := range b {
+			if ipA.Equal(ipB) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// changeAliasIPs sets the alias ips of the server in network and waits for the action to complete
+func changeAliasIPs(logger *log.Logger, client *hcloud.Client, server *hcloud.Server, network *hcloud.Network, aliasIPs []net.IP) error {
+	logger.Printf("setting alias ips %v in network %s\n", aliasIPs, network.Name)
+	action, _, err := client.Server.ChangeAliasIPs(context.Background(), server, hcloud.ServerChangeAliasIPsOpts{
+		Network:  network,
+		AliasIPs: aliasIPs,
+	})
+	if err != nil {
+		return fmt.Errorf("error requesting alias ip change: %w", err)
+	}
+	if action.Error() != nil {
+		return fmt.Errorf("error changing alias ips: %w", action.Error())
+	}
+	err = waitForAction(logger, client.Action, action)
+	if err != nil {
+		return fmt.Errorf("error waiting for action: %w", err)
+	}
+	return nil
+}
+
+// networkRoute is a route of the private network, traffic to Destination is forwarded to the server at Gateway
+type networkRoute struct {
+	Destination string
+	Gateway     string
+}
+
+// networkRoutes returns the routes of the private network, including the default route via the nat gateway
+func (c hcloudConfig) networkRoutes() []hcloud.NetworkRoute {
+	routes := c.PrivateNetworkRoutes
+	if c.NATGateway != "" {
+		routes = append([]networkRoute{{Destination: "0.0.0.0/0", Gateway: c.NATGateway}}, routes...)
+	}
+	var networkRoutes []hcloud.NetworkRoute
+	for _, route := range routes {
+		// validated by verifyConfig
+		_, destination, _ := net.ParseCIDR(route.Destination)
+		networkRoutes = append(networkRoutes, hcloud.NetworkRoute{Destination: destination, Gateway: net.ParseIP(route.Gateway)})
+	}
+	return networkRoutes
+}
+
+// missingRoutes returns the routes network doesn't have
+func missingRoutes(network *hcloud.Network, routes []hcloud.NetworkRoute) []hcloud.NetworkRoute {
+	var missing []hcloud.NetworkRoute
+	for _, route := range routes {
+		found := false
+		for _, existing := range network.Routes {
+			if existing.Destination.String() == route.Destination.String() && existing.Gateway.Equal(route.Gateway) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, route)
+		}
+	}
+	return missing
+}
+
+// subnetGateway returns the gateway of the subnet of network containing ip, nil if there's none
+func subnetGateway(network *hcloud.Network, ip net.IP) net.IP {
+	if network == nil || ip == nil {
+		return nil
+	}
+	for _, subnet := range network.Subnets {
+		if subnet.IPRange.Contains(ip) {
+			return subnet.Gateway
+		}
+	}
+	return nil
+}
+
+// privateNetworkUnitName is the name of the generated networkd unit for the private interface
+const privateNetworkUnitName = "10-hcloud-private.network"
+
+// privateNetworkUnit generates a networkd unit configuring the private interface of the server statically,
+// with defaultRoute the default route points to the gateway of the network, which forwards it to the nat gateway
+func privateNetworkUnit(privateNet hcloud.ServerPrivateNet, network *hcloud.Network, defaultRoute bool) (string, error) {
+	if privateNet.IP == nil {
+		return "", errors.New("server isn't attached to the private network")
+	}
+	gateway := subnetGateway(network, privateNet.IP)
+	if gateway == nil {
+		return "", fmt.Errorf("no subnet of network %s contains %s", network.Name, privateNet.IP)
+	}
+
+	lines := []string{
+		"[Match]",
+		fmt.Sprintf("MACAddress=%s", privateNet.MACAddress),
+		"",
+		"[Link]",
+		"MTUBytes=1450",
+		"",
+		"[Network]",
+		fmt.Sprintf("Address=%s/32", privateNet.IP),
+	}
+	for _, aliasIP := range privateNet.Aliases {
+		lines = append(lines, fmt.Sprintf("Address=%s/32", aliasIP))
+	}
+	// the whole network is routed via the gateway, which isn't part of the /32 address
+	lines = append(lines,
+		"",
+		"[Route]",
+		fmt.Sprintf("Destination=%s", network.IPRange),
+		fmt.Sprintf("Gateway=%s", gateway),
+		"GatewayOnLink=yes",
+	)
+	if defaultRoute {
+		lines = append(lines,
+			"",
+			"[Route]",
+			fmt.Sprintf("Gateway=%s", gateway),
+			"GatewayOnLink=yes",
+		)
+	}
+	return strings.Join(lines, "\n") + "\n", nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// oidcClient fetches the discovery document and the keys of the issuer
+var oidcClient = &http.Client{Timeout: 10 * time.Second}
+
+// oidcLeeway is the clock skew tolerated when checking the expiry of tokens
+const oidcLeeway = time.Minute
+
+// oidcVerifier verifies OIDC id tokens (RS256 or ES256) of an issuer and returns the identity of the caller
+type oidcVerifier struct {
+	issuer   string
+	audience string
+	// claim identifies the caller, sub is used if the token doesn't contain it
+	claim string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+func newOIDCVerifier(issuer string, audience string, claim string) *oidcVerifier {
+	return &oidcVerifier{issuer: strings.TrimSuffix(issuer, "/"), audience: audience, claim: claim}
+}
+
+// fetchKeys loads the keys of the issuer via its discovery document
+func (v *oidcVerifier) fetchKeys() error {
+	var discovery struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	if err := getJSON(v.issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return fmt.Errorf("error fetching openid configuration: %w", err)
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(discovery.JWKSURI, &jwks); err != nil {
+		return fmt.Errorf("error fetching keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range jwks.Keys {
+		switch {
+		case key.Kty == "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(key.N)
+			e, errE := base64.RawURLEncoding.DecodeString(key.E)
+			if errN != nil || errE != nil {
+				continue
+			}
+			keys[key.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case key.Kty == "EC" && key.Crv == "P-256":
+			x, errX := base64.RawURLEncoding.DecodeString(key.X)
+			y, errY := base64.RawURLEncoding.DecodeString(key.Y)
+			if errX != nil || errY != nil {
+				continue
+			}
+			keys[key.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		}
+	}
+	v.keys = keys
+	v.fetched = time.Now()
+	return nil
+}
+
+// key returns the key kid of the issuer, the keys are fetched again for unknown ids at most once a minute
+func (v *oidcVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	if time.Since(v.fetched) > time.Minute {
+		if err := v.fetchKeys(); err != nil {
+			return nil, err
+		}
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown key %s", kid)
+}
+
+// verify checks the signature, issuer, audience and expiry of token and returns the identity of the caller
+func (v *oidcVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("token isn't a jwt")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return "", fmt.Errorf("invalid token header: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid token signature: %w", err)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return "", errors.New("invalid token signature")
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 ||
+			!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+			return "", errors.New("invalid token signature")
+		}
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return "", fmt.Errorf("invalid token claims: %w", err)
+	}
+	if issuer, _ := claims["iss"].(string); strings.TrimSuffix(issuer, "/") != v.issuer {
+		return "", fmt.Errorf("token issued by %s", issuer)
+	}
+	if !hasAudience(claims["aud"], v.audience) {
+		return "", errors.New("token isn't issued for this audience")
+	}
+	now := time.Now()
+	if expiry, ok := claims["exp"].(float64); !ok || now.After(time.Unix(int64(expiry), 0).Add(oidcLeeway)) {
+		return "", errors.New("token expired")
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now.Add(oidcLeeway).Before(time.Unix(int64(notBefore), 0)) {
+		return "", errors.New("token not valid yet")
+	}
+	if identity, _ := claims[v.claim].(string); identity != "" {
+		return identity, nil
+	}
+	if subject, _ := claims["sub"].(string); subject != "" {
+		return subject, nil
+	}
+	return "", fmt.Errorf("token has neither %s nor sub", v.claim)
+}
+
+// hasAudience returns whether the aud claim, a string or a list of strings, contains audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, candidate := range aud {
+			if candidate == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, value)
+}
+
+func getJSON(url string, value interface{}) error {
+	resp, err := oidcClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
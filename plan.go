@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// planEntry describes what provisioning a server would do
+type planEntry struct {
+	Server     string
+	Action     string
+	ServerType *hcloud.ServerType
+	Location   *hcloud.Location
+	// Config is the drift state of existing servers
+	Config string
+	// CurrentType is the server type of an existing server if it differs from the configured one
+	CurrentType *hcloud.ServerType
+}
+
+// serverTypePrice returns the gross hourly and monthly price of the server type in location
+func serverTypePrice(serverType *hcloud.ServerType, location *hcloud.Location) (hourly float64, monthly float64, currency string, err error) {
+	for _, pricing := range serverType.Pricings {
+		if pricing.Location.Name != location.Name {
+			continue
+		}
+		hourly, err = strconv.ParseFloat(pricing.Hourly.Gross, 64)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		monthly, err = strconv.ParseFloat(pricing.Monthly.Gross, 64)
+		if err != nil {
+			return 0, 0, "", err
+		}
+		return hourly, monthly, pricing.Monthly.Currency, nil
+	}
+	return 0, 0, "", fmt.Errorf("no pricing for server type %s in %s", serverType.Name, location.Name)
+}
+
+// plan determines the actions for the given servers without changing anything
+func (p *provisioner) plan(serverNames []string) ([]planEntry, error) {
+	entries := make([]planEntry, 0, len(serverNames))
+	for _, serverName := range serverNames {
+		server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+		if err != nil {
+			return nil, fmt.Errorf("error finding server: %w", err)
+		}
+		if server == nil {
+			entry := planEntry{Server: serverName, Action: "create", ServerType: p.serverType}
+			for _, location := range p.locations {
+				if p.checkServerTypeAvailability(location) == nil {
+					entry.Location = location
+					break
+				}
+			}
+			entries = append(entries, entry)
+			continue
+		}
+
+		state, err := p.driftState(server)
+		if err != nil {
+			return nil, fmt.Errorf("error rendering config for %s: %w", serverName, err)
+		}
+		entry := planEntry{
+			Server:     serverName,
+			Action:     "reinstall",
+			ServerType: server.ServerType,
+			Location:   server.Datacenter.Location,
+			Config:     state,
+		}
+		if server.ServerType.Name != p.serverType.Name {
+			entry.CurrentType = server.ServerType
+			entry.ServerType = p.serverType
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// printPlan writes the plan as table including the costs of new servers and the difference of changed server types
+func printPlan(w io.Writer, entries []planEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tACTION\tTYPE\tLOCATION\tCONFIG\tHOURLY\tMONTHLY")
+	var totalMonthly float64
+	var totalCurrency string
+	for _, entry := range entries {
+		config := entry.Config
+		if config == "" {
+			config = "-"
+		}
+		if entry.Location == nil {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Server, entry.Action, entry.ServerType.Name, "unavailable", config, "-", "-")
+			continue
+		}
+		hourly, monthly, currency, err := serverTypePrice(entry.ServerType, entry.Location)
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.Action == "create":
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%.4f %s\t%.2f %s\n", entry.Server, entry.Action, entry.ServerType.Name, entry.Location.Name, config, hourly, currency, monthly, currency)
+			totalMonthly += monthly
+			totalCurrency = currency
+		case entry.CurrentType != nil:
+			// hetzner-flatcar doesn't resize servers, the difference is informational
+			currentHourly, currentMonthly, _, err := serverTypePrice(entry.CurrentType, entry.Location)
+			if err != nil {
+				return err
+			}
+			typeChange := fmt.Sprintf("%s (config: %s)", entry.CurrentType.Name, entry.ServerType.Name)
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%+.4f %s\t%+.2f %s\n", entry.Server, entry.Action, typeChange, entry.Location.Name, config, hourly-currentHourly, currency, monthly-currentMonthly, currency)
+		default:
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", entry.Server, entry.Action, entry.ServerType.Name, entry.Location.Name, config, "-", "-")
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if totalCurrency != "" {
+		fmt.Fprintf(w, "new servers cost %.2f %s per month\n", totalMonthly, totalCurrency)
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// phases plugins can hook into with before-<phase> and after-<phase>, provision covers the whole provisioning
+var pluginPhases = []string{"provision", "ensure_server", "render", "snapshot", "enable_rescue", "boot_rescue", "flatcar_install", "first_boot"}
+
+// pluginConfig is an executable run at hook points of the provisioning
+type pluginConfig struct {
+	// Name identifies the plugin in the log output
+	Name string
+	// Command is the executable and its arguments, the hook and the server name are appended
+	Command []string
+	// Hooks are the hook points the plugin is run at, e.g. after-first_boot, all if empty
+	Hooks []string
+	// Timeout limits a single run of the plugin, defaults to 5m
+	Timeout string
+	// Optional plugins only log failures instead of failing the provisioning
+	Optional bool
+}
+
+// timeout returns the time a single run of the plugin may take
+func (c pluginConfig) timeout() time.Duration {
+	timeout, err := time.ParseDuration(c.Timeout)
+	if err != nil {
+		return 5 * time.Minute
+	}
+	return timeout
+}
+
+// runsAt returns whether the plugin is run at hook
+func (c pluginConfig) runsAt(hook string) bool {
+	if len(c.Hooks) == 0 {
+		return true
+	}
+	for _, candidate := range c.Hooks {
+		if candidate == hook {
+			return true
+		}
+	}
+	return false
+}
+
+// validHook returns whether hook is before-<phase> or after-<phase> of a known phase
+func validHook(hook string) bool {
+	for _, phase := range pluginPhases {
+		if hook == "before-"+phase || hook == "after-"+phase {
+			return true
+		}
+	}
+	return false
+}
+
+// pluginRequest is passed to plugins as JSON on stdin
+type pluginRequest struct {
+	Hook   string `json:"hook"`
+	Server string `json:"server"`
+	// Error is the error provisioning failed with, only set for after-provision
+	Error string `json:"error,omitempty"`
+	// Hetzner is the same data passed to the template command, missing before the server exists
+	Hetzner     *customTemplateDataHetzner `json:"hetzner,omitempty"`
+	Index       int                        `json:"index"`
+	GitRevision string                     `json:"git_revision,omitempty"`
+	Operator    string                     `json:"operator"`
+	Version     string                     `json:"version"`
+}
+
+// pluginResponse is the optional JSON object plugins write to stdout
+type pluginResponse struct {
+	// Message is logged
+	Message string `json:"message"`
+	// Error fails the hook like a non-zero exit code
+	Error string `json:"error"`
+}
+
+// runHooks runs the plugins registered for hook, server is nil if it doesn't exist yet.
+// It returns the error of the first failing plugin that isn't optional.
+func (p *provisioner) runHooks(hook string, serverName string, server *hcloud.Server, provisionErr error) error {
+	for _, plugin := range p.cfg.Plugins {
+		if !plugin.runsAt(hook) {
+			continue
+		}
+		request := pluginRequest{
+			Hook:        hook,
+			Server:      serverName,
+			Index:       p.indexes[serverName],
+			GitRevision: p.revision,
+			Operator:    p.operatorName(),
+			Version:     buildVersion().Version,
+		}
+		if server != nil {
+			data := p.serverContext(server)
+			request.Hetzner = &data
+		}
+		if provisionErr != nil {
+			request.Error = secrets.redact(provisionErr.Error())
+		}
+		if err := runPlugin(p.logger, plugin, request); err != nil {
+			if plugin.Optional {
+				p.logger.Printf("warning: plugin %s failed at %s: %v\n", plugin.Name, hook, err)
+				continue
+			}
+			return fmt.Errorf("plugin %s failed at %s: %w", plugin.Name, hook, err)
+		}
+	}
+	return nil
+}
+
+// runPlugin runs plugin with request on stdin, its stderr is logged line by line
+func runPlugin(logger *log.Logger, plugin pluginConfig, request pluginRequest) error {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("error encoding request: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), plugin.timeout())
+	defer cancel()
+	args := append(append([]string{}, plugin.Command[1:]...), request.Hook, request.Server)
+	cmd := exec.CommandContext(ctx, plugin.Command[0], args...)
+	cmd.Env = append(os.Environ(), "HETZNER_FLATCAR_HOOK="+request.Hook, "HETZNER_FLATCAR_SERVER="+request.Server)
+	cmd.Stdin = bytes.NewReader(input)
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	scanner := bufio.NewScanner(stderr)
+	for scanner.Scan() {
+		logger.Printf("[%s] %s\n", plugin.Name, scanner.Text())
+	}
+	if err := cmd.Wait(); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("timed out after %s", plugin.timeout())
+		}
+		return err
+	}
+	if len(bytes.TrimSpace(stdout.Bytes())) == 0 {
+		return nil
+	}
+	var response pluginResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return fmt.Errorf("invalid response: %w", err)
+	}
+	if response.Message != "" {
+		logger.Printf("[%s] %s\n", plugin.Name, strings.TrimSpace(response.Message))
+	}
+	if response.Error != "" {
+		return errors.New(response.Error)
+	}
+	return nil
+}
+
+// beginPhase runs the before hooks of phase and starts measuring its duration. The returned function stops
+// the measurement and runs the after hooks unless the phase failed with err, which is returned unchanged then.
+// server is passed again as it may have been created meanwhile.
+func (p *provisioner) beginPhase(serverName string, server *hcloud.Server, phase string) (func(*hcloud.Server, error) error, error) {
+	if err := p.runHooks("before-"+phase, serverName, server, nil); err != nil {
+		return nil, err
+	}
+	done := p.timePhase(serverName, phase)
+	return func(server *hcloud.Server, err error) error {
+		done()
+		if err != nil {
+			return err
+		}
+		return p.runHooks("after-"+phase, serverName, server, nil)
+	}, nil
+}
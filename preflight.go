@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// checkServerTypeAvailability verifies that the server type can currently be created in the location
+// and reports the locations it's available in otherwise
+func (p *provisioner) checkServerTypeAvailability(location *hcloud.Location) error {
+	datacenters, err := p.client.Datacenter.All(context.Background())
+	if err != nil {
+		return fmt.Errorf("error requesting datacenters: %w", err)
+	}
+	availableLocations := map[string]bool{}
+	for _, datacenter := range datacenters {
+		for _, serverType := range datacenter.ServerTypes.Available {
+			if serverType.ID == p.serverType.ID {
+				availableLocations[datacenter.Location.Name] = true
+			}
+		}
+	}
+	if availableLocations[location.Name] {
+		return nil
+	}
+	if len(availableLocations) == 0 {
+		return fmt.Errorf("server type %s isn't available in any location (sold out or deprecated)", p.serverType.Name)
+	}
+	alternatives := make([]string, 0, len(availableLocations))
+	for location := range availableLocations {
+		alternatives = append(alternatives, location)
+	}
+	sort.Strings(alternatives)
+	return fmt.Errorf("server type %s isn't available in %s (sold out or deprecated), available in: %s", p.serverType.Name, location.Name, strings.Join(alternatives, ", "))
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// progress modes of --progress
+const (
+	progressAuto   = "auto"
+	progressAlways = "always"
+	progressNever  = "never"
+)
+
+// progressRedraw is the time between two redraws of the progress table
+var progressRedraw = 100 * time.Millisecond
+
+var spinnerFrames = []string{"⠋", "⠙", "⠹", "⠸", "⠼", "⠴", "⠦", "⠧", "⠇", "⠏"}
+
+// serverProgress is the state of a server shown in the progress table
+type serverProgress struct {
+	phase string
+	// detail is shown after the elapsed time, e.g. the install progress
+	detail string
+	// started is zero until the first event of the server
+	started time.Time
+	ended   time.Time
+	result  string
+	err     string
+}
+
+// progressUI draws a table with the phase of every server instead of the log lines, which are written to a file.
+// It's updated by the events of the provisioner and redrawn in place.
+type progressUI struct {
+	mu      sync.Mutex
+	out     io.Writer
+	color   bool
+	names   []string
+	servers map[string]*serverProgress
+	// lastLine is the most recent log line, shown below the table
+	lastLine string
+	// logFile receives the full log output
+	logFile *os.File
+	drawn   int
+	frame   int
+	stop    chan struct{}
+	done    chan struct{}
+}
+
+// useProgress returns whether the progress table is shown for mode
+func useProgress(mode string) (bool, error) {
+	switch mode {
+	case progressAlways:
+		return true, nil
+	case progressNever:
+		return false, nil
+	case progressAuto:
+		return term.IsTerminal(int(os.Stderr.Fd())) && os.Getenv("TERM") != "dumb", nil
+	}
+	return false, fmt.Errorf("invalid progress mode %s, use auto, always or never", mode)
+}
+
+// startProgress shows the progress of serverNames on stderr and redirects the log output into a temporary file
+func startProgress(serverNames []string) (*progressUI, error) {
+	logFile, err := os.CreateTemp("", "hetzner-flatcar-*.log")
+	if err != nil {
+		return nil, fmt.Errorf("error creating log file: %w", err)
+	}
+	ui := &progressUI{
+		out:     os.Stderr,
+		color:   os.Getenv("NO_COLOR") == "",
+		names:   serverNames,
+		servers: make(map[string]*serverProgress, len(serverNames)),
+		logFile: logFile,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	for _, serverName := range serverNames {
+		ui.servers[serverName] = &serverProgress{phase: "pending"}
+	}
+	setLogOutput(io.MultiWriter(logFile, ui))
+	go ui.run()
+	return ui, nil
+}
+
+// Write receives the log output and keeps the last line for the footer
+func (ui *progressUI) Write(data []byte) (int, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			ui.lastLine = line
+		}
+	}
+	return len(data), nil
+}
+
+// update records that serverName reached phase
+func (ui *progressUI) update(serverName string, phase string, err error) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	server, ok := ui.servers[serverName]
+	if !ok {
+		server = &serverProgress{}
+		ui.servers[serverName] = server
+		ui.names = append(ui.names, serverName)
+	}
+	now := time.Now()
+	if server.started.IsZero() {
+		server.started = now
+	}
+	server.phase, server.detail = phase, ""
+	switch phase {
+	case eventSucceeded:
+		server.ended, server.result = now, resultSucceeded
+	case eventFailed:
+		server.ended, server.result = now, resultFailed
+		if err != nil {
+			server.err = secrets.redact(err.Error())
+		}
+	}
+}
+
+// detail sets the detail of the current phase of serverName
+func (ui *progressUI) detail(serverName string, detail string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	if server, ok := ui.servers[serverName]; ok {
+		server.detail = detail
+	}
+}
+
+func (ui *progressUI) run() {
+	defer close(ui.done)
+	ticker := time.NewTicker(progressRedraw)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ui.stop:
+			return
+		case <-ticker.C:
+			ui.mu.Lock()
+			ui.frame++
+			ui.draw(true)
+			ui.mu.Unlock()
+		}
+	}
+}
+
+// finish marks the servers skipped according to summary, draws the final table without footer and restores the log output.
+// The path of the log file is printed so the details of failures can be looked up.
+func (ui *progressUI) finish(summary batchSummary) {
+	if ui == nil {
+		return
+	}
+	close(ui.stop)
+	<-ui.done
+	ui.mu.Lock()
+	for _, result := range summary.Servers {
+		if server, ok := ui.servers[result.Name]; ok && result.Result == resultSkipped {
+			server.phase, server.result = resultSkipped, resultSkipped
+		}
+	}
+	ui.draw(false)
+	ui.mu.Unlock()
+	setLogOutput(os.Stderr)
+	ui.logFile.Close()
+	fmt.Fprintf(ui.out, "log written to %s\n", ui.logFile.Name())
+}
+
+// draw redraws the table in place of the previous one, it has to be called with mu held
+func (ui *progressUI) draw(footer bool) {
+	var buffer bytes.Buffer
+	if ui.drawn > 0 {
+		// move to the start of the previous table
+		fmt.Fprintf(&buffer, "\x1b[%dA", ui.drawn)
+	}
+	columns, _, err := term.GetSize(int(os.Stderr.Fd()))
+	if err != nil {
+		columns = 120
+	}
+	lines := 0
+	width := 0
+	for _, serverName := range ui.names {
+		if len(serverName) > width {
+			width = len(serverName)
+		}
+	}
+	for _, serverName := range ui.names {
+		server := ui.servers[serverName]
+		row := fmt.Sprintf("%-*s  %-16s %s", width, serverName, server.phase, ui.elapsed(server))
+		if server.detail != "" {
+			row += "  " + server.detail
+		}
+		line := ui.symbol(server) + " " + row
+		if server.err != "" {
+			// wrapped lines would break redrawing in place
+			line += "  " + ui.paint("31", truncate(server.err, columns-len(row)-4))
+		}
+		fmt.Fprintf(&buffer, "\x1b[2K%s\n", line)
+		lines++
+	}
+	if footer {
+		fmt.Fprintf(&buffer, "\x1b[2K%s\n", ui.paint("2", truncate(ui.lastLine, columns-1)))
+		lines++
+	}
+	// clear the footer of the previous table if it's gone
+	for ; lines < ui.drawn; lines++ {
+		buffer.WriteString("\x1b[2K\n")
+	}
+	ui.drawn = lines
+	ui.out.Write(buffer.Bytes())
+}
+
+// symbol returns the status symbol of server
+func (ui *progressUI) symbol(server *serverProgress) string {
+	switch {
+	case server.result == resultSucceeded:
+		return ui.paint("32", "✓")
+	case server.result == resultFailed:
+		return ui.paint("31", "✗")
+	case server.result == resultSkipped || server.started.IsZero():
+		return ui.paint("2", "·")
+	}
+	return ui.paint("33", spinnerFrames[ui.frame%len(spinnerFrames)])
+}
+
+// elapsed returns the time server has been or was in progress
+func (ui *progressUI) elapsed(server *serverProgress) string {
+	if server.started.IsZero() {
+		return ""
+	}
+	end := server.ended
+	if end.IsZero() {
+		end = time.Now()
+	}
+	return end.Sub(server.started).Round(time.Second).String()
+}
+
+// paint colors text with the ansi code unless colors are disabled with NO_COLOR
+func (ui *progressUI) paint(code string, text string) string {
+	if !ui.color || text == "" {
+		return text
+	}
+	return "\x1b[" + code + "m" + text + "\x1b[0m"
+}
+
+// truncate shortens text to at most length characters
+func truncate(text string, length int) string {
+	runes := []rune(text)
+	if length < 1 {
+		return ""
+	}
+	if len(runes) <= length {
+		return text
+	}
+	return string(runes[:length-1]) + "…"
+}
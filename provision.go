@@ -0,0 +1,592 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// managedLabel marks servers created or adopted by hetzner-flatcar
+const managedLabel = "managed-by"
+
+// managedLabelValue is the value of managedLabel
+const managedLabelValue = "hetzner-flatcar"
+
+// configHashLabel is the server label storing the hash of the last applied ignition config
+const configHashLabel = "hetzner-flatcar/config-hash"
+
+// labels describing the last install, so the state of the fleet can be queried in the hcloud console and api
+const (
+	installedVersionLabel = "flatcar/version"
+	installedAtLabel      = "hetzner-flatcar/installed-at"
+	templateSHALabel      = "hetzner-flatcar/template-sha"
+)
+
+// installedAtFormat is the format of installedAtLabel, label values can't contain colons
+const installedAtFormat = "20060102T150405Z"
+
+// provisioner creates and (re)installs servers with the hcloud resources referenced in the config.
+// The resources are looked up once and shared by all servers provisioned in a run.
+type provisioner struct {
+	cfg    config
+	client *hcloud.Client
+	sshKey *hcloud.SSHKey
+	// selectedSSHKeys are the keys matching hcloud.ssh_keys_selector
+	selectedSSHKeys []*hcloud.SSHKey
+	privateNetwork  *hcloud.Network
+	serverType      *hcloud.ServerType
+	image           *hcloud.Image
+	// locations are tried in order when creating servers
+	locations []*hcloud.Location
+	// revision is the commit of the git source the config was loaded from
+	revision string
+	// force installs even if the ignition config has warnings
+	force bool
+	// noCreate fails instead of creating missing servers
+	noCreate bool
+	// dial opens the connections used for ssh, directly or via the configured proxy
+	dial dialFunc
+	// keepalive is the interval keepalives are sent on ssh connections, set by ssh.keepalive_interval
+	keepalive time.Duration
+	// networkMu guards creating the private network
+	networkMu sync.Mutex
+	// firewallMu guards syncing the firewall, which happens once per run
+	firewallMu     sync.Mutex
+	firewallSynced bool
+	// firewall and stagingFirewall are the synced firewalls, stagingFirewall only with firewall.delay_exposure
+	firewall        *hcloud.Firewall
+	stagingFirewall *hcloud.Firewall
+	// indexes are the numbers server names were generated from by a range like web-{1..5}
+	indexes map[string]int
+	// events receives the phases of provisioning, nil if not requested
+	events *eventWriter
+	// runs are the runs in progress recorded in the run database
+	runs runTracker
+	// report collects the details of the run for --report, nil if not requested
+	report *report
+	// progress shows the phase of every server on a terminal, nil if disabled
+	progress *progressUI
+	// timings are the phase durations of the servers provisioned in this run
+	timings timingCollector
+	// sshKeyCheck verifies the local key matches the hcloud ssh key once per run
+	sshKeyCheck sync.Once
+	sshKeyErr   error
+	// tokenCheck verifies the token is allowed to write once per run
+	tokenCheck sync.Once
+	tokenErr   error
+	// inputs are the files the configs were rendered from in deterministic mode
+	inputs inputRecorder
+	// operator is the identity of the caller of the api in serve mode, operator() otherwise
+	operator string
+	// logger receives the log output of the provisioning, the log of the job in serve mode
+	logger *log.Logger
+}
+
+// newProvisioner looks up the hcloud resources referenced in the config concurrently, all unknown ones are reported at once
+func newProvisioner(cfg config, client *hcloud.Client) (*provisioner, error) {
+	dial, err := newDialer(cfg.SSH.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	p := &provisioner{
+		cfg:    cfg,
+		client: client,
+		dial:   dial,
+		logger: log.Default(),
+	}
+	if interval, err := time.ParseDuration(cfg.SSH.KeepaliveInterval); err == nil && interval > 0 {
+		p.keepalive = interval
+	}
+	if cfg.SSH.Bastion != "" {
+		p.dial, err = p.bastionDialer(dial)
+		if err != nil {
+			return nil, err
+		}
+	}
+	ctx := context.Background()
+	lookups := []func() error{
+		func() (err error) {
+			p.sshKey, err = findSSHKey(client, cfg.HCloud.SSHKey)
+			return err
+		},
+		func() (err error) {
+			p.privateNetwork, _, err = client.Network.GetByName(ctx, cfg.HCloud.PrivateNetwork)
+			if err != nil {
+				return fmt.Errorf("error requesting network: %w", err)
+			}
+			if p.privateNetwork == nil {
+				if !cfg.HCloud.CreatePrivateNetwork {
+					return fieldError{Field: "hcloud.private_network", Message: fmt.Sprintf("network %s doesn't exist", cfg.HCloud.PrivateNetwork), Hint: "create it or set hcloud.create_private_network"}
+				}
+				// created before the first server is attached to it
+				_, ipRange, _ := net.ParseCIDR(cfg.HCloud.PrivateNetworkIPRange)
+				p.privateNetwork = &hcloud.Network{Name: cfg.HCloud.PrivateNetwork, IPRange: ipRange}
+				return nil
+			}
+			// routes are only added to created networks, existing ones might be managed elsewhere
+			for _, route := range missingRoutes(p.privateNetwork, cfg.HCloud.networkRoutes()) {
+				log.Printf("warning: network %s has no route to %s via %s\n", p.privateNetwork.Name, route.Destination, route.Gateway)
+			}
+			return nil
+		},
+		func() (err error) {
+			p.serverType, err = findServerType(client, cfg.HCloud.ServerType)
+			return err
+		},
+		func() (err error) {
+			p.image, err = findImage(client, cfg.HCloud.Image)
+			if err == nil && p.image.IsDeprecated() {
+				log.Printf("warning: image %s is deprecated since %s\n", describeImage(p.image), p.image.Deprecated.Format("2006-01-02"))
+			}
+			if err == nil && cfg.HCloud.StartAfterCreate && p.image.Type != hcloud.ImageTypeSnapshot {
+				return fieldError{Field: "hcloud.image", Message: fmt.Sprintf("%s isn't a snapshot", describeImage(p.image)), Hint: "start_after_create boots a snapshot with flatcar, e.g. flatcar/channel=stable"}
+			}
+			return err
+		},
+	}
+	if cfg.HCloud.SSHKeysSelector != "" {
+		lookups = append(lookups, func() (err error) {
+			p.selectedSSHKeys, err = findSSHKeys(client, cfg.HCloud.SSHKeysSelector)
+			return err
+		})
+	}
+	p.locations = make([]*hcloud.Location, len(cfg.HCloud.Location))
+	for i, locationName := range cfg.HCloud.Location {
+		i, locationName := i, locationName
+		lookups = append(lookups, func() (err error) {
+			p.locations[i], err = findLocation(client, locationName)
+			return err
+		})
+	}
+
+	errs := make([]error, len(lookups))
+	var wg sync.WaitGroup
+	for i, lookup := range lookups {
+		wg.Add(1)
+		go func(i int, lookup func() error) {
+			defer wg.Done()
+			errs[i] = lookup()
+		}(i, lookup)
+	}
+	wg.Wait()
+	if err := catalogErrors(errs); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// sshKeys returns hcloud.ssh_key followed by the keys selected by hcloud.ssh_keys_selector
+func (p *provisioner) sshKeys() []*hcloud.SSHKey {
+	sshKeys := []*hcloud.SSHKey{p.sshKey}
+	for _, sshKey := range p.selectedSSHKeys {
+		if sshKey.ID != p.sshKey.ID {
+			sshKeys = append(sshKeys, sshKey)
+		}
+	}
+	return sshKeys
+}
+
+// checkWriteAccess fails for read-only tokens before anything is changed, instead of with a forbidden error halfway through.
+// If the permissions can't be determined, the provisioning goes on.
+func (p *provisioner) checkWriteAccess() error {
+	p.tokenCheck.Do(func() {
+		err := probeWriteAccess(p.client)
+		switch {
+		case errors.Is(err, errReadOnlyToken):
+			p.tokenErr = err
+		case err != nil:
+			p.logger.Printf("warning: can't verify the token is allowed to write: %v\n", err)
+		}
+	})
+	return p.tokenErr
+}
+
+// provision creates the server if necessary, renders its ignition config and (re)installs flatcar
+func (p *provisioner) provision(serverName string) (err error) {
+	var hash string
+	var server *hcloud.Server
+	p.startRun(serverName, "provision")
+	defer func() {
+		// plugins are told about failed provisionings as well
+		if hookErr := p.runHooks("after-provision", serverName, server, err); hookErr != nil {
+			if err == nil {
+				err = hookErr
+			} else {
+				p.logger.Println(hookErr)
+			}
+		}
+		p.finishRun(serverName, hash, p.revision, err)
+		observeProvision(serverName, err)
+		if err != nil {
+			p.emit(serverName, eventFailed, err)
+		} else {
+			p.emit(serverName, eventSucceeded, nil)
+		}
+	}()
+	if err := p.checkWriteAccess(); err != nil {
+		return err
+	}
+	if err := p.runHooks("before-provision", serverName, nil, nil); err != nil {
+		return err
+	}
+	end, err := p.beginPhase(serverName, nil, "ensure_server")
+	if err != nil {
+		return err
+	}
+	server, created, err := p.ensureServer(serverName)
+	if err := end(server, err); err != nil {
+		return err
+	}
+	if created {
+		p.emit(serverName, eventServerCreated, nil)
+	} else {
+		p.emit(serverName, eventServerFound, nil)
+	}
+	end, err = p.beginPhase(serverName, server, "render")
+	if err != nil {
+		return err
+	}
+	rendered, err := p.renderIgnition(server)
+	if err := end(server, err); err != nil {
+		return err
+	}
+	p.emit(serverName, eventRendered, nil)
+	p.logInputs(serverName)
+	hash, err = configHash(rendered)
+	if err != nil {
+		return err
+	}
+	if err := p.reportIgnition(server, rendered); err != nil {
+		p.logger.Printf("error adding ignition config of %s to report: %v\n", serverName, err)
+	}
+	if err := p.checkUserData(server); err != nil {
+		return err
+	}
+	// the user data can't be changed, if the config of the created server differs from it, it's installed via rescue instead
+	snapshotBoot := created && p.cfg.HCloud.StartAfterCreate && server.Labels[configHashLabel] == hash
+	if created && p.cfg.HCloud.StartAfterCreate && !snapshotBoot {
+		p.logger.Printf("warning: config of %s depends on values only known after creating it, installing it via rescue\n", serverName)
+	}
+	if !snapshotBoot {
+		if err := p.checkInstall(server, rendered); err != nil {
+			return err
+		}
+	}
+	if !created && p.cfg.HCloud.SnapshotBeforeReinstall {
+		end, err := p.beginPhase(serverName, server, "snapshot")
+		if err != nil {
+			return err
+		}
+		if err := end(server, p.snapshotServer(server)); err != nil {
+			return err
+		}
+		p.emit(serverName, eventSnapshotCreated, nil)
+	}
+	if p.delaysExposure() && !created {
+		if err := p.stageServer(server); err != nil {
+			return err
+		}
+	}
+	if snapshotBoot {
+		err = p.bootSnapshot(server, rendered)
+	} else {
+		err = p.install(server, rendered)
+	}
+	if err != nil {
+		if p.delaysExposure() {
+			p.logger.Printf("%s stays behind firewall %s until it's provisioned successfully\n", serverName, p.stagingFirewall.Name)
+		}
+		return err
+	}
+	if p.delaysExposure() {
+		if err := p.exposeServer(server); err != nil {
+			return err
+		}
+	}
+	labels := map[string]string{
+		managedLabel:    managedLabelValue,
+		configHashLabel: hash,
+	}
+	if p.revision != "" {
+		labels[gitRevisionLabel] = p.revision
+	}
+	if err := p.addInstallLabels(server, labels); err != nil {
+		return err
+	}
+	if version := p.image.Labels[installedVersionLabel]; snapshotBoot && version != "" {
+		// the snapshot determines the version instead of flatcar.version
+		labels[installedVersionLabel] = version
+	}
+	if err := p.persistApplied(server, rendered, labels); err != nil {
+		return err
+	}
+	if err := p.setLabels(server, labels); err != nil {
+		return err
+	}
+	return p.recordHistory(server.Name, rendered, hash, p.revision)
+}
+
+// addInstallLabels adds the installed flatcar version, the install time and the sha of the template to labels
+func (p *provisioner) addInstallLabels(server *hcloud.Server, labels map[string]string) error {
+	version, _, err := p.flatcarRelease(server)
+	if err != nil {
+		return err
+	}
+	templateSHA, err := p.templateSHA(server)
+	if err != nil {
+		return err
+	}
+	labels[installedVersionLabel] = version
+	labels[installedAtLabel] = time.Now().UTC().Format(installedAtFormat)
+	labels[templateSHALabel] = templateSHA
+	return nil
+}
+
+// ensureServer returns the server named serverName and whether it was created because it didn't exist yet
+func (p *provisioner) ensureServer(serverName string) (*hcloud.Server, bool, error) {
+	client := p.client
+	aliasIPs := p.cfg.HCloud.aliasIPs()
+	if err := p.ensurePrivateNetwork(); err != nil {
+		return nil, false, err
+	}
+	if err := p.syncFirewall(); err != nil {
+		return nil, false, err
+	}
+
+	server, _, err := client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return nil, false, fmt.Errorf("error finding server: %w", err)
+	}
+
+	if server != nil {
+		p.logger.Printf("server '%s' (id %d) already exists, checking for necessary changes\n", serverName, server.ID)
+		// check if redeploy is necessary -- fetching user data afterwards not possible, maybe cache locally/connect to server?
+		// TODO: check if specification matches
+		// TODO: support more than one network?
+		// TODO: disable if network doesn't exist / not given
+		privateNet, privateNetworkAttached := findPrivateNet(server, p.privateNetwork)
+		if !privateNetworkAttached {
+			// attach to private network
+			action, _, err := client.Server.AttachToNetwork(context.Background(), server, hcloud.ServerAttachToNetworkOpts{
+				Network:  p.privateNetwork,
+				AliasIPs: aliasIPs,
+			})
+			if err != nil {
+				return nil, false, fmt.Errorf("error request attach to network: %w", err)
+			}
+			if action.Error() != nil {
+				return nil, false, fmt.Errorf("error attaching server to network: %w", action.Error())
+			}
+			err = waitForAction(p.logger, client.Action, action)
+			if err != nil {
+				return nil, false, fmt.Errorf("error waiting for action: %w", err)
+			}
+			p.logger.Printf("attached server to network %s\n", p.privateNetwork.Name)
+		} else if !equalIPs(privateNet.Aliases, aliasIPs) {
+			if err := changeAliasIPs(p.logger, client, server, p.privateNetwork, aliasIPs); err != nil {
+				return nil, false, err
+			}
+		}
+
+		// update server object for templating
+		server, _, err = client.Server.GetByID(context.Background(), server.ID)
+		if err != nil {
+			return nil, false, fmt.Errorf("error requesting updated server object: %w", err)
+		}
+		return server, false, nil
+	}
+
+	if p.noCreate {
+		return nil, false, fmt.Errorf("server %s doesn't exist and creating servers is disabled", serverName)
+	}
+	serverCreateResult, err := p.createServer(serverName)
+	if err != nil {
+		return nil, false, err
+	}
+	if serverCreateResult.Action.Error() != nil {
+		return nil, false, fmt.Errorf("error creating server: %w", serverCreateResult.Action.Error())
+	}
+
+	// the follow-up actions (e.g. attaching networks, starting) run alongside the create action
+	actions := append([]*hcloud.Action{serverCreateResult.Action}, serverCreateResult.NextActions...)
+	if err := waitForActions(p.logger, client.Action, actions); err != nil {
+		return nil, false, fmt.Errorf("error waiting for action: %w", err)
+	}
+
+	if len(aliasIPs) > 0 {
+		if err := changeAliasIPs(p.logger, client, serverCreateResult.Server, p.privateNetwork, aliasIPs); err != nil {
+			return nil, false, err
+		}
+	}
+
+	// update server object for templating
+	server, _, err = client.Server.GetByID(context.Background(), serverCreateResult.Server.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("error requesting updated server object: %w", err)
+	}
+	return server, true, nil
+}
+
+// createServer creates the server in the first configured location the server type is available in
+func (p *provisioner) createServer(serverName string) (hcloud.ServerCreateResult, error) {
+	var lastErr error
+	for _, location := range p.locations {
+		if err := p.checkServerTypeAvailability(location); err != nil {
+			p.logger.Printf("%v\n", err)
+			lastErr = err
+			continue
+		}
+
+		p.logger.Printf("creating server '%s' in %s\n", serverName, location.Name)
+		startAfterCreate := p.cfg.HCloud.StartAfterCreate
+		createOpts := hcloud.ServerCreateOpts{
+			Name:             serverName,
+			StartAfterCreate: &startAfterCreate,
+			ServerType:       p.serverType,
+			Image:            p.image,
+			Location:         location,
+			SSHKeys:          p.sshKeys(),
+			Networks:         []*hcloud.Network{p.privateNetwork},
+			Labels:           map[string]string{managedLabel: managedLabelValue},
+		}
+		if p.cfg.HCloud.PrivateOnly {
+			createOpts.PublicNet = &hcloud.ServerCreatePublicNet{EnableIPv4: false, EnableIPv6: false}
+		}
+		if p.delaysExposure() {
+			// applied right away instead of waiting for hcloud to match the label selector
+			createOpts.Firewalls = []*hcloud.ServerCreateFirewall{{Firewall: *p.stagingFirewall}}
+			createOpts.Labels[stagingLabel] = "true"
+		}
+		if startAfterCreate {
+			userData, hash, err := p.userData(serverName, location)
+			if err != nil {
+				return hcloud.ServerCreateResult{}, err
+			}
+			createOpts.UserData = userData
+			// compared to the config rendered for the created server by bootSnapshot
+			createOpts.Labels[configHashLabel] = hash
+		}
+		if p.cfg.Flatcar.UserData.Template != "" {
+			userData, err := p.renderUserData(serverName, location)
+			if err != nil {
+				return hcloud.ServerCreateResult{}, err
+			}
+			createOpts.UserData = string(userData)
+			// compared by checkUserData, the user data can't be read from the api
+			createOpts.Labels[userDataHashLabel] = userDataHash(userData)
+		}
+		serverCreateResult, _, err := p.client.Server.Create(context.Background(), createOpts)
+		if hcloud.IsError(err, hcloud.ErrorCodeResourceUnavailable) {
+			p.logger.Printf("server type %s is unavailable in %s: %v\n", p.serverType.Name, location.Name, err)
+			lastErr = err
+			continue
+		}
+		if err != nil {
+			return hcloud.ServerCreateResult{}, fmt.Errorf("error creating server: %w", err)
+		}
+		p.logger.Printf("created server '%s' in %s\n", serverName, location.Name)
+		return serverCreateResult, nil
+	}
+	return hcloud.ServerCreateResult{}, fmt.Errorf("server couldn't be created in any location: %w", lastErr)
+}
+
+// driftState renders the ignition config for server and compares it with the hash of the applied one
+func (p *provisioner) driftState(server *hcloud.Server) (string, error) {
+	rendered, err := p.renderIgnition(server)
+	if err != nil {
+		return "", err
+	}
+	hash, err := configHash(rendered)
+	if err != nil {
+		return "", err
+	}
+	if server.Labels[configHashLabel] == hash {
+		return stateInSync, nil
+	}
+	return stateDrifted, nil
+}
+
+// setLabels adds labels to the labels already set on the server
+func (p *provisioner) setLabels(server *hcloud.Server, labels map[string]string) error {
+	merged := make(map[string]string, len(server.Labels)+len(labels))
+	for key, value := range server.Labels {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	updatedServer, _, err := p.client.Server.Update(context.Background(), server, hcloud.ServerUpdateOpts{
+		Labels: merged,
+	})
+	if err != nil {
+		return fmt.Errorf("error updating server labels: %w", err)
+	}
+	if updatedServer == nil {
+		return errors.New("server vanished while updating labels")
+	}
+	server.Labels = updatedServer.Labels
+	return nil
+}
+
+// configHash returns a hash of the ignition config short enough to be used as label value
+func configHash(rendered renderedIgnition) (string, error) {
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(cfgJSON)
+	return hex.EncodeToString(sum[:])[:40], nil
+}
+
+// adopt marks an existing server as managed by hetzner-flatcar without changing anything else,
+// the adoption is recorded in the run database with the config hash the server carries
+func (p *provisioner) adopt(serverName string) (err error) {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	if server.Labels[managedLabel] == managedLabelValue {
+		p.logger.Printf("server '%s' is already managed\n", serverName)
+		return nil
+	}
+	p.logger.Printf("adopting server '%s' (id %d)\n", serverName, server.ID)
+	p.startRun(serverName, "adopt")
+	defer func() {
+		p.finishRun(serverName, server.Labels[configHashLabel], p.revision, err)
+	}()
+	return p.setLabels(server, map[string]string{managedLabel: managedLabelValue})
+}
+
+// destroy deletes the server named serverName
+func (p *provisioner) destroy(serverName string) error {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	if server.Labels[managedLabel] != managedLabelValue {
+		return fmt.Errorf("server %s isn't managed by hetzner-flatcar", serverName)
+	}
+	if err := p.removeFromLoadBalancers(server); err != nil {
+		return err
+	}
+	p.logger.Printf("deleting server '%s' (id %d)\n", serverName, server.ID)
+	result, _, err := p.client.Server.DeleteWithResult(context.Background(), server)
+	if err != nil {
+		return fmt.Errorf("error deleting server: %w", err)
+	}
+	return waitForAction(p.logger, p.client.Action, result.Action)
+}
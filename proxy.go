@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// dialFunc opens the connection used for ssh to addr (host:port)
+type dialFunc func(addr string) (net.Conn, error)
+
+// newDialer returns a dialer connecting directly, via a socks5 proxy given as socks5://host:port
+// or via a proxy command like "ssh -W %h:%p bastion"
+func newDialer(proxyConfig string) (dialFunc, error) {
+	if proxyConfig == "" {
+		return func(addr string) (net.Conn, error) {
+			return net.DialTimeout("tcp", addr, sshTimeout)
+		}, nil
+	}
+	if strings.HasPrefix(proxyConfig, "socks5://") || strings.HasPrefix(proxyConfig, "socks5h://") {
+		proxyURL, err := url.Parse(proxyConfig)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh proxy: %w", err)
+		}
+		dialer, err := proxy.FromURL(proxyURL, &net.Dialer{Timeout: sshTimeout})
+		if err != nil {
+			return nil, fmt.Errorf("invalid ssh proxy: %w", err)
+		}
+		return func(addr string) (net.Conn, error) {
+			return dialer.Dial("tcp", addr)
+		}, nil
+	}
+	return func(addr string) (net.Conn, error) {
+		return dialProxyCommand(proxyConfig, addr)
+	}, nil
+}
+
+// dialProxyCommand runs the proxy command with %h and %p replaced and uses its stdin and stdout as connection
+func dialProxyCommand(command string, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	command = strings.NewReplacer("%h", host, "%p", port, "%%", "%").Replace(command)
+	cmd := exec.Command("sh", "-c", command)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("error starting proxy command: %w", err)
+	}
+	return &commandConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: addr}, nil
+}
+
+// commandConn is a connection through the stdin and stdout of a proxy command
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	addr   string
+}
+
+func (c *commandConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *commandConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *commandConn) Close() error {
+	c.stdin.Close()
+	if c.cmd.Process != nil {
+		c.cmd.Process.Kill()
+	}
+	return c.cmd.Wait()
+}
+
+func (c *commandConn) LocalAddr() net.Addr  { return commandAddr("proxy command") }
+func (c *commandConn) RemoteAddr() net.Addr { return commandAddr(c.addr) }
+
+// deadlines aren't supported by pipes, the ssh handshake timeout is enforced by sshConnect
+func (c *commandConn) SetDeadline(t time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type commandAddr string
+
+func (a commandAddr) Network() string { return "proxy" }
+func (a commandAddr) String() string  { return string(a) }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// imageChannelLabel is the snapshot label image_retention groups the snapshots selected by hcloud.image by
+const imageChannelLabel = "flatcar/channel"
+
+// pruneEntry is a snapshot exceeding its retention
+type pruneEntry struct {
+	Image *hcloud.Image
+	// Group is the server a safety snapshot was created of or the channel of an image snapshot
+	Group string
+	Kind  string
+}
+
+// exceedingRetention returns the images of every group beyond the newest keep ones, groups are the values of label
+func exceedingRetention(images []*hcloud.Image, label string, keep int, kind string) []pruneEntry {
+	groups := make(map[string][]*hcloud.Image)
+	for _, image := range images {
+		groups[image.Labels[label]] = append(groups[image.Labels[label]], image)
+	}
+	var entries []pruneEntry
+	for group, groupImages := range groups {
+		sort.Slice(groupImages, func(i, j int) bool {
+			return groupImages[i].Created.After(groupImages[j].Created)
+		})
+		for i := keep; i < len(groupImages); i++ {
+			entries = append(entries, pruneEntry{Image: groupImages[i], Group: group, Kind: kind})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Group != entries[j].Group {
+			return entries[i].Group < entries[j].Group
+		}
+		return entries[i].Image.Created.After(entries[j].Image.Created)
+	})
+	return entries
+}
+
+// pruneCandidates returns the safety snapshots exceeding hcloud.snapshot_retention per server and,
+// with hcloud.image_retention, the snapshots selected by hcloud.image exceeding it per channel
+func (p *provisioner) pruneCandidates() ([]pruneEntry, error) {
+	ctx := context.Background()
+	safetySnapshots, err := p.client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: snapshotOfLabel},
+		Type:     []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing safety snapshots: %w", err)
+	}
+	entries := exceedingRetention(safetySnapshots, snapshotOfLabel, p.cfg.HCloud.SnapshotRetention, "safety")
+	if p.cfg.HCloud.ImageRetention > 0 && isLabelSelector(p.cfg.HCloud.Image) {
+		imageSnapshots, err := p.client.Image.AllWithOpts(ctx, hcloud.ImageListOpts{
+			ListOpts: hcloud.ListOpts{LabelSelector: p.cfg.HCloud.Image},
+			Type:     []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing image snapshots: %w", err)
+		}
+		entries = append(entries, exceedingRetention(imageSnapshots, imageChannelLabel, p.cfg.HCloud.ImageRetention, "image")...)
+	}
+	return entries, nil
+}
+
+// prune deletes the snapshots exceeding their retention and returns them, they're only listed with dryRun
+func (p *provisioner) prune(dryRun bool) ([]pruneEntry, error) {
+	entries, err := p.pruneCandidates()
+	if err != nil || dryRun {
+		return entries, err
+	}
+	for _, entry := range entries {
+		p.logger.Printf("deleting %s snapshot %d (%s) exceeding the retention\n", entry.Kind, entry.Image.ID, entry.Image.Description)
+		if _, err := p.client.Image.Delete(context.Background(), entry.Image); err != nil {
+			return entries, fmt.Errorf("error deleting snapshot %d: %w", entry.Image.ID, err)
+		}
+	}
+	return entries, nil
+}
+
+func printPrune(w io.Writer, entries []pruneEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tKIND\tOF\tCREATED\tDESCRIPTION")
+	for _, entry := range entries {
+		group := entry.Group
+		if group == "" {
+			group = "-"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", entry.Image.ID, entry.Kind, group, entry.Image.Created.Local().Format(time.RFC3339), entry.Image.Description)
+	}
+	return tw.Flush()
+}
+
+// runPrune deletes the snapshots exceeding their retention
+func runPrune(args []string) {
+	fs := flag.NewFlagSet("prune", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	dryRun := fs.Bool("dry-run", false, "list the snapshots which would be deleted without deleting them")
+	fs.Parse(args)
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(1)
+	}
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if !*dryRun {
+		if err := p.checkWriteAccess(); err != nil {
+			fatalf("%v\n", err)
+		}
+	}
+	entries, err := p.prune(*dryRun)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if len(entries) == 0 {
+		log.Println("no snapshots exceed their retention")
+		return
+	}
+	if err := printPrune(os.Stdout, entries); err != nil {
+		fatalf("error printing snapshots: %v\n", err)
+	}
+}
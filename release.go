@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// versionLabel and channelLabel pin the flatcar version or channel of a single server, overriding the config
+const (
+	versionLabel = "flatcar.version"
+	channelLabel = "flatcar.channel"
+)
+
+// flatcarVersionPattern matches release versions like 3815.2.0 and current
+var flatcarVersionPattern = regexp.MustCompile(`^(\d+\.\d+\.\d+|current)$`)
+
+var flatcarChannels = map[string]bool{"stable": true, "beta": true, "alpha": true, "lts": true}
+
+// flatcarRelease returns the flatcar version and channel to install on server, the labels of the server take precedence over the config
+func (p *provisioner) flatcarRelease(server *hcloud.Server) (string, string, error) {
+	version, channel := p.cfg.Flatcar.Version, p.cfg.Flatcar.Channel
+	if labelVersion, ok := server.Labels[versionLabel]; ok {
+		if !flatcarVersionPattern.MatchString(labelVersion) {
+			return "", "", fmt.Errorf("invalid flatcar version %s in label %s", labelVersion, versionLabel)
+		}
+		version = labelVersion
+	}
+	if labelChannel, ok := server.Labels[channelLabel]; ok {
+		if !flatcarChannels[labelChannel] {
+			return "", "", fmt.Errorf("invalid flatcar channel %s in label %s", labelChannel, channelLabel)
+		}
+		channel = labelChannel
+	}
+	return version, channel, nil
+}
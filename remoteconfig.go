@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	ignTypes "github.com/flatcar/ignition/config/v2_3/types"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// urls returns the url the full config of server is uploaded to and the url ignition fetches it from
+func (c remoteConfig) urls(serverName string) (string, string) {
+	uploadURL := strings.ReplaceAll(c.UploadURL, "{server}", serverName)
+	fetchURL := uploadURL
+	if c.URL != "" {
+		fetchURL = strings.ReplaceAll(c.URL, "{server}", serverName)
+	}
+	return uploadURL, fetchURL
+}
+
+// uploadClient returns an http client trusting the configured ca in addition to the system ones
+func (c remoteConfig) uploadClient() (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if c.CAFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca file: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: time.Minute}, nil
+}
+
+// uploadConfig stores the full ignition config at url with a PUT request
+func (c remoteConfig) uploadConfig(url string, cfgJSON []byte) error {
+	client, err := c.uploadClient()
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, url, bytes.NewReader(cfgJSON))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range c.UploadHeaders {
+		req.Header.Set(name, value)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	return nil
+}
+
+// pointerIgnition uploads the full config of server and returns a config replacing itself with the uploaded one.
+// The pointer uses the same spec version as the full config, ignition can't replace a config with one of another major version.
+func (p *provisioner) pointerIgnition(server *hcloud.Server, rendered renderedIgnition) (renderedIgnition, error) {
+	conf := p.cfg.Flatcar.RemoteConfig
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return renderedIgnition{}, err
+	}
+	uploadURL, fetchURL := conf.urls(server.Name)
+	p.logger.Printf("uploading ignition config to %s\n", uploadURL)
+	if err := conf.uploadConfig(uploadURL, cfgJSON); err != nil {
+		return renderedIgnition{}, fmt.Errorf("error uploading ignition config: %w", err)
+	}
+
+	var hash *string
+	if !conf.AllowUpdates {
+		sum := sha512.Sum512(cfgJSON)
+		pinned := "sha512-" + hex.EncodeToString(sum[:])
+		hash = &pinned
+	}
+	var caSource string
+	if conf.CAFile != "" {
+		ca, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return renderedIgnition{}, fmt.Errorf("error reading ca file: %w", err)
+		}
+		caSource = "data:;base64," + base64.StdEncoding.EncodeToString(ca)
+	}
+
+	if rendered.config != nil {
+		if len(conf.Headers) > 0 {
+			return renderedIgnition{}, errors.New("flatcar.remote_config.headers need ignition spec 3.1 or later, use a butane template")
+		}
+		pointer := &ignTypes.Config{}
+		pointer.Ignition.Version = rendered.config.Ignition.Version
+		pointer.Ignition.Config.Replace = &ignTypes.ConfigReference{
+			Source:       fetchURL,
+			Verification: ignTypes.Verification{Hash: hash},
+		}
+		if caSource != "" {
+			pointer.Ignition.Security.TLS.CertificateAuthorities = []ignTypes.CaReference{{Source: caSource}}
+		}
+		return renderedIgnition{config: pointer}, nil
+	}
+
+	// butane configs are ignition v3, which isn't vendored, so the pointer is built from plain maps
+	var header struct {
+		Ignition struct {
+			Version string `json:"version"`
+		} `json:"ignition"`
+	}
+	if err := json.Unmarshal(rendered.raw, &header); err != nil {
+		return renderedIgnition{}, fmt.Errorf("error reading ignition version: %w", err)
+	}
+	replace := map[string]interface{}{"source": fetchURL}
+	if hash != nil {
+		replace["verification"] = map[string]interface{}{"hash": *hash}
+	}
+	if len(conf.Headers) > 0 {
+		if header.Ignition.Version == "3.0.0" {
+			return renderedIgnition{}, errors.New("flatcar.remote_config.headers need ignition spec 3.1 or later")
+		}
+		names := make([]string, 0, len(conf.Headers))
+		for name := range conf.Headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		var headers []map[string]string
+		for _, name := range names {
+			headers = append(headers, map[string]string{"name": name, "value": conf.Headers[name]})
+		}
+		replace["httpHeaders"] = headers
+	}
+	ignition := map[string]interface{}{
+		"version": header.Ignition.Version,
+		"config":  map[string]interface{}{"replace": replace},
+	}
+	if caSource != "" {
+		ignition["security"] = map[string]interface{}{
+			"tls": map[string]interface{}{
+				"certificateAuthorities": []map[string]string{{"source": caSource}},
+			},
+		}
+	}
+	raw, err := json.Marshal(map[string]interface{}{"ignition": ignition})
+	if err != nil {
+		return renderedIgnition{}, err
+	}
+	return renderedIgnition{raw: raw}, nil
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	ignTypes "github.com/flatcar/ignition/config/v2_3/types"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"gopkg.in/yaml.v3"
+)
+
+type templateData struct {
+	Server hcloud.Server
+	SSHKey hcloud.SSHKey
+	// SSHKeys are SSHKey and the keys selected by hcloud.ssh_keys_selector
+	SSHKeys []hcloud.SSHKey
+	// PrivateNet is the attachment of the server to the configured private network
+	PrivateNet hcloud.ServerPrivateNet
+	// ServerType, Datacenter and Location of the server and the Image booted before installing flatcar
+	ServerType hcloud.ServerType
+	Datacenter hcloud.Datacenter
+	Location   hcloud.Location
+	Image      hcloud.Image
+	// Index is the number the server name was generated from, e.g. 3 for web-3 of web-{1..5}
+	Index  int
+	Static map[string]string
+	// Secrets are the resolved flatcar.template_secrets
+	Secrets map[string]string
+	// NetworkGateway is the gateway of the subnet of the private network the server is in, NATGateway is hcloud.nat_gateway
+	NetworkGateway net.IP
+	NATGateway     string
+	// NTP and DNS are the time servers and resolvers recommended by Hetzner for the location of the server,
+	// TimeAndDNSFiles returns storage files configuring them in systemd-timesyncd and systemd-resolved
+	NTP             []string
+	DNS             []string
+	TimeAndDNSFiles func(int) string
+	ReadFile        func(string) (string, error)
+	Indent          func(int, string) string
+}
+
+type customTemplateDataHetzner struct {
+	Server     hcloud.Server
+	SSHKey     hcloud.SSHKey
+	PrivateNet hcloud.ServerPrivateNet
+	ServerType hcloud.ServerType
+	Datacenter hcloud.Datacenter
+	Location   hcloud.Location
+	Image      hcloud.Image
+}
+
+// sshKeyValues dereferences sshKeys for the template data
+func sshKeyValues(sshKeys []*hcloud.SSHKey) []hcloud.SSHKey {
+	values := make([]hcloud.SSHKey, len(sshKeys))
+	for i, sshKey := range sshKeys {
+		values[i] = *sshKey
+	}
+	return values
+}
+
+// serverPlacement returns server type, datacenter and location of the server, empty if unknown
+func serverPlacement(server *hcloud.Server) (hcloud.ServerType, hcloud.Datacenter, hcloud.Location) {
+	var serverType hcloud.ServerType
+	var datacenter hcloud.Datacenter
+	var location hcloud.Location
+	if server.ServerType != nil {
+		serverType = *server.ServerType
+	}
+	if server.Datacenter != nil {
+		datacenter = *server.Datacenter
+		if datacenter.Location != nil {
+			location = *datacenter.Location
+		}
+	}
+	return serverType, datacenter, location
+}
+
+type customTemplateData struct {
+	Hetzner        customTemplateDataHetzner
+	Index          int
+	Secrets        map[string]string
+	NetworkGateway net.IP
+	NATGateway     string
+	NTP            []string
+	DNS            []string
+}
+
+// templateSHA returns the first 16 hex digits of the sha256 of the template of server, of the template command if one is configured
+func (p *provisioner) templateSHA(server *hcloud.Server) (string, error) {
+	content := []byte(p.cfg.Flatcar.TemplateCommand)
+	if p.cfg.Flatcar.TemplateCommand == "" {
+		templatePath, err := p.templateFor(server)
+		if err != nil {
+			return "", err
+		}
+		content, err = ioutil.ReadFile(templatePath)
+		if err != nil {
+			return "", fmt.Errorf("error reading template: %w", err)
+		}
+	}
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// templateFor returns the template for the server, the one of the matching templates pattern or the config template
+func (p *provisioner) templateFor(server *hcloud.Server) (string, error) {
+	var matches []string
+	for pattern := range p.cfg.Flatcar.Templates {
+		if key, value, isLabel := strings.Cut(pattern, "="); isLabel {
+			if labelValue, ok := server.Labels[key]; ok && labelValue == value {
+				matches = append(matches, pattern)
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, server.Name); matched {
+			matches = append(matches, pattern)
+		}
+	}
+	switch len(matches) {
+	case 0:
+		return p.cfg.Flatcar.ConfigTemplate, nil
+	case 1:
+		return p.cfg.Flatcar.Templates[matches[0]], nil
+	}
+	sort.Strings(matches)
+	return "", fmt.Errorf("server %s matches multiple templates: %s", server.Name, strings.Join(matches, ", "))
+}
+
+// renderTemplate renders the container linux config for server using the native template or the template command
+func (p *provisioner) renderTemplate(server *hcloud.Server) ([]byte, error) {
+	cfg := p.cfg
+	privateNet, _ := findPrivateNet(server, p.privateNetwork)
+	_, _, location := serverPlacement(server)
+	services := servicesFor(location)
+
+	if cfg.Flatcar.TemplateCommand == "" {
+		ignitionTemplate, err := p.templateFor(server)
+		if err != nil {
+			return nil, err
+		}
+		return p.renderNativeTemplate(server, ignitionTemplate)
+	}
+
+	p.logger.Printf("rendering ignition config using command '%s'\n", cfg.Flatcar.TemplateCommand)
+
+	// marshal template data for passing it to the custom command
+	templateData := customTemplateData{
+		Hetzner:        p.serverContext(server),
+		Index:          p.indexes[server.Name],
+		Secrets:        cfg.Flatcar.TemplateSecrets,
+		NetworkGateway: subnetGateway(p.privateNetwork, privateNet.IP),
+		NATGateway:     cfg.HCloud.NATGateway,
+		NTP:            services.NTP,
+		DNS:            services.DNS,
+	}
+	templateDataYAML, err := yaml.Marshal(templateData)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling hcloud data to yaml: %w", err)
+	}
+
+	// execute custom template command
+	tmplCmd := exec.Command(cfg.Flatcar.TemplateCommand, server.Name)
+	tmplCmd.Stdin = bytes.NewReader(templateDataYAML)
+	templateContent, err := tmplCmd.Output()
+	if err != nil {
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			p.logger.Println(string(exitError.Stderr))
+		}
+		return nil, fmt.Errorf("error running template command: %w", err)
+	}
+	return templateContent, nil
+}
+
+// renderNativeTemplate renders the go template at ignitionTemplate for server
+func (p *provisioner) renderNativeTemplate(server *hcloud.Server, ignitionTemplate string) ([]byte, error) {
+	cfg := p.cfg
+	privateNet, _ := findPrivateNet(server, p.privateNetwork)
+	serverType, datacenter, location := serverPlacement(server)
+	services := servicesFor(location)
+
+	p.logger.Printf("rendering ignition config using native template at %s\n", ignitionTemplate)
+	buffer := &bytes.Buffer{}
+	content, err := p.readInput(server.Name, ignitionTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("error loading template: %w", err)
+	}
+	tmpl, err := template.New(filepath.Base(ignitionTemplate)).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("error loading template: %w", err)
+	}
+	templateServer := *server
+	if cfg.Flatcar.Deterministic {
+		templateServer = deterministicServer(templateServer)
+	}
+	err = tmpl.Execute(buffer, templateData{
+		Server:     templateServer,
+		SSHKey:     *p.sshKey,
+		SSHKeys:    sshKeyValues(p.sshKeys()),
+		PrivateNet: privateNet,
+		ServerType: serverType,
+		Datacenter: datacenter,
+		Location:   location,
+		Image:      *p.image,
+		Index:      p.indexes[server.Name],
+		Static:     cfg.Flatcar.TemplateStatic,
+		Secrets:    cfg.Flatcar.TemplateSecrets,
+		// nil while the private network is created by the first server
+		NetworkGateway:  subnetGateway(p.privateNetwork, privateNet.IP),
+		NATGateway:      cfg.HCloud.NATGateway,
+		NTP:             services.NTP,
+		DNS:             services.DNS,
+		TimeAndDNSFiles: services.storageFiles,
+		ReadFile: func(filename string) (string, error) {
+			content, err := p.readInput(server.Name, filename)
+			return string(content), err
+		},
+		Indent: func(indent int, input string) string {
+			lines := strings.Split(input, "\n")
+			output := make([]string, len(lines))
+			indentString := strings.Repeat(" ", indent)
+			for i := 0; i < len(output); i++ {
+				output[i] = indentString + lines[i]
+			}
+			return strings.Join(output, "\n")
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error rendering template: %w", err)
+	}
+
+	return ioutil.ReadAll(buffer)
+}
+
+// serverContext returns the data of server passed to the template command and plugins
+func (p *provisioner) serverContext(server *hcloud.Server) customTemplateDataHetzner {
+	privateNet, _ := findPrivateNet(server, p.privateNetwork)
+	serverType, datacenter, location := serverPlacement(server)
+	data := customTemplateDataHetzner{
+		Server:     *server,
+		PrivateNet: privateNet,
+		ServerType: serverType,
+		Datacenter: datacenter,
+		Location:   location,
+	}
+	if p.sshKey != nil {
+		data.SSHKey = *p.sshKey
+	}
+	if p.image != nil {
+		data.Image = *p.image
+	}
+	return data
+}
+
+// renderIgnition renders the template for server and transpiles it into an ignition config
+func (p *provisioner) renderIgnition(server *hcloud.Server) (renderedIgnition, error) {
+	p.inputs.reset(server.Name)
+	templateContent, err := p.renderTemplate(server)
+	if err != nil {
+		return renderedIgnition{}, err
+	}
+	rendered, err := transpileConfig(p.logger, templateContent)
+	if err != nil {
+		return renderedIgnition{}, fmt.Errorf("error transpiling config: %w", err)
+	}
+	ignitionConfig := rendered.config
+	if ignitionConfig == nil {
+		// butane configs can't be extended
+		conf := p.cfg.Flatcar
+		if conf.UpdateGroup != "" || conf.RebootStrategy != "" || conf.LocksmithWindow != "" || conf.PrivateNetworkUnit || conf.InjectSSHKey {
+			return renderedIgnition{}, errors.New("update strategy, private_network_unit and inject_ssh_key are only supported for container linux configs")
+		}
+		return p.withUserData(server, rendered)
+	}
+	injectUpdateConfig(p.logger, ignitionConfig, p.cfg.Flatcar)
+	if p.cfg.Flatcar.PrivateNetworkUnit {
+		if err := p.injectPrivateNetworkUnit(ignitionConfig, server); err != nil {
+			return renderedIgnition{}, err
+		}
+	}
+	if p.cfg.Flatcar.InjectSSHKey {
+		sshKeys := p.sshKeys()
+		publicKeys := make([]string, len(sshKeys))
+		for i, sshKey := range sshKeys {
+			publicKeys[i] = sshKey.PublicKey
+		}
+		if injectCoreSSHKeys(ignitionConfig, publicKeys) {
+			p.logger.Printf("injected %d ssh keys for user core\n", len(publicKeys))
+		}
+	}
+	return p.withUserData(server, rendered)
+}
+
+// injectPrivateNetworkUnit adds the generated networkd unit for the private interface unless the template defines it
+func (p *provisioner) injectPrivateNetworkUnit(ignitionConfig *ignTypes.Config, server *hcloud.Server) error {
+	for _, unit := range ignitionConfig.Networkd.Units {
+		if unit.Name == privateNetworkUnitName {
+			p.logger.Printf("template already defines %s, not injecting it\n", privateNetworkUnitName)
+			return nil
+		}
+	}
+	privateNet, _ := findPrivateNet(server, p.privateNetwork)
+	// servers without public ipv4 reach the internet via the nat gateway
+	defaultRoute := p.cfg.HCloud.NATGateway != "" && (server.PublicNet.IPv4.IP == nil || server.PublicNet.IPv4.IP.IsUnspecified())
+	contents, err := privateNetworkUnit(privateNet, p.privateNetwork, defaultRoute)
+	if err != nil {
+		return fmt.Errorf("error generating private network unit: %w", err)
+	}
+	ignitionConfig.Networkd.Units = append(ignitionConfig.Networkd.Units, ignTypes.Networkdunit{
+		Name:     privateNetworkUnitName,
+		Contents: contents,
+	})
+	return nil
+}
@@ -0,0 +1,515 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	htmlTemplate "html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// redacted replaces secret values in reports
+const redacted = "<redacted>"
+
+// transcriptLines is the number of output lines of a command kept in the report
+const transcriptLines = 200
+
+// diffContext is the number of unchanged lines around changes in the ignition diff
+const diffContext = 3
+
+// maxDiffCells limits the memory used to diff large configs, beyond it the changed lines are replaced as a whole
+const maxDiffCells = 1 << 22
+
+// commandTranscript is a command run in the rescue system with its output
+type commandTranscript struct {
+	Command  string
+	Output   []string
+	Duration time.Duration
+	Error    string
+}
+
+// serverReport is everything recorded about provisioning a single server
+type serverReport struct {
+	Name string
+	// Diff is the unified diff of the previously applied and the new ignition config, both redacted
+	Diff     string
+	Commands []commandTranscript
+	Run      *runRecord
+}
+
+// report collects the plan, ignition diffs, command transcripts and timings of a run, nil if not requested
+type report struct {
+	mu      sync.Mutex
+	started time.Time
+	plan    string
+	servers map[string]*serverReport
+}
+
+func newReport() *report {
+	return &report{started: time.Now(), servers: make(map[string]*serverReport)}
+}
+
+func (r *report) server(serverName string) *serverReport {
+	server, ok := r.servers[serverName]
+	if !ok {
+		server = &serverReport{Name: serverName}
+		r.servers[serverName] = server
+	}
+	return server
+}
+
+// setPlan adds the plan printed as by --dry-run
+func (r *report) setPlan(entries []planEntry) error {
+	if r == nil {
+		return nil
+	}
+	var plan bytes.Buffer
+	if err := printPlan(&plan, entries); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.plan = plan.String()
+	return nil
+}
+
+// recorder returns the function adding command transcripts of serverName, nil without report
+func (r *report) recorder(serverName string) func(commandTranscript) {
+	if r == nil {
+		return nil
+	}
+	return func(transcript commandTranscript) {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		server := r.server(serverName)
+		server.Commands = append(server.Commands, transcript)
+	}
+}
+
+// setRun adds the finished run with its phases
+func (r *report) setRun(run *runRecord) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.server(run.Server).Run = run
+}
+
+// reportIgnition adds the diff of the ignition config last applied to the server and rendered
+func (p *provisioner) reportIgnition(server *hcloud.Server, rendered renderedIgnition) error {
+	if p.report == nil {
+		return nil
+	}
+	current, err := redactRendered(rendered)
+	if err != nil {
+		return err
+	}
+	previous, previousName, err := p.appliedConfig(server)
+	if err != nil {
+		return err
+	}
+	if previous == nil {
+		previous, previousName = []byte{}, "/dev/null"
+	}
+	diff := unifiedDiff(previousName, "rendered", splitLines(previous), splitLines(current))
+	p.report.mu.Lock()
+	defer p.report.mu.Unlock()
+	p.report.server(server.Name).Diff = diff
+	return nil
+}
+
+// redactIgnition returns the ignition config as indented json with password hashes, http header values,
+// the contents of files which aren't world readable and registered secrets replaced
+func redactIgnition(cfgJSON []byte) ([]byte, error) {
+	var cfg interface{}
+	if err := json.Unmarshal(cfgJSON, &cfg); err != nil {
+		return nil, fmt.Errorf("error parsing ignition config: %w", err)
+	}
+	redactValue(cfg)
+	cfgJSON, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return []byte(secrets.redact(string(cfgJSON))), nil
+}
+
+func redactValue(value interface{}) {
+	switch value := value.(type) {
+	case []interface{}:
+		for _, item := range value {
+			redactValue(item)
+		}
+	case map[string]interface{}:
+		for key, item := range value {
+			switch key {
+			case "passwordHash":
+				value[key] = redacted
+			case "httpHeaders":
+				if headers, ok := item.([]interface{}); ok {
+					for _, header := range headers {
+						if header, ok := header.(map[string]interface{}); ok && header["value"] != nil {
+							header["value"] = redacted
+						}
+					}
+				}
+			default:
+				redactValue(item)
+			}
+		}
+		// files without mode are created world readable
+		if mode, ok := value["mode"].(float64); ok && int(mode)&0004 == 0 {
+			if contents, ok := value["contents"].(map[string]interface{}); ok && contents["source"] != nil {
+				contents["source"] = redacted
+			}
+		}
+	}
+}
+
+func splitLines(content []byte) []string {
+	if len(content) == 0 {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+}
+
+// diffOp is a line of a diff, kind is ' ' for unchanged, '-' for removed and '+' for added lines
+type diffOp struct {
+	kind byte
+	text string
+}
+
+// diffLines returns the operations turning a into b based on the longest common subsequence of the lines
+func diffLines(a []string, b []string) []diffOp {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+	middleA, middleB := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	ops := make([]diffOp, 0, len(a)+len(b))
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	// lcs[i][j] is the length of the longest common subsequence of middleA[i:] and middleB[j:],
+	// too large configs aren't aligned and all removed lines are shown before the added ones
+	var lcs [][]int
+	if len(middleA)*len(middleB) <= maxDiffCells {
+		lcs = make([][]int, len(middleA)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(middleB)+1)
+		}
+		for i := len(middleA) - 1; i >= 0; i-- {
+			for j := len(middleB) - 1; j >= 0; j-- {
+				switch {
+				case middleA[i] == middleB[j]:
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				case lcs[i+1][j] >= lcs[i][j+1]:
+					lcs[i][j] = lcs[i+1][j]
+				default:
+					lcs[i][j] = lcs[i][j+1]
+				}
+			}
+		}
+	}
+	i, j := 0, 0
+	for i < len(middleA) || j < len(middleB) {
+		switch {
+		case i < len(middleA) && j < len(middleB) && middleA[i] == middleB[j]:
+			ops = append(ops, diffOp{' ', middleA[i]})
+			i++
+			j++
+		case j == len(middleB) || (i < len(middleA) && (lcs == nil || lcs[i+1][j] >= lcs[i][j+1])):
+			ops = append(ops, diffOp{'-', middleA[i]})
+			i++
+		default:
+			ops = append(ops, diffOp{'+', middleB[j]})
+			j++
+		}
+	}
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{' ', line})
+	}
+	return ops
+}
+
+// unifiedDiff formats the changes from a to b as unified diff, empty if they are equal
+func unifiedDiff(fromName string, toName string, a []string, b []string) string {
+	ops := diffLines(a, b)
+	// linesA[i] and linesB[i] are the numbers of lines of a and b preceding ops[i]
+	linesA, linesB := make([]int, len(ops)+1), make([]int, len(ops)+1)
+	for i, op := range ops {
+		linesA[i+1], linesB[i+1] = linesA[i], linesB[i]
+		if op.kind != '+' {
+			linesA[i+1]++
+		}
+		if op.kind != '-' {
+			linesB[i+1]++
+		}
+	}
+	var out strings.Builder
+	for end, change := 0, 0; ; {
+		for change < len(ops) && ops[change].kind == ' ' {
+			change++
+		}
+		if change == len(ops) {
+			break
+		}
+		start := change - diffContext
+		if start < end {
+			start = end
+		}
+		// changes separated by at most two contexts of unchanged lines share a hunk
+		last := change
+		for k := change + 1; k < len(ops) && k-last <= 2*diffContext+1; k++ {
+			if ops[k].kind != ' ' {
+				last = k
+			}
+		}
+		end = last + 1 + diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", fromName, toName)
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n", hunkRange(linesA[start], linesA[end]-linesA[start]), hunkRange(linesB[start], linesB[end]-linesB[start]))
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&out, "%c%s\n", op.kind, op.text)
+		}
+		change = end
+	}
+	return out.String()
+}
+
+func hunkRange(line int, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", line)
+	}
+	return fmt.Sprintf("%d,%d", line+1, count)
+}
+
+// reportData is passed to the report templates
+type reportData struct {
+	Started     time.Time
+	Finished    time.Time
+	Version     string
+	Operator    string
+	GitRevision string
+	Plan        string
+	Servers     []*serverReport
+}
+
+var reportFuncs = map[string]interface{}{
+	"duration": func(duration time.Duration) string {
+		return duration.Round(time.Millisecond).String()
+	},
+	"time": func(t time.Time) string {
+		return t.Local().Format(time.RFC3339)
+	},
+	"join": strings.Join,
+}
+
+const markdownReport = `# Provisioning report
+
+| | |
+|---|---|
+| Started | {{ time .Started }} |
+| Finished | {{ time .Finished }} |
+| Operator | {{ .Operator }} |
+| Version | {{ .Version }} |
+{{- if .GitRevision }}
+| Git revision | {{ .GitRevision }} |
+{{- end }}
+
+{{- if .Plan }}
+
+## Plan
+
+` + "```" + `
+{{ .Plan }}` + "```" + `
+{{- end }}
+{{ range .Servers }}
+## {{ .Name }}
+{{ with .Run }}
+**{{ .Result }}** in {{ duration (.Finished.Sub .Started) }}{{ if .ConfigHash }}, config hash ` + "`{{ .ConfigHash }}`" + `{{ end }}
+{{- if .Error }}
+
+` + "```" + `
+{{ .Error }}
+` + "```" + `
+{{- end }}
+
+| Phase | Started | Duration |
+|---|---|---|
+{{- range .Phases }}
+| {{ .Phase }} | {{ time .Started }} | {{ duration .Duration }} |
+{{- end }}
+{{ end }}
+### Ignition config
+{{ if .Diff }}
+` + "```diff" + `
+{{ .Diff }}` + "```" + `
+{{ else }}
+No changes.
+{{ end }}
+{{- if .Commands }}
+### Commands
+{{ range .Commands }}
+` + "`{{ .Command }}`" + ` ({{ duration .Duration }}{{ if .Error }}, failed: {{ .Error }}{{ end }})
+{{- if .Output }}
+
+` + "```" + `
+{{ join .Output "\n" }}
+` + "```" + `
+{{- end }}
+{{ end }}
+{{- end }}
+{{- end }}
+`
+
+const htmlReport = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Provisioning report {{ time .Started }}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.6em; text-align: left; }
+pre { background: #f6f8fa; padding: 0.8em; overflow-x: auto; }
+.succeeded { color: #1a7f37; }
+.failed { color: #cf222e; }
+.add { color: #1a7f37; }
+.del { color: #cf222e; }
+</style>
+</head>
+<body>
+<h1>Provisioning report</h1>
+<table>
+<tr><th>Started</th><td>{{ time .Started }}</td></tr>
+<tr><th>Finished</th><td>{{ time .Finished }}</td></tr>
+<tr><th>Operator</th><td>{{ .Operator }}</td></tr>
+<tr><th>Version</th><td>{{ .Version }}</td></tr>
+{{- if .GitRevision }}
+<tr><th>Git revision</th><td>{{ .GitRevision }}</td></tr>
+{{- end }}
+</table>
+{{- if .Plan }}
+<h2>Plan</h2>
+<pre>{{ .Plan }}</pre>
+{{- end }}
+{{- range .Servers }}
+<h2>{{ .Name }}</h2>
+{{- with .Run }}
+<p><strong class="{{ .Result }}">{{ .Result }}</strong> in {{ duration (.Finished.Sub .Started) }}{{ if .ConfigHash }}, config hash <code>{{ .ConfigHash }}</code>{{ end }}</p>
+{{- if .Error }}
+<pre class="failed">{{ .Error }}</pre>
+{{- end }}
+<table>
+<tr><th>Phase</th><th>Started</th><th>Duration</th></tr>
+{{- range .Phases }}
+<tr><td>{{ .Phase }}</td><td>{{ time .Started }}</td><td>{{ duration .Duration }}</td></tr>
+{{- end }}
+</table>
+{{- end }}
+<h3>Ignition config</h3>
+{{- if .Diff }}
+<pre>{{ range diffLines .Diff }}{{ if hasPrefix . "+" }}<span class="add">{{ . }}</span>{{ else if hasPrefix . "-" }}<span class="del">{{ . }}</span>{{ else }}{{ . }}{{ end }}
+{{ end }}</pre>
+{{- else }}
+<p>No changes.</p>
+{{- end }}
+{{- if .Commands }}
+<h3>Commands</h3>
+{{- range .Commands }}
+<p><code>{{ .Command }}</code> ({{ duration .Duration }}{{ if .Error }}, <span class="failed">failed: {{ .Error }}</span>{{ end }})</p>
+{{- if .Output }}
+<pre>{{ join .Output "\n" }}</pre>
+{{- end }}
+{{- end }}
+{{- end }}
+{{- end }}
+</body>
+</html>
+`
+
+// write renders the report as html if path ends with .html or .htm and as markdown otherwise
+func (r *report) write(path string, gitRevision string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	data := reportData{
+		Started:     r.started,
+		Finished:    time.Now(),
+		Version:     buildVersion().Version,
+		Operator:    operator(),
+		GitRevision: gitRevision,
+		Plan:        r.plan,
+	}
+	for _, server := range r.servers {
+		data.Servers = append(data.Servers, server)
+	}
+	sort.Slice(data.Servers, func(i, j int) bool {
+		return data.Servers[i].Name < data.Servers[j].Name
+	})
+
+	var out bytes.Buffer
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".html", ".htm":
+		funcs := htmlTemplate.FuncMap(reportFuncs)
+		funcs["diffLines"] = func(diff string) []string {
+			return strings.Split(strings.TrimSuffix(diff, "\n"), "\n")
+		}
+		funcs["hasPrefix"] = strings.HasPrefix
+		tmpl, err := htmlTemplate.New("report").Funcs(funcs).Parse(htmlReport)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(&out, data); err != nil {
+			return err
+		}
+	default:
+		tmpl, err := template.New("report").Funcs(reportFuncs).Parse(markdownReport)
+		if err != nil {
+			return err
+		}
+		if err := tmpl.Execute(&out, data); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(path, out.Bytes(), 0600); err != nil {
+		return fmt.Errorf("error writing report: %w", err)
+	}
+	log.Printf("wrote report to %s\n", path)
+	return nil
+}
+
+// writeTranscript records a command for the report with the last lines of its output and the number of lines omitted before
+func writeTranscript(record func(commandTranscript), command string, output []string, omitted int, duration time.Duration, err error) {
+	if record == nil {
+		return
+	}
+	if omitted > 0 {
+		output = append([]string{fmt.Sprintf("[%d lines omitted]", omitted)}, output...)
+	}
+	for i, line := range output {
+		output[i] = secrets.redact(line)
+	}
+	transcript := commandTranscript{Command: secrets.redact(command), Output: output, Duration: duration}
+	if err != nil {
+		transcript.Error = secrets.redact(err.Error())
+	}
+	record(transcript)
+}
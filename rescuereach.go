@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// rescueRetryDelay is the delay between attempts to connect to the rescue system
+var rescueRetryDelay = 10 * time.Second
+
+// firewallCheckAttempt is the failed attempt after which the firewalls of a server are checked for blocking ssh
+const firewallCheckAttempt = 3
+
+// kinds of errors connecting to the rescue system
+const (
+	dialTimeout     = "timeout"
+	dialRefused     = "refused"
+	dialUnreachable = "unreachable"
+	dialOther       = "other"
+)
+
+// classifyDialError returns the kind of a network error connecting to a server
+func classifyDialError(err error) string {
+	var netError net.Error
+	switch {
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return dialRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return dialUnreachable
+	case errors.As(err, &netError) && netError.Timeout():
+		return dialTimeout
+	}
+	return dialOther
+}
+
+// rescueReachability collects the failed attempts to connect to the rescue system to explain why it isn't reachable
+type rescueReachability struct {
+	attempts int
+	kinds    map[string]int
+	last     error
+	hinted   bool
+}
+
+func (r *rescueReachability) add(err error) {
+	if r.kinds == nil {
+		r.kinds = make(map[string]int)
+	}
+	r.attempts++
+	r.kinds[classifyDialError(err)]++
+	r.last = err
+}
+
+// onlyTimeouts returns whether every attempt timed out, which usually means something drops the packets
+func (r *rescueReachability) onlyTimeouts() bool {
+	return r.attempts > 0 && r.kinds[dialTimeout] == r.attempts
+}
+
+// blockingFirewalls returns the names of the hcloud firewalls applied to server if none of them allows inbound ssh.
+// The rules of all firewalls applied to a server are combined, so a single one allowing ssh is enough.
+func (p *provisioner) blockingFirewalls(server *hcloud.Server) ([]string, error) {
+	ctx := context.Background()
+	current, _, err := p.client.Server.GetByID(ctx, server.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error refreshing server: %w", err)
+	}
+	if current == nil {
+		return nil, nil
+	}
+	var names []string
+	for _, status := range current.PublicNet.Firewalls {
+		firewall, _, err := p.client.Firewall.GetByID(ctx, status.Firewall.ID)
+		if err != nil {
+			return nil, fmt.Errorf("error getting firewall %d: %w", status.Firewall.ID, err)
+		}
+		if firewall == nil {
+			continue
+		}
+		if allowsSSH(firewall.Rules) {
+			return nil, nil
+		}
+		names = append(names, firewall.Name)
+	}
+	return names, nil
+}
+
+// checkRescueReachability is called after every failed attempt to connect to the rescue system of server.
+// It returns an error to give up early if a firewall of the server blocks ssh and hints at blocked egress once.
+func (p *provisioner) checkRescueReachability(server *hcloud.Server, reach *rescueReachability) error {
+	if reach.attempts != firewallCheckAttempt {
+		return nil
+	}
+	firewalls, err := p.blockingFirewalls(server)
+	if err != nil {
+		p.logger.Printf("warning: error checking firewalls of %s: %v\n", server.Name, err)
+	} else if len(firewalls) > 0 {
+		return fmt.Errorf("rescue system of %s isn't reachable via ssh: firewall %s applied to it doesn't allow inbound tcp port 22, "+
+			"add a rule allowing it from this host or remove the firewall until the server is installed", server.Name, strings.Join(firewalls, ", "))
+	}
+	if reach.onlyTimeouts() && !reach.hinted {
+		reach.hinted = true
+		p.logger.Printf("warning: connections to the rescue system of %s time out, outgoing ssh may be blocked by the network this runs in\n", server.Name)
+	}
+	return nil
+}
+
+// explainUnreachableRescue returns the error after all attempts to connect to the rescue system at addr failed,
+// explaining what the errors point at
+func explainUnreachableRescue(serverName string, addr string, reach *rescueReachability) error {
+	summary := fmt.Sprintf("rescue system of %s at %s wasn't reachable via ssh after %d attempts (%d timed out, %d refused, %d unreachable)",
+		serverName, addr, reach.attempts, reach.kinds[dialTimeout], reach.kinds[dialRefused], reach.kinds[dialUnreachable])
+	var hint string
+	switch {
+	case reach.onlyTimeouts():
+		hint = "no connection was answered, outgoing tcp port 22 is likely blocked between this host and the server, " +
+			"run this from another network or tunnel ssh through ssh.proxy or ssh.bastion"
+	case reach.kinds[dialRefused] > 0:
+		hint = "the server answers but nothing listens on port 22, the rescue system may not have booted, " +
+			"check its console with console --screenshot"
+	case reach.kinds[dialUnreachable] > 0:
+		hint = "there is no route to the server, check the network of this host and ssh.address_family"
+	}
+	if hint == "" {
+		return fmt.Errorf("%s: %w", summary, reach.last)
+	}
+	return fmt.Errorf("%s: %s: %w", summary, hint, reach.last)
+}
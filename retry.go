@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// outputTail is the number of output lines of a failed command kept to classify the failure
+const outputTail = 20
+
+// retriableCurlCodes are exit codes of curl caused by network problems:
+// couldn't resolve host, couldn't connect, partial file, timeout, tls handshake failed, empty reply, send and receive errors
+var retriableCurlCodes = map[int]bool{6: true, 7: true, 18: true, 28: true, 35: true, 52: true, 55: true, 56: true}
+
+// retriableOutputs are output fragments of apt, curl and flatcar-install failing because of transient network or mirror problems
+var retriableOutputs = []string{
+	"Temporary failure resolving",
+	"Could not resolve",
+	"Could not connect to",
+	"Unable to connect to",
+	"Connection timed out",
+	"Connection reset by peer",
+	"Failed to fetch",
+	"Hash Sum mismatch",
+	"Could not get lock",
+	"curl: (6)",
+	"curl: (7)",
+	"curl: (18)",
+	"curl: (28)",
+	"curl: (35)",
+	"curl: (52)",
+	"curl: (56)",
+	"returned error: 5",
+}
+
+// errCommandTimeout is returned for commands not finishing within ssh.command_timeout
+var errCommandTimeout = errors.New("timed out")
+
+// commandError is a failed remote command with the last lines of its output
+type commandError struct {
+	err    error
+	output []string
+}
+
+func (e *commandError) Error() string {
+	if len(e.output) == 0 {
+		return e.err.Error()
+	}
+	return fmt.Sprintf("%v: %s", e.err, e.output[len(e.output)-1])
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// connectionLost returns whether the command failed because the ssh connection broke
+func connectionLost(err error) bool {
+	var exitMissing *ssh.ExitMissingError
+	return errors.As(err, &exitMissing) || errors.Is(err, io.EOF)
+}
+
+// retryPolicy decides which failures of a remote command are retried
+type retryPolicy int
+
+const (
+	// retryTransient retries broken connections and failures caused by the network or a mirror
+	retryTransient retryPolicy = iota
+	// retryTimeouts retries commands exceeding ssh.command_timeout as well
+	retryTimeouts
+	// retryNever runs commands which aren't idempotent exactly once, e.g. flatcar-install,
+	// which would be run again against a half-written disk
+	retryNever
+)
+
+// retriable classifies a failure of command as transient, e.g. caused by the network or a mirror
+func retriable(command string, err error, policy retryPolicy) bool {
+	if policy == retryNever {
+		return false
+	}
+	if connectionLost(err) || (policy == retryTimeouts && errors.Is(err, errCommandTimeout)) {
+		return true
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) && strings.HasPrefix(command, "curl ") && retriableCurlCodes[exitErr.ExitStatus()] {
+		return true
+	}
+	var cmdErr *commandError
+	if !errors.As(err, &cmdErr) {
+		return false
+	}
+	for _, line := range cmdErr.output {
+		for _, fragment := range retriableOutputs {
+			if strings.Contains(line, fragment) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// runRetry runs command like runTimeout and retries the failures policy allows with exponential backoff,
+// reconnecting if the connection broke
+func (s *sshSession) runRetry(command string, conf sshConfig, policy retryPolicy, output func(line string)) error {
+	delay := conf.commandRetryDelay()
+	for attempt := 0; ; attempt++ {
+		err := s.runTimeout(command, conf.commandTimeout(), output)
+		if err == nil {
+			return nil
+		}
+		if attempt >= conf.CommandRetries || !retriable(command, err, policy) {
+			return err
+		}
+		s.logger.Printf("command '%s' failed transiently, retrying in %s (%d/%d): %v\n", command, delay, attempt+1, conf.CommandRetries, err)
+		time.Sleep(delay)
+		delay *= 2
+		if connectionLost(err) {
+			if err := s.reconnect(); err != nil {
+				s.logger.Printf("error reconnecting: %v\n", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRetriableFollowsPolicy(t *testing.T) {
+	timeout := &commandError{err: errCommandTimeout}
+	transient := &commandError{err: errors.New("exit 100"), output: []string{"Temporary failure resolving 'deb.debian.org'"}}
+	install := "/root/flatcar-install -i /root/ignition.json"
+	for _, test := range []struct {
+		name      string
+		command   string
+		err       error
+		policy    retryPolicy
+		retriable bool
+	}{
+		{name: "timeout with retryTimeouts", command: "apt update", err: timeout, policy: retryTimeouts, retriable: true},
+		{name: "timeout with retryTransient", command: "apt update", err: timeout, policy: retryTransient, retriable: false},
+		{name: "lost connection", command: "apt update", err: io.EOF, policy: retryTransient, retriable: true},
+		{name: "transient output", command: "apt update", err: transient, policy: retryTransient, retriable: true},
+		{name: "other failure", command: "apt update", err: &commandError{err: errors.New("exit 1"), output: []string{"E: Unable to locate package"}}, policy: retryTimeouts, retriable: false},
+		{name: "install timeout", command: install, err: timeout, policy: retryNever, retriable: false},
+		{name: "install lost connection", command: install, err: io.EOF, policy: retryNever, retriable: false},
+		{name: "install transient output", command: install, err: transient, policy: retryNever, retriable: false},
+	} {
+		if retriable(test.command, test.err, test.policy) != test.retriable {
+			t.Errorf("%s: expected retriable to be %v", test.name, test.retriable)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// rolloutConfig configures canary rollouts, the canaries are provisioned and checked before the remaining servers
+type rolloutConfig struct {
+	// Canary is the number (e.g. 1) or percentage (e.g. 10%) of servers provisioned first, disabled if empty
+	Canary string
+	// Soak is waited after the canaries were provisioned before checking their health, defaults to 0
+	Soak string
+	// HealthCommands are run on every canary after the soak, all of them have to exit with 0
+	HealthCommands []string `toml:"health_commands"`
+}
+
+// canaryCount returns the number of canaries of total servers for canary, percentages are rounded up
+func canaryCount(canary string, total int) (int, error) {
+	if canary == "" {
+		return 0, nil
+	}
+	var count int
+	if percentage := strings.TrimSuffix(canary, "%"); percentage != canary {
+		value, err := strconv.ParseFloat(percentage, 64)
+		if err != nil || value <= 0 || value > 100 {
+			return 0, fmt.Errorf("invalid canary percentage %s", canary)
+		}
+		count = int(math.Ceil(float64(total) * value / 100))
+	} else {
+		value, err := strconv.Atoi(canary)
+		if err != nil || value < 1 {
+			return 0, fmt.Errorf("invalid canary count %s", canary)
+		}
+		count = value
+	}
+	if count > total {
+		count = total
+	}
+	return count, nil
+}
+
+// provisionCanary provisions count canaries first, waits for soak and checks their health.
+// The remaining servers are only provisioned if all canaries succeeded and are healthy, otherwise they're skipped.
+func (p *provisioner) provisionCanary(serverNames []string, count int, soak time.Duration, concurrency int, keepGoing bool) batchSummary {
+	canaries, rest := serverNames[:count], serverNames[count:]
+	p.logger.Printf("provisioning canaries %s\n", strings.Join(canaries, ", "))
+	errs := p.provisionAll(canaries, concurrency, keepGoing)
+	if len(errs) == 0 && len(rest) > 0 {
+		if soak > 0 {
+			p.logger.Printf("canaries provisioned, soaking for %s\n", soak)
+			time.Sleep(soak)
+		}
+		errs = p.checkCanaries(canaries)
+	}
+	if len(errs) > 0 {
+		p.logger.Printf("canary rollout aborted, %d of %d canaries failed, skipping %d servers\n", len(errs), len(canaries), len(rest))
+		for _, serverName := range rest {
+			errs[serverName] = errSkipped
+		}
+	} else if len(rest) > 0 {
+		p.logger.Printf("canaries healthy, provisioning %d remaining servers\n", len(rest))
+		errs = p.provisionAll(rest, concurrency, keepGoing)
+	}
+	summary := summarize(serverNames, errs)
+	summary.Canaries = canaries
+	return summary
+}
+
+// checkCanaries verifies that the canaries are still running and runs the health commands on them
+func (p *provisioner) checkCanaries(canaries []string) map[string]error {
+	var outputLock sync.Mutex
+	return forEachServer(canaries, len(canaries), func(serverName string) error {
+		server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+		if err != nil {
+			return fmt.Errorf("error finding server: %w", err)
+		}
+		if server == nil {
+			return fmt.Errorf("canary %s doesn't exist anymore", serverName)
+		}
+		if server.Status != hcloud.ServerStatusRunning {
+			return fmt.Errorf("canary %s is %s", serverName, server.Status)
+		}
+		for _, command := range p.cfg.Rollout.HealthCommands {
+			if err := p.execCommand(serverName, command, &outputLock); err != nil {
+				return fmt.Errorf("health command '%s' failed on canary %s: %w", command, serverName, err)
+			}
+		}
+		p.logger.Printf("canary %s is healthy\n", serverName)
+		return nil
+	})
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// runsSchema creates the tables of the run database, phases are the events of a run with the time until the next one
+const runsSchema = `
+CREATE TABLE IF NOT EXISTS runs (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	server TEXT NOT NULL,
+	operation TEXT NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	finished_at TIMESTAMP NOT NULL,
+	result TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT '',
+	config_hash TEXT NOT NULL DEFAULT '',
+	git_revision TEXT NOT NULL DEFAULT '',
+	operator TEXT NOT NULL,
+	version TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS runs_server ON runs (server, started_at);
+CREATE TABLE IF NOT EXISTS run_phases (
+	run_id INTEGER NOT NULL REFERENCES runs (id),
+	phase TEXT NOT NULL,
+	started_at TIMESTAMP NOT NULL,
+	duration_ms INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	time TIMESTAMP NOT NULL,
+	operator TEXT NOT NULL,
+	server TEXT NOT NULL,
+	command TEXT NOT NULL,
+	config_hash TEXT NOT NULL DEFAULT '',
+	git_revision TEXT NOT NULL DEFAULT '',
+	result TEXT NOT NULL,
+	error TEXT NOT NULL DEFAULT ''
+);
+CREATE INDEX IF NOT EXISTS audit_server ON audit (server, time);
+`
+
+// runPhase is a phase reached during a run
+type runPhase struct {
+	Phase    string        `json:"phase"`
+	Started  time.Time     `json:"started_at"`
+	Duration time.Duration `json:"duration"`
+}
+
+// runRecord is a provisioning or rollback of a server
+type runRecord struct {
+	ID          int64      `json:"id"`
+	Server      string     `json:"server"`
+	Operation   string     `json:"operation"`
+	Started     time.Time  `json:"started_at"`
+	Finished    time.Time  `json:"finished_at"`
+	Result      string     `json:"result"`
+	Error       string     `json:"error,omitempty"`
+	ConfigHash  string     `json:"config_hash,omitempty"`
+	GitRevision string     `json:"git_revision,omitempty"`
+	Operator    string     `json:"operator"`
+	Version     string     `json:"version"`
+	Phases      []runPhase `json:"phases,omitempty"`
+}
+
+// runTracker collects the phases of the runs in progress, keyed by server name
+type runTracker struct {
+	mu   sync.Mutex
+	runs map[string]*runRecord
+}
+
+// operatorOverride is the operator given with --operator
+var operatorOverride string
+
+// operator identifies who started a run, --operator, $HETZNER_FLATCAR_OPERATOR or user@host
+func operator() string {
+	if operatorOverride != "" {
+		return operatorOverride
+	}
+	if name := os.Getenv("HETZNER_FLATCAR_OPERATOR"); name != "" {
+		return name
+	}
+	name := "unknown"
+	if current, err := user.Current(); err == nil {
+		name = current.Username
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		name += "@" + hostname
+	}
+	return name
+}
+
+// runDatabase returns the path of the run database
+func (c historyConfig) runDatabase() string {
+	if c.Database != "" {
+		return c.Database
+	}
+	return filepath.Join(c.Dir, "runs.db")
+}
+
+// runDatabases are the open run databases by path, shared by all provisioners of the process
+var runDatabases = struct {
+	sync.Mutex
+	dbs map[string]*sql.DB
+}{dbs: make(map[string]*sql.DB)}
+
+// openRuns returns the run database at path, it's opened once per process and must not be closed.
+// Its single connection serializes the writes of concurrent provisionings in a batch,
+// the busy timeout makes writes of other processes, e.g. serve and the cli, wait for each other.
+func openRuns(path string) (*sql.DB, error) {
+	runDatabases.Lock()
+	defer runDatabases.Unlock()
+	if db, ok := runDatabases.dbs[path]; ok {
+		return db, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("error creating history directory: %w", err)
+	}
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(runsSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error creating run database: %w", err)
+	}
+	runDatabases.dbs[path] = db
+	return db, nil
+}
+
+// startRun begins recording a run of serverName
+func (p *provisioner) startRun(serverName string, operation string) {
+	p.runs.mu.Lock()
+	defer p.runs.mu.Unlock()
+	if p.runs.runs == nil {
+		p.runs.runs = make(map[string]*runRecord)
+	}
+	p.runs.runs[serverName] = &runRecord{
+		Server:    serverName,
+		Operation: operation,
+		Started:   time.Now().UTC(),
+		Operator:  p.operatorName(),
+		Version:   buildVersion().Version,
+	}
+}
+
+// operatorName returns the operator of the runs of p, the caller of the api in serve mode
+func (p *provisioner) operatorName() string {
+	if p.operator != "" {
+		return p.operator
+	}
+	return operator()
+}
+
+// recordPhase adds phase to the run of serverName in progress
+func (p *provisioner) recordPhase(serverName string, phase string) {
+	p.runs.mu.Lock()
+	defer p.runs.mu.Unlock()
+	if run := p.runs.runs[serverName]; run != nil {
+		run.Phases = append(run.Phases, runPhase{Phase: phase, Started: time.Now().UTC()})
+	}
+}
+
+// finishRun stores the run of serverName in the run database, errors are only logged to not fail the provisioning
+func (p *provisioner) finishRun(serverName string, configHash string, gitRevision string, err error) {
+	p.runs.mu.Lock()
+	run := p.runs.runs[serverName]
+	delete(p.runs.runs, serverName)
+	p.runs.mu.Unlock()
+	if run == nil {
+		return
+	}
+	run.Finished = time.Now().UTC()
+	run.Result = resultSucceeded
+	if err != nil {
+		run.Result = resultFailed
+		run.Error = secrets.redact(err.Error())
+	}
+	run.ConfigHash = configHash
+	run.GitRevision = gitRevision
+	for i := range run.Phases {
+		next := run.Finished
+		if i+1 < len(run.Phases) {
+			next = run.Phases[i+1].Started
+		}
+		run.Phases[i].Duration = next.Sub(run.Phases[i].Started)
+	}
+	p.report.setRun(run)
+	if err := p.storeRun(run); err != nil {
+		p.logger.Printf("error recording run of %s: %v\n", serverName, err)
+	}
+}
+
+func (p *provisioner) storeRun(run *runRecord) error {
+	db, err := openRuns(p.cfg.History.runDatabase())
+	if err != nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`INSERT INTO runs (server, operation, started_at, finished_at, result, error, config_hash, git_revision, operator, version)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		run.Server, run.Operation, run.Started, run.Finished, run.Result, run.Error, run.ConfigHash, run.GitRevision, run.Operator, run.Version)
+	if err != nil {
+		return err
+	}
+	runID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for _, phase := range run.Phases {
+		if _, err := tx.Exec("INSERT INTO run_phases (run_id, phase, started_at, duration_ms) VALUES (?, ?, ?, ?)",
+			runID, phase.Phase, phase.Started, phase.Duration.Milliseconds()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// runFilter restricts the runs returned by queryRuns, empty fields match everything
+type runFilter struct {
+	Server string
+	Result string
+	Since  time.Time
+	Limit  int
+}
+
+// queryRuns returns the recorded runs matching filter with their phases, newest first
+func queryRuns(path string, filter runFilter) ([]runRecord, error) {
+	db, err := openRuns(path)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []string
+	var args []interface{}
+	if filter.Server != "" {
+		conditions = append(conditions, "server = ?")
+		args = append(args, filter.Server)
+	}
+	if filter.Result != "" {
+		conditions = append(conditions, "result = ?")
+		args = append(args, filter.Result)
+	}
+	if !filter.Since.IsZero() {
+		conditions = append(conditions, "started_at >= ?")
+		args = append(args, filter.Since.UTC())
+	}
+	query := "SELECT id, server, operation, started_at, finished_at, result, error, config_hash, git_revision, operator, version FROM runs"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY started_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	runs := []runRecord{}
+	for rows.Next() {
+		var run runRecord
+		if err := rows.Scan(&run.ID, &run.Server, &run.Operation, &run.Started, &run.Finished, &run.Result, &run.Error, &run.ConfigHash, &run.GitRevision, &run.Operator, &run.Version); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		runs = append(runs, run)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range runs {
+		phases, err := db.Query("SELECT phase, started_at, duration_ms FROM run_phases WHERE run_id = ? ORDER BY started_at", runs[i].ID)
+		if err != nil {
+			return nil, err
+		}
+		for phases.Next() {
+			var phase runPhase
+			var durationMS int64
+			if err := phases.Scan(&phase.Phase, &phase.Started, &durationMS); err != nil {
+				phases.Close()
+				return nil, err
+			}
+			phase.Duration = time.Duration(durationMS) * time.Millisecond
+			runs[i].Phases = append(runs[i].Phases, phase)
+		}
+		phases.Close()
+	}
+	return runs, nil
+}
+
+func printRuns(w io.Writer, runs []runRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSERVER\tOPERATION\tSTARTED\tDURATION\tRESULT\tCONFIG\tGIT\tOPERATOR")
+	for _, run := range runs {
+		configHash, gitRevision := "-", "-"
+		if len(run.ConfigHash) >= 12 {
+			configHash = run.ConfigHash[:12]
+		}
+		if run.GitRevision != "" {
+			gitRevision = run.GitRevision
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", run.ID, run.Server, run.Operation, run.Started.Local().Format(time.RFC3339),
+			run.Finished.Sub(run.Started).Round(time.Second), run.Result, configHash, gitRevision, run.Operator)
+	}
+	return tw.Flush()
+}
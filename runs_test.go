@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestRunDatabaseConcurrentWrites(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "runs.db")
+	var wg sync.WaitGroup
+	errs := make(chan error, 40)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// provisioners of a batch and of serve jobs share the database
+			p := &provisioner{cfg: config{History: historyConfig{Dir: dir}}}
+			now := time.Now().UTC()
+			errs <- p.storeRun(&runRecord{Server: fmt.Sprintf("web-%d", i), Operation: "provision", Started: now, Finished: now, Result: resultSucceeded,
+				Phases: []runPhase{{Phase: "render", Started: now}}})
+			id, err := p.startAudit(&hcloud.Server{Name: fmt.Sprintf("web-%d", i)}, "uptime")
+			if err == nil {
+				err = p.finishAudit(id, nil)
+			}
+			errs <- err
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("concurrent write failed: %v", err)
+		}
+	}
+
+	runs, err := queryRuns(path, runFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runs) != 20 {
+		t.Errorf("expected 20 runs, got %d", len(runs))
+	}
+	records, err := queryAudit(path, runFilter{Result: resultSucceeded})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 20 {
+		t.Errorf("expected 20 finished audit records, got %d", len(records))
+	}
+}
+
+func TestRunDatabaseWaitsForOtherProcesses(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "runs.db")
+	p := &provisioner{cfg: config{History: historyConfig{Dir: dir}}}
+	if _, err := openRuns(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// another process holding the write lock for a moment
+	other, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(context.Background(), "BEGIN IMMEDIATE"); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		conn.ExecContext(context.Background(), "COMMIT")
+	}()
+
+	now := time.Now().UTC()
+	if err := p.storeRun(&runRecord{Server: "web-1", Operation: "provision", Started: now, Finished: now, Result: resultSucceeded}); err != nil {
+		t.Errorf("write didn't wait for the lock: %v", err)
+	}
+}
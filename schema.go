@@ -0,0 +1,102 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// schemaTypes are the json schemas of config types decoded by UnmarshalTOML, which reflection can't derive
+var schemaTypes = map[reflect.Type]map[string]interface{}{
+	reflect.TypeOf(stringList{}): {"anyOf": []interface{}{
+		map[string]interface{}{"type": "string"},
+		map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+	}},
+}
+
+// schemaBuilder derives a json schema from the config structs, structs are defined once in $defs so recursive ones like
+// hcloud.contexts work
+type schemaBuilder struct {
+	defs map[string]interface{}
+}
+
+// configSchema returns the json schema of the config file, generated from the config structs so it can't drift from them
+func configSchema() map[string]interface{} {
+	builder := &schemaBuilder{defs: make(map[string]interface{})}
+	schema := builder.build(reflect.TypeOf(config{}))
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "hetzner-flatcar config"
+	schema["$defs"] = builder.defs
+	return schema
+}
+
+// build returns the schema of t, a reference for structs except the root
+func (b *schemaBuilder) build(t reflect.Type) map[string]interface{} {
+	if schema, ok := schemaTypes[t]; ok {
+		return schema
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": b.build(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": b.build(t.Elem())}
+	case reflect.Ptr:
+		return b.build(t.Elem())
+	case reflect.Struct:
+		if t == reflect.TypeOf(config{}) {
+			return b.object(t)
+		}
+		if _, ok := b.defs[t.Name()]; !ok {
+			// reserved before the fields are built, they may refer to t
+			b.defs[t.Name()] = nil
+			b.defs[t.Name()] = b.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+// object returns the schema of the struct t with a property per exported field, named like toml decodes them
+func (b *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		name := strings.ToLower(field.Name)
+		if tag, _, _ := strings.Cut(field.Tag.Get("toml"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+		properties[name] = b.build(field.Type)
+	}
+	return map[string]interface{}{"type": "object", "properties": properties, "additionalProperties": false}
+}
+
+// runConfig runs the config subcommands
+func runConfig(args []string) {
+	fs := flag.NewFlagSet("config", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "%s config schema\n", os.Args[0])
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 || fs.Arg(0) != "schema" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if err := printJSON(os.Stdout, configSchema()); err != nil {
+		fatalf("error printing schema: %v\n", err)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestConfigSchemaFollowsConfigStructs(t *testing.T) {
+	encoded, err := json.Marshal(configSchema())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var schema struct {
+		Properties map[string]json.RawMessage `json:"properties"`
+		Defs       map[string]struct {
+			Properties map[string]json.RawMessage `json:"properties"`
+		} `json:"$defs"`
+	}
+	if err := json.Unmarshal(encoded, &schema); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := schema.Properties["load_balancer"]; !ok {
+		t.Errorf("tagged section missing: %v", schema.Properties)
+	}
+	hcloudProperties := schema.Defs["hcloudConfig"].Properties
+	for property, expected := range map[string]string{
+		"ssh_keys_selector": `{"type":"string"}`,
+		"contexts":          `{"additionalProperties":{"$ref":"#/$defs/hcloudConfig"},"type":"object"}`,
+		"location":          `{"anyOf":[{"type":"string"},{"items":{"type":"string"},"type":"array"}]}`,
+	} {
+		if string(hcloudProperties[property]) != expected {
+			t.Errorf("unexpected schema of hcloud.%s: %s, expected %s", property, hcloudProperties[property], expected)
+		}
+	}
+}
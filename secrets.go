@@ -0,0 +1,117 @@
+package main
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// minSecretLength is the length below which values aren't redacted, masking them would garble unrelated output
+const minSecretLength = 4
+
+// redactor masks registered secret values
+type redactor struct {
+	mu       sync.RWMutex
+	values   map[string]bool
+	replacer *strings.Replacer
+}
+
+// secrets masks the secrets of the config and the rescue passwords in log output, events, reports and the run database
+var secrets = &redactor{values: make(map[string]bool)}
+
+// add registers value as secret, including the encodings used by ignition data urls
+func (r *redactor) add(value string) {
+	if len(value) < minSecretLength {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, variant := range []string{value, url.PathEscape(value), url.QueryEscape(value), base64.StdEncoding.EncodeToString([]byte(value))} {
+		r.values[variant] = true
+	}
+	values := make([]string, 0, len(r.values))
+	for value := range r.values {
+		values = append(values, value)
+	}
+	// longer values first, so secrets containing others are masked completely
+	sort.Slice(values, func(i, j int) bool {
+		return len(values[i]) > len(values[j])
+	})
+	pairs := make([]string, 0, 2*len(values))
+	for _, value := range values {
+		pairs = append(pairs, value, redacted)
+	}
+	r.replacer = strings.NewReplacer(pairs...)
+}
+
+// redact replaces all registered secrets in s
+func (r *redactor) redact(s string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if r.replacer == nil {
+		return s
+	}
+	return r.replacer.Replace(s)
+}
+
+// redactingWriter masks secrets before writing, log writes every message at once so secrets aren't split
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(data []byte) (int, error) {
+	if _, err := io.WriteString(w.w, secrets.redact(string(data))); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+// setLogOutput directs the log output to w with secrets masked
+func setLogOutput(w io.Writer) {
+	log.SetOutput(redactingWriter{w})
+}
+
+// resolveSecret returns the value of a secret, file:PATH reads it from a file without trailing newline,
+// everything else is taken literally, environment variables are already expanded with ${NAME}
+func resolveSecret(ref string) (string, error) {
+	if path := strings.TrimPrefix(ref, "file:"); path != ref {
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(content), "\r\n"), nil
+	}
+	return ref, nil
+}
+
+// proxyPassword returns the password of a proxy url, empty if it has none
+func proxyPassword(proxyURL string) string {
+	parsed, err := url.Parse(proxyURL)
+	if err != nil || parsed.User == nil {
+		return ""
+	}
+	password, _ := parsed.User.Password()
+	return password
+}
+
+// registerSecrets marks the secret values of the config, the token, the private key, template secrets, header values and proxy passwords
+func registerSecrets(cfg config) {
+	secrets.add(cfg.HCloud.Token)
+	secrets.add(cfg.HCloud.SSHKeyPrivate)
+	for _, value := range cfg.Flatcar.TemplateSecrets {
+		secrets.add(value)
+	}
+	for _, headers := range []map[string]string{cfg.Flatcar.RemoteConfig.UploadHeaders, cfg.Flatcar.RemoteConfig.Headers, cfg.History.RemoteHeaders} {
+		for _, value := range headers {
+			secrets.add(value)
+		}
+	}
+	for _, proxyURL := range []string{cfg.SSH.Proxy, cfg.Rescue.HTTPProxy, cfg.Rescue.HTTPSProxy} {
+		secrets.add(proxyPassword(proxyURL))
+	}
+}
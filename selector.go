@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func addSelectorFlag(fs *flag.FlagSet) *string {
+	return fs.String("selector", "", "select servers by hcloud label selector (e.g. role=web,env=prod) in addition to the given names")
+}
+
+// resolveServerNames returns the given server names with expanded ranges and the names of all managed servers
+// matching the label selector, servers hetzner-flatcar didn't create are never selected
+func (p *provisioner) resolveServerNames(names []string, selector string) ([]string, error) {
+	serverNames, err := p.expandServerNames(names)
+	if err != nil {
+		return nil, err
+	}
+	if selector != "" {
+		servers, err := p.client.Server.AllWithOpts(context.Background(), hcloud.ServerListOpts{
+			ListOpts: hcloud.ListOpts{LabelSelector: selector + "," + managedSelector},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error listing servers: %w", err)
+		}
+		seen := map[string]bool{}
+		for _, name := range serverNames {
+			seen[name] = true
+		}
+		for _, server := range servers {
+			if !seen[server.Name] {
+				serverNames = append(serverNames, server.Name)
+				seen[server.Name] = true
+			}
+		}
+		p.logger.Printf("selector %s matches %d servers\n", selector, len(servers))
+	}
+	if len(serverNames) == 0 {
+		return nil, errors.New("no servers given or selected")
+	}
+	return serverNames, nil
+}
+
+// confirm asks the user to confirm the action on stdin
+func confirm(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func runDestroy(args []string) {
+	fs := flag.NewFlagSet("destroy", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	selector := addSelectorFlag(fs)
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	fs.Parse(args)
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	serverNames, err := p.resolveServerNames(fs.Args(), *selector)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if !*yes && !confirm(fmt.Sprintf("delete %s?", strings.Join(serverNames, ", "))) {
+		fatalf("aborted\n")
+	}
+	for _, serverName := range serverNames {
+		if err := p.destroy(serverName); err != nil {
+			fatalf("error destroying %s: %v\n", serverName, err)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectorOnlyMatchesManagedServers(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	api.addServer("web-1", "running", map[string]string{managedLabel: managedLabelValue, "env": "prod"})
+	api.addServer("legacy", "running", map[string]string{"env": "prod"})
+	api.addServer("web-2", "running", map[string]string{managedLabel: managedLabelValue, "env": "staging"})
+
+	serverNames, err := p.resolveServerNames(nil, "env=prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(serverNames, []string{"web-1"}) {
+		t.Errorf("expected only the managed server web-1, got %v", serverNames)
+	}
+}
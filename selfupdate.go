@@ -0,0 +1,315 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/mod/semver"
+)
+
+// releasesURL is the GitHub api url of the releases of hetzner-flatcar
+const releasesURL = "https://api.github.com/repos/thor77/hetzner-flatcar/releases"
+
+// checksumsAsset is the name of the checksums file of every release, see .goreleaser.yaml
+const checksumsAsset = "checksums.txt"
+
+// signatureAsset is the minisign signature of the checksums file, see .goreleaser.yaml
+const signatureAsset = checksumsAsset + ".minisig"
+
+// releasePublicKey is the minisign public key the checksums of the releases are signed with (the line after the comment),
+// it's set at build time with -ldflags "-X main.releasePublicKey=..."
+var releasePublicKey = ""
+
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+var updateClient = &http.Client{Timeout: 5 * time.Minute}
+
+// fetchRelease returns the release with the given tag or the latest one if tag is empty
+func fetchRelease(tag string) (*githubRelease, error) {
+	url := releasesURL + "/latest"
+	if tag != "" {
+		url = releasesURL + "/tags/" + tag
+	}
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("error requesting release: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error requesting release: %s", resp.Status)
+	}
+	var release githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return nil, fmt.Errorf("error decoding release: %w", err)
+	}
+	return &release, nil
+}
+
+// assetURL returns the download url of the named asset of the release
+func (r *githubRelease) assetURL(name string) (string, error) {
+	for _, asset := range r.Assets {
+		if asset.Name == name {
+			return asset.URL, nil
+		}
+	}
+	return "", fmt.Errorf("release %s has no asset %s", r.TagName, name)
+}
+
+// archiveName returns the name of the release archive for the running platform, following the replacements in .goreleaser.yaml
+func archiveName(tag string) string {
+	goos := map[string]string{"linux": "Linux"}[runtime.GOOS]
+	if goos == "" {
+		goos = runtime.GOOS
+	}
+	goarch := map[string]string{"386": "i386", "amd64": "x86_64"}[runtime.GOARCH]
+	if goarch == "" {
+		goarch = runtime.GOARCH
+	}
+	return fmt.Sprintf("hetzner-flatcar_%s_%s_%s.tar.gz", strings.TrimPrefix(tag, "v"), goos, goarch)
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := updateClient.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error downloading %s: %s", url, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// expectedChecksum looks up the sha256 checksum of name in a checksums file
+func expectedChecksum(checksums []byte, name string) (string, error) {
+	scanner := bufio.NewScanner(bytes.NewReader(checksums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[1] == name {
+			return fields[0], nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s", name)
+}
+
+// verifySignature verifies the minisign signature of data by publicKey, the base64 encoded minisign public key
+func verifySignature(data []byte, signature []byte, publicKey string) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(publicKey))
+	if err != nil || len(key) != 42 || string(key[:2]) != "Ed" {
+		return errors.New("invalid minisign public key")
+	}
+	// untrusted comment, signature, trusted comment and global signature
+	lines := strings.Split(strings.TrimSpace(string(signature)), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("invalid minisign signature")
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(sig) != 74 {
+		return errors.New("invalid minisign signature")
+	}
+	if !bytes.Equal(sig[2:10], key[2:10]) {
+		return fmt.Errorf("signed by key %X instead of %X", sig[2:10], key[2:10])
+	}
+	publicKeyBytes := ed25519.PublicKey(key[10:])
+	switch string(sig[:2]) {
+	case "ED":
+		// prehashed, the default of minisign
+		hash := blake2b.Sum512(data)
+		data = hash[:]
+	case "Ed":
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(publicKeyBytes, data, sig[10:]) {
+		return errors.New("signature doesn't match")
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return errors.New("invalid minisign signature")
+	}
+	trustedComment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	signed := append(append([]byte{}, sig[10:]...), trustedComment...)
+	if !ed25519.Verify(publicKeyBytes, signed, globalSig) {
+		return errors.New("signature of the trusted comment doesn't match")
+	}
+	return nil
+}
+
+// compareVersions compares the release versions a and b like semver, ok is false if either isn't one, e.g. dev
+func compareVersions(a string, b string) (int, bool) {
+	a, b = "v"+strings.TrimPrefix(a, "v"), "v"+strings.TrimPrefix(b, "v")
+	if !semver.IsValid(a) || !semver.IsValid(b) {
+		return 0, false
+	}
+	return semver.Compare(a, b), true
+}
+
+// extractBinary returns the hetzner-flatcar binary from a release archive
+func extractBinary(archive []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		return nil, err
+	}
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil, errors.New("archive doesn't contain hetzner-flatcar")
+		}
+		if err != nil {
+			return nil, err
+		}
+		if filepath.Base(header.Name) == "hetzner-flatcar" && header.Typeflag == tar.TypeReg {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// replaceExecutable atomically replaces the running binary with binary
+func replaceExecutable(binary []byte) (string, error) {
+	executable, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return "", err
+	}
+	// the temp file has to be in the same directory for the rename to be atomic
+	tmp, err := os.CreateTemp(filepath.Dir(executable), ".hetzner-flatcar-update-*")
+	if err != nil {
+		return "", fmt.Errorf("error creating temp file: %w", err)
+	}
+	removeTmp := cleanups.push("remove "+tmp.Name(), func() error {
+		if err := os.Remove(tmp.Name()); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	})
+	defer removeTmp.run()
+	if _, err := tmp.Write(binary); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return "", err
+	}
+	return executable, os.Rename(tmp.Name(), executable)
+}
+
+// runSelfUpdate replaces the running binary with a release from GitHub after verifying the signature of its checksums
+func runSelfUpdate(args []string) {
+	fs := flag.NewFlagSet("self-update", flag.ExitOnError)
+	check := fs.Bool("check", false, "only check whether a newer release is available")
+	tag := fs.String("version", "", "install this release (e.g. v1.2.0) instead of the latest")
+	yes := fs.Bool("yes", false, "don't ask for confirmation")
+	fs.Parse(args)
+
+	current := buildVersion().Version
+	release, err := fetchRelease(*tag)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if strings.TrimPrefix(release.TagName, "v") == strings.TrimPrefix(current, "v") {
+		fmt.Printf("hetzner-flatcar %s is up to date\n", current)
+		return
+	}
+	downgrade := false
+	if order, ok := compareVersions(release.TagName, current); ok && order < 0 {
+		// older releases are only installed when asked for explicitly
+		if *tag == "" {
+			fmt.Printf("hetzner-flatcar %s is newer than the latest release %s\n", current, release.TagName)
+			return
+		}
+		downgrade = true
+	}
+	if *check {
+		fmt.Printf("hetzner-flatcar %s is available (running %s)\n", release.TagName, current)
+		return
+	}
+	if releasePublicKey == "" {
+		fatalf("this build has no release signing key to verify updates with, download releases manually\n")
+	}
+	question := fmt.Sprintf("Replace hetzner-flatcar %s with %s?", current, release.TagName)
+	if downgrade {
+		question = fmt.Sprintf("Downgrade hetzner-flatcar %s to %s?", current, release.TagName)
+	}
+	if !*yes && !confirm(question) {
+		fatalf("aborted\n")
+	}
+
+	name := archiveName(release.TagName)
+	archiveURL, err := release.assetURL(name)
+	if err != nil {
+		fatalf("%v, no release for %s/%s?\n", err, runtime.GOOS, runtime.GOARCH)
+	}
+	checksumsURL, err := release.assetURL(checksumsAsset)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	checksums, err := download(checksumsURL)
+	if err != nil {
+		fatalf("error downloading checksums: %v\n", err)
+	}
+	signatureURL, err := release.assetURL(signatureAsset)
+	if err != nil {
+		fatalf("%v, unsigned release?\n", err)
+	}
+	signature, err := download(signatureURL)
+	if err != nil {
+		fatalf("error downloading signature: %v\n", err)
+	}
+	if err := verifySignature(checksums, signature, releasePublicKey); err != nil {
+		fatalf("error verifying the signature of %s: %v\n", checksumsAsset, err)
+	}
+	expected, err := expectedChecksum(checksums, name)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	log.Printf("downloading %s\n", archiveURL)
+	archive, err := download(archiveURL)
+	if err != nil {
+		fatalf("error downloading release: %v\n", err)
+	}
+	sum := sha256.Sum256(archive)
+	if actual := hex.EncodeToString(sum[:]); actual != expected {
+		fatalf("checksum mismatch of %s: expected %s, got %s\n", name, expected, actual)
+	}
+	binary, err := extractBinary(archive)
+	if err != nil {
+		fatalf("error extracting release: %v\n", err)
+	}
+	executable, err := replaceExecutable(binary)
+	if err != nil {
+		fatalf("error replacing %s: %v\n", executable, err)
+	}
+	log.Printf("updated %s to %s\n", executable, release.TagName)
+}
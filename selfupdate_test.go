@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey returns a key pair with the public key encoded like minisign
+func minisignKey(t *testing.T, keyID string) (string, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := append([]byte("Ed"+keyID), public...)
+	return base64.StdEncoding.EncodeToString(key), private
+}
+
+// minisign signs data like minisign -S, prehashed unless algorithm is Ed
+func minisign(private ed25519.PrivateKey, keyID string, algorithm string, data []byte, trustedComment string) []byte {
+	message := data
+	if algorithm == "ED" {
+		hash := blake2b.Sum512(data)
+		message = hash[:]
+	}
+	signature := ed25519.Sign(private, message)
+	globalSignature := ed25519.Sign(private, append(append([]byte{}, signature...), trustedComment...))
+	encoded := base64.StdEncoding.EncodeToString(append([]byte(algorithm+keyID), signature...))
+	return []byte(fmt.Sprintf("untrusted comment: signature from minisign secret key\n%s\ntrusted comment: %s\n%s\n",
+		encoded, trustedComment, base64.StdEncoding.EncodeToString(globalSignature)))
+}
+
+func TestVerifySignature(t *testing.T) {
+	publicKey, private := minisignKey(t, "12345678")
+	otherKey, _ := minisignKey(t, "87654321")
+	checksums := []byte("abc123  hetzner-flatcar_1.2.0_Linux_x86_64.tar.gz\n")
+	signed := minisign(private, "12345678", "ED", checksums, "timestamp:1700000000\tfile:checksums.txt")
+
+	tests := []struct {
+		name      string
+		data      []byte
+		signature []byte
+		publicKey string
+		err       string
+	}{
+		{"prehashed", checksums, signed, publicKey, ""},
+		{"legacy", checksums, minisign(private, "12345678", "Ed", checksums, "timestamp:1700000000"), publicKey, ""},
+		{"changed checksums", []byte("def456  hetzner-flatcar_1.2.0_Linux_x86_64.tar.gz\n"), signed, publicKey, "signature doesn't match"},
+		{"other key", checksums, signed, otherKey, "signed by key"},
+		{"changed trusted comment", checksums, []byte(strings.Replace(string(signed), "1700000000", "1800000000", 1)), publicKey, "trusted comment doesn't match"},
+		{"garbage", checksums, []byte("not a signature"), publicKey, "invalid minisign signature"},
+		{"no key", checksums, signed, "", "invalid minisign public key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := verifySignature(test.data, test.signature, test.publicKey)
+			if test.err == "" && err != nil {
+				t.Errorf("expected valid signature, got %v", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b  string
+		order int
+		ok    bool
+	}{
+		{"v1.3.0", "1.2.9", 1, true},
+		{"v1.2.0", "v1.10.0", -1, true},
+		{"1.2.0", "v1.2.0", 0, true},
+		{"v1.2.1", "1.2.1-next", 1, true},
+		{"v1.2.0", "dev", 0, false},
+	}
+	for _, test := range tests {
+		order, ok := compareVersions(test.a, test.b)
+		if order != test.order || ok != test.ok {
+			t.Errorf("compareVersions(%s, %s) = %d, %v, expected %d, %v", test.a, test.b, order, ok, test.order, test.ok)
+		}
+	}
+}
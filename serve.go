@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// job states
+const (
+	jobScheduled = "scheduled"
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+type jobInfo struct {
+	ID      string    `json:"id"`
+	Server  string    `json:"server"`
+	Action  string    `json:"action"`
+	State   string    `json:"state"`
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	// Operator is the identity of the caller recorded as operator of the run
+	Operator string `json:"operator"`
+	// Scheduled is the start of the maintenance window a reinstall waits for
+	Scheduled *time.Time `json:"scheduled,omitempty"`
+}
+
+// job is an operation triggered via the api, its log output is collected while it's running
+type job struct {
+	mu      sync.Mutex
+	info    jobInfo
+	lines   []string
+	partial string
+	// updated is closed and replaced whenever new lines are added or the job finishes
+	updated chan struct{}
+}
+
+func (j *job) snapshot() jobInfo {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.info
+}
+
+// queue marks a scheduled job as queued
+func (j *job) queue() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.info.State = jobQueued
+	j.info.Scheduled = nil
+}
+
+func (j *job) setState(state string, err error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.info.State = state
+	if err != nil {
+		j.info.Error = err.Error()
+	}
+	close(j.updated)
+	j.updated = make(chan struct{})
+}
+
+// Write collects the complete lines of the log output
+func (j *job) Write(p []byte) (int, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	lines := strings.Split(j.partial+string(p), "\n")
+	j.partial = lines[len(lines)-1]
+	j.lines = append(j.lines, lines[:len(lines)-1]...)
+	close(j.updated)
+	j.updated = make(chan struct{})
+	return len(p), nil
+}
+
+// linesSince returns the lines after offset, whether the job finished and a channel closed on the next update
+func (j *job) linesSince(offset int) ([]string, bool, <-chan struct{}) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	finished := j.info.State == jobSucceeded || j.info.State == jobFailed
+	return j.lines[offset:], finished, j.updated
+}
+
+// apiServer exposes provisioning operations via http, jobs are run one after another
+type apiServer struct {
+	load  func() (*provisioner, error)
+	token string
+	// loadMu serializes loading the config, which syncs the git source and changes the working directory
+	loadMu sync.Mutex
+	// cfg is the config of the last load, status requests use it instead of loading it again
+	cfg config
+	// oidc verifies id tokens given instead of the api token, nil if not configured
+	oidc *oidcVerifier
+	// maintenance delays reinstall jobs until the next maintenance window, it's read once at startup
+	maintenance maintenanceSchedule
+	queue       chan *job
+
+	mu     sync.Mutex
+	jobs   map[string]*job
+	nextID int
+}
+
+func runServe(args []string) {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	listen := fs.String("listen", ":8080", "address to listen on")
+	token := fs.String("api-token", os.Getenv("HETZNER_FLATCAR_API_TOKEN"), "bearer token required for all requests (default $HETZNER_FLATCAR_API_TOKEN)")
+	at := fs.String("at", "", "only run reinstall jobs after this time, e.g. 2024-05-03T02:00Z")
+	oidcIssuer := fs.String("oidc-issuer", "", "accept OIDC id tokens of this issuer, the caller is recorded as operator")
+	oidcAudience := fs.String("oidc-audience", "", "audience the OIDC id tokens have to be issued for")
+	oidcClaim := fs.String("oidc-claim", "email", "claim of the OIDC id tokens identifying the caller, sub if the token doesn't contain it")
+	fs.Parse(args)
+	if *token == "" && *oidcIssuer == "" {
+		fatalf("api token missing\n")
+	}
+	if *oidcIssuer != "" && *oidcAudience == "" {
+		fatalf("--oidc-audience is required with --oidc-issuer\n")
+	}
+	notBefore, err := parseAt(*at)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+
+	cfg, _, err := common.loadConfig()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+
+	s := &apiServer{
+		load:        common.loadProvisioner,
+		token:       *token,
+		cfg:         cfg,
+		maintenance: newMaintenanceSchedule(cfg.Maintenance, notBefore),
+		queue:       make(chan *job, 100),
+		jobs:        map[string]*job{},
+	}
+	if *oidcIssuer != "" {
+		s.oidc = newOIDCVerifier(*oidcIssuer, *oidcAudience, *oidcClaim)
+	}
+	go s.work()
+	log.Printf("serving api on %s\n", *listen)
+	if err := http.ListenAndServe(*listen, s); err != nil {
+		fatalf("error serving api: %v\n", err)
+	}
+}
+
+// work runs the queued jobs, each with a logger copying its output into the job
+func (s *apiServer) work() {
+	for j := range s.queue {
+		j.setState(jobRunning, nil)
+		logger := log.New(redactingWriter{io.MultiWriter(os.Stderr, j)}, "", log.Flags())
+		err := s.runJob(j.snapshot(), logger)
+		if err != nil {
+			log.Printf("job %s failed: %v\n", j.info.ID, err)
+			j.setState(jobFailed, err)
+		} else {
+			j.setState(jobSucceeded, nil)
+		}
+	}
+}
+
+func (s *apiServer) runJob(info jobInfo, logger *log.Logger) error {
+	p, err := s.loadJob()
+	if err != nil {
+		return err
+	}
+	p.operator = info.Operator
+	p.logger = logger
+	switch info.Action {
+	case "provision":
+		return p.provision(info.Server)
+	case "reinstall":
+		server, _, err := p.client.Server.GetByName(context.Background(), info.Server)
+		if err != nil {
+			return fmt.Errorf("error finding server: %w", err)
+		}
+		if server == nil {
+			return fmt.Errorf("server %s doesn't exist", info.Server)
+		}
+		return p.provision(info.Server)
+	case "destroy":
+		return p.destroy(info.Server)
+	}
+	return fmt.Errorf("unknown action %s", info.Action)
+}
+
+// loadJob loads the config for a job, the git source is synced once per job
+func (s *apiServer) loadJob() (*provisioner, error) {
+	s.loadMu.Lock()
+	defer s.loadMu.Unlock()
+	p, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.cfg = p.cfg
+	return p, nil
+}
+
+// errQueueFull is returned when a job is requested while the queue is full
+var errQueueFull = errors.New("job queue is full, retry later")
+
+func (s *apiServer) enqueue(serverName string, action string, operator string) (*job, error) {
+	var start *time.Time
+	if action == "reinstall" {
+		start = s.maintenanceStart()
+	}
+	s.mu.Lock()
+	s.nextID++
+	j := &job{
+		info: jobInfo{
+			ID:       strconv.Itoa(s.nextID),
+			Server:   serverName,
+			Action:   action,
+			State:    jobQueued,
+			Created:  time.Now(),
+			Operator: operator,
+		},
+		updated: make(chan struct{}),
+	}
+	if start != nil {
+		j.info.State = jobScheduled
+		j.info.Scheduled = start
+	}
+	s.jobs[j.info.ID] = j
+	s.mu.Unlock()
+
+	if start != nil {
+		log.Printf("reinstall of %s scheduled for %s\n", serverName, start.Format(time.RFC3339))
+		go func() {
+			time.Sleep(time.Until(*start))
+			j.queue()
+			s.queue <- j
+		}()
+		return j, nil
+	}
+	// the queue is sent to without holding the lock, a full queue is reported instead of blocking the request
+	select {
+	case s.queue <- j:
+		return j, nil
+	default:
+		s.mu.Lock()
+		delete(s.jobs, j.info.ID)
+		s.mu.Unlock()
+		return nil, errQueueFull
+	}
+}
+
+// handleEnqueue queues action on serverName and responds with the job, 503 if the queue is full
+func (s *apiServer) handleEnqueue(rw http.ResponseWriter, serverName string, action string, operator string) {
+	j, err := s.enqueue(serverName, action, operator)
+	if err != nil {
+		writeError(rw, http.StatusServiceUnavailable, err)
+		return
+	}
+	writeJSON(rw, http.StatusAccepted, j.snapshot())
+}
+
+// maintenanceStart returns the start of the next maintenance window if reinstalls aren't allowed right now
+func (s *apiServer) maintenanceStart() *time.Time {
+	now := time.Now()
+	if s.maintenance.open(now) {
+		return nil
+	}
+	start, ok := s.maintenance.next(now)
+	if !ok {
+		return nil
+	}
+	return &start
+}
+
+// identify returns the identity of the caller, api-token for the api token or the identity of an OIDC id token
+func (s *apiServer) identify(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" || token == r.Header.Get("Authorization") {
+		return "", false
+	}
+	if s.token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1 {
+		return "api-token", true
+	}
+	if s.oidc == nil {
+		return "", false
+	}
+	identity, err := s.oidc.verify(token)
+	if err != nil {
+		log.Printf("rejected OIDC token: %v\n", err)
+		return "", false
+	}
+	return identity, true
+}
+
+func writeJSON(rw http.ResponseWriter, status int, value interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(value); err != nil {
+		log.Printf("error encoding response: %v\n", err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	writeJSON(rw, status, map[string]string{"error": err.Error()})
+}
+
+// ServeHTTP routes the requests:
+// GET /servers/<name>, POST /servers/<name>/provision, POST /servers/<name>/reinstall, DELETE /servers/<name>,
+// GET /jobs/<id>, GET /jobs/<id>/logs (server-sent events) and GET /metrics
+func (s *apiServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/healthz" {
+		fmt.Fprintln(rw, "ok")
+		return
+	}
+	identity, ok := s.identify(r)
+	if !ok {
+		writeError(rw, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+
+	if r.URL.Path == "/metrics" {
+		metricsHandler.ServeHTTP(rw, r)
+		return
+	}
+
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	switch {
+	case len(parts) == 2 && parts[0] == "servers" && r.Method == http.MethodGet:
+		s.handleServerStatus(rw, parts[1])
+	case len(parts) == 2 && parts[0] == "servers" && r.Method == http.MethodDelete:
+		s.handleEnqueue(rw, parts[1], "destroy", identity)
+	case len(parts) == 3 && parts[0] == "servers" && r.Method == http.MethodPost && (parts[2] == "provision" || parts[2] == "reinstall"):
+		s.handleEnqueue(rw, parts[1], parts[2], identity)
+	case len(parts) >= 2 && parts[0] == "jobs" && r.Method == http.MethodGet:
+		s.mu.Lock()
+		j, ok := s.jobs[parts[1]]
+		s.mu.Unlock()
+		if !ok {
+			writeError(rw, http.StatusNotFound, fmt.Errorf("job %s doesn't exist", parts[1]))
+			return
+		}
+		if len(parts) == 3 && parts[2] == "logs" {
+			streamLogs(rw, r, j)
+			return
+		}
+		writeJSON(rw, http.StatusOK, j.snapshot())
+	default:
+		writeError(rw, http.StatusNotFound, errors.New("not found"))
+	}
+}
+
+// handleServerStatus responds with the status of serverName, it uses the config of the last load
+// to not sync the git source or change the working directory under a running job
+func (s *apiServer) handleServerStatus(rw http.ResponseWriter, serverName string) {
+	s.loadMu.Lock()
+	cfg := s.cfg
+	s.loadMu.Unlock()
+	p, err := newProvisioner(cfg, newHCloudClient(cfg.HCloud))
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	status, err := p.status(serverName)
+	if err != nil {
+		writeError(rw, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(rw, http.StatusOK, status)
+}
+
+// streamLogs sends the log lines of the job as server-sent events until it's finished
+func streamLogs(rw http.ResponseWriter, r *http.Request, j *job) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		writeError(rw, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+
+	offset := 0
+	for {
+		lines, finished, updated := j.linesSince(offset)
+		for _, line := range lines {
+			fmt.Fprintf(rw, "data: %s\n\n", line)
+		}
+		offset += len(lines)
+		if finished {
+			info := j.snapshot()
+			fmt.Fprintf(rw, "event: %s\ndata: %s\n\n", info.State, info.Error)
+			flusher.Flush()
+			return
+		}
+		flusher.Flush()
+		select {
+		case <-updated:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJob waits until j is finished and returns its log lines
+func waitForJob(t *testing.T, j *job) []string {
+	deadline := time.After(10 * time.Second)
+	for {
+		lines, finished, updated := j.linesSince(0)
+		if finished {
+			return lines
+		}
+		select {
+		case <-updated:
+		case <-deadline:
+			t.Fatalf("job %s didn't finish", j.info.ID)
+		}
+	}
+}
+
+func TestServeJobsLogOnlyTheirOwnOutput(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	api.addServer("web-1", "running", map[string]string{managedLabel: managedLabelValue})
+	s := &apiServer{
+		load: func() (*provisioner, error) {
+			// written by a concurrent request while the job is running
+			log.Println("unrelated request")
+			return p, nil
+		},
+		queue: make(chan *job, 1),
+		jobs:  map[string]*job{},
+	}
+	go s.work()
+	defer close(s.queue)
+
+	j, err := s.enqueue("web-1", "destroy", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := waitForJob(t, j)
+	if info := j.snapshot(); info.State != jobSucceeded {
+		t.Fatalf("expected destroy to succeed, got %s: %s", info.State, info.Error)
+	}
+	output := strings.Join(lines, "\n")
+	if !strings.Contains(output, "deleting server 'web-1'") {
+		t.Errorf("expected the job log to contain its output, got %q", output)
+	}
+	if strings.Contains(output, "unrelated request") {
+		t.Errorf("expected the job log to not contain other log output, got %q", output)
+	}
+}
+
+func TestServeDestroysOnlyManagedServers(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	api.addServer("db-1", "running", map[string]string{"role": "db"})
+	s := &apiServer{
+		load:  func() (*provisioner, error) { return p, nil },
+		queue: make(chan *job, 1),
+		jobs:  map[string]*job{},
+	}
+	go s.work()
+	defer close(s.queue)
+
+	j, err := s.enqueue("db-1", "destroy", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForJob(t, j)
+	if info := j.snapshot(); info.State != jobFailed || !strings.Contains(info.Error, "isn't managed") {
+		t.Errorf("expected destroying an unmanaged server to fail, got %s: %s", info.State, info.Error)
+	}
+	for _, action := range api.actions {
+		if action == "delete_server" {
+			t.Errorf("expected unmanaged server to not be deleted")
+		}
+	}
+}
+
+func TestServeIdentifiesOIDCCallers(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issuer *httptest.Server
+	issuer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"jwks_uri": issuer.URL + "/keys"})
+		case "/keys":
+			json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+				"kid": "test", "kty": "EC", "crv": "P-256",
+				"x": base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+				"y": base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+			}}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(issuer.Close)
+	sign := func(claims map[string]interface{}) string {
+		header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "test"})
+		payload, _ := json.Marshal(claims)
+		input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+		digest := sha256.Sum256([]byte(input))
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return input + "." + base64.RawURLEncoding.EncodeToString(append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...))
+	}
+	s := &apiServer{token: "static", oidc: newOIDCVerifier(issuer.URL, "hetzner-flatcar", "email")}
+	identify := func(token string) (string, bool) {
+		r := httptest.NewRequest(http.MethodPost, "/servers/web-1/provision", nil)
+		r.Header.Set("Authorization", "Bearer "+token)
+		return s.identify(r)
+	}
+	valid := map[string]interface{}{"iss": issuer.URL, "aud": "hetzner-flatcar", "exp": time.Now().Add(time.Hour).Unix(), "sub": "1234", "email": "alice@example.com"}
+
+	if identity, ok := identify(sign(valid)); !ok || identity != "alice@example.com" {
+		t.Errorf("valid token identified as %q (%v)", identity, ok)
+	}
+	if identity, ok := identify("static"); !ok || identity != "api-token" {
+		t.Errorf("api token identified as %q (%v)", identity, ok)
+	}
+	for name, change := range map[string]func(map[string]interface{}){
+		"expired":        func(claims map[string]interface{}) { claims["exp"] = time.Now().Add(-time.Hour).Unix() },
+		"other audience": func(claims map[string]interface{}) { claims["aud"] = []string{"other"} },
+		"other issuer":   func(claims map[string]interface{}) { claims["iss"] = "https://issuer.example.com" },
+	} {
+		claims := map[string]interface{}{}
+		for key, value := range valid {
+			claims[key] = value
+		}
+		change(claims)
+		if _, ok := identify(sign(claims)); ok {
+			t.Errorf("%s token was accepted", name)
+		}
+	}
+	if _, ok := identify(sign(valid) + "x"); ok {
+		t.Error("token with invalid signature was accepted")
+	}
+}
+
+func TestServeRejectsJobsWhenQueueIsFull(t *testing.T) {
+	s := &apiServer{token: "static", queue: make(chan *job, 1), jobs: map[string]*job{}}
+	request := func(method string, path string) int {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Authorization", "Bearer static")
+		rw := httptest.NewRecorder()
+		s.ServeHTTP(rw, r)
+		return rw.Code
+	}
+
+	if status := request(http.MethodPost, "/servers/web-1/provision"); status != http.StatusAccepted {
+		t.Fatalf("expected job to be accepted, got %d", status)
+	}
+	if status := request(http.MethodPost, "/servers/web-2/provision"); status != http.StatusServiceUnavailable {
+		t.Errorf("expected full queue to be rejected, got %d", status)
+	}
+	// the rejected job isn't registered and the lock isn't held
+	if status := request(http.MethodGet, "/jobs/1"); status != http.StatusOK {
+		t.Errorf("expected queued job, got %d", status)
+	}
+	if status := request(http.MethodGet, "/jobs/2"); status != http.StatusNotFound {
+		t.Errorf("expected rejected job to be forgotten, got %d", status)
+	}
+}
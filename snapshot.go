@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// snapshotOfLabel is the image label storing the name of the server a snapshot was created from
+const snapshotOfLabel = "hetzner-flatcar/snapshot-of"
+
+// snapshotServer creates a snapshot of the server and deletes its snapshots exceeding the configured retention
+func (p *provisioner) snapshotServer(server *hcloud.Server) error {
+	description := fmt.Sprintf("%s before reinstall %s", server.Name, time.Now().UTC().Format(time.RFC3339))
+	// keep the labels describing the installed config to restore them on rollback
+	labels := map[string]string{
+		managedLabel:    managedLabelValue,
+		snapshotOfLabel: server.Name,
+	}
+	for _, label := range []string{configHashLabel, gitRevisionLabel} {
+		if value, ok := server.Labels[label]; ok {
+			labels[label] = value
+		}
+	}
+	p.logger.Printf("creating snapshot of server '%s'\n", server.Name)
+	result, _, err := p.client.Server.CreateImage(context.Background(), server, &hcloud.ServerCreateImageOpts{
+		Type:        hcloud.ImageTypeSnapshot,
+		Description: &description,
+		Labels:      labels,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating snapshot: %w", err)
+	}
+	if err := waitForAction(p.logger, p.client.Action, result.Action); err != nil {
+		return fmt.Errorf("error waiting for snapshot: %w", err)
+	}
+	p.logger.Printf("created snapshot %d\n", result.Image.ID)
+
+	snapshots, err := p.snapshots(server.Name)
+	if err != nil {
+		return err
+	}
+	for i := p.cfg.HCloud.SnapshotRetention; i < len(snapshots); i++ {
+		p.logger.Printf("deleting snapshot %d exceeding the retention\n", snapshots[i].ID)
+		if _, err := p.client.Image.Delete(context.Background(), snapshots[i]); err != nil {
+			return fmt.Errorf("error deleting snapshot: %w", err)
+		}
+	}
+	return nil
+}
+
+// snapshots returns the snapshots created of the server named serverName, newest first
+func (p *provisioner) snapshots(serverName string) ([]*hcloud.Image, error) {
+	snapshots, err := p.client.Image.AllWithOpts(context.Background(), hcloud.ImageListOpts{
+		ListOpts: hcloud.ListOpts{LabelSelector: fmt.Sprintf("%s=%s", snapshotOfLabel, serverName)},
+		Type:     []hcloud.ImageType{hcloud.ImageTypeSnapshot},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error listing snapshots: %w", err)
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Created.After(snapshots[j].Created)
+	})
+	return snapshots, nil
+}
+
+// rollback rebuilds the server from a snapshot, the latest one if snapshotID is 0
+func (p *provisioner) rollback(serverName string, snapshotID int) error {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	snapshots, err := p.snapshots(serverName)
+	if err != nil {
+		return err
+	}
+	var snapshot *hcloud.Image
+	for _, candidate := range snapshots {
+		if snapshotID == 0 || candidate.ID == snapshotID {
+			snapshot = candidate
+			break
+		}
+	}
+	if snapshot == nil {
+		if snapshotID == 0 {
+			return fmt.Errorf("no snapshots of server %s", serverName)
+		}
+		return fmt.Errorf("snapshot %d of server %s doesn't exist", snapshotID, serverName)
+	}
+
+	p.logger.Printf("rebuilding server '%s' from snapshot %d (%s)\n", serverName, snapshot.ID, snapshot.Description)
+	action, _, err := p.client.Server.Rebuild(context.Background(), server, hcloud.ServerRebuildOpts{Image: snapshot})
+	if err != nil {
+		return fmt.Errorf("error rebuilding server: %w", err)
+	}
+	if err := waitForAction(p.logger, p.client.Action, action); err != nil {
+		return fmt.Errorf("error waiting for rebuild: %w", err)
+	}
+	labels := map[string]string{configHashLabel: snapshot.Labels[configHashLabel]}
+	if revision, ok := snapshot.Labels[gitRevisionLabel]; ok {
+		labels[gitRevisionLabel] = revision
+	}
+	if err := p.setLabels(server, labels); err != nil {
+		return err
+	}
+	p.logger.Printf("successfully rolled back server '%s'\n", serverName)
+	return nil
+}
+
+// runRollback rebuilds a server from a snapshot or reinstalls it with a previous revision
+func runRollback(args []string) {
+	fs := flag.NewFlagSet("rollback", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	snapshotID := fs.Int("snapshot", 0, "id of the snapshot to restore (default latest)")
+	list := fs.Bool("list", false, "list the snapshots instead of restoring one")
+	to := fs.String("to", "", "reinstall the ignition config of a previous revision from the history instead of restoring a snapshot")
+	fs.Parse(args)
+	if fs.NArg() != 1 || (*to != "" && (*snapshotID != 0 || *list)) {
+		fs.Usage()
+		os.Exit(1)
+	}
+	serverName := fs.Arg(0)
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	if *list {
+		snapshots, err := p.snapshots(serverName)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+		for _, snapshot := range snapshots {
+			fmt.Printf("%d\t%s\t%s\n", snapshot.ID, snapshot.Created.Format(time.RFC3339), snapshot.Description)
+		}
+		return
+	}
+	if *to != "" {
+		if err := p.reinstallRevision(serverName, *to); err != nil {
+			fatalf("error rolling back %s: %v\n", serverName, err)
+		}
+		return
+	}
+	if err := p.rollback(serverName, *snapshotID); err != nil {
+		fatalf("error rolling back %s: %v\n", serverName, err)
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// userDataLimit is the maximum size of the user data of a server
+const userDataLimit = 32 * 1024
+
+// serverStub returns the server named serverName as far as it's known before it's created in location
+func (p *provisioner) serverStub(serverName string, location *hcloud.Location) *hcloud.Server {
+	return &hcloud.Server{
+		Name:       serverName,
+		ServerType: p.serverType,
+		Image:      p.image,
+		Datacenter: &hcloud.Datacenter{Location: location},
+		Labels:     map[string]string{managedLabel: managedLabelValue},
+	}
+}
+
+// userData renders the ignition config of the server named serverName for its user data before it's created in location,
+// for servers booting the flatcar snapshot with hcloud.start_after_create.
+// Only values known before the server exists are available to the template, the hash of the config is returned
+// so bootSnapshot can tell whether the config of the created server differs.
+func (p *provisioner) userData(serverName string, location *hcloud.Location) (string, string, error) {
+	server := p.serverStub(serverName, location)
+	rendered, err := p.renderIgnition(server)
+	if err != nil {
+		return "", "", err
+	}
+	hash, err := configHash(rendered)
+	if err != nil {
+		return "", "", err
+	}
+	// the public ip isn't assigned yet, the lint only checks whether there is one
+	linted := *server
+	if !p.cfg.HCloud.PrivateOnly {
+		linted.PublicNet.IPv4.IP = net.IPv4bcast
+	}
+	warnings, err := lintIgnition(rendered, &linted)
+	if err != nil {
+		return "", "", err
+	}
+	for _, warning := range warnings {
+		p.logger.Printf("warning: %s\n", warning)
+	}
+	if len(warnings) > 0 && !p.force {
+		return "", "", errors.New("ignition config has warnings, use --force to create the server anyway")
+	}
+	if p.cfg.Flatcar.RemoteConfig.UploadURL != "" {
+		rendered, err = p.pointerIgnition(server, rendered)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return "", "", fmt.Errorf("error encoding ignition config: %w", err)
+	}
+	if len(cfgJSON) > userDataLimit {
+		return "", "", fieldError{
+			Field:   "hcloud.start_after_create",
+			Message: fmt.Sprintf("ignition config of %s has %s, user data is limited to %s", serverName, formatBytes(int64(len(cfgJSON))), formatBytes(userDataLimit)),
+			Hint:    "set flatcar.remote_config.upload_url to pass a pointer config",
+		}
+	}
+	return string(cfgJSON), hash, nil
+}
+
+// bootSnapshot finishes a server created from the flatcar snapshot with its config as user data,
+// which ignition applies on its first boot instead of an install via rescue
+func (p *provisioner) bootSnapshot(server *hcloud.Server, rendered renderedIgnition) error {
+	if p.cfg.Artifacts.Console {
+		defer p.startConsoleCapture(server)()
+	}
+	cfgJSON, err := rendered.JSON()
+	if err != nil {
+		return fmt.Errorf("error encoding ignition config: %w", err)
+	}
+	p.logger.Printf("%s boots %s with its config as user data, skipping the install\n", server.Name, describeImage(p.image))
+	// there's no install which could have failed instead, the server has to show that it came up
+	return p.firstBoot(server, cfgJSON, nil, nil, true)
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	ignTypes "github.com/flatcar/ignition/config/v2_3/types"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// buildSSHAuth returns the authentication used for the ssh connections to the server.
+// It uses the configured private key or the ssh agent and wraps the keys in the OpenSSH certificate if one is given.
+func buildSSHAuth(conf hcloudConfig) ([]ssh.AuthMethod, error) {
+	signer, _, err := privateKeySigner(conf)
+	if err != nil {
+		return nil, err
+	}
+	if conf.SSHCertificatePath == "" {
+		if signer != nil {
+			return []ssh.AuthMethod{ssh.PublicKeys(signer)}, nil
+		}
+		sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+		if err != nil {
+			return nil, fmt.Errorf("could not find ssh agent: %w", err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)}, nil
+	}
+
+	cert, err := readCertificate(conf.SSHCertificatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if signer != nil {
+		certSigner, err := ssh.NewCertSigner(cert, signer)
+		if err != nil {
+			return nil, fmt.Errorf("error combining certificate with private key: %w", err)
+		}
+		return []ssh.AuthMethod{ssh.PublicKeys(certSigner)}, nil
+	}
+
+	sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
+	if err != nil {
+		return nil, fmt.Errorf("could not find ssh agent: %w", err)
+	}
+	agentClient := agent.NewClient(sshAgent)
+	return []ssh.AuthMethod{ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+		signers, err := agentClient.Signers()
+		if err != nil {
+			return nil, err
+		}
+		// only the agent key matching the certificate can be used to sign with it
+		for _, signer := range signers {
+			if bytes.Equal(signer.PublicKey().Marshal(), cert.Key.Marshal()) {
+				certSigner, err := ssh.NewCertSigner(cert, signer)
+				if err != nil {
+					return nil, err
+				}
+				return []ssh.Signer{certSigner}, nil
+			}
+		}
+		return nil, fmt.Errorf("no key in ssh agent matches certificate %s", conf.SSHCertificatePath)
+	})}, nil
+}
+
+// errNoAgent is returned by matchLocalKey if no private key is configured and the ssh agent can't be used
+var errNoAgent = errors.New("ssh agent not available")
+
+// matchLocalKey checks that the configured private key or one of the agent keys is the hcloud ssh key
+// and returns which one matched
+func matchLocalKey(conf hcloudConfig, sshKey *hcloud.SSHKey) (string, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(sshKey.PublicKey))
+	if err != nil {
+		return "", fmt.Errorf("error parsing public key of %s: %w", sshKey.Name, err)
+	}
+	signer, source, err := privateKeySigner(conf)
+	if err != nil {
+		return "", err
+	}
+	if signer != nil {
+		if !bytes.Equal(signer.PublicKey().Marshal(), publicKey.Marshal()) {
+			return "", fmt.Errorf("%s (%s) doesn't match hcloud ssh key %s (%s)", source, ssh.FingerprintLegacyMD5(signer.PublicKey()), sshKey.Name, ssh.FingerprintLegacyMD5(publicKey))
+		}
+		return fmt.Sprintf("%s matches", source), nil
+	}
+	agentKeys, err := listAgentKeys()
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errNoAgent, err)
+	}
+	for _, key := range agentKeys {
+		if bytes.Equal(key.Marshal(), publicKey.Marshal()) {
+			return fmt.Sprintf("agent key %s matches", key.Comment), nil
+		}
+	}
+	return "", fmt.Errorf("none of the %d ssh agent keys matches hcloud ssh key %s (%s), add it with ssh-add or set ssh_key_private_path or ssh_key_private", len(agentKeys), sshKey.Name, ssh.FingerprintLegacyMD5(publicKey))
+}
+
+// checkSSHKey fails if the local key doesn't match the hcloud ssh key, which would only show up as failing ssh connections.
+// Without agent the check is skipped, the rescue system can still be reached with its root password.
+func (p *provisioner) checkSSHKey() error {
+	p.sshKeyCheck.Do(func() {
+		match, err := matchLocalKey(p.cfg.HCloud, p.sshKey)
+		switch {
+		case errors.Is(err, errNoAgent):
+			p.logger.Printf("warning: can't verify the local ssh key: %v\n", err)
+		case err != nil:
+			p.sshKeyErr = err
+		default:
+			p.logger.Printf("ssh key: %s\n", match)
+		}
+	})
+	return p.sshKeyErr
+}
+
+// privateKeySigner loads the configured private key, from hcloud.ssh_key_private in memory or from hcloud.ssh_key_private_path.
+// It returns a nil signer if neither is set and the ssh agent is used, source describes where the key came from.
+func privateKeySigner(conf hcloudConfig) (signer ssh.Signer, source string, err error) {
+	switch {
+	case conf.SSHKeyPrivate != "":
+		source = "hcloud.ssh_key_private"
+		// the key isn't part of the error, it would end up in the logs if it's malformed
+		if signer, err = ssh.ParsePrivateKey([]byte(conf.SSHKeyPrivate)); err != nil {
+			return nil, source, fmt.Errorf("error parsing %s: %w", source, err)
+		}
+	case conf.SSHKeyPrivatePath != "":
+		source = conf.SSHKeyPrivatePath
+		key, err := ioutil.ReadFile(conf.SSHKeyPrivatePath)
+		if err != nil {
+			return nil, source, fmt.Errorf("error loading %s: %w", source, err)
+		}
+		if signer, err = ssh.ParsePrivateKey(key); err != nil {
+			return nil, source, fmt.Errorf("error loading %s: %w", source, err)
+		}
+	}
+	return signer, source, nil
+}
+
+// readCertificate parses the OpenSSH certificate at path
+func readCertificate(path string) (*ssh.Certificate, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pubKey, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing certificate: %w", err)
+	}
+	cert, ok := pubKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ssh certificate", path)
+	}
+	return cert, nil
+}
+
+// recordHostKey returns a host key callback accepting every key and storing it in hostKey
+func recordHostKey(hostKey *ssh.PublicKey) ssh.HostKeyCallback {
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		*hostKey = key
+		return nil
+	}
+}
+
+// publicAddress returns the public address of the server in the preferred address family, the other one if it's not available.
+// hostSuffix is appended to the IPv6 network, rescue uses ::2 and flatcar ::1.
+func (p *provisioner) publicAddress(server *hcloud.Server, hostSuffix string) (string, bool) {
+	var ipv4, ipv6 string
+	if ip := server.PublicNet.IPv4.IP; ip != nil {
+		ipv4 = ip.String()
+	}
+	if ip := server.PublicNet.IPv6.IP; ip != nil {
+		ipv6 = ip.String() + hostSuffix
+	}
+	candidates := []string{ipv4, ipv6}
+	if p.cfg.SSH.AddressFamily == "ipv6" {
+		candidates = []string{ipv6, ipv4}
+	}
+	for _, candidate := range candidates {
+		if candidate != "" {
+			return candidate, true
+		}
+	}
+	return "", false
+}
+
+// rescueAddress returns the address the rescue system is reachable at
+func (p *provisioner) rescueAddress(server *hcloud.Server) (string, error) {
+	if addr, ok := p.publicAddress(server, "2"); ok {
+		return addr, nil
+	}
+	return p.privateAddress(server)
+}
+
+// flatcarAddress returns the address the installed system is reachable at
+func (p *provisioner) flatcarAddress(server *hcloud.Server) (string, error) {
+	if addr, ok := p.publicAddress(server, "1"); ok {
+		return addr, nil
+	}
+	return p.privateAddress(server)
+}
+
+// privateAddress returns the ip of servers without public network in the private network, reachable via bastion or proxy
+func (p *provisioner) privateAddress(server *hcloud.Server) (string, error) {
+	privateNet, ok := findPrivateNet(server, p.privateNetwork)
+	if !ok {
+		return "", fmt.Errorf("server %s has no public address and isn't attached to network %s", server.Name, p.privateNetwork.Name)
+	}
+	return privateNet.IP.String(), nil
+}
+
+// scanHostKey performs a ssh handshake with addr and returns the host key presented by the server.
+// Authentication isn't necessary because the host key is exchanged beforehand.
+func scanHostKey(dial dialFunc, addr string, hostKeyAlgorithms ...string) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+	client, err := sshConnect(dial, sshTarget{
+		User:              "core",
+		Addr:              addr,
+		Port:              22,
+		Callback:          recordHostKey(&hostKey),
+		HostKeyAlgorithms: hostKeyAlgorithms,
+	})
+	if client != nil {
+		client.Close()
+	}
+	if hostKey == nil {
+		return nil, err
+	}
+	return hostKey, nil
+}
+
+// waitForHostKey scans the host key of addr until it differs from previousKey (the one of the rescue system)
+func waitForHostKey(logger *log.Logger, dial dialFunc, addr string, previousKey ssh.PublicKey, hostKeyAlgorithms ...string) (ssh.PublicKey, error) {
+	initialRetries := 30
+	retryDelay := 10 * time.Second
+	for retries := 1; retries <= initialRetries; retries++ {
+		hostKey, err := scanHostKey(dial, addr, hostKeyAlgorithms...)
+		if err != nil {
+			logger.Printf("retrying host key scan (%d/%d): %v\n", retries, initialRetries, err)
+		} else if previousKey != nil && bytes.Equal(hostKey.Marshal(), previousKey.Marshal()) {
+			logger.Printf("server still presents rescue host key, retrying (%d/%d)\n", retries, initialRetries)
+		} else {
+			return hostKey, nil
+		}
+		time.Sleep(retryDelay)
+	}
+	return nil, fmt.Errorf("no new host key presented by %s", addr)
+}
+
+// updateKnownHosts replaces all entries for addr in the known_hosts file at path with key
+func updateKnownHosts(path string, addr string, key ssh.PublicKey) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	normalizedAddr := knownhosts.Normalize(addr)
+	var lines []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		matchesAddr := false
+		for _, host := range strings.Split(fields[0], ",") {
+			if host == normalizedAddr {
+				matchesAddr = true
+				break
+			}
+		}
+		if !matchesAddr {
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, knownhosts.Line([]string{normalizedAddr}, key))
+	return ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+// knownHostAlgorithms returns the host key algorithms of the entries for addr in the known_hosts file at path,
+// so the server presents a key that can be verified instead of its preferred one
+func knownHostAlgorithms(path string, addr string) ([]string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	normalizedAddr := knownhosts.Normalize(addr)
+	var algorithms []string
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || strings.HasPrefix(fields[0], "@") {
+			continue
+		}
+		for _, host := range strings.Split(fields[0], ",") {
+			if host == normalizedAddr {
+				algorithms = append(algorithms, fields[1])
+				break
+			}
+		}
+	}
+	return algorithms, nil
+}
+
+// injectHostKey generates an ecdsa ssh host key and adds it to the ignition config.
+// The remaining key types are generated by flatcar on first boot.
+func injectHostKey(ignitionConfig *ignTypes.Config) (ssh.PublicKey, error) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyDER, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: privateKeyDER})
+	addFile(ignitionConfig, "/etc/ssh/ssh_host_ecdsa_key", 0600, privateKeyPEM)
+	addFile(ignitionConfig, "/etc/ssh/ssh_host_ecdsa_key.pub", 0644, ssh.MarshalAuthorizedKey(publicKey))
+	return publicKey, nil
+}
+
+// shellQuote quotes value for use as a single argument in a remote shell command
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+func TestServerAddresses(t *testing.T) {
+	network := &hcloud.Network{ID: 2, Name: "internal"}
+	p := &provisioner{privateNetwork: network}
+	public := &hcloud.Server{Name: "web-1"}
+	public.PublicNet.IPv4.IP = net.ParseIP("192.0.2.10")
+	private := &hcloud.Server{Name: "web-2", PrivateNet: []hcloud.ServerPrivateNet{{Network: network, IP: net.ParseIP("10.0.0.2")}}}
+	detached := &hcloud.Server{Name: "web-3"}
+
+	if addr, err := p.flatcarAddress(public); err != nil || addr != "192.0.2.10" {
+		t.Errorf("expected public address, got %q, %v", addr, err)
+	}
+	if addr, err := p.rescueAddress(private); err != nil || addr != "10.0.0.2" {
+		t.Errorf("expected private address, got %q, %v", addr, err)
+	}
+	if addr, err := p.flatcarAddress(detached); err == nil || !strings.Contains(err.Error(), "network internal") {
+		t.Errorf("expected error naming the network, got %q, %v", addr, err)
+	}
+}
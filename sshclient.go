@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// The ssh connections to the rescue and installed systems are built on x/crypto/ssh directly:
+// a connection is shared by its commands and sftp sessions, commands are cancelled with their context
+// and fail with the end of their stderr, dead connections are detected by keepalives.
+
+// sshTimeout is the time the tcp connection and the ssh handshake may take
+const sshTimeout = 20 * time.Second
+
+// sshTarget describes a ssh connection established by sshConnect
+type sshTarget struct {
+	User string
+	Addr string
+	Port uint
+	Auth []ssh.AuthMethod
+	// Callback verifies the host key presented by the server
+	Callback ssh.HostKeyCallback
+	// HostKeyAlgorithms restricts the host keys the server may present, all are accepted if empty
+	HostKeyAlgorithms []string
+	// Keepalive is the interval keepalives are sent in, defaultKeepaliveInterval if zero
+	Keepalive time.Duration
+}
+
+// sshClient is a ssh connection, every command and sftp session runs in a channel of its own
+type sshClient struct {
+	*ssh.Client
+}
+
+// defaultKeepaliveInterval is the interval keepalives are sent on ssh connections if ssh.keepalive_interval isn't set
+const defaultKeepaliveInterval = 30 * time.Second
+
+// keepaliveMaxMissed is the number of unanswered keepalives after which a connection is considered dead
+const keepaliveMaxMissed = 3
+
+// keepAlive sends keepalives on client until it's closed and closes it if the other side stops answering,
+// so commands and uploads on dead connections fail instead of waiting forever
+func keepAlive(client *ssh.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	missed := 0
+	for range ticker.C {
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+		select {
+		case err := <-replied:
+			if err != nil {
+				// connection is closed
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= keepaliveMaxMissed {
+				log.Printf("ssh connection to %s didn't answer %d keepalives, closing it\n", client.RemoteAddr(), missed)
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+// sshConnect establishes the ssh connection described by target using dial
+func sshConnect(dial dialFunc, target sshTarget) (*sshClient, error) {
+	addr := net.JoinHostPort(target.Addr, fmt.Sprint(target.Port))
+	conn, err := dial(addr)
+	if err != nil {
+		return nil, err
+	}
+	type handshakeResult struct {
+		conn  ssh.Conn
+		chans <-chan ssh.NewChannel
+		reqs  <-chan *ssh.Request
+		err   error
+	}
+	done := make(chan handshakeResult, 1)
+	go func() {
+		sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, &ssh.ClientConfig{
+			User:              target.User,
+			Auth:              target.Auth,
+			HostKeyCallback:   target.Callback,
+			HostKeyAlgorithms: target.HostKeyAlgorithms,
+		})
+		done <- handshakeResult{sshConn, chans, reqs, err}
+	}()
+	select {
+	case result := <-done:
+		if result.err != nil {
+			conn.Close()
+			return nil, result.err
+		}
+		client := ssh.NewClient(result.conn, result.chans, result.reqs)
+		keepalive := target.Keepalive
+		if keepalive <= 0 {
+			keepalive = defaultKeepaliveInterval
+		}
+		go keepAlive(client, keepalive)
+		return &sshClient{Client: client}, nil
+	case <-time.After(sshTimeout):
+		conn.Close()
+		return nil, fmt.Errorf("ssh handshake with %s timed out", addr)
+	}
+}
+
+// run runs command in a new session, writing its stdout and stderr to the writers if they aren't nil.
+// If ctx is done first, the command is interrupted and its session closed, ctx.Err() is returned.
+func (c *sshClient) run(ctx context.Context, command string, stdout io.Writer, stderr io.Writer) error {
+	session, err := c.NewSession()
+	if err != nil {
+		return fmt.Errorf("error creating session: %w", err)
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+	if err := session.Start(command); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// most servers ignore signals, closing the channel ends the command anyways
+		session.Signal(ssh.SIGINT)
+		session.Close()
+		return ctx.Err()
+	}
+}
+
+// output runs command and returns its stdout, the failure includes the end of its stderr
+func (c *sshClient) output(ctx context.Context, command string) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	if err := c.run(ctx, command, &stdout, &stderr); err != nil {
+		var tail []string
+		if lines := splitLines(bytes.TrimSpace(stderr.Bytes())); len(lines) > outputTail {
+			tail = lines[len(lines)-outputTail:]
+		} else {
+			tail = lines
+		}
+		return stdout.Bytes(), &commandError{err: err, output: tail}
+	}
+	return stdout.Bytes(), nil
+}
+
+// sftp starts a sftp session on the connection
+func (c *sshClient) sftp() (*sftp.Client, error) {
+	return sftp.NewClient(c.Client)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+type serverStatus struct {
+	Name   string            `json:"name"`
+	Exists bool              `json:"exists"`
+	ID     int               `json:"id,omitempty"`
+	Status string            `json:"status,omitempty"`
+	IPv4   string            `json:"ipv4,omitempty"`
+	IPv6   string            `json:"ipv6,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+	Config string            `json:"config,omitempty"`
+	// Orphan is set for existing servers without the managed label
+	Orphan bool `json:"orphan,omitempty"`
+	// NextMaintenance is when a drifted server is reinstalled at the earliest if maintenance windows are configured
+	NextMaintenance *time.Time `json:"next_maintenance,omitempty"`
+}
+
+// status returns the state of the server including whether its applied config is in sync with the rendered one
+func (p *provisioner) status(serverName string) (serverStatus, error) {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return serverStatus{}, fmt.Errorf("error finding server: %w", err)
+	}
+	status := serverStatus{Name: serverName}
+	if server == nil {
+		return status, nil
+	}
+	status.Exists = true
+	status.ID = server.ID
+	status.Status = string(server.Status)
+	if ip := server.PublicNet.IPv4.IP; ip != nil {
+		status.IPv4 = ip.String()
+	}
+	if ip := server.PublicNet.IPv6.IP; ip != nil {
+		status.IPv6 = ip.String()
+	}
+	status.Labels = server.Labels
+	status.Orphan = server.Labels[managedLabel] != managedLabelValue
+	status.Config, err = p.driftState(server)
+	if err != nil {
+		return serverStatus{}, err
+	}
+	if maintenance := newMaintenanceSchedule(p.cfg.Maintenance, time.Time{}); status.Config == stateDrifted && maintenance.restricted() {
+		if next, ok := maintenance.next(time.Now()); ok {
+			status.NextMaintenance = &next
+		}
+	}
+	return status, nil
+}
+
+// namePatterns returns the globs of the server names managed by hetzner-flatcar,
+// hcloud.name_patterns and the name patterns of flatcar.templates
+func (c config) namePatterns() []string {
+	patterns := append([]string{}, c.HCloud.NamePatterns...)
+	for pattern := range c.Flatcar.Templates {
+		if !strings.Contains(pattern, "=") {
+			patterns = append(patterns, pattern)
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// orphans returns the names of the servers matching the name patterns without the managed label,
+// likely created manually or by an older version
+func (p *provisioner) orphans() ([]string, error) {
+	patterns := p.cfg.namePatterns()
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	servers, err := p.client.Server.AllWithOpts(context.Background(), hcloud.ServerListOpts{})
+	if err != nil {
+		return nil, fmt.Errorf("error listing servers: %w", err)
+	}
+	var orphans []string
+	for _, server := range servers {
+		if server.Labels[managedLabel] == managedLabelValue {
+			continue
+		}
+		for _, pattern := range patterns {
+			if match, _ := path.Match(pattern, server.Name); match {
+				orphans = append(orphans, server.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(orphans)
+	return orphans, nil
+}
+
+func printStatus(w io.Writer, statuses []serverStatus) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tID\tSTATUS\tIPV4\tCONFIG")
+	for _, status := range statuses {
+		if !status.Exists {
+			fmt.Fprintf(tw, "%s\t-\tmissing\t-\t-\n", status.Name)
+			continue
+		}
+		ipv4 := status.IPv4
+		if ipv4 == "" {
+			ipv4 = "-"
+		}
+		config := status.Config
+		if status.NextMaintenance != nil {
+			config = fmt.Sprintf("%s (reinstall pending, next window %s)", config, status.NextMaintenance.Format("2006-01-02 15:04 MST"))
+		}
+		if status.Orphan {
+			config += " (orphan, not managed)"
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\n", status.Name, status.ID, status.Status, ipv4, config)
+	}
+	return tw.Flush()
+}
+
+func runStatus(args []string) {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	selector := addSelectorFlag(fs)
+	adopt := fs.Bool("adopt", false, "adopt the orphans, servers matching the name patterns or given without the managed label")
+	fs.Parse(args)
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	serverNames, err := p.resolveServerNames(fs.Args(), *selector)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	// orphans are listed after the given servers
+	orphans, err := p.orphans()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	listed := make(map[string]bool, len(serverNames))
+	for _, serverName := range serverNames {
+		listed[serverName] = true
+	}
+	for _, orphan := range orphans {
+		if !listed[orphan] {
+			serverNames = append(serverNames, orphan)
+		}
+	}
+	statuses := make([]serverStatus, 0, len(serverNames))
+	orphanCount := 0
+	for _, serverName := range serverNames {
+		status, err := p.status(serverName)
+		if err != nil {
+			fatalf("error requesting status of %s: %v\n", serverName, err)
+		}
+		if status.Orphan && *adopt {
+			if err := p.adopt(serverName); err != nil {
+				fatalf("error adopting %s: %v\n", serverName, err)
+			}
+			status.Orphan = false
+		}
+		if status.Orphan {
+			orphanCount++
+		}
+		statuses = append(statuses, status)
+	}
+	if err := printStatus(os.Stdout, statuses); err != nil {
+		fatalf("error printing status: %v\n", err)
+	}
+	if orphanCount > 0 {
+		log.Printf("%d servers aren't managed by hetzner-flatcar, adopt them with status --adopt\n", orphanCount)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// phaseTiming is the duration of a phase of provisioning a server, steps are part of their parent phase
+type phaseTiming struct {
+	Phase string `json:"phase"`
+	// Parent is the phase containing the step, empty for phases
+	Parent  string  `json:"parent,omitempty"`
+	Seconds float64 `json:"seconds"`
+}
+
+// phaseTotal aggregates the durations of a phase over all servers
+type phaseTotal struct {
+	Phase        string  `json:"phase"`
+	Parent       string  `json:"parent,omitempty"`
+	Count        int     `json:"count"`
+	TotalSeconds float64 `json:"total_seconds"`
+	MaxSeconds   float64 `json:"max_seconds"`
+	// MaxServer is the server the phase took longest on
+	MaxServer string `json:"max_server"`
+}
+
+// timingCollector collects the phase durations of all servers of a run
+type timingCollector struct {
+	mu      sync.Mutex
+	servers map[string][]phaseTiming
+}
+
+// timePhase starts timing phase of serverName, the returned function records its duration for the summary and metrics
+func (p *provisioner) timePhase(serverName string, phase string) func() {
+	return p.timeStep(serverName, "", phase)
+}
+
+// timeStep starts timing a step of the phase parent like timePhase, consecutive runs of a step are added up
+func (p *provisioner) timeStep(serverName string, parent string, step string) func() {
+	done := startPhase(step)
+	start := time.Now()
+	return func() {
+		done()
+		seconds := time.Since(start).Seconds()
+		p.timings.mu.Lock()
+		defer p.timings.mu.Unlock()
+		if p.timings.servers == nil {
+			p.timings.servers = make(map[string][]phaseTiming)
+		}
+		timings := p.timings.servers[serverName]
+		if last := len(timings) - 1; last >= 0 && timings[last].Phase == step && timings[last].Parent == parent {
+			timings[last].Seconds += seconds
+			return
+		}
+		p.timings.servers[serverName] = append(timings, phaseTiming{Phase: step, Parent: parent, Seconds: seconds})
+	}
+}
+
+// addTimings adds the phase durations of every server and their totals to summary
+func (p *provisioner) addTimings(summary *batchSummary) {
+	p.timings.mu.Lock()
+	defer p.timings.mu.Unlock()
+	indexes := make(map[string]int)
+	for i, result := range summary.Servers {
+		timings := p.timings.servers[result.Name]
+		summary.Servers[i].Phases = timings
+		for _, timing := range timings {
+			index, ok := indexes[timing.Phase]
+			if !ok {
+				index = len(summary.Timings)
+				indexes[timing.Phase] = index
+				summary.Timings = append(summary.Timings, phaseTotal{Phase: timing.Phase, Parent: timing.Parent})
+			}
+			total := &summary.Timings[index]
+			total.Count++
+			total.TotalSeconds += timing.Seconds
+			if timing.Seconds > total.MaxSeconds {
+				total.MaxSeconds, total.MaxServer = timing.Seconds, result.Name
+			}
+		}
+	}
+}
+
+// printTimings writes the totals of the phases as table, steps are indented below their phase
+func printTimings(w io.Writer, totals []phaseTotal) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "PHASE\tSERVERS\tAVERAGE\tMAX\tSLOWEST")
+	round := func(seconds float64) time.Duration {
+		return (time.Duration(seconds * float64(time.Second))).Round(100 * time.Millisecond)
+	}
+	printed := make(map[string]bool)
+	var printTotal func(total phaseTotal, indent string)
+	printTotal = func(total phaseTotal, indent string) {
+		printed[total.Phase] = true
+		fmt.Fprintf(tw, "%s%s\t%d\t%s\t%s\t%s\n", indent, total.Phase, total.Count, round(total.TotalSeconds/float64(total.Count)), round(total.MaxSeconds), total.MaxServer)
+		for _, step := range totals {
+			if step.Parent == total.Phase && !printed[step.Phase] {
+				printTotal(step, indent+"  ")
+			}
+		}
+	}
+	for _, total := range totals {
+		if !printed[total.Phase] && total.Parent == "" {
+			printTotal(total, "")
+		}
+	}
+	// steps of phases which failed before their end was recorded
+	for _, total := range totals {
+		if !printed[total.Phase] {
+			printTotal(total, "")
+		}
+	}
+	return tw.Flush()
+}
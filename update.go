@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	ignTypes "github.com/flatcar/ignition/config/v2_3/types"
+)
+
+const updateConfPath = "/etc/flatcar/update.conf"
+
+// legacyUpdateConfPath is used by the update and locksmith sections of container linux configs
+const legacyUpdateConfPath = "/etc/coreos/update.conf"
+
+// parseLocksmithWindow splits a window like "Thu 04:00/1h" into its start and length
+func parseLocksmithWindow(window string) (string, time.Duration, error) {
+	start, length, found := strings.Cut(window, "/")
+	if !found {
+		return "", 0, fmt.Errorf("locksmith window %s isn't in the format <start>/<length>", window)
+	}
+	duration, err := time.ParseDuration(length)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid locksmith window length: %w", err)
+	}
+	return strings.TrimSpace(start), duration, nil
+}
+
+// injectUpdateConfig writes the configured update strategy to update.conf if the template doesn't define it itself
+func injectUpdateConfig(logger *log.Logger, ignitionConfig *ignTypes.Config, conf flatcarConfig) {
+	var lines []string
+	if conf.UpdateGroup != "" {
+		lines = append(lines, fmt.Sprintf("GROUP=%s", conf.UpdateGroup))
+	}
+	if conf.RebootStrategy != "" {
+		lines = append(lines, fmt.Sprintf("REBOOT_STRATEGY=%s", conf.RebootStrategy))
+	}
+	if conf.LocksmithWindow != "" {
+		// validated while parsing the config
+		start, length, _ := parseLocksmithWindow(conf.LocksmithWindow)
+		lines = append(lines,
+			fmt.Sprintf("LOCKSMITHD_REBOOT_WINDOW_START=%s", start),
+			fmt.Sprintf("LOCKSMITHD_REBOOT_WINDOW_LENGTH=%s", length),
+		)
+	}
+	if len(lines) == 0 {
+		return
+	}
+	if hasFile(*ignitionConfig, updateConfPath) || hasFile(*ignitionConfig, legacyUpdateConfPath) {
+		logger.Println("template already defines update.conf, not injecting update strategy")
+		return
+	}
+	addFile(ignitionConfig, updateConfPath, 0644, []byte(strings.Join(lines, "\n")+"\n"))
+}
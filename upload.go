@@ -0,0 +1,322 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadRetries is how often an interrupted upload is resumed before giving up
+var uploadRetries = 5
+
+// uploadRetryDelay is waited before reconnecting after an upload was interrupted
+var uploadRetryDelay = 10 * time.Second
+
+// progressInterval is the minimum time between two progress logs of an upload
+var progressInterval = 5 * time.Second
+
+// sshSession is a ssh connection which can be reestablished after it broke, e.g. to resume uploads
+type sshSession struct {
+	*sshClient
+	connect func() (*sshClient, error)
+	// env is prefixed to commands run with runTimeout, e.g. to export proxy variables
+	env string
+	// sudo runs the commands run with runTimeout including env with sudo
+	sudo bool
+	// transcript receives the commands run with runTimeout and their output for the report, nil without report
+	transcript func(commandTranscript)
+	// logger receives the progress of uploads and retries, the logger of the provisioner
+	logger *log.Logger
+}
+
+// Close closes the current connection
+func (s *sshSession) Close() error {
+	return s.sshClient.Close()
+}
+
+// reconnect replaces the connection with a new one
+func (s *sshSession) reconnect() error {
+	s.sshClient.Close()
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	s.sshClient = client
+	return nil
+}
+
+// formatBytes formats a size in bytes with a binary unit
+func formatBytes(size int64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := int64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
+
+// progressReader logs the transferred bytes, the rate and the remaining time at most every progressInterval
+type progressReader struct {
+	logger *log.Logger
+	reader io.Reader
+	name   string
+	total  int64
+	read   int64
+	// offset is the amount of bytes transferred before resuming, excluded from the rate
+	offset int64
+	start  time.Time
+	last   time.Time
+}
+
+func newProgressReader(logger *log.Logger, reader io.Reader, name string, total int64, offset int64) *progressReader {
+	now := time.Now()
+	return &progressReader{logger: logger, reader: reader, name: name, total: total, read: offset, offset: offset, start: now, last: now}
+}
+
+func (r *progressReader) Read(data []byte) (int, error) {
+	n, err := r.reader.Read(data)
+	r.read += int64(n)
+	if time.Since(r.last) >= progressInterval {
+		r.last = time.Now()
+		r.logger.Printf("uploading %s\n", r.status())
+	}
+	return n, err
+}
+
+func (r *progressReader) rate() float64 {
+	elapsed := time.Since(r.start).Seconds()
+	if elapsed == 0 {
+		return 0
+	}
+	return float64(r.read-r.offset) / elapsed
+}
+
+func (r *progressReader) status() string {
+	status := fmt.Sprintf("%s: %s/%s", r.name, formatBytes(r.read), formatBytes(r.total))
+	if r.total > 0 {
+		status += fmt.Sprintf(" (%d%%)", r.read*100/r.total)
+	}
+	if rate := r.rate(); rate > 0 {
+		eta := time.Duration(float64(r.total-r.read) / rate * float64(time.Second)).Round(time.Second)
+		status += fmt.Sprintf(", %s/s, eta %s", formatBytes(int64(rate)), eta)
+	}
+	return status
+}
+
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// upload copies localPath to remotePath via sftp, resumes it after reconnecting if the connection breaks
+// and verifies the sha256 of the remote file afterwards. It returns the sha256 of the file.
+func (s *sshSession) upload(localPath string, remotePath string) (string, error) {
+	sum, err := fileSHA256(localPath)
+	if err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		err := s.uploadFrom(localPath, remotePath, attempt > 1)
+		if err == nil {
+			break
+		}
+		if attempt > uploadRetries {
+			return "", err
+		}
+		s.logger.Printf("upload of %s interrupted, resuming (%d/%d): %v\n", localPath, attempt, uploadRetries, err)
+		time.Sleep(uploadRetryDelay)
+		if err := s.reconnect(); err != nil {
+			s.logger.Printf("error reconnecting: %v\n", err)
+		}
+	}
+	if err := s.verifySHA256(remotePath, sum); err != nil {
+		return "", err
+	}
+	return sum, nil
+}
+
+// verifySHA256 compares the sha256 of remotePath with sum
+func (s *sshSession) verifySHA256(remotePath string, sum string) error {
+	output, err := s.output(context.Background(), fmt.Sprintf("sha256sum %s", shellQuote(remotePath)))
+	if err != nil {
+		return fmt.Errorf("error computing checksum of %s: %w", remotePath, err)
+	}
+	if fields := strings.Fields(string(output)); len(fields) == 0 || fields[0] != sum {
+		return fmt.Errorf("checksum mismatch of uploaded %s: expected %s, got %s", remotePath, sum, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// uploadContent writes content to remotePath via sftp without a local file, the remote file is only readable by its owner.
+// Interrupted uploads are retried after reconnecting and the sha256 is verified afterwards.
+func (s *sshSession) uploadContent(content []byte, remotePath string) error {
+	for attempt := 1; ; attempt++ {
+		err := s.writeContent(content, remotePath)
+		if err == nil {
+			break
+		}
+		if attempt > uploadRetries {
+			return err
+		}
+		s.logger.Printf("upload of %s interrupted, retrying (%d/%d): %v\n", remotePath, attempt, uploadRetries, err)
+		time.Sleep(uploadRetryDelay)
+		if err := s.reconnect(); err != nil {
+			s.logger.Printf("error reconnecting: %v\n", err)
+		}
+	}
+	sum := sha256.Sum256(content)
+	return s.verifySHA256(remotePath, hex.EncodeToString(sum[:]))
+}
+
+func (s *sshSession) writeContent(content []byte, remotePath string) error {
+	sftpClient, err := s.sftp()
+	if err != nil {
+		return fmt.Errorf("error starting sftp: %w", err)
+	}
+	defer sftpClient.Close()
+	remote, err := sftpClient.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	// restricted before writing, the file may already exist with other permissions
+	if err := sftpClient.Chmod(remotePath, 0600); err != nil {
+		return fmt.Errorf("error restricting permissions of %s: %w", remotePath, err)
+	}
+	if _, err := remote.Write(content); err != nil {
+		return err
+	}
+	return remote.Close()
+}
+
+// uploadFrom copies localPath to remotePath, continuing after the bytes already present remotely if resume is set
+func (s *sshSession) uploadFrom(localPath string, remotePath string, resume bool) error {
+	local, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	info, err := local.Stat()
+	if err != nil {
+		return err
+	}
+	sftpClient, err := s.sftp()
+	if err != nil {
+		return fmt.Errorf("error starting sftp: %w", err)
+	}
+	defer sftpClient.Close()
+
+	var offset int64
+	if resume {
+		if remoteInfo, err := sftpClient.Stat(remotePath); err == nil && remoteInfo.Size() <= info.Size() {
+			offset = remoteInfo.Size()
+		}
+	}
+	flags := os.O_WRONLY | os.O_CREATE
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	remote, err := sftpClient.OpenFile(remotePath, flags)
+	if err != nil {
+		return err
+	}
+	defer remote.Close()
+	if _, err := local.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := remote.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	if offset > 0 {
+		s.logger.Printf("resuming upload of %s at %s\n", info.Name(), formatBytes(offset))
+	}
+
+	reader := newProgressReader(s.logger, local, info.Name(), info.Size(), offset)
+	if _, err := io.Copy(remote, reader); err != nil {
+		return err
+	}
+	s.logger.Printf("uploaded %s in %s\n", reader.status(), time.Since(reader.start).Round(time.Millisecond))
+	return nil
+}
+
+// runTimeout runs command, passing every line of its output to output if set, and fails if it doesn't finish within timeout.
+// Failures are returned as commandError with the last lines of the output.
+func (s *sshSession) runTimeout(command string, timeout time.Duration, output func(line string)) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	fullCommand := s.env + command
+	if s.sudo {
+		fullCommand = sudoCommand(fullCommand)
+	}
+	var mu sync.Mutex
+	var tail, transcript []string
+	var omitted int
+	var wg sync.WaitGroup
+	collect := func(pipe io.Reader) {
+		defer wg.Done()
+		scanner := bufio.NewScanner(pipe)
+		for scanner.Scan() {
+			if output != nil {
+				output(scanner.Text())
+			}
+			mu.Lock()
+			tail = append(tail, scanner.Text())
+			if len(tail) > outputTail {
+				tail = tail[1:]
+			}
+			if s.transcript != nil {
+				transcript = append(transcript, scanner.Text())
+				if len(transcript) > transcriptLines {
+					transcript = transcript[1:]
+					omitted++
+				}
+			}
+			mu.Unlock()
+		}
+		// keep draining after a too long line so the command isn't blocked writing to the pipe
+		io.Copy(io.Discard, pipe)
+	}
+	stdoutReader, stdoutWriter := io.Pipe()
+	stderrReader, stderrWriter := io.Pipe()
+	wg.Add(2)
+	go collect(stdoutReader)
+	go collect(stderrReader)
+	started := time.Now()
+	err := s.run(ctx, fullCommand, stdoutWriter, stderrWriter)
+	stdoutWriter.Close()
+	stderrWriter.Close()
+	if errors.Is(err, context.DeadlineExceeded) {
+		err = fmt.Errorf("%w after %s", errCommandTimeout, timeout)
+		mu.Lock()
+		writeTranscript(s.transcript, command, transcript, omitted, time.Since(started), err)
+		mu.Unlock()
+		return err
+	}
+	wg.Wait()
+	if err != nil {
+		err = &commandError{err: err, output: tail}
+	}
+	writeTranscript(s.transcript, command, transcript, omitted, time.Since(started), err)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	ignTypes "github.com/flatcar/ignition/config/v2_3/types"
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// modes of flatcar.user_data, whether the installed config merges the user data or is replaced by it
+const (
+	userDataMerge   = "merge"
+	userDataReplace = "replace"
+)
+
+// userDataURL is where ignition fetches the user data of the server from
+const userDataURL = "http://169.254.169.254/hetzner/v1/userdata"
+
+// userDataHashLabel is the server label storing the hash of the user data set when the server was created
+const userDataHashLabel = "hetzner-flatcar/user-data-hash"
+
+// renderUserData renders flatcar.user_data.template for the server named serverName in location.
+// Only values known before the server is created are available, so it renders the same for existing servers
+// and can be compared to the user data they were created with.
+func (p *provisioner) renderUserData(serverName string, location *hcloud.Location) ([]byte, error) {
+	templateContent, err := p.renderNativeTemplate(p.serverStub(serverName, location), p.cfg.Flatcar.UserData.Template)
+	if err != nil {
+		return nil, err
+	}
+	rendered, err := transpileConfig(p.logger, templateContent)
+	if err != nil {
+		return nil, fmt.Errorf("error transpiling user data: %w", err)
+	}
+	userData, err := rendered.JSON()
+	if err != nil {
+		return nil, fmt.Errorf("error encoding user data: %w", err)
+	}
+	if len(userData) > userDataLimit {
+		return nil, fieldError{
+			Field:   "flatcar.user_data.template",
+			Message: fmt.Sprintf("user data of %s has %s, it's limited to %s", serverName, formatBytes(int64(len(userData))), formatBytes(userDataLimit)),
+			Hint:    "move everything that doesn't depend on the first boot into the config template",
+		}
+	}
+	return userData, nil
+}
+
+// userDataHash returns the hash of userData stored in userDataHashLabel
+func userDataHash(userData []byte) string {
+	sum := sha256.Sum256(userData)
+	return hex.EncodeToString(sum[:])[:40]
+}
+
+// withUserData makes the installed config of server merge or be replaced by its user data on the first boot.
+// The user data is pinned by its hash, ignition fails instead of applying user data the server wasn't created with.
+func (p *provisioner) withUserData(server *hcloud.Server, rendered renderedIgnition) (renderedIgnition, error) {
+	conf := p.cfg.Flatcar.UserData
+	if conf.Template == "" {
+		return rendered, nil
+	}
+	_, _, location := serverPlacement(server)
+	userData, err := p.renderUserData(server.Name, &location)
+	if err != nil {
+		return renderedIgnition{}, err
+	}
+	sum := sha512.Sum512(userData)
+	hash := "sha512-" + hex.EncodeToString(sum[:])
+
+	if rendered.config != nil {
+		reference := ignTypes.ConfigReference{Source: userDataURL, Verification: ignTypes.Verification{Hash: &hash}}
+		if conf.Mode == userDataReplace {
+			rendered.config.Ignition.Config.Replace = &reference
+		} else {
+			rendered.config.Ignition.Config.Append = append(rendered.config.Ignition.Config.Append, reference)
+		}
+		return rendered, nil
+	}
+
+	// butane configs are ignition v3, which isn't vendored, so the reference is added to plain maps
+	var ignitionConfig map[string]interface{}
+	if err := json.Unmarshal(rendered.raw, &ignitionConfig); err != nil {
+		return renderedIgnition{}, fmt.Errorf("error reading ignition config: %w", err)
+	}
+	ignition, _ := ignitionConfig["ignition"].(map[string]interface{})
+	if ignition == nil {
+		ignition = make(map[string]interface{})
+		ignitionConfig["ignition"] = ignition
+	}
+	references, _ := ignition["config"].(map[string]interface{})
+	if references == nil {
+		references = make(map[string]interface{})
+		ignition["config"] = references
+	}
+	reference := map[string]interface{}{"source": userDataURL, "verification": map[string]interface{}{"hash": hash}}
+	if conf.Mode == userDataReplace {
+		references["replace"] = reference
+	} else {
+		merge, _ := references["merge"].([]interface{})
+		references["merge"] = append(merge, reference)
+	}
+	raw, err := json.Marshal(ignitionConfig)
+	if err != nil {
+		return renderedIgnition{}, err
+	}
+	return renderedIgnition{raw: raw}, nil
+}
+
+// checkUserData fails if server wasn't created with the current user data, it can't be changed afterwards
+// and ignition would fail to verify it on the first boot
+func (p *provisioner) checkUserData(server *hcloud.Server) error {
+	if p.cfg.Flatcar.UserData.Template == "" {
+		return nil
+	}
+	_, _, location := serverPlacement(server)
+	userData, err := p.renderUserData(server.Name, &location)
+	if err != nil {
+		return err
+	}
+	switch server.Labels[userDataHashLabel] {
+	case userDataHash(userData):
+		p.logger.Printf("%s was created with the current user data\n", server.Name)
+		return nil
+	case "":
+		return fmt.Errorf("%s wasn't created with flatcar.user_data, user data can only be set when creating a server, recreate it", server.Name)
+	}
+	return fmt.Errorf("user data of %s differs from flatcar.user_data, user data can only be set when creating a server, recreate it", server.Name)
+}
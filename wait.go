@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/hetznercloud/hcloud-go/hcloud"
+)
+
+// waitPollInterval is the interval the conditions of wait are checked in
+var waitPollInterval = 5 * time.Second
+
+// waitClient checks the http conditions of wait
+var waitClient = &http.Client{Timeout: 10 * time.Second}
+
+// kinds of conditions wait blocks on
+const (
+	waitSSH  = "ssh"
+	waitUnit = "unit"
+	waitHTTP = "http"
+)
+
+// waitCondition is a condition of a server wait blocks on until it holds
+type waitCondition struct {
+	kind string
+	// target is the name of the unit or the url
+	target string
+}
+
+func (c waitCondition) String() string {
+	if c.target == "" {
+		return c.kind
+	}
+	return c.kind + ":" + c.target
+}
+
+// parseWaitCondition parses ssh, unit:<name> or http:<url>
+func parseWaitCondition(value string) (waitCondition, error) {
+	kind, target, _ := strings.Cut(value, ":")
+	switch kind {
+	case waitSSH:
+		if target != "" {
+			return waitCondition{}, fmt.Errorf("condition %s doesn't take a value", value)
+		}
+	case waitUnit, waitHTTP:
+		if target == "" {
+			return waitCondition{}, fmt.Errorf("condition %s needs a value, e.g. unit:<name> or http:<url>", value)
+		}
+	default:
+		return waitCondition{}, fmt.Errorf("unknown condition %s, expected ssh, unit:<name> or http:<url>", value)
+	}
+	return waitCondition{kind: kind, target: target}, nil
+}
+
+// checkCondition returns nil if condition holds on server, the error why it doesn't otherwise
+func (p *provisioner) checkCondition(ctx context.Context, server *hcloud.Server, condition waitCondition) error {
+	if condition.kind == waitHTTP {
+		host, err := p.flatcarAddress(server)
+		if err != nil {
+			return err
+		}
+		if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.ReplaceAll(condition.target, "{ip}", host), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := waitClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("status %s", resp.Status)
+		}
+		return nil
+	}
+	client, err := p.connect(server)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	if condition.kind == waitUnit {
+		state, err := client.output(ctx, "systemctl is-active "+shellQuote(condition.target))
+		if err != nil {
+			var commandErr *commandError
+			if errors.As(err, &commandErr) && len(strings.TrimSpace(string(state))) > 0 {
+				return fmt.Errorf("unit is %s", strings.TrimSpace(string(state)))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// waitFor blocks until all conditions hold on the server named serverName, one after another, or the timeout is exceeded
+func (p *provisioner) waitFor(serverName string, conditions []waitCondition, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		return fmt.Errorf("server %s doesn't exist", serverName)
+	}
+	for _, condition := range conditions {
+		for {
+			ctx, cancel := context.WithDeadline(context.Background(), deadline)
+			err := p.checkCondition(ctx, server, condition)
+			cancel()
+			if err == nil {
+				p.logger.Printf("%s: %s holds\n", serverName, condition)
+				break
+			}
+			if time.Now().Add(waitPollInterval).After(deadline) {
+				return fmt.Errorf("%s didn't hold within %s: %w", condition, timeout, err)
+			}
+			p.logger.Printf("%s: waiting for %s: %v\n", serverName, condition, err)
+			time.Sleep(waitPollInterval)
+		}
+	}
+	return nil
+}
+
+// runWait blocks until the conditions hold on all given servers
+func runWait(args []string) {
+	fs := flag.NewFlagSet("wait", flag.ExitOnError)
+	common := addCommonFlags(fs)
+	selector := addSelectorFlag(fs)
+	var conditionFlags stringListFlag
+	fs.Var(&conditionFlags, "for", "condition to wait for: ssh, unit:<name> or http:<url> ({ip} is replaced by the address of the server), can be repeated, defaults to ssh")
+	timeout := fs.Duration("timeout", 5*time.Minute, "maximum time to wait for all conditions")
+	fs.Parse(args)
+	if fs.NArg() == 0 && *selector == "" {
+		fs.Usage()
+		os.Exit(1)
+	}
+	if len(conditionFlags) == 0 {
+		conditionFlags = stringListFlag{waitSSH}
+	}
+	conditions := make([]waitCondition, len(conditionFlags))
+	for i, value := range conditionFlags {
+		condition, err := parseWaitCondition(value)
+		if err != nil {
+			fatalf("%v\n", err)
+		}
+		conditions[i] = condition
+	}
+	p, err := common.loadProvisioner()
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	serverNames, err := p.resolveServerNames(fs.Args(), *selector)
+	if err != nil {
+		fatalf("%v\n", err)
+	}
+	errs := forEachServer(serverNames, len(serverNames), func(serverName string) error {
+		return p.waitFor(serverName, conditions, *timeout)
+	})
+	if len(errs) > 0 {
+		printErrors(os.Stderr, errs)
+		fatalf("conditions didn't hold on %d of %d servers\n", len(errs), len(serverNames))
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWaitForHTTPCondition(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	api.addServer("web-1", "running", map[string]string{managedLabel: managedLabelValue})
+	waitPollInterval = 0
+	t.Cleanup(func() {
+		waitPollInterval = 5 * time.Second
+	})
+	var requests int
+	health := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(health.Close)
+
+	condition, err := parseWaitCondition("http:" + health.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := p.waitFor("web-1", []waitCondition{condition}, time.Minute); err != nil {
+		t.Fatalf("waiting failed: %v", err)
+	}
+	if requests != 3 {
+		t.Errorf("expected 3 requests, got %d", requests)
+	}
+	if err := p.waitFor("web-2", []waitCondition{condition}, 0); err == nil || !strings.Contains(err.Error(), "doesn't exist") {
+		t.Errorf("expected error for missing server, got %v", err)
+	}
+	for _, value := range []string{"unit", "ssh:22", "tcp:80"} {
+		if _, err := parseWaitCondition(value); err == nil {
+			t.Errorf("condition %s was accepted", value)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// server states reported by the status endpoint
+const (
+	stateCreated     = "created"
+	stateInSync      = "in sync"
+	stateDrifted     = "drifted"
+	stateReinstalled = "reinstalled"
+	stateFailed      = "failed"
+	statePending     = "pending"
+)
+
+type reconcileStatus struct {
+	LastReconcile time.Time         `json:"last_reconcile"`
+	LastError     string            `json:"last_error,omitempty"`
+	Servers       map[string]string `json:"servers"`
+	// NextMaintenance is the start of the next maintenance window if reinstalls are pending
+	NextMaintenance *time.Time `json:"next_maintenance,omitempty"`
+}
+
+// watcher periodically reconciles the given and selected servers with the config
+type watcher struct {
+	load        func() (*provisioner, error)
+	serverNames []string
+	// selector is resolved on every reconciliation, so servers labeled later are picked up
+	selector string
+	interval time.Duration
+	fixDrift bool
+	// at delays reinstalls of drifted servers until this time
+	at time.Time
+	// healthcheck is a dead man's switch url pinged after every reconciliation, /start and /fail are appended for starts and failures
+	healthcheck string
+
+	mu     sync.Mutex
+	status reconcileStatus
+}
+
+// run reconciles forever, waiting a jittered interval between the runs
+func (w *watcher) run() {
+	for {
+		w.reconcile()
+		// add up to +-10% jitter to avoid synchronized api calls of multiple instances
+		jitter := time.Duration((rand.Float64()*0.2 - 0.1) * float64(w.interval))
+		wait := w.interval + jitter
+		// don't miss maintenance windows shorter than the interval
+		w.mu.Lock()
+		if next := w.status.NextMaintenance; next != nil && time.Until(*next) < wait {
+			wait = time.Until(*next)
+		}
+		w.mu.Unlock()
+		log.Printf("next reconciliation in %s\n", wait)
+		time.Sleep(wait)
+	}
+}
+
+// reconcile creates missing servers and detects (or fixes) drifted ones
+func (w *watcher) reconcile() {
+	log.Println("reconciling servers")
+	w.ping("/start", "")
+	status := reconcileStatus{
+		Servers: make(map[string]string),
+	}
+	defer func() {
+		status.LastReconcile = time.Now()
+		lastReconcile.Set(float64(status.LastReconcile.Unix()))
+		result := resultSucceeded
+		if status.LastError != "" {
+			result = resultFailed
+			w.ping("/fail", status.LastError)
+		} else {
+			w.ping("", "")
+		}
+		reconciliationsTotal.WithLabelValues(result).Inc()
+		w.mu.Lock()
+		w.status = status
+		w.mu.Unlock()
+	}()
+
+	p, err := w.load()
+	if err != nil {
+		log.Printf("error loading config: %v\n", err)
+		status.LastError = err.Error()
+		return
+	}
+	serverNames, err := p.resolveServerNames(w.serverNames, w.selector)
+	if err != nil {
+		log.Printf("%v\n", err)
+		status.LastError = err.Error()
+		return
+	}
+	maintenance := newMaintenanceSchedule(p.cfg.Maintenance, w.at)
+	for _, serverName := range serverNames {
+		state, err := w.reconcileServer(p, serverName, maintenance)
+		if err != nil {
+			log.Printf("error reconciling %s: %v\n", serverName, err)
+			status.LastError = fmt.Sprintf("%s: %v", serverName, err)
+			state = stateFailed
+		}
+		status.Servers[serverName] = state
+		if state == stateDrifted || state == statePending {
+			serverDrifted.WithLabelValues(serverName).Set(1)
+		} else if state != stateFailed {
+			serverDrifted.WithLabelValues(serverName).Set(0)
+		}
+		if state == statePending && status.NextMaintenance == nil {
+			if next, ok := maintenance.next(time.Now()); ok {
+				status.NextMaintenance = &next
+			}
+		}
+	}
+}
+
+var healthcheckClient = &http.Client{Timeout: 10 * time.Second}
+
+// ping notifies the healthcheck url, suffix is empty for success, /start or /fail, body is shown in the log of the check
+func (w *watcher) ping(suffix string, body string) {
+	if w.healthcheck == "" {
+		return
+	}
+	resp, err := healthcheckClient.Post(strings.TrimSuffix(w.healthcheck, "/")+suffix, "text/plain", strings.NewReader(body))
+	if err != nil {
+		log.Printf("error pinging healthcheck: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Printf("error pinging healthcheck: %s\n", resp.Status)
+	}
+}
+
+// reconcileServer provisions serverName if it doesn't exist or its applied config hash differs from the rendered one
+// Reinstalls of drifted servers only happen while the maintenance schedule is open.
+func (w *watcher) reconcileServer(p *provisioner, serverName string, maintenance maintenanceSchedule) (string, error) {
+	server, _, err := p.client.Server.GetByName(context.Background(), serverName)
+	if err != nil {
+		return "", fmt.Errorf("error finding server: %w", err)
+	}
+	if server == nil {
+		log.Printf("server %s is missing\n", serverName)
+		return stateCreated, p.provision(serverName)
+	}
+
+	state, err := p.driftState(server)
+	if err != nil || state == stateInSync {
+		return state, err
+	}
+	if !w.fixDrift {
+		log.Printf("server %s drifted from rendered config\n", serverName)
+		return stateDrifted, nil
+	}
+	if !maintenance.open(time.Now()) {
+		log.Printf("server %s drifted from rendered config, reinstall pending until the next maintenance window\n", serverName)
+		return statePending, nil
+	}
+	log.Printf("server %s drifted from rendered config, reinstalling\n", serverName)
+	return stateReinstalled, p.provision(serverName)
+}
+
+// serve exposes /healthz, /metrics and the status of the last reconciliation on /status
+func (w *watcher) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(rw http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(rw, "ok")
+	})
+	mux.Handle("/metrics", metricsHandler)
+	mux.HandleFunc("/status", func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(rw).Encode(w.status); err != nil {
+			log.Printf("error encoding status: %v\n", err)
+		}
+	})
+	log.Printf("serving status on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		fatalf("error serving status: %v\n", err)
+	}
+}
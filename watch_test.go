@@ -0,0 +1,24 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestWatchResolvesSelectorOnEveryReconcile(t *testing.T) {
+	p, api, _ := newTestProvisioner(t)
+	api.addServer("web-1", "running", map[string]string{managedLabel: managedLabelValue, "role": "web"})
+	w := &watcher{
+		load:     func() (*provisioner, error) { return p, nil },
+		selector: "role=web",
+	}
+
+	w.reconcile()
+	if _, ok := w.status.Servers["web-1"]; !ok || len(w.status.Servers) != 1 {
+		t.Fatalf("expected web-1 to be reconciled, got %v (%s)", w.status.Servers, w.status.LastError)
+	}
+	api.addServer("web-2", "running", map[string]string{managedLabel: managedLabelValue, "role": "web"})
+	w.reconcile()
+	if _, ok := w.status.Servers["web-2"]; !ok {
+		t.Errorf("server labeled after the first reconciliation wasn't picked up: %v", w.status.Servers)
+	}
+}
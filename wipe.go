@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// wipe methods of flatcar.wipe and the blkdiscard arguments they run
+var wipeArgs = map[string]string{
+	// discards all blocks, the storage returns zeros for them afterwards on hcloud
+	"discard": "-f",
+	// discards securely, fails if the device doesn't support it
+	"secure": "-f -s",
+	// overwrites the whole device with zeros, takes minutes for large disks
+	"zero": "-f -z",
+}
+
+// blockDevice is a disk of the rescue system
+type blockDevice struct {
+	name string
+	size int64
+}
+
+// parseDisks parses the output of lsblk -dbnpo NAME,SIZE,TYPE into the disks
+func parseDisks(lines []string) []blockDevice {
+	var disks []blockDevice
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[2] != "disk" {
+			continue
+		}
+		size, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil || size == 0 {
+			continue
+		}
+		disks = append(disks, blockDevice{name: fields[0], size: size})
+	}
+	return disks
+}
+
+// installTarget returns the disk flatcar is installed on, device or like flatcar-install -s the smallest one
+func installTarget(disks []blockDevice, device string) (blockDevice, error) {
+	if device != "" {
+		for _, disk := range disks {
+			if disk.name == device {
+				return disk, nil
+			}
+		}
+		return blockDevice{}, fmt.Errorf("install device %s isn't a disk of the rescue system", device)
+	}
+	if len(disks) == 0 {
+		return blockDevice{}, fmt.Errorf("no disk found in the rescue system")
+	}
+	sort.Slice(disks, func(i, j int) bool {
+		return disks[i].size < disks[j].size
+	})
+	return disks[0], nil
+}
+
+// wipeDevice erases the install target with flatcar.wipe before flatcar-install writes it,
+// e.g. when servers are recycled between tenants
+func (p *provisioner) wipeDevice(sshClient *sshSession, serverName string) error {
+	method := p.cfg.Flatcar.Wipe
+	var lines []string
+	if err := sshClient.runRetry("lsblk -dbnpo NAME,SIZE,TYPE", p.cfg.SSH, retryTimeouts, func(line string) {
+		lines = append(lines, line)
+	}); err != nil {
+		return fmt.Errorf("error listing disks: %w", err)
+	}
+	disk, err := installTarget(parseDisks(lines), p.cfg.Flatcar.InstallDevice)
+	if err != nil {
+		return err
+	}
+	p.logger.Printf("wiping %s (%s) of %s with blkdiscard (%s)\n", disk.name, formatBytes(disk.size), serverName, method)
+	start := time.Now()
+	command := fmt.Sprintf("blkdiscard %s %s", wipeArgs[method], disk.name)
+	// the wipe isn't retried, it's interrupted on the disk flatcar-install writes next
+	if err := sshClient.runRetry(command, p.cfg.SSH, retryNever, nil); err != nil {
+		return fmt.Errorf("error wiping %s: %w", disk.name, err)
+	}
+	p.logger.Printf("wiped %s (%s) of %s with blkdiscard (%s) in %s\n", disk.name, formatBytes(disk.size), serverName, method, time.Since(start).Round(time.Second))
+	return nil
+}